@@ -12,6 +12,11 @@ type ClientInfo struct {
 	ClientIDPref string
 }
 
+// ClientID returns the Control D client ID of the client, as sent to upstreams with client info.
+func (ci *ClientInfo) ClientID() string {
+	return clientIdFromClientInfo(nil, ci)
+}
+
 // LeaseFileFormat specifies the format of DHCP lease file.
 type LeaseFileFormat string
 
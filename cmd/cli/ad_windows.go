@@ -45,7 +45,7 @@ func addSplitDnsRule(cfg *ctrld.Config, domain string) bool {
 			}
 		}
 		mainLog.Load().Debug().Msgf("adding split-rule %q for listener.%s", domain, n)
-		lc.Policy.Rules = append(lc.Policy.Rules, ctrld.Rule{domain: []string{}})
+		lc.Policy.Rules = append(lc.Policy.Rules, ctrld.Rule{domain: {Upstreams: []string{}}})
 	}
 	return true
 }
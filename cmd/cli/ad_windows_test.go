@@ -44,7 +44,7 @@ func Test_addSplitDnsRule(t *testing.T) {
 		cfg := testhelper.SampleConfig(t)
 		lc := cfg.Listener["0"]
 		for _, domain := range domains {
-			lc.Policy.Rules = append(lc.Policy.Rules, ctrld.Rule{domain: []string{}})
+			lc.Policy.Rules = append(lc.Policy.Rules, ctrld.Rule{domain: {Upstreams: []string{}}})
 		}
 		return cfg
 	}
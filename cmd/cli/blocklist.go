@@ -0,0 +1,223 @@
+package cli
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/blocklist"
+)
+
+const (
+	// blocklistCacheFilePrefix is the prefix of files in ctrld home dir, which store
+	// downloaded blocklists, so they are still usable when the sources are unreachable.
+	blocklistCacheFilePrefix = "ctrld-blocklist-"
+	// blockedAnswerTTL is the TTL of records in blocked answers.
+	blockedAnswerTTL = 60
+	// maxBlocklistDownloadSize is the maximum size of a downloaded blocklist.
+	maxBlocklistDownloadSize = 64 << 20
+)
+
+// localBlocklist is a blocklist defined in config.
+type localBlocklist struct {
+	name string
+	cfg  *ctrld.BlocklistConfig
+	list atomic.Pointer[blocklist.List]
+	// lastLoad is the time of the last load, in Unix nanoseconds.
+	lastLoad atomic.Int64
+}
+
+// localBlocklists holds all blocklists defined in config.
+type localBlocklists struct {
+	lists []*localBlocklist
+}
+
+// newLocalBlocklists creates localBlocklists from given blocklists config. Blocklists are
+// loaded lazily by refreshLoop, but lists from prev with the same sources are re-used,
+// so queries are still filtered while reloading.
+func newLocalBlocklists(bcs map[string]*ctrld.BlocklistConfig, prev *localBlocklists) *localBlocklists {
+	lbs := &localBlocklists{}
+	for n, bc := range bcs {
+		b := &localBlocklist{name: "blocklist." + n, cfg: bc}
+		if prev != nil {
+			for _, pb := range prev.lists {
+				if pb.name == b.name && slices.Equal(pb.cfg.Sources, bc.Sources) {
+					b.list.Store(pb.list.Load())
+					b.lastLoad.Store(pb.lastLoad.Load())
+				}
+			}
+		}
+		lbs.lists = append(lbs.lists, b)
+	}
+	sort.Slice(lbs.lists, func(i, j int) bool {
+		return lbs.lists[i].name < lbs.lists[j].name
+	})
+	return lbs
+}
+
+// match returns the first blocklist which blocks msg, or nil if msg is not blocked.
+func (lbs *localBlocklists) match(msg *dns.Msg) *localBlocklist {
+	if lbs == nil || len(msg.Question) == 0 {
+		return nil
+	}
+	name := msg.Question[0].Name
+	for _, b := range lbs.lists {
+		if b.list.Load().Match(name) {
+			return b
+		}
+	}
+	return nil
+}
+
+// refreshLoop loads all blocklists which are not loaded yet, then refreshes them periodically until ctx is done.
+func (lbs *localBlocklists) refreshLoop(ctx context.Context) {
+	if lbs == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(lbs.lists))
+	for _, b := range lbs.lists {
+		go func(b *localBlocklist) {
+			defer wg.Done()
+			// A list re-used from the previous config is already loaded,
+			// it will be refreshed when due since its last load.
+			if b.list.Load() == nil {
+				b.load(ctx)
+			}
+			timer := time.NewTimer(b.nextRefresh())
+			defer timer.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-timer.C:
+					b.load(ctx)
+					timer.Reset(b.nextRefresh())
+				}
+			}
+		}(b)
+	}
+	wg.Wait()
+}
+
+// nextRefresh returns the duration until the blocklist must be refreshed, one refresh interval after its last load.
+func (b *localBlocklist) nextRefresh() time.Duration {
+	return max(b.cfg.RefreshDuration()-time.Since(time.Unix(0, b.lastLoad.Load())), 0)
+}
+
+// load loads the blocklist from its sources. If any source fails to load,
+// the current list, if any, is kept.
+func (b *localBlocklist) load(ctx context.Context) {
+	defer func() { b.lastLoad.Store(time.Now().UnixNano()) }()
+	l := blocklist.New()
+	for _, source := range b.cfg.Sources {
+		if err := loadBlocklistSource(ctx, l, source); err != nil {
+			mainLog.Load().Warn().Err(err).Msgf("could not load %s source: %s", b.name, source)
+			if b.list.Load() != nil {
+				return
+			}
+		}
+	}
+	b.list.Store(l)
+	mainLog.Load().Debug().Msgf("loaded %d domains from %s", l.Len(), b.name)
+}
+
+// loadBlocklistSource adds domains from source to l. An URL source is downloaded to
+// ctrld home dir first, the previous downloaded file is used if downloading failed.
+func loadBlocklistSource(ctx context.Context, l *blocklist.List, source string) error {
+	file := source
+	if ctrld.IsURLSource(source) {
+		file = blocklistCacheFile(source)
+		if err := downloadBlocklist(ctx, source, file); err != nil {
+			mainLog.Load().Warn().Err(err).Msgf("could not download blocklist: %s, using cached file", source)
+		}
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return l.Parse(f)
+}
+
+// downloadBlocklist downloads blocklist from url, then saves it to file.
+func downloadBlocklist(ctx context.Context, url, file string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := doWithRetry(req, defaultMaxRetries, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	// Write to a temporary file first, so a failed download won't corrupt the cached file.
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, io.LimitReader(resp.Body, maxBlocklistDownloadSize))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// blocklistCacheFile returns the path of file storing downloaded blocklist from url.
+func blocklistCacheFile(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return absHomeDir(blocklistCacheFilePrefix + hex.EncodeToString(sum[:8]) + ".txt")
+}
+
+// newBlockedAnswer returns the answer for msg, which is blocked by blocklist config bc.
+func newBlockedAnswer(msg *dns.Msg, bc *ctrld.BlocklistConfig) *dns.Msg {
+	answer := new(dns.Msg)
+	answer.RecursionAvailable = true
+	switch bc.Response {
+	case "", ctrld.BlocklistResponseNxdomain:
+		answer.SetRcode(msg, dns.RcodeNameError)
+		return answer
+	case ctrld.BlocklistResponseRefused:
+		answer.SetRcode(msg, dns.RcodeRefused)
+		return answer
+	}
+	answer.SetReply(msg)
+	var ip4, ip6 net.IP
+	if bc.Response == ctrld.BlocklistResponseNull {
+		ip4, ip6 = net.IPv4zero, net.IPv6zero
+	} else if ip := bc.ResponseIP(); ip.To4() != nil {
+		ip4 = ip
+	} else {
+		ip6 = ip
+	}
+	q := msg.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: blockedAnswerTTL}
+	switch {
+	case q.Qtype == dns.TypeA && ip4 != nil:
+		answer.Answer = append(answer.Answer, &dns.A{Hdr: hdr, A: ip4})
+	case q.Qtype == dns.TypeAAAA && ip6 != nil:
+		answer.Answer = append(answer.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip6})
+	}
+	return answer
+}
@@ -0,0 +1,145 @@
+package cli
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/blocklist"
+)
+
+func Test_newBlockedAnswer(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		qtype    uint16
+		rcode    int
+		answer   string
+	}{
+		{"default", "", dns.TypeA, dns.RcodeNameError, ""},
+		{"nxdomain", ctrld.BlocklistResponseNxdomain, dns.TypeA, dns.RcodeNameError, ""},
+		{"refused", ctrld.BlocklistResponseRefused, dns.TypeA, dns.RcodeRefused, ""},
+		{"null A", ctrld.BlocklistResponseNull, dns.TypeA, dns.RcodeSuccess, "0.0.0.0"},
+		{"null AAAA", ctrld.BlocklistResponseNull, dns.TypeAAAA, dns.RcodeSuccess, "::"},
+		{"null TXT", ctrld.BlocklistResponseNull, dns.TypeTXT, dns.RcodeSuccess, ""},
+		{"custom IPv4 A", "192.168.1.1", dns.TypeA, dns.RcodeSuccess, "192.168.1.1"},
+		{"custom IPv4 AAAA", "192.168.1.1", dns.TypeAAAA, dns.RcodeSuccess, ""},
+		{"custom IPv6 AAAA", "fd00::1", dns.TypeAAAA, dns.RcodeSuccess, "fd00::1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := new(dns.Msg)
+			msg.SetQuestion("ads.example.com.", tc.qtype)
+			answer := newBlockedAnswer(msg, &ctrld.BlocklistConfig{Response: tc.response})
+			assert.Equal(t, tc.rcode, answer.Rcode)
+			assert.Equal(t, msg.Id, answer.Id)
+			if tc.answer == "" {
+				assert.Empty(t, answer.Answer)
+				return
+			}
+			require.Len(t, answer.Answer, 1)
+			switch rr := answer.Answer[0].(type) {
+			case *dns.A:
+				assert.Equal(t, tc.answer, rr.A.String())
+			case *dns.AAAA:
+				assert.Equal(t, tc.answer, rr.AAAA.String())
+			}
+		})
+	}
+}
+
+func Test_localBlocklist_load(t *testing.T) {
+	oldHomedir := homedir
+	homedir = t.TempDir()
+	t.Cleanup(func() { homedir = oldHomedir })
+
+	var unavailable atomic.Bool
+	var downloads atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		if unavailable.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("||doubleclick.test^\n"))
+	}))
+	defer ts.Close()
+
+	file := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(file, []byte("0.0.0.0 ads.example.com\n"), 0600))
+
+	lbs := newLocalBlocklists(map[string]*ctrld.BlocklistConfig{
+		"0": {Sources: []string{file, ts.URL}},
+	}, nil)
+	b := lbs.lists[0]
+	b.load(context.Background())
+
+	query := func(name string) *localBlocklist {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		return lbs.match(msg)
+	}
+	assert.Equal(t, b, query("ads.example.com."))
+	assert.Equal(t, b, query("ad.doubleclick.test."))
+	assert.Nil(t, query("example.com."))
+
+	// The downloaded file must be used when the source is unavailable.
+	unavailable.Store(true)
+	b.list.Store(nil)
+	b.load(context.Background())
+	assert.Equal(t, b, query("ad.doubleclick.test."))
+
+	// Loaded lists must be kept on reload, if sources do not change.
+	b.lastLoad.Store(time.Now().Add(-time.Hour).UnixNano())
+	reloaded := newLocalBlocklists(map[string]*ctrld.BlocklistConfig{
+		"0": {Sources: []string{file, ts.URL}},
+		"1": {Sources: []string{file}},
+	}, lbs)
+	require.Len(t, reloaded.lists, 2)
+	assert.Equal(t, b.list.Load(), reloaded.lists[0].list.Load())
+	assert.Nil(t, reloaded.lists[1].list.Load())
+	// Re-used lists are refreshed one refresh interval after their last load, not after the reload.
+	assert.InDelta(t, b.cfg.RefreshDuration()-time.Hour, reloaded.lists[0].nextRefresh(), float64(time.Second))
+
+	// Re-used lists must not be downloaded again until the next refresh.
+	n := downloads.Load()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		reloaded.refreshLoop(ctx)
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return reloaded.lists[1].list.Load() != nil }, time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+	assert.Equal(t, n, downloads.Load())
+}
+
+func Test_prog_proxy_blocklist(t *testing.T) {
+	p := &prog{cfg: &ctrld.Config{}}
+	lbs := newLocalBlocklists(map[string]*ctrld.BlocklistConfig{
+		"0": {Sources: []string{"unused"}, Response: ctrld.BlocklistResponseNull},
+	}, nil)
+	bl := blocklist.New()
+	bl.Block("ads.example.com", false)
+	lbs.lists[0].list.Store(bl)
+	p.blocklists.Store(lbs)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("ads.example.com.", dns.TypeA)
+	res := p.proxy(context.Background(), &proxyRequest{msg: msg, ufr: &upstreamForResult{}})
+	require.NotNil(t, res.answer)
+	assert.True(t, res.blocked)
+	require.Len(t, res.answer.Answer, 1)
+	assert.Equal(t, "0.0.0.0", res.answer.Answer[0].(*dns.A).A.String())
+}
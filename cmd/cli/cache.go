@@ -0,0 +1,266 @@
+package cli
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+const (
+	// persistentCacheFile is the name of the persistent cache snapshot file, in ctrld home dir.
+	persistentCacheFile = "ctrld_cache.bin"
+	// defaultCachePersistInterval is the default time interval between persistent cache snapshots.
+	defaultCachePersistInterval = 5 * time.Minute
+)
+
+// Cache key scopes, see cacheScope.
+const (
+	cacheKeyScopeClientID = "client_id"
+	cacheKeyScopeMac      = "mac"
+	cacheKeyScopeNetwork  = "network"
+)
+
+// newCacher returns the DNS cache of current config, restoring the persisted
+// cached values if the persistent cache is enabled.
+func (p *prog) newCacher() (dnscache.Cacher, error) {
+	size, shards := p.cfg.Service.CacheSize, p.cfg.Service.CacheShards
+	if !p.cfg.Service.CachePersist {
+		if shards > 1 {
+			return dnscache.NewShardedCache(size, shards)
+		}
+		return dnscache.NewLRUCache(size)
+	}
+	path := absHomeDir(persistentCacheFile)
+	var pc *dnscache.PersistentCache
+	var err error
+	if shards > 1 {
+		pc, err = dnscache.NewShardedPersistentCache(size, shards, path)
+	} else {
+		pc, err = dnscache.NewPersistentCache(size, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	n, err := pc.Load()
+	if err != nil {
+		mainLog.Load().Warn().Err(err).Msgf("could not restore persistent cache from: %s", path)
+	} else {
+		mainLog.Load().Debug().Msgf("restored %d cached responses from: %s", n, path)
+	}
+	return pc, nil
+}
+
+// cacheScope returns the cache key scope of the request to the given upstream.
+//
+// Client ID and MAC scopes only apply to upstreams, which receive client info,
+// since other upstreams answer all clients the same.
+func (p *prog) cacheScope(req *proxyRequest, uc *ctrld.UpstreamConfig) string {
+	switch p.cfg.Service.CacheKeyScope {
+	case cacheKeyScopeClientID:
+		if req.ci != nil && uc != nil && uc.UpstreamSendClientInfo() {
+			return req.ci.ClientID()
+		}
+	case cacheKeyScopeMac:
+		if req.ci != nil && uc != nil && uc.UpstreamSendClientInfo() {
+			return req.ci.Mac
+		}
+	case cacheKeyScopeNetwork:
+		if req.ufr != nil {
+			return req.ufr.matchedNetwork
+		}
+	}
+	return ""
+}
+
+// snapshotCacheLoop snapshots the persistent cache periodically, and when ctrld is reloaded.
+// Snapshot on stopping is done by p.Stop, since the process may exit before this loop is notified.
+func (p *prog) snapshotCacheLoop(pc *dnscache.PersistentCache, reloadCh chan struct{}) {
+	interval := defaultCachePersistInterval
+	if n := p.cfg.Service.CachePersistInterval; n > 0 {
+		interval = time.Duration(n) * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			saveCacheSnapshot(pc)
+		case <-reloadCh:
+			saveCacheSnapshot(pc)
+			return
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+// saveCacheSnapshot snapshots the persistent cache, logging any error.
+func saveCacheSnapshot(pc *dnscache.PersistentCache) {
+	if err := pc.Save(); err != nil {
+		mainLog.Load().Warn().Err(err).Msg("could not save persistent cache snapshot")
+		return
+	}
+	mainLog.Load().Debug().Msg("saved persistent cache snapshot")
+}
+
+// cacheEntry is a cached response, as reported by the control server.
+type cacheEntry struct {
+	Domain   string   `json:"domain"`
+	Type     string   `json:"type"`
+	Class    string   `json:"class"`
+	Upstream string   `json:"upstream"`
+	Dnssec   bool     `json:"dnssec"`
+	Scope    string   `json:"scope,omitempty"`
+	Negative bool     `json:"negative"`
+	Rcode    string   `json:"rcode"`
+	TTL      int64    `json:"ttl"` // Remaining TTL in seconds, negative if expired.
+	Expire   string   `json:"expire"`
+	Hits     int64    `json:"hits"`
+	Records  []string `json:"records"`
+}
+
+// cacheStats is the statistics of the cache, as reported by the control server.
+type cacheStats struct {
+	Enabled    bool           `json:"enabled"`
+	Size       int            `json:"size"`
+	Entries    int            `json:"entries"`
+	Expired    int            `json:"expired"`
+	Negative   int            `json:"negative"`
+	Upstreams  map[string]int `json:"upstreams"`
+	Hits       uint64         `json:"hits"`
+	Misses     uint64         `json:"misses"`
+	Prefetches uint64         `json:"prefetches"`
+}
+
+// cacheDomainMatches reports whether the cached domain name matches the pattern,
+// which is either a domain name, or a wildcard pattern like "*.example.com".
+func cacheDomainMatches(pattern, name string) bool {
+	pattern = strings.ToLower(dns.Fqdn(pattern))
+	if strings.Contains(pattern, "*") {
+		return wildcardMatches(pattern, name)
+	}
+	return pattern == name
+}
+
+// cacheEntries returns the cached responses, whose domain matches the given pattern if not empty.
+func (p *prog) cacheEntries(domain string) []*cacheEntry {
+	entries := []*cacheEntry{}
+	if p.cache == nil {
+		return entries
+	}
+	now := time.Now()
+	p.cache.Range(func(key dnscache.Key, v *dnscache.Value) bool {
+		if domain != "" && !cacheDomainMatches(domain, key.Name) {
+			return true
+		}
+		e := &cacheEntry{
+			Domain:   key.Name,
+			Type:     dns.TypeToString[key.Qtype],
+			Class:    dns.ClassToString[key.Qclass],
+			Upstream: key.Upstream,
+			Dnssec:   key.Dnssec,
+			Scope:    key.Scope,
+			Negative: v.Negative,
+			Rcode:    dns.RcodeToString[v.Msg.Rcode],
+			TTL:      int64(v.Expire.Sub(now) / time.Second),
+			Expire:   v.Expire.Format(time.RFC3339),
+			Hits:     v.Hits(),
+		}
+		for _, rrs := range [][]dns.RR{v.Msg.Answer, v.Msg.Ns} {
+			for _, rr := range rrs {
+				e.Records = append(e.Records, rr.String())
+			}
+		}
+		entries = append(entries, e)
+		return true
+	})
+	slices.SortFunc(entries, func(a, b *cacheEntry) int {
+		return cmp.Or(
+			strings.Compare(a.Domain, b.Domain),
+			strings.Compare(a.Type, b.Type),
+			strings.Compare(a.Upstream, b.Upstream),
+		)
+	})
+	return entries
+}
+
+// cacheStats returns the statistics of the cache.
+func (p *prog) cacheStats() *cacheStats {
+	stats := &cacheStats{
+		Upstreams:  make(map[string]int),
+		Hits:       counterValue(statsCacheHits),
+		Misses:     counterValue(statsCacheMisses),
+		Prefetches: counterValue(statsCachePrefetches),
+	}
+	if p.cache == nil {
+		return stats
+	}
+	stats.Enabled = p.cfg.Service.CacheEnable
+	stats.Size = p.cfg.Service.CacheSize
+	now := time.Now()
+	p.cache.Range(func(key dnscache.Key, v *dnscache.Value) bool {
+		stats.Entries++
+		stats.Upstreams[key.Upstream]++
+		if !v.Expire.After(now) {
+			stats.Expired++
+		}
+		if v.Negative {
+			stats.Negative++
+		}
+		return true
+	})
+	return stats
+}
+
+// flushCache removes cached responses matching the given domain pattern and upstream,
+// the whole cache is purged if both are empty. It returns the number of removed responses.
+func (p *prog) flushCache(domain, upstream string) int {
+	if p.cache == nil {
+		return 0
+	}
+	if domain == "" && upstream == "" {
+		n := p.cache.Len()
+		p.cache.Purge()
+		return n
+	}
+	var keys []dnscache.Key
+	p.cache.Range(func(key dnscache.Key, _ *dnscache.Value) bool {
+		if (domain == "" || cacheDomainMatches(domain, key.Name)) && (upstream == "" || key.Upstream == upstream) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	n := 0
+	for _, key := range keys {
+		if p.cache.Remove(key) {
+			n++
+		}
+	}
+	return n
+}
+
+// counterValue returns the current value of the prometheus counter.
+func counterValue(c prometheus.Counter) uint64 {
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil || m.Counter == nil {
+		return 0
+	}
+	return uint64(m.Counter.GetValue())
+}
+
+// gaugeValue returns the current value of the prometheus gauge.
+func gaugeValue(g prometheus.Gauge) float64 {
+	m := &dto.Metric{}
+	if err := g.Write(m); err != nil || m.Gauge == nil {
+		return 0
+	}
+	return m.Gauge.GetValue()
+}
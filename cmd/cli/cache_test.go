@@ -0,0 +1,117 @@
+package cli
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+func newTestCacheProg(t *testing.T) *prog {
+	t.Helper()
+	cache, err := dnscache.NewLRUCache(16)
+	require.NoError(t, err)
+	p := &prog{cfg: &ctrld.Config{Service: ctrld.ServiceConfig{CacheEnable: true, CacheSize: 16}}, cache: cache}
+	add := func(name, upstream string, rcode int, expire time.Time) {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		answer := new(dns.Msg)
+		answer.SetRcode(msg, rcode)
+		if rcode == dns.RcodeSuccess {
+			answer.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("10.0.0.1"),
+			}}
+		}
+		cache.Add(dnscache.NewKey(msg, upstream), dnscache.NewValue(answer, expire))
+	}
+	now := time.Now()
+	add("example.com.", "upstream.0", dns.RcodeSuccess, now.Add(time.Minute))
+	add("www.example.com.", "upstream.0", dns.RcodeSuccess, now.Add(-time.Minute))
+	add("www.example.com.", "upstream.1", dns.RcodeSuccess, now.Add(time.Minute))
+	add("none.example.org.", "upstream.1", dns.RcodeNameError, now.Add(time.Minute))
+	return p
+}
+
+func Test_prog_cacheEntries(t *testing.T) {
+	p := newTestCacheProg(t)
+
+	entries := p.cacheEntries("")
+	require.Len(t, entries, 4)
+	assert.Equal(t, "example.com.", entries[0].Domain)
+	assert.Equal(t, "A", entries[0].Type)
+	assert.Equal(t, []string{"example.com.\t60\tIN\tA\t10.0.0.1"}, entries[0].Records)
+	assert.True(t, entries[1].Negative)
+
+	assert.Len(t, p.cacheEntries("*.example.com"), 2)
+	assert.Len(t, p.cacheEntries("Example.COM"), 1)
+	assert.Empty(t, p.cacheEntries("example.net"))
+
+	stats := p.cacheStats()
+	assert.Equal(t, 4, stats.Entries)
+	assert.Equal(t, 1, stats.Expired)
+	assert.Equal(t, 1, stats.Negative)
+	assert.Equal(t, map[string]int{"upstream.0": 2, "upstream.1": 2}, stats.Upstreams)
+}
+
+func Test_prog_flushCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		domain   string
+		upstream string
+		flushed  int
+	}{
+		{"all", "", "", 4},
+		{"domain", "www.example.com", "", 2},
+		{"wildcard", "*.example.com", "", 2},
+		{"upstream", "", "upstream.1", 2},
+		{"domain and upstream", "www.example.com", "upstream.1", 1},
+		{"no match", "example.net", "", 0},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			p := newTestCacheProg(t)
+			assert.Equal(t, tc.flushed, p.flushCache(tc.domain, tc.upstream))
+			assert.Equal(t, 4-tc.flushed, p.cache.Len())
+		})
+	}
+}
+
+func Test_prog_cacheScope(t *testing.T) {
+	sendClientInfo := true
+	withClientInfo := &ctrld.UpstreamConfig{Type: ctrld.ResolverTypeDOH, Endpoint: "https://example.com/dns-query", SendClientInfo: &sendClientInfo}
+	withoutClientInfo := &ctrld.UpstreamConfig{Type: ctrld.ResolverTypeLegacy, Endpoint: "1.1.1.1:53"}
+	req := &proxyRequest{
+		ci:  &ctrld.ClientInfo{Mac: "aa:bb:cc:dd:ee:ff", Hostname: "host", ClientIDPref: "mac"},
+		ufr: &upstreamForResult{matchedNetwork: "network.0"},
+	}
+
+	tests := []struct {
+		name  string
+		scope string
+		uc    *ctrld.UpstreamConfig
+		want  string
+	}{
+		{"none", "", withClientInfo, ""},
+		{"client id", cacheKeyScopeClientID, withClientInfo, "aa-bb-cc-dd-ee-ff"},
+		{"client id without client info", cacheKeyScopeClientID, withoutClientInfo, ""},
+		{"mac", cacheKeyScopeMac, withClientInfo, "aa:bb:cc:dd:ee:ff"},
+		{"network", cacheKeyScopeNetwork, withoutClientInfo, "network.0"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			p := &prog{cfg: &ctrld.Config{Service: ctrld.ServiceConfig{CacheKeyScope: tc.scope}}}
+			assert.Equal(t, tc.want, p.cacheScope(req, tc.uc))
+		})
+	}
+}
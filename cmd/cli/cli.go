@@ -138,6 +138,9 @@ func initCLI() {
 	interfacesCmd := initInterfacesCmd()
 	initServicesCmd(startCmd, stopCmd, restartCmd, reloadCmd, statusCmd, uninstallCmd, interfacesCmd)
 	initClientsCmd()
+	initUpstreamsCmd()
+	initCacheCmd()
+	initStatsCmd()
 	initUpgradeCmd()
 	initLogCmd()
 }
@@ -276,7 +279,7 @@ func run(appCallback *AppCallback, stopCh chan struct{}) {
 	// After s.Run() was called, if ctrld is going to be terminated for any reason,
 	// write msgExit to p.logConn so others (like "ctrld start") won't have to wait for timeout.
 	p.mu.Lock()
-	if err := v.Unmarshal(&cfg); err != nil {
+	if err := v.Unmarshal(&cfg, ctrld.DecodeHook()); err != nil {
 		notifyExitToLogServer()
 		mainLog.Load().Fatal().Msgf("failed to unmarshal config: %v", err)
 	}
@@ -476,7 +479,7 @@ func writeConfigFile(cfg *ctrld.Config) error {
 		}
 	}
 	enc := toml.NewEncoder(f).SetIndentTables(true)
-	if err := enc.Encode(&cfg); err != nil {
+	if err := enc.Encode(cfg.TOMLValue()); err != nil {
 		return err
 	}
 	if err := f.Close(); err != nil {
@@ -507,7 +510,7 @@ func readConfigFile(writeDefaultConfig, notice bool) bool {
 
 	// If error is viper.ConfigFileNotFoundError, write default config.
 	if errors.As(err, &viper.ConfigFileNotFoundError{}) {
-		if err := v.Unmarshal(&cfg); err != nil {
+		if err := v.Unmarshal(&cfg, ctrld.DecodeHook()); err != nil {
 			mainLog.Load().Fatal().Msgf("failed to unmarshal default config: %v", err)
 		}
 		nop := zerolog.Nop()
@@ -613,7 +616,7 @@ func processNoConfigFlags(noConfigStart bool) {
 		upstream["1"] = suc
 		rules := make([]ctrld.Rule, 0, len(domains))
 		for _, domain := range domains {
-			rules = append(rules, ctrld.Rule{domain: []string{"upstream.1"}})
+			rules = append(rules, ctrld.Rule{domain: {Upstreams: []string{"upstream.1"}}})
 		}
 		lc := v.Get("listener").(map[string]*ctrld.ListenerConfig)["0"]
 		lc.Policy = &ctrld.ListenerPolicyConfig{Name: "My Policy", Rules: rules}
@@ -707,7 +710,7 @@ func processCDFlags(cfg *ctrld.Config) (*controld.ResolverConfig, error) {
 	}
 	rules := make([]ctrld.Rule, 0, len(resolverConfig.Exclude))
 	for _, domain := range resolverConfig.Exclude {
-		rules = append(rules, ctrld.Rule{domain: []string{}})
+		rules = append(rules, ctrld.Rule{domain: {Upstreams: []string{}}})
 	}
 	cfg.Listener = make(map[string]*ctrld.ListenerConfig)
 	lc := &ctrld.ListenerConfig{
@@ -756,7 +759,7 @@ func validateCdRemoteConfig(rc *controld.ResolverConfig, cfg *ctrld.Config) erro
 	if err := readBase64Config(rc.Ctrld.CustomConfig); err != nil {
 		return err
 	}
-	return v.Unmarshal(&cfg)
+	return v.Unmarshal(&cfg, ctrld.DecodeHook())
 }
 
 func processListenFlag() {
@@ -879,7 +882,7 @@ func selfCheckStatus(ctx context.Context, s service.Service, sockDir string) (bo
 	}
 
 	cfg = ctrld.Config{}
-	if err := v.Unmarshal(&cfg); err != nil {
+	if err := v.Unmarshal(&cfg, ctrld.DecodeHook()); err != nil {
 		mainLog.Load().Error().Err(err).Msg("failed to update new config")
 		return false, status, err
 	}
@@ -1146,6 +1149,10 @@ func fieldErrorMsg(fe validator.FieldError) string {
 		return fmt.Sprintf("minimum len: %q", fe.Param())
 	case "gte":
 		return fmt.Sprintf("must be greater than or equal to: %s", fe.Param())
+	case "gt":
+		return fmt.Sprintf("must be greater than: %s", fe.Param())
+	case "lte":
+		return fmt.Sprintf("must be less than or equal to: %s", fe.Param())
 	case "cidr":
 		return fmt.Sprintf("invalid value: %s", fe.Value())
 	case "required_unless", "required":
@@ -1161,6 +1168,14 @@ func fieldErrorMsg(fe validator.FieldError) string {
 		return fmt.Sprintf("filed does not exist: %s", fe.Value())
 	case "http_url":
 		return fmt.Sprintf("invalid http/https url: %s", fe.Value())
+	case "rule_pattern":
+		return fmt.Sprintf("invalid rule pattern: %s", fe.Value())
+	case "blocklist_source":
+		return fmt.Sprintf("invalid blocklist source, must be an existing file or http/https url: %s", fe.Value())
+	case "blocklist_response":
+		return fmt.Sprintf("invalid blocklist response: %s", fe.Value())
+	case "dns_record":
+		return fmt.Sprintf("invalid zone records: %s", fe.Param())
 	}
 	return ""
 }
@@ -1227,6 +1242,17 @@ func tryUpdateListenerConfig(cfg *ctrld.Config, infoLogger *zerolog.Logger, noti
 	isDesktop := ctrld.IsDesktopPlatform()
 	for n, listener := range cfg.Listener {
 		lcc[n] = &listenerConfigCheck{}
+		// Encrypted listeners are additional listeners for LAN clients,
+		// they are never used as OS resolver, so just use the defaults.
+		if listener.IsEncrypted() {
+			if listener.IP == "" {
+				listener.IP = "0.0.0.0"
+			}
+			if listener.Port == 0 {
+				listener.Port = encryptedListenerDefaultPort(listener.Protocol)
+			}
+			continue
+		}
 		if listener.IP == "" {
 			listener.IP = "0.0.0.0"
 			// Windows Server lies to us that we could listen on 0.0.0.0:53
@@ -1317,6 +1343,9 @@ func tryUpdateListenerConfig(cfg *ctrld.Config, infoLogger *zerolog.Logger, noti
 
 	for _, n := range listeners {
 		listener := cfg.Listener[strconv.Itoa(n)]
+		if listener.IsEncrypted() {
+			continue
+		}
 		check := lcc[strconv.Itoa(n)]
 		oldIP := listener.IP
 		oldPort := listener.Port
@@ -29,6 +29,7 @@ import (
 	"github.com/Control-D-Inc/ctrld"
 	"github.com/Control-D-Inc/ctrld/internal/clientinfo"
 	"github.com/Control-D-Inc/ctrld/internal/router"
+	"github.com/Control-D-Inc/ctrld/internal/topstats"
 )
 
 // dialSocketControlServerTimeout is the default timeout to wait when ping control server.
@@ -146,6 +147,74 @@ func initLogCmd() *cobra.Command {
 			fmt.Println(logs.Data)
 		},
 	}
+	var tailReq logTailRequest
+	var tailJson bool
+	logTailCmd := &cobra.Command{
+		Use:   "tail",
+		Short: "Stream DNS queries answered by ctrld, as they happen",
+		Args:  cobra.NoArgs,
+		PreRun: func(cmd *cobra.Command, args []string) {
+			checkHasElevatedPrivilege()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+
+			p := &prog{router: router.New(&cfg, false)}
+			s, _ := newService(p, svcConfig)
+
+			status, err := s.Status()
+			if errors.Is(err, service.ErrNotInstalled) {
+				mainLog.Load().Warn().Msg("service not installed")
+				return
+			}
+			if status == service.StatusStopped {
+				mainLog.Load().Warn().Msg("service is not running")
+				return
+			}
+
+			dir, err := socketDir()
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to find ctrld home dir")
+			}
+			data, err := json.Marshal(&tailReq)
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to marshal log tail request")
+			}
+			cc := newControlClient(filepath.Join(dir, ctrldControlUnixSock))
+			resp, err := cc.post(tailLogsPath, bytes.NewReader(data))
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to stream queries")
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				mainLog.Load().Fatal().Msgf("log tail request failed: %s", strings.TrimSpace(string(body)))
+			}
+			if tailJson {
+				_, _ = io.Copy(os.Stdout, resp.Body)
+				return
+			}
+			dec := json.NewDecoder(resp.Body)
+			for {
+				var ev logTailEvent
+				if err := dec.Decode(&ev); err != nil {
+					if !errors.Is(err, io.EOF) {
+						mainLog.Load().Error().Err(err).Msg("failed to decode query event")
+					}
+					return
+				}
+				if ev.Dropped > 0 {
+					fmt.Fprintln(os.Stderr, (&logTailDropped{Dropped: ev.Dropped}).String())
+					continue
+				}
+				fmt.Println(ev.String())
+			}
+		},
+	}
+	logTailCmd.Flags().StringVarP(&tailReq.Client, "client", "", "", "Stream only queries of the client IP, MAC or hostname")
+	logTailCmd.Flags().StringVarP(&tailReq.Domain, "domain", "", "", `Stream only queries of domains matching the pattern, e.g: "*.example.com"`)
+	logTailCmd.Flags().StringVarP(&tailReq.Rcode, "rcode", "", "", "Stream only queries answered with the rcode, e.g: NXDOMAIN")
+	logTailCmd.Flags().StringVarP(&tailReq.Upstream, "upstream", "", "", `Stream only queries answered by the upstream, given by its id or endpoint, e.g: "upstream.0", "cache", "blocklist"`)
+	logTailCmd.Flags().BoolVarP(&tailJson, "json", "", false, `Print queries as JSON lines, dropped queries are reported as {"dropped": N} lines`)
 	logCmd := &cobra.Command{
 		Use:   "log",
 		Short: "Manage runtime debug logs",
@@ -156,6 +225,7 @@ func initLogCmd() *cobra.Command {
 	}
 	logCmd.AddCommand(logSendCmd)
 	logCmd.AddCommand(logViewCmd)
+	logCmd.AddCommand(logTailCmd)
 	rootCmd.AddCommand(logCmd)
 
 	return logCmd
@@ -347,7 +417,7 @@ NOTE: running "ctrld start" without any arguments will start already installed c
 			// If user run "ctrld start" and ctrld is already installed, starting existing service.
 			if startOnly && isCtrldInstalled {
 				tryReadingConfigWithNotice(false, true)
-				if err := v.Unmarshal(&cfg); err != nil {
+				if err := v.Unmarshal(&cfg, ctrld.DecodeHook()); err != nil {
 					mainLog.Load().Fatal().Msgf("failed to unmarshal config: %v", err)
 				}
 
@@ -414,7 +484,7 @@ NOTE: running "ctrld start" without any arguments will start already installed c
 
 			tryReadingConfigWithNotice(writeDefaultConfig, true)
 
-			if err := v.Unmarshal(&cfg); err != nil {
+			if err := v.Unmarshal(&cfg, ctrld.DecodeHook()); err != nil {
 				mainLog.Load().Fatal().Msgf("failed to unmarshal config: %v", err)
 			}
 
@@ -606,7 +676,7 @@ func initStopCmd() *cobra.Command {
 		Args:  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
 			readConfig(false)
-			v.Unmarshal(&cfg)
+			v.Unmarshal(&cfg, ctrld.DecodeHook())
 			p := &prog{router: router.New(&cfg, runInCdMode())}
 			s, err := newService(p, svcConfig)
 			if err != nil {
@@ -691,7 +761,7 @@ func initRestartCmd() *cobra.Command {
 		Args:  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
 			readConfig(false)
-			v.Unmarshal(&cfg)
+			v.Unmarshal(&cfg, ctrld.DecodeHook())
 			cdUID = curCdUID()
 			cdMode := cdUID != ""
 
@@ -944,7 +1014,7 @@ NOTE: Uninstalling will set DNS to values provided by DHCP.`,
 		Args: cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
 			readConfig(false)
-			v.Unmarshal(&cfg)
+			v.Unmarshal(&cfg, ctrld.DecodeHook())
 			p := &prog{router: router.New(&cfg, runInCdMode())}
 			s, err := newService(p, svcConfig)
 			if err != nil {
@@ -1202,6 +1272,368 @@ func initClientsCmd() *cobra.Command {
 	return clientsCmd
 }
 
+func initUpstreamsCmd() *cobra.Command {
+	statusUpstreamsCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show upstreams health and statistics",
+		Args:  cobra.NoArgs,
+		PreRun: func(cmd *cobra.Command, args []string) {
+			checkHasElevatedPrivilege()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			p := &prog{router: router.New(&cfg, false)}
+			s, _ := newService(p, svcConfig)
+
+			status, err := s.Status()
+			if errors.Is(err, service.ErrNotInstalled) {
+				mainLog.Load().Warn().Msg("service not installed")
+				return
+			}
+			if status == service.StatusStopped {
+				mainLog.Load().Warn().Msg("service is not running")
+				return
+			}
+
+			dir, err := socketDir()
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to find ctrld home dir")
+			}
+			cc := newControlClient(filepath.Join(dir, ctrldControlUnixSock))
+			resp, err := cc.post(upstreamsPath, nil)
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to get upstreams status")
+			}
+			defer resp.Body.Close()
+
+			var stats []*upstreamStats
+			if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to decode upstreams status result")
+			}
+			formatFloat := func(f float64) string {
+				return strconv.FormatFloat(f, 'f', 2, 64)
+			}
+			data := make([][]string, len(stats))
+			for i, s := range stats {
+				reason := s.Reason
+				if s.LastError != "" {
+					reason = strings.TrimPrefix(reason+" (last error: "+s.LastError+")", " ")
+				}
+				data[i] = []string{
+					s.Upstream,
+					s.State,
+					strconv.FormatUint(s.Queries, 10),
+					formatFloat(s.ErrorRate * 100),
+					formatFloat(s.TimeoutRate * 100),
+					formatFloat(s.RTTP50),
+					formatFloat(s.RTTP90),
+					formatFloat(s.RTTP99),
+					reason,
+				}
+			}
+			table := tablewriter.NewWriter(os.Stdout)
+			table.SetHeader([]string{"Upstream", "State", "Queries", "Errors (%)", "Timeouts (%)", "P50 (ms)", "P90 (ms)", "P99 (ms)", "Reason"})
+			table.SetAutoFormatHeaders(false)
+			table.AppendBulk(data)
+			table.Render()
+		},
+	}
+	upstreamsCmd := &cobra.Command{
+		Use:   "upstreams",
+		Short: "Manage upstreams",
+		Args:  cobra.OnlyValidArgs,
+		ValidArgs: []string{
+			statusUpstreamsCmd.Use,
+		},
+	}
+	upstreamsCmd.AddCommand(statusUpstreamsCmd)
+	rootCmd.AddCommand(upstreamsCmd)
+
+	return upstreamsCmd
+}
+
+func initCacheCmd() *cobra.Command {
+	// postCache sends the cache request to the running ctrld service, decoding the response into v.
+	postCache := func(path string, req *cacheRequest, v any) bool {
+		p := &prog{router: router.New(&cfg, false)}
+		s, _ := newService(p, svcConfig)
+
+		status, err := s.Status()
+		if errors.Is(err, service.ErrNotInstalled) {
+			mainLog.Load().Warn().Msg("service not installed")
+			return false
+		}
+		if status == service.StatusStopped {
+			mainLog.Load().Warn().Msg("service is not running")
+			return false
+		}
+
+		dir, err := socketDir()
+		if err != nil {
+			mainLog.Load().Fatal().Err(err).Msg("failed to find ctrld home dir")
+		}
+		data, err := json.Marshal(req)
+		if err != nil {
+			mainLog.Load().Fatal().Err(err).Msg("failed to marshal cache request")
+		}
+		cc := newControlClient(filepath.Join(dir, ctrldControlUnixSock))
+		resp, err := cc.post(path, bytes.NewReader(data))
+		if err != nil {
+			mainLog.Load().Fatal().Err(err).Msg("failed to send cache request")
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			mainLog.Load().Fatal().Msgf("cache request failed: %s", strings.TrimSpace(string(body)))
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			mainLog.Load().Fatal().Err(err).Msg("failed to decode cache response")
+		}
+		return true
+	}
+
+	var cacheDomain string
+	listCacheCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List cached responses",
+		Args:  cobra.NoArgs,
+		PreRun: func(cmd *cobra.Command, args []string) {
+			checkHasElevatedPrivilege()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			var entries []*cacheEntry
+			if !postCache(cacheListPath, &cacheRequest{Domain: cacheDomain}, &entries) {
+				return
+			}
+			data := make([][]string, len(entries))
+			for i, e := range entries {
+				data[i] = []string{
+					e.Domain,
+					e.Type,
+					e.Upstream,
+					e.Rcode,
+					strconv.FormatInt(e.TTL, 10),
+					strconv.FormatBool(e.Negative),
+					strconv.FormatBool(e.Dnssec),
+					strconv.FormatInt(e.Hits, 10),
+				}
+			}
+			table := tablewriter.NewWriter(os.Stdout)
+			table.SetHeader([]string{"Domain", "Type", "Upstream", "Rcode", "TTL", "Negative", "DNSSEC", "Hits"})
+			table.SetAutoFormatHeaders(false)
+			table.AppendBulk(data)
+			table.Render()
+		},
+	}
+	listCacheCmd.Flags().StringVarP(&cacheDomain, "domain", "", "", `List only cached responses of domains matching the pattern, e.g: "*.example.com"`)
+
+	statsCacheCmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Show cache statistics",
+		Args:  cobra.NoArgs,
+		PreRun: func(cmd *cobra.Command, args []string) {
+			checkHasElevatedPrivilege()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			var stats cacheStats
+			if !postCache(cacheStatsPath, &cacheRequest{}, &stats) {
+				return
+			}
+			data := [][]string{
+				{"Enabled", strconv.FormatBool(stats.Enabled)},
+				{"Size", strconv.Itoa(stats.Size)},
+				{"Entries", strconv.Itoa(stats.Entries)},
+				{"Expired", strconv.Itoa(stats.Expired)},
+				{"Negative", strconv.Itoa(stats.Negative)},
+				{"Hits", strconv.FormatUint(stats.Hits, 10)},
+				{"Misses", strconv.FormatUint(stats.Misses, 10)},
+				{"Prefetches", strconv.FormatUint(stats.Prefetches, 10)},
+			}
+			upstreams := make([]string, 0, len(stats.Upstreams))
+			for upstream := range stats.Upstreams {
+				upstreams = append(upstreams, upstream)
+			}
+			sort.Strings(upstreams)
+			for _, upstream := range upstreams {
+				data = append(data, []string{"Entries of " + upstream, strconv.Itoa(stats.Upstreams[upstream])})
+			}
+			table := tablewriter.NewWriter(os.Stdout)
+			table.SetHeader([]string{"Stat", "Value"})
+			table.SetAutoFormatHeaders(false)
+			table.AppendBulk(data)
+			table.Render()
+		},
+	}
+
+	var cacheUpstream string
+	flushCacheCmd := &cobra.Command{
+		Use:   "flush [domain]",
+		Short: "Flush cached responses",
+		Long: `Flush cached responses
+
+Without arguments, the whole cache is flushed. The domain may be a wildcard pattern, e.g: "*.example.com".`,
+		Args: cobra.MaximumNArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			checkHasElevatedPrivilege()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			req := &cacheRequest{Upstream: cacheUpstream}
+			if len(args) > 0 {
+				req.Domain = args[0]
+			}
+			var res cacheFlushResponse
+			if !postCache(cacheFlushPath, req, &res) {
+				return
+			}
+			mainLog.Load().Notice().Msgf("Flushed %d cached responses", res.Flushed)
+		},
+	}
+	flushCacheCmd.Flags().StringVarP(&cacheUpstream, "upstream", "", "", "Flush only cached responses of the upstream, e.g: upstream.0")
+
+	var cacheDumpJson bool
+	dumpCacheCmd := &cobra.Command{
+		Use:   "dump",
+		Short: "Dump cached responses",
+		Args:  cobra.NoArgs,
+		PreRun: func(cmd *cobra.Command, args []string) {
+			checkHasElevatedPrivilege()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			var entries []*cacheEntry
+			if !postCache(cacheListPath, &cacheRequest{}, &entries) {
+				return
+			}
+			if cacheDumpJson {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(entries); err != nil {
+					mainLog.Load().Fatal().Err(err).Msg("failed to encode cache entries")
+				}
+				return
+			}
+			for _, e := range entries {
+				scope := ""
+				if e.Scope != "" {
+					scope = ", scope: " + e.Scope
+				}
+				fmt.Printf("; %s %s %s via %s, rcode: %s, ttl: %d, hits: %d%s\n", e.Domain, e.Class, e.Type, e.Upstream, e.Rcode, e.TTL, e.Hits, scope)
+				for _, rr := range e.Records {
+					fmt.Println(rr)
+				}
+			}
+		},
+	}
+	dumpCacheCmd.Flags().BoolVarP(&cacheDumpJson, "json", "", false, "Dump cached responses in JSON format")
+
+	cacheCmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage DNS cache",
+		Args:  cobra.OnlyValidArgs,
+		ValidArgs: []string{
+			listCacheCmd.Name(),
+			statsCacheCmd.Name(),
+			flushCacheCmd.Name(),
+			dumpCacheCmd.Name(),
+		},
+	}
+	cacheCmd.AddCommand(listCacheCmd)
+	cacheCmd.AddCommand(statsCacheCmd)
+	cacheCmd.AddCommand(flushCacheCmd)
+	cacheCmd.AddCommand(dumpCacheCmd)
+	rootCmd.AddCommand(cacheCmd)
+
+	return cacheCmd
+}
+
+func initStatsCmd() *cobra.Command {
+	var statsWindow string
+	var statsLimit int
+	statsCmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Show top queried domains and clients",
+		Long: `Show top queried domains and clients
+
+The top queried, NXDOMAIN and blocked domains, and the top clients are shown over the last hour and the last 24 hours.
+Counts are estimated, and require top_stats to be enabled in [service] config.`,
+		Args: cobra.NoArgs,
+		PreRun: func(cmd *cobra.Command, args []string) {
+			checkHasElevatedPrivilege()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			p := &prog{router: router.New(&cfg, false)}
+			s, _ := newService(p, svcConfig)
+
+			status, err := s.Status()
+			if errors.Is(err, service.ErrNotInstalled) {
+				mainLog.Load().Warn().Msg("service not installed")
+				return
+			}
+			if status == service.StatusStopped {
+				mainLog.Load().Warn().Msg("service is not running")
+				return
+			}
+
+			dir, err := socketDir()
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to find ctrld home dir")
+			}
+			data, err := json.Marshal(&topStatsRequest{Window: statsWindow, Limit: statsLimit})
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to marshal stats request")
+			}
+			cc := newControlClient(filepath.Join(dir, ctrldControlUnixSock))
+			resp, err := cc.post(topStatsPath, bytes.NewReader(data))
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to get stats")
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				mainLog.Load().Fatal().Msgf("stats request failed: %s", strings.TrimSpace(string(body)))
+			}
+
+			var reports []*topStatsReport
+			if err := json.NewDecoder(resp.Body).Decode(&reports); err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to decode stats result")
+			}
+			renderDomains := func(title string, entries []topstats.Entry) {
+				fmt.Println(title)
+				data := make([][]string, len(entries))
+				for i, e := range entries {
+					data[i] = []string{strconv.Itoa(i + 1), e.Key, strconv.FormatUint(e.Count, 10)}
+				}
+				table := tablewriter.NewWriter(os.Stdout)
+				table.SetHeader([]string{"Rank", "Domain", "Queries"})
+				table.SetAutoFormatHeaders(false)
+				table.AppendBulk(data)
+				table.Render()
+			}
+			for _, r := range reports {
+				fmt.Printf("Last %s: %d queries\n\n", r.Window, r.Queries)
+				renderDomains("Top queried domains", r.Domains)
+				renderDomains("Top NXDOMAIN domains", r.NXDomains)
+				renderDomains("Top blocked domains", r.Blocked)
+
+				fmt.Println("Top clients")
+				data := make([][]string, len(r.Clients))
+				for i, c := range r.Clients {
+					data[i] = []string{strconv.Itoa(i + 1), c.IP, c.Hostname, strconv.FormatUint(c.Count, 10)}
+				}
+				table := tablewriter.NewWriter(os.Stdout)
+				table.SetHeader([]string{"Rank", "IP", "Hostname", "Queries"})
+				table.SetAutoFormatHeaders(false)
+				table.AppendBulk(data)
+				table.Render()
+				fmt.Println()
+			}
+		},
+	}
+	statsCmd.Flags().StringVarP(&statsWindow, "window", "", "", fmt.Sprintf("Show only stats of the window, %q or %q", topStatsWindowHour, topStatsWindowDay))
+	statsCmd.Flags().IntVarP(&statsLimit, "limit", "n", 0, "Maximum number of entries in each list, default to top_stats_size")
+	rootCmd.AddCommand(statsCmd)
+
+	return statsCmd
+}
+
 func initUpgradeCmd() *cobra.Command {
 	const (
 		upgradeChannelDev     = "dev"
@@ -1233,7 +1665,7 @@ func initUpgradeCmd() *cobra.Command {
 			*sc = *svcConfig
 			sc.Executable = bin
 			readConfig(false)
-			v.Unmarshal(&cfg)
+			v.Unmarshal(&cfg, ctrld.DecodeHook())
 			p := &prog{router: router.New(&cfg, runInCdMode())}
 			s, err := newService(p, sc)
 			if err != nil {
@@ -29,9 +29,38 @@ func (c *controlClient) post(path string, data io.Reader) (*http.Response, error
 	if path == sendLogsPath {
 		c.c.Timeout = time.Minute * 5
 	}
+	// for log/tail, the response is streamed until the client stops.
+	if path == tailLogsPath {
+		c.c.Timeout = 0
+	}
 	return c.c.Post("http://unix"+path, contentTypeJson, data)
 }
 
+// cacheRequest represents request for inspecting or flushing cache.
+type cacheRequest struct {
+	Domain   string `json:"domain,omitempty"`
+	Upstream string `json:"upstream,omitempty"`
+}
+
+// topStatsRequest represents request for top statistics.
+type topStatsRequest struct {
+	Window string `json:"window,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+// cacheFlushResponse represents response of flushing cache.
+type cacheFlushResponse struct {
+	Flushed int `json:"flushed"`
+}
+
+// logTailRequest represents request for streaming query events, with optional filters.
+type logTailRequest struct {
+	Client   string `json:"client,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Rcode    string `json:"rcode,omitempty"`
+	Upstream string `json:"upstream,omitempty"`
+}
+
 // deactivationRequest represents request for validating deactivation pin.
 type deactivationRequest struct {
 	Pin int64 `json:"pin"`
@@ -3,6 +3,7 @@ package cli
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -29,6 +30,12 @@ const (
 	ifacePath        = "/iface"
 	viewLogsPath     = "/log/view"
 	sendLogsPath     = "/log/send"
+	tailLogsPath     = "/log/tail"
+	upstreamsPath    = "/upstreams"
+	cacheListPath    = "/cache/list"
+	cacheStatsPath   = "/cache/stats"
+	cacheFlushPath   = "/cache/flush"
+	topStatsPath     = "/stats"
 )
 
 type ifaceResponse struct {
@@ -168,8 +175,11 @@ func (p *prog) registerControlServerHandler() {
 		p.mu.Lock()
 		for k, v := range p.cfg.Listener {
 			listeners[k] = &ctrld.ListenerConfig{
-				IP:   v.IP,
-				Port: v.Port,
+				IP:       v.IP,
+				Port:     v.Port,
+				Protocol: v.Protocol,
+				CertFile: v.CertFile,
+				KeyFile:  v.KeyFile,
 			}
 		}
 		oldSvc := p.cfg.Service
@@ -191,10 +201,11 @@ func (p *prog) registerControlServerHandler() {
 
 		// Checking for cases that we could not do a reload.
 
-		// 1. Listener config ip or port changes.
+		// 1. Listener config ip, port or protocol changes.
 		for k, v := range p.cfg.Listener {
 			l := listeners[k]
-			if l == nil || l.IP != v.IP || l.Port != v.Port {
+			if l == nil || l.IP != v.IP || l.Port != v.Port ||
+				l.Protocol != v.Protocol || l.CertFile != v.CertFile || l.KeyFile != v.KeyFile {
 				w.WriteHeader(http.StatusCreated)
 				return
 			}
@@ -279,6 +290,69 @@ func (p *prog) registerControlServerHandler() {
 			return
 		}
 	}))
+	p.cs.register(upstreamsPath, http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		stats := []*upstreamStats{}
+		if um := p.um; um != nil {
+			stats = um.stats()
+		}
+		if err := json.NewEncoder(w).Encode(&stats); err != nil {
+			http.Error(w, fmt.Sprintf("could not marshal upstreams stats: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}))
+	p.cs.register(cacheListPath, http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		var req cacheRequest
+		if err := decodeCacheRequest(request, &req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid cache request: %v", err), http.StatusBadRequest)
+			return
+		}
+		entries := p.cacheEntries(req.Domain)
+		if err := json.NewEncoder(w).Encode(&entries); err != nil {
+			http.Error(w, fmt.Sprintf("could not marshal cache entries: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}))
+	p.cs.register(cacheStatsPath, http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		if err := json.NewEncoder(w).Encode(p.cacheStats()); err != nil {
+			http.Error(w, fmt.Sprintf("could not marshal cache stats: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}))
+	p.cs.register(cacheFlushPath, http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		var req cacheRequest
+		if err := decodeCacheRequest(request, &req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid cache request: %v", err), http.StatusBadRequest)
+			return
+		}
+		res := &cacheFlushResponse{Flushed: p.flushCache(req.Domain, req.Upstream)}
+		mainLog.Load().Info().Msgf("flushed %d cached responses", res.Flushed)
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			http.Error(w, fmt.Sprintf("could not marshal cache flush result: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}))
+	p.cs.register(topStatsPath, http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		var req topStatsRequest
+		if err := json.NewDecoder(request.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, fmt.Sprintf("invalid stats request: %v", err), http.StatusBadRequest)
+			return
+		}
+		switch req.Window {
+		case "", topStatsWindowHour, topStatsWindowDay:
+		default:
+			http.Error(w, fmt.Sprintf("invalid stats window: %q", req.Window), http.StatusBadRequest)
+			return
+		}
+		reports := p.topStatsReports(req.Window, req.Limit)
+		if reports == nil {
+			http.Error(w, "top stats are disabled, set top_stats = true in [service] config", http.StatusServiceUnavailable)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(reports); err != nil {
+			http.Error(w, fmt.Sprintf("could not marshal top stats: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}))
 	p.cs.register(viewLogsPath, http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
 		lr, err := p.logReader()
 		if err != nil {
@@ -301,6 +375,56 @@ func (p *prog) registerControlServerHandler() {
 			return
 		}
 	}))
+	p.cs.register(tailLogsPath, http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		var req logTailRequest
+		if err := json.NewDecoder(request.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, fmt.Sprintf("invalid log tail request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := req.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+		sub := p.queryStream.subscribe(&req)
+		defer p.queryStream.unsubscribe(sub)
+		mainLog.Load().Debug().Msg("streaming query events to log tail client")
+
+		// Query events are sent as JSON lines.
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		enc := json.NewEncoder(w)
+		ticker := time.NewTicker(queryStreamDroppedInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case r := <-sub.ch:
+				if err := enc.Encode(r); err != nil {
+					return
+				}
+				// Write all pending events before flushing.
+				if len(sub.ch) == 0 {
+					flusher.Flush()
+				}
+			case <-ticker.C:
+				if d := sub.droppedReport(); d != nil {
+					if err := enc.Encode(d); err != nil {
+						return
+					}
+					flusher.Flush()
+				}
+			case <-request.Context().Done():
+				return
+			case <-p.stopCh:
+				return
+			}
+		}
+	}))
 	p.cs.register(sendLogsPath, http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
 		if time.Since(p.internalLogSent) < logWriterSentInterval {
 			w.WriteHeader(http.StatusServiceUnavailable)
@@ -342,3 +466,11 @@ func jsonResponse(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// decodeCacheRequest decodes the cache request from the request body, an empty body is an empty request.
+func decodeCacheRequest(r *http.Request, req *cacheRequest) error {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
@@ -17,6 +17,7 @@ import (
 	"time"
 
 	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 	"tailscale.com/net/netmon"
 	"tailscale.com/net/tsaddr"
@@ -25,11 +26,11 @@ import (
 	"github.com/Control-D-Inc/ctrld/internal/controld"
 	"github.com/Control-D-Inc/ctrld/internal/dnscache"
 	ctrldnet "github.com/Control-D-Inc/ctrld/internal/net"
+	"github.com/Control-D-Inc/ctrld/internal/querylog"
 	"github.com/Control-D-Inc/ctrld/internal/router"
 )
 
 const (
-	staleTTL = 60 * time.Second
 	localTTL = 3600 * time.Second
 	// EDNS0_OPTION_MAC is dnsmasq EDNS0 code for adding mac option.
 	// https://thekelleys.org.uk/gitweb/?p=dnsmasq.git;a=blob;f=src/dns-protocol.h;h=76ac66a8c28317e9c121a74ab5fd0e20f6237dc8;hb=HEAD#l81
@@ -40,6 +41,13 @@ const (
 	selfUninstallMaxQueries = 32
 )
 
+// Placeholders of upstreamForResult matched names, when nothing matched.
+const (
+	noPolicy  = "no policy"
+	noNetwork = "no network"
+	noRule    = "no rule"
+)
+
 var osUpstreamConfig = &ctrld.UpstreamConfig{
 	Name:    "OS resolver",
 	Type:    ctrld.ResolverTypeOS,
@@ -64,6 +72,8 @@ type proxyRequest struct {
 	ci             *ctrld.ClientInfo
 	failoverRcodes []int
 	ufr            *upstreamForResult
+	// dnssec reports whether answers should be validated with DNSSEC, regardless of upstreams config.
+	dnssec bool
 }
 
 // proxyResponse contains data for proxying a DNS response from upstream.
@@ -71,7 +81,10 @@ type proxyResponse struct {
 	answer     *dns.Msg
 	cached     bool
 	clientInfo bool
+	localZone  bool
+	blocked    bool
 	upstream   string
+	upstreamID string
 }
 
 // upstreamForResult represents the result of processing rules for a request.
@@ -82,6 +95,8 @@ type upstreamForResult struct {
 	matchedRule    string
 	matched        bool
 	srcAddr        string
+	// strategy is the upstream strategy of the matched policy.
+	strategy *upstreamStrategy
 }
 
 func (p *prog) serveDNS(listenerNum string) error {
@@ -95,6 +110,8 @@ func (p *prog) serveDNS(listenerNum string) error {
 	handler := dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
 		p.sema.acquire()
 		defer p.sema.release()
+		statsInflightRequests.Inc()
+		defer statsInflightRequests.Dec()
 		if len(m.Question) == 0 {
 			answer := new(dns.Msg)
 			answer.SetRcode(m, dns.RcodeFormatError)
@@ -133,25 +150,43 @@ func (p *prog) serveDNS(listenerNum string) error {
 		remoteIP, _, _ := net.SplitHostPort(w.RemoteAddr().String())
 		ci := p.getClientInfo(remoteIP, m)
 		ci.ClientIDPref = p.cfg.Service.ClientIDPref
-		stripClientSubnet(m)
 		remoteAddr := spoofRemoteAddr(w.RemoteAddr(), ci)
 		fmtSrcToDest := fmtRemoteToLocal(listenerNum, ci.Hostname, remoteAddr.String())
 		t := time.Now()
+		listener := net.JoinHostPort(listenerConfig.IP, strconv.Itoa(listenerConfig.Port))
+		ctx, span := startSpan(ctx, "dns.query",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				otelAttrListener.String(listener),
+				otelAttrClientIP.String(ci.IP),
+				otelAttrQname.String(domain),
+				otelAttrQtype.String(dns.TypeToString[q.Qtype]),
+			))
+		defer span.End()
 		ctrld.Log(ctx, mainLog.Load().Info(), "QUERY: %s: %s %s", fmtSrcToDest, dns.TypeToString[q.Qtype], domain)
-		ur := p.upstreamFor(ctx, listenerNum, listenerConfig, remoteAddr, ci.Mac, domain)
+		_, policySpan := startSpan(ctx, "policy.evaluate")
+		ur := p.upstreamFor(ctx, listenerNum, listenerConfig, remoteAddr, ci.Mac, domain, q.Qtype)
+		policySpan.SetAttributes(
+			otelAttrPolicy.String(matchedName(ur.matchedPolicy, noPolicy)),
+			otelAttrNetwork.String(matchedName(ur.matchedNetwork, noNetwork)),
+			otelAttrRule.String(matchedName(ur.matchedRule, noRule)),
+			otelAttrUpstreams.StringSlice(ur.upstreams),
+		)
+		policySpan.End()
 
 		labelValues := make([]string, 0, len(statsQueriesCountLabels))
-		labelValues = append(labelValues, net.JoinHostPort(listenerConfig.IP, strconv.Itoa(listenerConfig.Port)))
+		labelValues = append(labelValues, listener)
 		labelValues = append(labelValues, ci.IP)
 		labelValues = append(labelValues, ci.Mac)
 		labelValues = append(labelValues, ci.Hostname)
 
 		var answer *dns.Msg
+		var upstream, upstreamID string
+		var cached, blocked bool
 		if !ur.matched && listenerConfig.Restricted {
 			ctrld.Log(ctx, mainLog.Load().Info(), "query refused, %s does not match any network policy", remoteAddr.String())
 			answer = new(dns.Msg)
 			answer.SetRcode(m, dns.RcodeRefused)
-			labelValues = append(labelValues, "") // no upstream
 		} else {
 			var failoverRcode []int
 			if listenerConfig.Policy != nil {
@@ -162,26 +197,63 @@ func (p *prog) serveDNS(listenerNum string) error {
 				ci:             ci,
 				failoverRcodes: failoverRcode,
 				ufr:            ur,
+				dnssec:         listenerConfig.Dnssec,
 			})
 			go p.doSelfUninstall(pr.answer)
 
 			answer = pr.answer
+			cached = pr.cached
+			blocked = pr.blocked
 			rtt := time.Since(t)
 			ctrld.Log(ctx, mainLog.Load().Debug(), "received response of %d bytes in %s", answer.Len(), rtt)
-			upstream := pr.upstream
+			upstream, upstreamID = pr.upstream, pr.upstreamID
 			switch {
 			case pr.cached:
 				upstream = "cache"
 			case pr.clientInfo:
 				upstream = "client_info_table"
+			case pr.localZone:
+				upstream = "local_zone"
+			case pr.blocked:
+				upstream = "blocklist"
 			}
-			labelValues = append(labelValues, upstream)
 		}
+		labelValues = append(labelValues, upstream)
 		labelValues = append(labelValues, dns.TypeToString[q.Qtype])
 		labelValues = append(labelValues, dns.RcodeToString[answer.Rcode])
+		statsQueryDuration.Observe(time.Since(t).Seconds())
+		otelRecordQuery(ctx, time.Since(t), dns.RcodeToString[answer.Rcode], cached)
+		span.SetAttributes(
+			otelAttrRcode.String(dns.RcodeToString[answer.Rcode]),
+			otelAttrUpstream.String(upstream),
+			otelAttrCached.Bool(cached),
+		)
+		p.logQuery(&querylog.Record{
+			Time:           t,
+			RequestID:      reqId,
+			Listener:       listener,
+			ClientIP:       ci.IP,
+			ClientMac:      ci.Mac,
+			ClientHostname: ci.Hostname,
+			Qname:          domain,
+			Qtype:          dns.TypeToString[q.Qtype],
+			Policy:         matchedName(ur.matchedPolicy, noPolicy),
+			Network:        matchedName(ur.matchedNetwork, noNetwork),
+			Rule:           matchedName(ur.matchedRule, noRule),
+			Upstream:       upstream,
+			UpstreamID:     upstreamID,
+			Cached:         cached,
+			Rcode:          dns.RcodeToString[answer.Rcode],
+			Latency:        time.Since(t),
+			ClientAddr:     w.RemoteAddr(),
+			ServerAddr:     w.LocalAddr(),
+			Query:          m,
+			Response:       answer,
+		})
 		go func() {
 			p.WithLabelValuesInc(statsQueriesCount, labelValues...)
 			p.WithLabelValuesInc(statsClientQueriesCount, []string{ci.IP, ci.Mac, ci.Hostname}...)
+			p.recordTopStats(domain, ci.IP, answer.Rcode, blocked)
 			p.forceFetchingAPI(domain)
 		}()
 		if err := w.WriteMsg(answer); err != nil {
@@ -189,6 +261,10 @@ func (p *prog) serveDNS(listenerNum string) error {
 		}
 	})
 
+	if listenerConfig.IsEncrypted() {
+		return p.serveEncryptedDNS(listenerConfig, handler)
+	}
+
 	g, ctx := errgroup.WithContext(context.Background())
 	for _, proto := range []string{"udp", "tcp"} {
 		proto := proto
@@ -255,11 +331,11 @@ func (p *prog) serveDNS(listenerNum string) error {
 // Though domain policy has higher priority than network policy, it is still
 // processed later, because policy logging want to know whether a network rule
 // is disregarded in favor of the domain level rule.
-func (p *prog) upstreamFor(ctx context.Context, defaultUpstreamNum string, lc *ctrld.ListenerConfig, addr net.Addr, srcMac, domain string) (res *upstreamForResult) {
+func (p *prog) upstreamFor(ctx context.Context, defaultUpstreamNum string, lc *ctrld.ListenerConfig, addr net.Addr, srcMac, domain string, qtype uint16) (res *upstreamForResult) {
 	upstreams := []string{upstreamPrefix + defaultUpstreamNum}
-	matchedPolicy := "no policy"
-	matchedNetwork := "no network"
-	matchedRule := "no rule"
+	matchedPolicy := noPolicy
+	matchedNetwork := noNetwork
+	matchedRule := noRule
 	matched := false
 	res = &upstreamForResult{srcAddr: addr.String()}
 
@@ -269,6 +345,9 @@ func (p *prog) upstreamFor(ctx context.Context, defaultUpstreamNum string, lc *c
 		res.matchedPolicy = matchedPolicy
 		res.matchedNetwork = matchedNetwork
 		res.matchedRule = matchedRule
+		if matched {
+			res.strategy = p.upstreamStrategyFor(lc.Policy)
+		}
 	}()
 
 	if lc.Policy == nil {
@@ -288,9 +367,20 @@ func (p *prog) upstreamFor(ctx context.Context, defaultUpstreamNum string, lc *c
 		sourceIP = addr.IP
 	}
 
+	rm := p.ruleMatcherFor(lc.Policy)
+	q, changedSchedules := rm.query(qtype, p.now())
+	if len(changedSchedules) > 0 && p.cache != nil {
+		// Queries may be routed to different upstreams now, purge cached answers of the policy upstreams.
+		p.cache.PurgeUpstreams(append([]string{upstreamPrefix + defaultUpstreamNum}, rm.upstreams...)...)
+		ctrld.Log(ctx, mainLog.Load().Debug(), "policy %q schedules changed: %v, local cache is purged", lc.Policy.Name, changedSchedules)
+	}
+
 networkRules:
-	for _, rule := range lc.Policy.Networks {
-		for source, targets := range rule {
+	for i, rule := range lc.Policy.Networks {
+		if !rm.networkConds[i].matches(q) {
+			continue
+		}
+		for source, target := range rule {
 			networkNum := strings.TrimPrefix(source, "network.")
 			nc := p.cfg.Network[networkNum]
 			if nc == nil {
@@ -299,8 +389,8 @@ networkRules:
 			for _, ipNet := range nc.IPNets {
 				if ipNet.Contains(sourceIP) {
 					matchedPolicy = lc.Policy.Name
-					matchedNetwork = source
-					networkTargets = targets
+					matchedNetwork = ruleName(source, target)
+					networkTargets = target.Upstreams
 					matched = true
 					break networkRules
 				}
@@ -308,32 +398,27 @@ networkRules:
 		}
 	}
 
-macRules:
-	for _, rule := range lc.Policy.Macs {
-		for source, targets := range rule {
-			if source != "" && (strings.EqualFold(source, srcMac) || wildcardMatches(strings.ToLower(source), strings.ToLower(srcMac))) {
-				matchedPolicy = lc.Policy.Name
-				matchedNetwork = source
-				networkTargets = targets
-				matched = true
-				break macRules
-			}
+	if i := rm.matchMac(srcMac, q); i != -1 {
+		// There's only one entry per rule, config validation ensures this.
+		for source, target := range lc.Policy.Macs[i] {
+			matchedPolicy = lc.Policy.Name
+			matchedNetwork = ruleName(source, target)
+			networkTargets = target.Upstreams
+			matched = true
 		}
 	}
 
-	for _, rule := range lc.Policy.Rules {
+	if i := rm.domains.match(domain, q); i != -1 {
 		// There's only one entry per rule, config validation ensures this.
-		for source, targets := range rule {
-			if source == domain || wildcardMatches(source, domain) {
-				matchedPolicy = lc.Policy.Name
-				if len(networkTargets) > 0 {
-					matchedNetwork += " (unenforced)"
-				}
-				matchedRule = source
-				do(targets)
-				matched = true
-				return
+		for source, target := range lc.Policy.Rules[i] {
+			matchedPolicy = lc.Policy.Name
+			if len(networkTargets) > 0 {
+				matchedNetwork += " (unenforced)"
 			}
+			matchedRule = ruleName(source, target)
+			do(target.Upstreams)
+			matched = true
+			return
 		}
 	}
 
@@ -421,6 +506,15 @@ func (p *prog) proxyLanHostnameQuery(ctx context.Context, msg *dns.Msg) *dns.Msg
 }
 
 func (p *prog) proxy(ctx context.Context, req *proxyRequest) *proxyResponse {
+	// Local zones are answered authoritatively, before reaching cache or upstreams.
+	if answer := p.localZones.Load().answer(req.msg); answer != nil {
+		ctrld.Log(ctx, mainLog.Load().Debug(), "answering from local zone")
+		return &proxyResponse{answer: answer, localZone: true}
+	}
+	if b := p.blocklists.Load().match(req.msg); b != nil {
+		ctrld.Log(ctx, mainLog.Load().Debug(), "blocked by %s", b.name)
+		return &proxyResponse{answer: newBlockedAnswer(req.msg, b.cfg), blocked: true}
+	}
 	var staleAnswer *dns.Msg
 	upstreams := req.ufr.upstreams
 	serveStaleCache := p.cache != nil && p.cfg.Service.CacheServeStale
@@ -486,27 +580,82 @@ func (p *prog) proxy(ctx context.Context, req *proxyRequest) *proxyResponse {
 		}
 	}
 
+	// LAN queries are answered by local resolvers, which do not sign them.
+	_, isLanQuery := ctx.Value(ctrld.LanQueryCtxKey{}).(bool)
+	validateDnssec := func(upstreamConfig *ctrld.UpstreamConfig) bool {
+		return !isLanQuery && (req.dnssec || upstreamConfig != nil && upstreamConfig.Dnssec)
+	}
+	cacheKey := func(upstream string, upstreamConfig *ctrld.UpstreamConfig) dnscache.Key {
+		key := dnscache.NewKey(req.msg, upstream)
+		if validateDnssec(upstreamConfig) {
+			key = dnscache.NewDnssecKey(req.msg, upstream)
+		}
+		key.Scope = p.cacheScope(req, upstreamConfig)
+		key.Subnet = p.ecsSubnet(req.msg, req.ci, upstreamConfig)
+		return key
+	}
+	// getCached looks up the cached answer of the key, falling back to the answer cached for all client subnets.
+	getCached := func(key dnscache.Key) *dnscache.Value {
+		if v := p.cache.Get(key); v != nil || key.Subnet == "" {
+			return v
+		}
+		key.Subnet = ""
+		return p.cache.Get(key)
+	}
+
 	// Inverse query should not be cached: https://www.rfc-editor.org/rfc/rfc1035#section-7.4
 	if p.cache != nil && req.msg.Question[0].Qtype != dns.TypePTR {
-		for _, upstream := range upstreams {
-			cachedValue := p.cache.Get(dnscache.NewKey(req.msg, upstream))
+		_, cacheSpan := startSpan(ctx, "cache.lookup")
+		for i, upstream := range upstreams {
+			cachedValue := getCached(cacheKey(upstream, upstreamConfigs[i]))
 			if cachedValue == nil {
 				continue
 			}
 			answer := cachedValue.Msg.Copy()
 			ctrld.SetCacheReply(answer, req.msg, answer.Rcode)
+			ctrld.StripDnssecRecords(req.msg, answer)
+			stripAnswerClientSubnet(req.msg, answer)
 			now := time.Now()
 			if cachedValue.Expire.After(now) {
-				ctrld.Log(ctx, mainLog.Load().Debug(), "hit cached response")
+				if cachedValue.Negative {
+					ctrld.Log(ctx, mainLog.Load().Debug(), "hit negative cached response")
+					statsCacheNegativeHits.Inc()
+				} else {
+					ctrld.Log(ctx, mainLog.Load().Debug(), "hit cached response")
+				}
+				statsCacheHits.Inc()
+				if p.shouldPrefetch(cachedValue, now) {
+					p.prefetch(cacheKey(upstream, upstreamConfigs[i]), upstream, upstreamConfigs[i], req.msg.Copy(), req.ci)
+				}
 				setCachedAnswerTTL(answer, now, cachedValue.Expire)
+				cacheSpan.SetAttributes(otelAttrCacheHit.Bool(true), otelAttrUpstream.String(upstream))
+				cacheSpan.End()
 				res.answer = answer
 				res.cached = true
 				return res
 			}
-			staleAnswer = answer
+			if serveStaleCache && p.canServeStale(cachedValue, now) {
+				staleAnswer = answer
+			}
 		}
-	}
-	resolve1 := func(upstream string, upstreamConfig *ctrld.UpstreamConfig, msg *dns.Msg) (*dns.Msg, error) {
+		statsCacheMisses.Inc()
+		cacheSpan.SetAttributes(otelAttrCacheHit.Bool(false), otelAttrCacheStale.Bool(staleAnswer != nil))
+		cacheSpan.End()
+	}
+	resolve1 := func(ctx context.Context, upstream string, upstreamConfig *ctrld.UpstreamConfig, msg *dns.Msg) (answer *dns.Msg, err error) {
+		ctx, span := startSpan(ctx, "upstream.resolve",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				otelAttrUpstream.String(upstream),
+				otelAttrUpstreamType.String(upstreamConfig.Type),
+				otelAttrServerAddr.String(upstreamConfig.Endpoint),
+			))
+		defer func() {
+			if answer != nil {
+				span.SetAttributes(otelAttrRcode.String(dns.RcodeToString[answer.Rcode]))
+			}
+			endSpanWithError(span, err)
+		}()
 		ctrld.Log(ctx, mainLog.Load().Debug(), "sending query to %s: %s", upstream, upstreamConfig.Name)
 		dnsResolver, err := ctrld.NewResolver(upstreamConfig)
 		if err != nil {
@@ -517,27 +666,46 @@ func (p *prog) proxy(ctx context.Context, req *proxyRequest) *proxyResponse {
 		defer cancel()
 		return dnsResolver.Resolve(resolveCtx, msg)
 	}
-	resolve := func(upstream string, upstreamConfig *ctrld.UpstreamConfig, msg *dns.Msg) *dns.Msg {
+	resolve := func(ctx context.Context, upstream string, upstreamConfig *ctrld.UpstreamConfig, msg *dns.Msg) *dns.Msg {
 		if upstreamConfig.UpstreamSendClientInfo() && req.ci != nil {
 			ctrld.Log(ctx, mainLog.Load().Debug(), "including client info with the request")
 			ctx = context.WithValue(ctx, ctrld.ClientInfoCtxKey{}, req.ci)
 		}
-		answer, err := resolve1(upstream, upstreamConfig, msg)
-		// if we have an answer, we should reset the failure count
+		ok, probe := p.um.admit(upstream)
+		if !ok {
+			ctrld.Log(ctx, mainLog.Load().Debug(), "upstream %s is being probed, skipping", upstream)
+			return nil
+		}
+		if probe {
+			defer p.um.probeDone(upstream)
+		}
+		query := p.ecsQuery(msg, req.ci, upstreamConfig)
+		if validateDnssec(upstreamConfig) {
+			query = ctrld.DnssecQuery(query)
+		}
+		start := time.Now()
+		answer, err := resolve1(ctx, upstream, upstreamConfig, query)
+		// if we have an answer, we should close the upstream circuit
 		// we dont use reset here since we dont want to prevent failure counts from being incremented
 		if answer != nil {
-			p.um.mu.Lock()
-			p.um.failureReq[upstream] = 0
-			p.um.down[upstream] = false
-			p.um.mu.Unlock()
+			p.um.recordSuccess(upstream, time.Since(start))
+			if validateDnssec(upstreamConfig) {
+				answer = p.validateDnssec(ctx, upstreamConfig, msg, answer)
+			}
 			return answer
 		}
 
+		// The query was cancelled because other upstream answered first, it's not an upstream failure.
+		if errors.Is(ctx.Err(), context.Canceled) {
+			ctrld.Log(ctx, mainLog.Load().Debug(), "query to %s cancelled", upstream)
+			return nil
+		}
+
 		ctrld.Log(ctx, mainLog.Load().Error().Err(err), "failed to resolve query")
 
-		// increase failure count when there is no answer
+		// record failure when there is no answer
 		// rehardless of what kind of error we get
-		p.um.increaseFailureCount(upstream)
+		p.um.recordFailure(upstream, err)
 
 		if err != nil {
 			// For timeout error (i.e: context deadline exceed), force re-bootstrapping.
@@ -553,108 +721,172 @@ func (p *prog) proxy(ctx context.Context, req *proxyRequest) *proxyResponse {
 
 		return nil
 	}
-	for n, upstreamConfig := range upstreamConfigs {
-		if upstreamConfig == nil {
-			continue
-		}
-		logger := mainLog.Load().Debug().
-			Str("upstream", upstreamConfig.String()).
-			Str("query", req.msg.Question[0].Name).
-			Bool("is_ad_query", p.isAdDomainQuery(req.msg)).
-			Bool("is_lan_query", isLanOrPtrQuery)
-
-		if p.isLoop(upstreamConfig) {
-			ctrld.Log(ctx, logger, "DNS loop detected")
-			continue
+	// race sends the query to upstreams concurrently, returning the index of the first
+	// good answer, which is either a success, or not matching failover rcodes.
+	race := func(upstreams []string, upstreamConfigs []*ctrld.UpstreamConfig) (int, *dns.Msg) {
+		raceCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		type raceResult struct {
+			n      int
+			answer *dns.Msg
 		}
-		answer := resolve(upstreams[n], upstreamConfig, req.msg)
-		if answer == nil {
-			if serveStaleCache && staleAnswer != nil {
-				ctrld.Log(ctx, mainLog.Load().Debug(), "serving stale cached response")
-				now := time.Now()
-				setCachedAnswerTTL(staleAnswer, now, now.Add(staleTTL))
-				res.answer = staleAnswer
-				res.cached = true
-				return res
+		results := make(chan raceResult, len(upstreamConfigs))
+		pending := 0
+		for n, upstreamConfig := range upstreamConfigs {
+			if upstreamConfig == nil || p.isLoop(upstreamConfig) {
+				continue
 			}
-			continue
-		}
-		// We are doing LAN/PTR lookup using private resolver, so always process next one.
-		// Except for the last, we want to send response instead of saying all upstream failed.
-		if answer.Rcode != dns.RcodeSuccess && isLanOrPtrQuery && n != len(upstreamConfigs)-1 {
-			ctrld.Log(ctx, mainLog.Load().Debug(), "no response from %s, process to next upstream", upstreams[n])
-			continue
+			pending++
+			go func() {
+				results <- raceResult{n: n, answer: resolve(raceCtx, upstreams[n], upstreamConfig, req.msg.Copy())}
+			}()
 		}
-		if answer.Rcode != dns.RcodeSuccess && len(upstreamConfigs) > 1 && containRcode(req.failoverRcodes, answer.Rcode) {
-			ctrld.Log(ctx, mainLog.Load().Debug(), "failover rcode matched, process to next upstream")
-			continue
+		for ; pending > 0; pending-- {
+			r := <-results
+			if r.answer != nil && (r.answer.Rcode == dns.RcodeSuccess || !containRcode(req.failoverRcodes, r.answer.Rcode)) {
+				return r.n, r.answer
+			}
 		}
-
+		return -1, nil
+	}
+	serveStale := func() *proxyResponse {
+		ctrld.Log(ctx, mainLog.Load().Debug(), "serving stale cached response")
+		return p.staleResponse(req.msg, staleAnswer)
+	}
+	reply := func(upstream string, upstreamConfig *ctrld.UpstreamConfig, answer *dns.Msg) *proxyResponse {
 		// set compression, as it is not set by default when unpacking
 		answer.Compress = true
 
 		if p.cache != nil && req.msg.Question[0].Qtype != dns.TypePTR {
-			ttl := ttlFromMsg(answer)
-			now := time.Now()
-			expired := now.Add(time.Duration(ttl) * time.Second)
-			if cachedTTL := p.cfg.Service.CacheTTLOverride; cachedTTL > 0 {
-				expired = now.Add(time.Duration(cachedTTL) * time.Second)
-			}
-			setCachedAnswerTTL(answer, now, expired)
-			p.cache.Add(dnscache.NewKey(req.msg, upstreams[n]), dnscache.NewValue(answer, expired))
+			p.cacheAnswer(ecsCacheKey(cacheKey(upstream, upstreamConfig), answer), answer)
 			ctrld.Log(ctx, mainLog.Load().Debug(), "add cached response")
+			answer = answer.Copy()
 		}
+		ctrld.StripDnssecRecords(req.msg, answer)
+		stripAnswerClientSubnet(req.msg, answer)
 		hostname := ""
 		if req.ci != nil {
 			hostname = req.ci.Hostname
 		}
-		ctrld.Log(ctx, mainLog.Load().Info(), "REPLY: %s -> %s (%s): %s", upstreams[n], req.ufr.srcAddr, hostname, dns.RcodeToString[answer.Rcode])
+		ctrld.Log(ctx, mainLog.Load().Info(), "REPLY: %s -> %s (%s): %s", upstream, req.ufr.srcAddr, hostname, dns.RcodeToString[answer.Rcode])
 		res.answer = answer
 		res.upstream = upstreamConfig.Endpoint
+		res.upstreamID = upstream
 		return res
 	}
-	ctrld.Log(ctx, mainLog.Load().Error(), "all %v endpoints failed", upstreams)
 
-	// if we have no healthy upstreams, trigger recovery flow
-	if p.leakOnUpstreamFailure() {
-		if p.um.countHealthy(upstreams) == 0 {
-			p.recoveryCancelMu.Lock()
-			if p.recoveryCancel == nil {
-				var reason RecoveryReason
-				if upstreams[0] == upstreamOS {
-					reason = RecoveryReasonOSFailure
+	resolveUpstreams := func() *proxyResponse {
+		upstreams, upstreamConfigs := req.ufr.strategy.order(p.um, upstreams, upstreamConfigs)
+		raced := 0
+		if n := req.ufr.strategy.raceSize(len(upstreamConfigs)); n > 1 {
+			ctrld.Log(ctx, mainLog.Load().Debug(), "racing upstreams: %v", upstreams[:n])
+			if i, answer := race(upstreams[:n], upstreamConfigs[:n]); answer != nil {
+				return reply(upstreams[i], upstreamConfigs[i], answer)
+			}
+			raced = n
+		}
+		for n := raced; n < len(upstreamConfigs); n++ {
+			upstreamConfig := upstreamConfigs[n]
+			if upstreamConfig == nil {
+				continue
+			}
+			logger := mainLog.Load().Debug().
+				Str("upstream", upstreamConfig.String()).
+				Str("query", req.msg.Question[0].Name).
+				Bool("is_ad_query", p.isAdDomainQuery(req.msg)).
+				Bool("is_lan_query", isLanOrPtrQuery)
+
+			if p.isLoop(upstreamConfig) {
+				ctrld.Log(ctx, logger, "DNS loop detected")
+				continue
+			}
+			answer := resolve(ctx, upstreams[n], upstreamConfig, req.msg)
+			if answer == nil {
+				statsUpstreamFailovers.WithLabelValues(upstreams[n]).Inc()
+				continue
+			}
+			// We are doing LAN/PTR lookup using private resolver, so always process next one.
+			// Except for the last, we want to send response instead of saying all upstream failed.
+			if answer.Rcode != dns.RcodeSuccess && isLanOrPtrQuery && n != len(upstreamConfigs)-1 {
+				ctrld.Log(ctx, mainLog.Load().Debug(), "no response from %s, process to next upstream", upstreams[n])
+				continue
+			}
+			if answer.Rcode != dns.RcodeSuccess && len(upstreamConfigs) > 1 && containRcode(req.failoverRcodes, answer.Rcode) {
+				ctrld.Log(ctx, mainLog.Load().Debug(), "failover rcode matched, process to next upstream")
+				statsUpstreamFailovers.WithLabelValues(upstreams[n]).Inc()
+				continue
+			}
+			return reply(upstreams[n], upstreamConfig, answer)
+		}
+		ctrld.Log(ctx, mainLog.Load().Error(), "all %v endpoints failed", upstreams)
+		if staleAnswer != nil {
+			return serveStale()
+		}
+
+		// if we have no healthy upstreams, trigger recovery flow
+		if p.leakOnUpstreamFailure() {
+			if p.um.countHealthy(upstreams) == 0 {
+				p.recoveryCancelMu.Lock()
+				if p.recoveryCancel == nil {
+					var reason RecoveryReason
+					if upstreams[0] == upstreamOS {
+						reason = RecoveryReasonOSFailure
+					} else {
+						reason = RecoveryReasonRegularFailure
+					}
+					mainLog.Load().Debug().Msgf("No healthy upstreams, triggering recovery with reason: %v", reason)
+					go p.handleRecovery(reason)
 				} else {
-					reason = RecoveryReasonRegularFailure
+					mainLog.Load().Debug().Msg("Recovery already in progress; skipping duplicate trigger from down detection")
 				}
-				mainLog.Load().Debug().Msgf("No healthy upstreams, triggering recovery with reason: %v", reason)
-				go p.handleRecovery(reason)
+				p.recoveryCancelMu.Unlock()
 			} else {
-				mainLog.Load().Debug().Msg("Recovery already in progress; skipping duplicate trigger from down detection")
+				mainLog.Load().Debug().Msg("One upstream is down but at least one is healthy; skipping recovery trigger")
 			}
-			p.recoveryCancelMu.Unlock()
-		} else {
-			mainLog.Load().Debug().Msg("One upstream is down but at least one is healthy; skipping recovery trigger")
-		}
 
-		// attempt query to OS resolver while as a retry catch all
-		// we dont want this to happen if leakOnUpstreamFailure is false
-		if upstreams[0] != upstreamOS {
-			ctrld.Log(ctx, mainLog.Load().Debug(), "attempting query to OS resolver as a retry catch all")
-			answer := resolve(upstreamOS, osUpstreamConfig, req.msg)
-			if answer != nil {
-				ctrld.Log(ctx, mainLog.Load().Debug(), "OS resolver retry query successful")
-				res.answer = answer
-				res.upstream = osUpstreamConfig.Endpoint
-				return res
+			// attempt query to OS resolver while as a retry catch all
+			// we dont want this to happen if leakOnUpstreamFailure is false
+			if upstreams[0] != upstreamOS {
+				ctrld.Log(ctx, mainLog.Load().Debug(), "attempting query to OS resolver as a retry catch all")
+				answer := resolve(ctx, upstreamOS, osUpstreamConfig, req.msg)
+				if answer != nil {
+					ctrld.Log(ctx, mainLog.Load().Debug(), "OS resolver retry query successful")
+					ctrld.StripDnssecRecords(req.msg, answer)
+					stripAnswerClientSubnet(req.msg, answer)
+					res.answer = answer
+					res.upstream = osUpstreamConfig.Endpoint
+					res.upstreamID = upstreamOS
+					return res
+				}
+				ctrld.Log(ctx, mainLog.Load().Debug(), "OS resolver retry query failed")
 			}
-			ctrld.Log(ctx, mainLog.Load().Debug(), "OS resolver retry query failed")
 		}
-	}
 
-	answer := new(dns.Msg)
-	answer.SetRcode(req.msg, dns.RcodeServerFailure)
-	res.answer = answer
-	return res
+		answer := new(dns.Msg)
+		answer.SetRcode(req.msg, dns.RcodeServerFailure)
+		res.answer = answer
+		return res
+	}
+	if staleAnswer == nil {
+		return resolveUpstreams()
+	}
+	// RFC 8767 client response timer: answer with stale data if upstreams are slow,
+	// the resolution continues in background, and refreshes the cache once an upstream answers.
+	// The resolution may outlive this request, so it uses its own copy of the query.
+	bgReq := *req
+	bgReq.msg = req.msg.Copy()
+	req = &bgReq
+	resCh := make(chan *proxyResponse, 1)
+	go func() { resCh <- resolveUpstreams() }()
+	timer := time.NewTimer(p.staleAnswerTimeout())
+	defer timer.Stop()
+	select {
+	case res := <-resCh:
+		return res
+	case <-timer.C:
+		ctrld.Log(ctx, mainLog.Load().Debug(), "client response timer expired")
+		return serveStale()
+	}
 }
 
 func (p *prog) upstreamsAndUpstreamConfigForPtr(upstreams []string, upstreamConfigs []*ctrld.UpstreamConfig) ([]string, []*ctrld.UpstreamConfig) {
@@ -694,6 +926,18 @@ func canonicalName(fqdn string) string {
 	return q
 }
 
+// ruleName returns the name of rule for logging, including the rule query types and schedule, if any.
+func ruleName(source string, target ctrld.RuleTarget) string {
+	name := source
+	if len(target.Types) > 0 {
+		name = fmt.Sprintf("%s %v", name, target.Types)
+	}
+	if target.Schedule != "" {
+		name = fmt.Sprintf("%s (schedule: %s)", name, target.Schedule)
+	}
+	return name
+}
+
 // wildcardMatches reports whether string str matches the wildcard pattern in case-insensitive manner.
 func wildcardMatches(wildcard, str string) bool {
 	// Wildcard match.
@@ -741,6 +985,19 @@ func containRcode(rcodes []int, rcode int) bool {
 	return false
 }
 
+// cacheAnswer adds answer to the cache, which expires after the answer TTL, or the cache TTL override if set.
+// Answers which must not be cached are skipped.
+func (p *prog) cacheAnswer(key dnscache.Key, answer *dns.Msg) {
+	ttl, ok := p.cacheTTL(answer)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	expired := now.Add(time.Duration(ttl) * time.Second)
+	setCachedAnswerTTL(answer, now, expired)
+	p.cache.Add(key, dnscache.NewValue(answer, expired))
+}
+
 func setCachedAnswerTTL(answer *dns.Msg, now, expiredTime time.Time) {
 	ttlSecs := expiredTime.Sub(now).Seconds()
 	if ttlSecs < 0 {
@@ -761,7 +1018,37 @@ func setCachedAnswerTTL(answer *dns.Msg, now, expiredTime time.Time) {
 	}
 }
 
+// cacheTTL returns the TTL of the cached answer, in seconds, and whether answer can be cached.
+//
+// Positive answers use cache_ttl_override if set, negative answers always use their
+// RFC 2308 TTL. The TTL is then clamped to the configured bounds of its kind.
+func (p *prog) cacheTTL(answer *dns.Msg) (uint32, bool) {
+	ttl := ttlFromMsg(answer)
+	minTTL, maxTTL := p.cfg.Service.CacheMinTTL, p.cfg.Service.CacheMaxTTL
+	if dnscache.IsNegative(answer) {
+		// Negative answers without SOA record must not be cached: https://www.rfc-editor.org/rfc/rfc2308#section-5
+		if ttl == 0 {
+			return 0, false
+		}
+		minTTL, maxTTL = p.cfg.Service.CacheNegativeMinTTL, p.cfg.Service.CacheNegativeMaxTTL
+	} else if cachedTTL := p.cfg.Service.CacheTTLOverride; cachedTTL > 0 {
+		return uint32(cachedTTL), true
+	}
+	if minTTL > 0 && ttl < uint32(minTTL) {
+		ttl = uint32(minTTL)
+	}
+	if maxTTL > 0 && ttl > uint32(maxTTL) {
+		ttl = uint32(maxTTL)
+	}
+	return ttl, true
+}
+
+// ttlFromMsg returns the TTL of msg. For negative responses, this is the
+// TTL of the SOA record, limited by its MINIMUM field, as described in RFC 2308.
 func ttlFromMsg(msg *dns.Msg) uint32 {
+	if dnscache.IsNegative(msg) {
+		return negativeTTLFromMsg(msg)
+	}
 	for _, rr := range msg.Answer {
 		return rr.Header().Ttl
 	}
@@ -771,6 +1058,16 @@ func ttlFromMsg(msg *dns.Msg) uint32 {
 	return 0
 }
 
+// negativeTTLFromMsg returns the negative caching TTL of msg, or 0 if there is no SOA record in the authority section.
+func negativeTTLFromMsg(msg *dns.Msg) uint32 {
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+	return 0
+}
+
 func needLocalIPv6Listener() bool {
 	// On Windows, there's no easy way for disabling/removing IPv6 DNS resolver, so we check whether we can
 	// listen on ::1, then spawn a listener for receiving DNS requests.
@@ -797,23 +1094,6 @@ func ipAndMacFromMsg(msg *dns.Msg) (string, string) {
 	return ip, mac
 }
 
-// stripClientSubnet removes EDNS0_SUBNET from DNS message if the IP is RFC1918 or loopback address,
-// passing them to upstream is pointless, these cannot be used by anything on the WAN.
-func stripClientSubnet(msg *dns.Msg) {
-	if opt := msg.IsEdns0(); opt != nil {
-		opts := make([]dns.EDNS0, 0, len(opt.Option))
-		for _, s := range opt.Option {
-			if e, ok := s.(*dns.EDNS0_SUBNET); ok && (e.Address.IsPrivate() || e.Address.IsLoopback()) {
-				continue
-			}
-			opts = append(opts, s)
-		}
-		if len(opts) != len(opt.Option) {
-			opt.Option = opts
-		}
-	}
-}
-
 func spoofRemoteAddr(addr net.Addr, ci *ctrld.ClientInfo) net.Addr {
 	if ci != nil && ci.IP != "" {
 		switch addr := addr.(type) {
@@ -1457,6 +1737,7 @@ func (p *prog) handleRecovery(reason RecoveryReason) {
 	recoveryCtx, cancel := context.WithCancel(context.Background())
 	p.recoveryCancel = cancel
 	p.recoveryCancelMu.Unlock()
+	statsRecoveryEvents.WithLabelValues(reason.String(), "started").Inc()
 
 	// Immediately remove our DNS settings from the interface.
 	// set recoveryRunning to true to prevent watchdogs from putting the listener back on the interface
@@ -1484,12 +1765,14 @@ func (p *prog) handleRecovery(reason RecoveryReason) {
 	recovered, err := p.waitForUpstreamRecovery(recoveryCtx, upstreams)
 	if err != nil {
 		mainLog.Load().Error().Err(err).Msg("Recovery canceled; DNS settings remain removed")
+		statsRecoveryEvents.WithLabelValues(reason.String(), "canceled").Inc()
 		p.recoveryCancelMu.Lock()
 		p.recoveryCancel = nil
 		p.recoveryCancelMu.Unlock()
 		return
 	}
 	mainLog.Load().Info().Msgf("Upstream %q recovered; re-applying DNS settings", recovered)
+	statsRecoveryEvents.WithLabelValues(reason.String(), "recovered").Inc()
 
 	// reset the upstream failure count and down state
 	p.um.reset(recovered)
@@ -1550,7 +1833,7 @@ func (p *prog) waitForUpstreamRecovery(ctx context.Context, upstreams map[string
 						return
 					}
 					mainLog.Load().Debug().Msgf("Upstream %s check failed, sleeping before retry", name)
-					time.Sleep(checkUpstreamBackoffSleep)
+					time.Sleep(p.um.probeBackoff(attempts))
 
 					// if this is the upstreamOS and it's the 3rd attempt (or multiple of 3),
 					// we should try to reinit the OS resolver to ensure we can recover
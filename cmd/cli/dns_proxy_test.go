@@ -2,6 +2,7 @@ package cli
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"testing"
 	"time"
@@ -127,7 +128,7 @@ func Test_prog_upstreamFor(t *testing.T) {
 				require.NoError(t, err)
 				require.NotNil(t, addr)
 				ctx := context.WithValue(context.Background(), ctrld.ReqIdCtxKey{}, requestID())
-				ufr := p.upstreamFor(ctx, tc.defaultUpstreamNum, tc.lc, addr, tc.mac, tc.domain)
+				ufr := p.upstreamFor(ctx, tc.defaultUpstreamNum, tc.lc, addr, tc.mac, tc.domain, dns.TypeA)
 				p.proxy(ctx, &proxyRequest{
 					msg: newDnsMsgWithHostname("foo", dns.TypeA),
 					ufr: ufr,
@@ -142,6 +143,204 @@ func Test_prog_upstreamFor(t *testing.T) {
 	}
 }
 
+func Test_prog_upstreamFor_schedule(t *testing.T) {
+	cfg := testhelper.SampleConfig(t)
+	now := time.Date(2024, time.June, 3, 22, 0, 0, 0, time.UTC)
+	p := &prog{cfg: cfg, clock: func() time.Time { return now }}
+	for _, nc := range p.cfg.Network {
+		for _, cidr := range nc.Cidrs {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			require.NoError(t, err)
+			nc.IPNets = append(nc.IPNets, ipNet)
+		}
+	}
+	cacher, err := dnscache.NewLRUCache(4096)
+	require.NoError(t, err)
+	p.cache = cacher
+
+	lc := &ctrld.ListenerConfig{Policy: &ctrld.ListenerPolicyConfig{
+		Name:     "Scheduled Policy",
+		Networks: []ctrld.Rule{{"network.1": {Schedule: "night", Upstreams: []string{"upstream.2"}}}},
+		Schedules: map[string]*ctrld.ScheduleConfig{
+			"night": {Times: []string{"21:00-07:00"}, Timezone: "UTC"},
+		},
+	}}
+	addr, err := net.ResolveUDPAddr("udp", "192.168.1.2:0")
+	require.NoError(t, err)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	answer := new(dns.Msg)
+	answer.SetReply(msg)
+	expire := now.Add(time.Hour)
+	p.cache.Add(dnscache.NewKey(msg, "upstream.2"), dnscache.NewValue(answer, expire))
+	p.cache.Add(dnscache.NewKey(msg, "upstream.3"), dnscache.NewValue(answer, expire))
+
+	ctx := context.WithValue(context.Background(), ctrld.ReqIdCtxKey{}, requestID())
+	ufr := p.upstreamFor(ctx, "0", lc, addr, "", "example.com", dns.TypeA)
+	assert.True(t, ufr.matched)
+	assert.Equal(t, []string{"upstream.2"}, ufr.upstreams)
+	assert.Equal(t, "network.1 (schedule: night)", ufr.matchedNetwork)
+	assert.NotNil(t, p.cache.Get(dnscache.NewKey(msg, "upstream.2")))
+
+	// Schedule transition purges cached answers of the policy upstreams only.
+	now = time.Date(2024, time.June, 4, 7, 0, 0, 0, time.UTC)
+	ufr = p.upstreamFor(ctx, "0", lc, addr, "", "example.com", dns.TypeA)
+	assert.False(t, ufr.matched)
+	assert.Equal(t, []string{"upstream.0"}, ufr.upstreams)
+	assert.Nil(t, p.cache.Get(dnscache.NewKey(msg, "upstream.2")))
+	assert.NotNil(t, p.cache.Get(dnscache.NewKey(msg, "upstream.3")))
+}
+
+func Test_newRulePattern(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		isDomain bool
+		s        string
+		match    bool
+	}{
+		{"domain - exact", "Example.com.", true, "example.com", true},
+		{"domain - single wildcard", "*.example.com", true, "a.b.example.com", true},
+		{"domain - regex", `regex:^(ads|tracker)[0-9]*\.example\.com$`, true, "ads12.example.com", true},
+		{"domain - regex not match", `regex:^(ads|tracker)[0-9]*\.example\.com$`, true, "www.example.com", false},
+		{"domain - regex unanchored", "regex:cdn", true, "eu.cdn.example.com", true},
+		{"domain - invalid regex", "regex:(", true, "example.com", false},
+		{"domain - multi wildcard", "*.cdn.*.example.com", true, "a.cdn.eu.example.com", true},
+		{"domain - multi wildcard leading labels", "*.cdn.*.example.com", true, "a.b.cdn.eu.example.com", true},
+		{"domain - multi wildcard no leading label", "*.cdn.*.example.com", true, "cdn.eu.example.com", false},
+		{"domain - multi wildcard inner label is exactly one", "*.cdn.*.example.com", true, "a.cdn.eu.west.example.com", false},
+		{"domain - multi wildcard inner labels", "a.*.*.example.com", true, "a.b.c.example.com", true},
+		{"domain - multi wildcard inner labels not match", "a.*.*.example.com", true, "a.b.example.com", false},
+		{"domain - multi wildcard trailing labels", "cdn.*.*", true, "cdn.example.co.uk", true},
+		{"domain - multi wildcard in label", "ads*.*.example.com", true, "ads1.eu.example.com", true},
+		{"domain - multi wildcard in label not match", "ads*.*.example.com", true, "tracker.eu.example.com", false},
+		{"domain - multi wildcard in label not cross dot", "*.a*b.com", true, "x.a.b.com", false},
+		{"mac - exact", "14:45:A0:67:83:0A", false, "14:45:a0:67:83:0a", true},
+		{"mac - single wildcard", "14:45:a0:*", false, "14:45:a0:67:83:0a", true},
+		{"mac - multi wildcard", "14:*:a0:*:0a", false, "14:45:a0:67:83:0a", true},
+		{"mac - multi wildcard not match", "14:*:a1:*:0a", false, "14:45:a0:67:83:0a", false},
+		{"mac - regex", "regex:^14:45:a0:", false, "14:45:a0:67:83:0a", true},
+		{"mac - empty", "", false, "", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			matches := newRulePattern(tc.source, tc.isDomain)
+			assert.Equal(t, tc.match, matches(tc.s))
+		})
+	}
+}
+
+func Test_domainRuleMatcher(t *testing.T) {
+	rules := []ctrld.Rule{
+		{"*.windscribe.com": {}},
+		{"anything.windscribe.com": {}},
+		{"example.com": {}},
+		{"suffix.*": {}},
+		{"*.Example.COM": {}},
+		{"suffix.example.com": {}},
+		{"*example.net": {}},
+		{"foo.example.net": {}},
+		{"*.ru": {}},
+		{"a.*.org": {}},
+		{"a.b.org": {}},
+		{"*": {}},
+		{`regex:^ads[0-9]+\.`: {}},
+		{"*.cdn.*.example.io": {}},
+		{"ads1.example.io": {}},
+		{"x.cdn.eu.example.io": {}},
+	}
+	tests := []struct {
+		domain string
+		index  int
+	}{
+		{"windscribe.com", -1},
+		{"anything.windscribe.com", 0},
+		{"a.b.windscribe.com", 0},
+		{"example.com", 2},
+		{"suffix.windscribe.com", 0},
+		{"suffix.example.com", 3},
+		{"sub.example.com", 4},
+		{"example.net", 6},
+		{"fooexample.net", 6},
+		{"foo.example.net", 6},
+		{"abc.ru", 8},
+		{"a.b.org", 9},
+		{"b.org", -1},
+		{"", -1},
+		{"ads1.example.io", 12},
+		{"ads1.example.com", 4},
+		{"a.cdn.eu.example.io", 13},
+		{"x.cdn.eu.example.io", 13},
+		{"cdn.eu.example.io", -1},
+		{"a.cdn.eu.example.org", 9},
+	}
+	m := newDomainRuleMatcher(rules, nil)
+	for _, tc := range tests {
+		t.Run(tc.domain, func(t *testing.T) {
+			assert.Equal(t, tc.index, m.match(tc.domain, ruleQuery{qtype: dns.TypeA}))
+			assert.Equal(t, linearRuleScan(rules, tc.domain), m.match(tc.domain, ruleQuery{qtype: dns.TypeA}))
+		})
+	}
+
+	// Overlapping rules must be matched in the same order as checking them one by one.
+	rules = benchmarkRules(100)
+	rules = append(rules, benchmarkRules(100)...)
+	m = newDomainRuleMatcher(rules, nil)
+	for i := 0; i < 100; i++ {
+		for _, domain := range []string{
+			fmt.Sprintf("prefix%d.domain%d.com", i, i),
+			fmt.Sprintf("host%d.domain%d.com", i, i),
+			fmt.Sprintf("sub.domain%d.com", i),
+		} {
+			assert.Equal(t, linearRuleScan(rules, domain), m.match(domain, ruleQuery{qtype: dns.TypeA}), domain)
+		}
+	}
+}
+
+func Test_domainRuleMatcher_qtype(t *testing.T) {
+	rules := []ctrld.Rule{
+		{"example.com": {Types: []string{"AAAA", "https"}, Upstreams: []string{"upstream.2"}}},
+		{"*.example.com": {Types: []string{"SVCB"}, Upstreams: []string{"upstream.2"}}},
+		{"*.168.192.in-addr.arpa": {Types: []string{"PTR"}, Upstreams: []string{"upstream.3"}}},
+		{"example.*": {Upstreams: []string{"upstream.1"}}},
+		{"regex:^ads\\.": {Types: []string{"A"}, Upstreams: []string{"upstream.1"}}},
+	}
+	tests := []struct {
+		domain string
+		qtype  uint16
+		index  int
+	}{
+		{"example.com", dns.TypeAAAA, 0},
+		{"example.com", dns.TypeHTTPS, 0},
+		{"example.com", dns.TypeA, 3},
+		{"sub.example.com", dns.TypeSVCB, 1},
+		{"sub.example.com", dns.TypeAAAA, -1},
+		{"1.0.168.192.in-addr.arpa", dns.TypePTR, 2},
+		{"1.0.168.192.in-addr.arpa", dns.TypeA, -1},
+		{"ads.example.org", dns.TypeA, 4},
+		{"ads.example.org", dns.TypeAAAA, -1},
+	}
+	m := newDomainRuleMatcher(rules, nil)
+	for _, tc := range tests {
+		t.Run(tc.domain+"/"+dns.TypeToString[tc.qtype], func(t *testing.T) {
+			assert.Equal(t, tc.index, m.match(tc.domain, ruleQuery{qtype: tc.qtype}))
+		})
+	}
+}
+
+// linearRuleScan returns the index of first rule matching domain, checking rules one by one.
+func linearRuleScan(rules []ctrld.Rule, domain string) int {
+	for i, rule := range rules {
+		for source := range rule {
+			if newRulePattern(source, true)(domain) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
 func TestCache(t *testing.T) {
 	cfg := testhelper.SampleConfig(t)
 	prog := &prog{cfg: cfg}
@@ -315,7 +514,8 @@ func newDnsMsgWithClientIP(ip string) *dns.Msg {
 	return m
 }
 
-func Test_stripClientSubnet(t *testing.T) {
+// Test_prog_ecsQuery_default tests the default ECS mode, where private and loopback client subnets are stripped.
+func Test_prog_ecsQuery_default(t *testing.T) {
 	tests := []struct {
 		name       string
 		msg        *dns.Msg
@@ -333,9 +533,10 @@ func Test_stripClientSubnet(t *testing.T) {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
-			stripClientSubnet(tc.msg)
+			p := &prog{}
+			query := p.ecsQuery(tc.msg, nil, nil)
 			hasSubnet := false
-			if opt := tc.msg.IsEdns0(); opt != nil {
+			if opt := query.IsEdns0(); opt != nil {
 				for _, s := range opt.Option {
 					if _, ok := s.(*dns.EDNS0_SUBNET); ok {
 						hasSubnet = true
@@ -464,3 +665,104 @@ func Test_isWanClient(t *testing.T) {
 		})
 	}
 }
+
+// benchmarkRules returns n split DNS rules, mixing exact, "*.domain" and generic wildcard rules.
+func benchmarkRules(n int) []ctrld.Rule {
+	rules := make([]ctrld.Rule, 0, n)
+	for i := 0; i < n; i++ {
+		var source string
+		switch i % 10 {
+		case 0:
+			source = fmt.Sprintf("prefix%d.*", i)
+		case 1, 2, 3:
+			source = fmt.Sprintf("*.domain%d.com", i)
+		default:
+			source = fmt.Sprintf("host%d.domain%d.com", i, i)
+		}
+		rules = append(rules, ctrld.Rule{source: {Upstreams: []string{"upstream.1"}}})
+	}
+	return rules
+}
+
+func BenchmarkDomainRuleMatcher(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		rules := benchmarkRules(n)
+		m := newDomainRuleMatcher(rules, nil)
+		domains := []string{
+			fmt.Sprintf("sub.domain%d.com", n-7),         // wildcard rule at the end.
+			fmt.Sprintf("host%d.domain%d.com", n-5, n-5), // exact rule at the end.
+			"no-match.example.com",
+		}
+		b.Run(fmt.Sprintf("compiled/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m.match(domains[i%len(domains)], ruleQuery{qtype: dns.TypeA})
+			}
+		})
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				linearRuleScan(rules, domains[i%len(domains)])
+			}
+		})
+	}
+}
+
+func BenchmarkProg_upstreamFor(b *testing.B) {
+	lc := &ctrld.ListenerConfig{Policy: &ctrld.ListenerPolicyConfig{Name: "My Policy", Rules: benchmarkRules(5000)}}
+	p := &prog{cfg: &ctrld.Config{}}
+	addr := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 5353}
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.upstreamFor(ctx, "0", lc, addr, "", "sub.domain4993.com", dns.TypeA)
+	}
+}
+
+func Test_prog_cacheTTL(t *testing.T) {
+	newAnswer := func(rcode int, answer, ns []dns.RR) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		m.Rcode = rcode
+		m.Answer = answer
+		m.Ns = ns
+		return m
+	}
+	a := func(ttl uint32) []dns.RR {
+		return []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: net.ParseIP("10.0.0.1")}}
+	}
+	soa := func(ttl, minttl uint32) []dns.RR {
+		return []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl}, Ns: "ns.com.", Mbox: "admin.com.", Minttl: minttl}}
+	}
+	tests := []struct {
+		name     string
+		cfg      ctrld.ServiceConfig
+		answer   *dns.Msg
+		ttl      uint32
+		cache    bool
+		negative bool
+	}{
+		{"positive", ctrld.ServiceConfig{}, newAnswer(dns.RcodeSuccess, a(300), nil), 300, true, false},
+		{"positive override", ctrld.ServiceConfig{CacheTTLOverride: 60}, newAnswer(dns.RcodeSuccess, a(300), nil), 60, true, false},
+		{"positive min", ctrld.ServiceConfig{CacheMinTTL: 600}, newAnswer(dns.RcodeSuccess, a(300), nil), 600, true, false},
+		{"positive max", ctrld.ServiceConfig{CacheMaxTTL: 100}, newAnswer(dns.RcodeSuccess, a(300), nil), 100, true, false},
+		{"nxdomain soa minimum", ctrld.ServiceConfig{}, newAnswer(dns.RcodeNameError, nil, soa(900, 120)), 120, true, true},
+		{"nxdomain soa ttl", ctrld.ServiceConfig{}, newAnswer(dns.RcodeNameError, nil, soa(60, 120)), 60, true, true},
+		{"nxdomain ignores override", ctrld.ServiceConfig{CacheTTLOverride: 3600}, newAnswer(dns.RcodeNameError, nil, soa(900, 120)), 120, true, true},
+		{"nodata negative max", ctrld.ServiceConfig{CacheNegativeMaxTTL: 30, CacheMaxTTL: 10}, newAnswer(dns.RcodeSuccess, nil, soa(900, 120)), 30, true, true},
+		{"nodata negative min", ctrld.ServiceConfig{CacheNegativeMinTTL: 300}, newAnswer(dns.RcodeSuccess, nil, soa(900, 120)), 300, true, true},
+		{"negative without soa", ctrld.ServiceConfig{CacheNegativeMinTTL: 300}, newAnswer(dns.RcodeNameError, nil, nil), 0, false, true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			p := &prog{cfg: &ctrld.Config{Service: tc.cfg}}
+			ttl, cache := p.cacheTTL(tc.answer)
+			assert.Equal(t, tc.ttl, ttl)
+			assert.Equal(t, tc.cache, cache)
+			assert.Equal(t, tc.negative, dnscache.NewValue(tc.answer, time.Now()).Negative)
+		})
+	}
+}
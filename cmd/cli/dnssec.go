@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// dnssecValidatorFor returns the DNSSEC validator of the given upstream, creating it on first use.
+func (p *prog) dnssecValidatorFor(uc *ctrld.UpstreamConfig) (*ctrld.DnssecValidator, error) {
+	if v, ok := p.dnssecValidators.Load(uc); ok {
+		return v.(*ctrld.DnssecValidator), nil
+	}
+	v, err := ctrld.NewDnssecValidator(uc)
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := p.dnssecValidators.LoadOrStore(uc, v)
+	return actual.(*ctrld.DnssecValidator), nil
+}
+
+// validateDnssec validates the DNSSEC signatures of the answer from the given upstream.
+//
+// The AD bit is set if the answer is secure, while a SERVFAIL response is returned if it is bogus.
+func (p *prog) validateDnssec(ctx context.Context, uc *ctrld.UpstreamConfig, msg, answer *dns.Msg) *dns.Msg {
+	result := ctrld.DnssecBogus
+	v, err := p.dnssecValidatorFor(uc)
+	if err == nil {
+		result, err = v.Validate(ctx, answer)
+	}
+	ctrld.Log(ctx, mainLog.Load().Debug(), "DNSSEC validation result: %s", result)
+	switch result {
+	case ctrld.DnssecSecure:
+		answer.AuthenticatedData = true
+	case ctrld.DnssecInsecure:
+		answer.AuthenticatedData = false
+	default:
+		ctrld.Log(ctx, mainLog.Load().Warn().Err(err), "DNSSEC validation failed for %s", msg.Question[0].Name)
+		servfail := new(dns.Msg)
+		servfail.SetRcode(msg, dns.RcodeServerFailure)
+		if opt := msg.IsEdns0(); opt != nil {
+			servfail.SetEdns0(opt.UDPSize(), opt.Do())
+			servfail.IsEdns0().Option = append(servfail.IsEdns0().Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeDNSBogus})
+		}
+		return servfail
+	}
+	return answer
+}
@@ -0,0 +1,218 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+// EDNS0 client subnet modes of upstreams.
+const (
+	ecsModeStrip      = "strip"
+	ecsModeForward    = "forward"
+	ecsModeTruncate   = "truncate"
+	ecsModeSynthesize = "synthesize"
+)
+
+const (
+	defaultEcsPrefixV4 = 24
+	defaultEcsPrefixV6 = 56
+	// ecsUDPSize is the EDNS0 UDP size of queries, which did not have EDNS0 before adding client subnet.
+	ecsUDPSize = 1232
+
+	wanIPRefreshInterval = 10 * time.Minute
+	wanIPLookupTimeout   = 2 * time.Second
+	// wanIPResolver answers "myip.opendns.com" queries with the IP address of the client.
+	wanIPResolver = "208.67.222.222:53"
+	wanIPDomain   = "myip.opendns.com."
+)
+
+// wanIPAddr is the WAN IP address of the host, with the time it was looked up.
+type wanIPAddr struct {
+	ip      net.IP
+	updated time.Time
+}
+
+// clientSubnetFromMsg returns the EDNS0 client subnet option of msg, if any.
+func clientSubnetFromMsg(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, s := range opt.Option {
+			if e, ok := s.(*dns.EDNS0_SUBNET); ok {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// newClientSubnet returns the EDNS0 client subnet option of ip, truncated to the prefix length of the upstream.
+// The prefix length is never longer than maxPrefix.
+func newClientSubnet(ip net.IP, uc *ctrld.UpstreamConfig, maxPrefix uint8) *dns.EDNS0_SUBNET {
+	e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	var prefix, bits int
+	if ip4 := ip.To4(); ip4 != nil {
+		e.Family, ip, prefix, bits = 1, ip4, defaultEcsPrefixV4, 32
+		if n := uc.EcsPrefixV4; n > 0 {
+			prefix = n
+		}
+	} else {
+		e.Family, prefix, bits = 2, defaultEcsPrefixV6, 128
+		if n := uc.EcsPrefixV6; n > 0 {
+			prefix = n
+		}
+	}
+	prefix = min(prefix, int(maxPrefix))
+	e.SourceNetmask = uint8(prefix)
+	e.Address = ip.Mask(net.CIDRMask(prefix, bits))
+	return e
+}
+
+// ecsOption returns the EDNS0 client subnet option to send to the upstream for msg, or nil if none.
+func (p *prog) ecsOption(msg *dns.Msg, ci *ctrld.ClientInfo, uc *ctrld.UpstreamConfig) *dns.EDNS0_SUBNET {
+	clientSubnet := clientSubnetFromMsg(msg)
+	mode := ""
+	if uc != nil {
+		mode = uc.Ecs
+	}
+	switch mode {
+	case ecsModeStrip:
+		return nil
+	case ecsModeForward:
+		return clientSubnet
+	case ecsModeTruncate:
+		if clientSubnet == nil || len(clientSubnet.Address) == 0 {
+			return nil
+		}
+		return newClientSubnet(clientSubnet.Address, uc, clientSubnet.SourceNetmask)
+	case ecsModeSynthesize:
+		var ip net.IP
+		if ci != nil {
+			ip = net.ParseIP(ci.IP)
+		}
+		if ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			ip = p.wanIPAddress()
+		}
+		if ip == nil {
+			return nil
+		}
+		return newClientSubnet(ip, uc, 128)
+	}
+	// Passing private or loopback subnets to upstream is pointless, these cannot be used by anything on the WAN.
+	if clientSubnet != nil && (clientSubnet.Address.IsPrivate() || clientSubnet.Address.IsLoopback()) {
+		return nil
+	}
+	return clientSubnet
+}
+
+// ecsQuery returns the query to send to the upstream, with the EDNS0 client subnet option of the upstream ECS mode.
+// The msg is copied if the option changes.
+func (p *prog) ecsQuery(msg *dns.Msg, ci *ctrld.ClientInfo, uc *ctrld.UpstreamConfig) *dns.Msg {
+	clientSubnet := clientSubnetFromMsg(msg)
+	ecs := p.ecsOption(msg, ci, uc)
+	if ecs == clientSubnet {
+		return msg
+	}
+	m := msg.Copy()
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(ecsUDPSize, false)
+		opt = m.IsEdns0()
+	}
+	opts := make([]dns.EDNS0, 0, len(opt.Option)+1)
+	for _, s := range opt.Option {
+		if _, ok := s.(*dns.EDNS0_SUBNET); !ok {
+			opts = append(opts, s)
+		}
+	}
+	if ecs != nil {
+		opts = append(opts, ecs)
+	}
+	opt.Option = opts
+	return m
+}
+
+// ecsSubnet returns the client subnet sent to the upstream for msg, used as part of cache keys.
+func (p *prog) ecsSubnet(msg *dns.Msg, ci *ctrld.ClientInfo, uc *ctrld.UpstreamConfig) string {
+	ecs := p.ecsOption(msg, ci, uc)
+	if ecs == nil || len(ecs.Address) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s/%d", ecs.Address, ecs.SourceNetmask)
+}
+
+// ecsCacheKey returns the cache key of the answer. Answers, which are not specific to the client subnet,
+// either without client subnet option or with zero scope prefix length, are cached for all subnets.
+// See: https://www.rfc-editor.org/rfc/rfc7871#section-7.3.1
+func ecsCacheKey(key dnscache.Key, answer *dns.Msg) dnscache.Key {
+	if key.Subnet == "" {
+		return key
+	}
+	if ecs := clientSubnetFromMsg(answer); ecs == nil || ecs.SourceScope == 0 {
+		key.Subnet = ""
+	}
+	return key
+}
+
+// stripAnswerClientSubnet removes the EDNS0 client subnet option from the answer, if the query did not have one.
+func stripAnswerClientSubnet(query, answer *dns.Msg) {
+	if clientSubnetFromMsg(query) != nil {
+		return
+	}
+	opt := answer.IsEdns0()
+	if opt == nil {
+		return
+	}
+	opts := opt.Option[:0]
+	for _, s := range opt.Option {
+		if _, ok := s.(*dns.EDNS0_SUBNET); !ok {
+			opts = append(opts, s)
+		}
+	}
+	opt.Option = opts
+}
+
+// wanIPAddress returns the WAN IP address of the host, or nil if it is not known yet.
+// The address is refreshed in background when outdated.
+func (p *prog) wanIPAddress() net.IP {
+	addr := p.wanIP.Load()
+	if (addr == nil || time.Since(addr.updated) > wanIPRefreshInterval) && p.wanIPRefreshing.CompareAndSwap(false, true) {
+		go func() {
+			defer p.wanIPRefreshing.Store(false)
+			ip, err := lookupWanIP()
+			if err != nil {
+				mainLog.Load().Debug().Err(err).Msg("could not lookup WAN IP address")
+				return
+			}
+			mainLog.Load().Debug().Msgf("WAN IP address: %s", ip)
+			p.wanIP.Store(&wanIPAddr{ip: ip, updated: time.Now()})
+		}()
+	}
+	if addr == nil {
+		return nil
+	}
+	return addr.ip
+}
+
+// lookupWanIP looks up the WAN IP address of the host.
+func lookupWanIP() (net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), wanIPLookupTimeout)
+	defer cancel()
+	msg := new(dns.Msg)
+	msg.SetQuestion(wanIPDomain, dns.TypeA)
+	answer, _, err := new(dns.Client).ExchangeContext(ctx, msg, wanIPResolver)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range answer.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			return a.A, nil
+		}
+	}
+	return nil, fmt.Errorf("no WAN IP address in answer: %s", dns.RcodeToString[answer.Rcode])
+}
@@ -0,0 +1,87 @@
+package cli
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+func Test_prog_ecsQuery(t *testing.T) {
+	p := &prog{}
+	p.wanIP.Store(&wanIPAddr{ip: net.ParseIP("203.0.113.7"), updated: time.Now()})
+	withSubnet := func(ip string, netmask uint8) *dns.Msg {
+		m := newDnsMsgWithClientIP(ip)
+		e := clientSubnetFromMsg(m)
+		e.Family, e.SourceNetmask = 1, netmask
+		if net.ParseIP(ip).To4() == nil {
+			e.Family = 2
+		}
+		return m
+	}
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeA)
+
+	tests := []struct {
+		name   string
+		msg    *dns.Msg
+		ci     *ctrld.ClientInfo
+		uc     *ctrld.UpstreamConfig
+		subnet string
+	}{
+		{"strip", withSubnet("1.2.3.4", 32), nil, &ctrld.UpstreamConfig{Ecs: ecsModeStrip}, ""},
+		{"forward", withSubnet("192.168.1.2", 32), nil, &ctrld.UpstreamConfig{Ecs: ecsModeForward}, "192.168.1.2/32"},
+		{"truncate v4", withSubnet("1.2.3.4", 32), nil, &ctrld.UpstreamConfig{Ecs: ecsModeTruncate}, "1.2.3.0/24"},
+		{"truncate v6", withSubnet("2001:db8:aaaa:bbbb::1", 128), nil, &ctrld.UpstreamConfig{Ecs: ecsModeTruncate}, "2001:db8:aaaa:bb00::/56"},
+		{"truncate configured", withSubnet("1.2.3.4", 32), nil, &ctrld.UpstreamConfig{Ecs: ecsModeTruncate, EcsPrefixV4: 16}, "1.2.0.0/16"},
+		{"truncate shorter client subnet", withSubnet("1.2.3.4", 20), nil, &ctrld.UpstreamConfig{Ecs: ecsModeTruncate}, "1.2.0.0/20"},
+		{"truncate without subnet", plain, nil, &ctrld.UpstreamConfig{Ecs: ecsModeTruncate}, ""},
+		{"synthesize client IP", plain, &ctrld.ClientInfo{IP: "1.2.3.4"}, &ctrld.UpstreamConfig{Ecs: ecsModeSynthesize}, "1.2.3.0/24"},
+		{"synthesize WAN IP", plain, &ctrld.ClientInfo{IP: "192.168.1.2"}, &ctrld.UpstreamConfig{Ecs: ecsModeSynthesize}, "203.0.113.0/24"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			original := tc.msg.Copy()
+			query := p.ecsQuery(tc.msg, tc.ci, tc.uc)
+			assert.Equal(t, original.String(), tc.msg.String(), "query must not be modified")
+			assert.Equal(t, tc.subnet, p.ecsSubnet(tc.msg, tc.ci, tc.uc))
+			e := clientSubnetFromMsg(query)
+			if tc.subnet == "" {
+				assert.Nil(t, e)
+				return
+			}
+			require.NotNil(t, e)
+			_, ipNet, err := net.ParseCIDR(tc.subnet)
+			require.NoError(t, err)
+			ones, _ := ipNet.Mask.Size()
+			assert.Equal(t, uint8(ones), e.SourceNetmask)
+			assert.True(t, ipNet.IP.Equal(e.Address))
+		})
+	}
+}
+
+func Test_ecsCacheKey(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	key := dnscache.NewKey(query, "upstream.0")
+	key.Subnet = "1.2.3.0/24"
+
+	answer := new(dns.Msg)
+	answer.SetReply(query)
+	assert.Empty(t, ecsCacheKey(key, answer).Subnet, "answer without client subnet is cached for all subnets")
+
+	answer.SetEdns0(ecsUDPSize, false)
+	answer.IsEdns0().Option = append(answer.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: 24, Address: net.ParseIP("1.2.3.0")})
+	assert.Equal(t, key, ecsCacheKey(key, answer))
+
+	stripAnswerClientSubnet(query, answer)
+	assert.Nil(t, clientSubnetFromMsg(answer))
+}
@@ -0,0 +1,395 @@
+package cli
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+const (
+	// dohListenerPath is the URL path which DoH/DoH3 listeners serve DNS queries on.
+	dohListenerPath = "/dns-query"
+	// listenerCACertFile/listenerCAKeyFile are the self-signed CA files, used for
+	// issuing certificates for encrypted listeners without cert_file/key_file.
+	// Clients must trust the CA certificate to use these listeners.
+	listenerCACertFile = "ctrld-ca.crt"
+	listenerCAKeyFile  = "ctrld-ca.key"
+)
+
+// encryptedListenerDefaultPort returns the default port for the given listener protocol.
+func encryptedListenerDefaultPort(protocol string) int {
+	switch protocol {
+	case ctrld.ResolverTypeDOH, ctrld.ResolverTypeDOH3:
+		return 443
+	case ctrld.ResolverTypeDOT, ctrld.ResolverTypeDOQ:
+		return 853
+	}
+	return 53
+}
+
+// serveEncryptedDNS serves DoH, DoH3, DoT or DoQ for the given listener, using the
+// same handler with plain DNS listeners, so queries go through the same pipeline.
+func (p *prog) serveEncryptedDNS(lc *ctrld.ListenerConfig, handler dns.Handler) error {
+	tlsConfig, err := listenerTLSConfig(lc)
+	if err != nil {
+		return fmt.Errorf("could not create tls config: %w", err)
+	}
+	addr := net.JoinHostPort(lc.IP, strconv.Itoa(lc.Port))
+	errCh := make(chan error, 1)
+	var closer io.Closer
+	switch lc.Protocol {
+	case ctrld.ResolverTypeDOT:
+		ln, err := tls.Listen("tcp", addr, tlsConfig)
+		if err != nil {
+			return err
+		}
+		s := &dns.Server{Listener: ln, Net: "tcp-tls", Handler: handler}
+		go func() { errCh <- s.ActivateAndServe() }()
+		closer = ln
+	case ctrld.ResolverTypeDOH:
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		s := &http.Server{Handler: dohHandler(handler, false), TLSConfig: tlsConfig}
+		go func() { errCh <- s.ServeTLS(ln, "", "") }()
+		closer = s
+	case ctrld.ResolverTypeDOH3:
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+		s := &http3.Server{Handler: dohHandler(handler, true), TLSConfig: http3.ConfigureTLSConfig(tlsConfig)}
+		go func() { errCh <- s.Serve(conn) }()
+		closer = closerFunc(func() error {
+			return errors.Join(s.Close(), conn.Close())
+		})
+	case ctrld.ResolverTypeDOQ:
+		tlsConfig.NextProtos = []string{"doq"}
+		ln, err := quic.ListenAddr(addr, tlsConfig, &quic.Config{Allow0RTT: true})
+		if err != nil {
+			return err
+		}
+		go func() { errCh <- serveDoQ(ln, handler) }()
+		closer = ln
+	default:
+		return fmt.Errorf("unsupported listener protocol: %q", lc.Protocol)
+	}
+	defer closer.Close()
+
+	p.started <- struct{}{}
+
+	select {
+	case <-p.stopCh:
+	case err := <-errCh:
+		return err
+	}
+	return nil
+}
+
+// closerFunc is an adapter to allow the use of ordinary functions as io.Closer.
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// encryptedResponseWriter implements dns.ResponseWriter for encrypted listeners,
+// keeping the answer for the caller to send it back using the listener protocol.
+type encryptedResponseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	answer     *dns.Msg
+}
+
+func (w *encryptedResponseWriter) LocalAddr() net.Addr  { return w.localAddr }
+func (w *encryptedResponseWriter) RemoteAddr() net.Addr { return w.remoteAddr }
+func (w *encryptedResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.answer = m
+	return nil
+}
+func (w *encryptedResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.answer = m
+	return len(b), nil
+}
+func (w *encryptedResponseWriter) Close() error        { return nil }
+func (w *encryptedResponseWriter) TsigStatus() error   { return nil }
+func (w *encryptedResponseWriter) TsigTimersOnly(bool) {}
+func (w *encryptedResponseWriter) Hijack()             {}
+
+// dohHandler returns an http.Handler which serves DoH requests, as described in RFC 8484.
+func dohHandler(handler dns.Handler, isDoH3 bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohListenerPath, func(w http.ResponseWriter, r *http.Request) {
+		var buf []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != "application/dns-message" {
+				http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			buf, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		msg := new(dns.Msg)
+		if err == nil {
+			err = msg.Unpack(buf)
+		}
+		if err != nil {
+			http.Error(w, "invalid dns message", http.StatusBadRequest)
+			return
+		}
+		rw := &encryptedResponseWriter{
+			localAddr:  localAddrFromRequest(r, isDoH3),
+			remoteAddr: remoteAddrFromRequest(r, isDoH3),
+		}
+		handler.ServeDNS(rw, msg)
+		if rw.answer == nil {
+			http.Error(w, "no answer", http.StatusInternalServerError)
+			return
+		}
+		answer, err := rw.answer.Pack()
+		if err != nil {
+			http.Error(w, "could not pack answer", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttlFromMsg(rw.answer)))
+		_, _ = w.Write(answer)
+	})
+	return mux
+}
+
+// remoteAddrFromRequest returns the remote address of DoH/DoH3 request.
+//
+// The address is *net.UDPAddr for DoH3, *net.TCPAddr for DoH, so policies
+// and client info lookup treat it the same as plain DNS listeners.
+func remoteAddrFromRequest(r *http.Request, isDoH3 bool) net.Addr {
+	return addrFromString(r.RemoteAddr, isDoH3)
+}
+
+// localAddrFromRequest returns the local address which the DoH/DoH3 request was received on.
+func localAddrFromRequest(r *http.Request, isDoH3 bool) net.Addr {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addrFromString(addr.String(), isDoH3)
+	}
+	return addrFromString("", isDoH3)
+}
+
+func addrFromString(s string, isUDP bool) net.Addr {
+	host, port, _ := net.SplitHostPort(s)
+	ip := net.ParseIP(host)
+	p, _ := strconv.Atoi(port)
+	if isUDP {
+		return &net.UDPAddr{IP: ip, Port: p}
+	}
+	return &net.TCPAddr{IP: ip, Port: p}
+}
+
+// serveDoQ accepts DoQ connections from ln, serving queries on each stream, see RFC 9250.
+func serveDoQ(ln *quic.Listener, handler dns.Handler) error {
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go func() {
+			for {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				go serveDoQStream(conn, stream, handler)
+			}
+		}()
+	}
+}
+
+// serveDoQStream reads a single query from the stream, and writes the answer back.
+func serveDoQStream(conn *quic.Conn, stream *quic.Stream, handler dns.Handler) {
+	defer stream.Close()
+	_ = stream.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(stream, lenBuf[:]); err != nil {
+		return
+	}
+	buf := make([]byte, int(lenBuf[0])<<8|int(lenBuf[1]))
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		return
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(buf); err != nil {
+		stream.CancelRead(quic.StreamErrorCode(quic.ProtocolViolation))
+		return
+	}
+	rw := &encryptedResponseWriter{localAddr: conn.LocalAddr(), remoteAddr: conn.RemoteAddr()}
+	handler.ServeDNS(rw, msg)
+	if rw.answer == nil {
+		return
+	}
+	answer, err := rw.answer.Pack()
+	if err != nil {
+		return
+	}
+	out := make([]byte, 2+len(answer))
+	out[0] = byte(len(answer) >> 8)
+	out[1] = byte(len(answer))
+	copy(out[2:], answer)
+	_, _ = stream.Write(out)
+}
+
+// listenerTLSConfig returns the tls.Config for the encrypted listener.
+//
+// If cert_file and key_file are not set, a certificate is issued by ctrld
+// self-signed CA, which is created in ctrld home directory if not existed.
+func listenerTLSConfig(lc *ctrld.ListenerConfig) (*tls.Config, error) {
+	if lc.CertFile != "" && lc.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(lc.CertFile, lc.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+	caCert, caKey, err := loadOrCreateListenerCA(absHomeDir(listenerCACertFile), absHomeDir(listenerCAKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := issueListenerCertificate(caCert, caKey, lc.IP)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// loadOrCreateListenerCA loads the CA certificate and key from given files,
+// creating new ones if they do not exist.
+func loadOrCreateListenerCA(certFile, keyFile string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPEM, certErr := os.ReadFile(certFile)
+	keyPEM, keyErr := os.ReadFile(keyFile)
+	if certErr == nil && keyErr == nil {
+		certBlock, _ := pem.Decode(certPEM)
+		keyBlock, _ := pem.Decode(keyPEM)
+		if certBlock == nil || keyBlock == nil {
+			return nil, nil, errors.New("invalid CA certificate or key file")
+		}
+		cert, err := x509.ParseCertificate(certBlock.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cert, key, nil
+	}
+	if !errors.Is(certErr, os.ErrNotExist) && certErr != nil {
+		return nil, nil, certErr
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "ctrld local CA", Organization: []string{"ctrld"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, nil, err
+	}
+	mainLog.Load().Notice().Msgf("created self-signed CA for encrypted listeners: %s", certFile)
+	return cert, key, nil
+}
+
+// issueListenerCertificate issues a server certificate signed by the given CA,
+// valid for the listener IP, localhost, machine hostname and its RFC1918 addresses.
+func issueListenerCertificate(caCert *x509.Certificate, caKey *ecdsa.PrivateKey, listenerIP string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "ctrld", Organization: []string{"ctrld"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if ip := net.ParseIP(listenerIP); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	}
+	for _, addr := range ctrld.Rfc1918Addresses() {
+		if ip := net.ParseIP(addr); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der, caCert.Raw}, PrivateKey: key}, nil
+}
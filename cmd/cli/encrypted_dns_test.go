@@ -0,0 +1,132 @@
+package cli
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_prog_serveEncryptedDNS(t *testing.T) {
+	oldHomedir := homedir
+	homedir = t.TempDir()
+	t.Cleanup(func() { homedir = oldHomedir })
+
+	var remoteAddr atomic.Pointer[net.Addr]
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		addr := w.RemoteAddr()
+		remoteAddr.Store(&addr)
+		answer := new(dns.Msg)
+		answer.SetReply(m)
+		answer.Answer = append(answer.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+		_ = w.WriteMsg(answer)
+	})
+
+	tests := []struct {
+		protocol   string
+		endpoint   func(addr string) string
+		remoteAddr net.Addr
+	}{
+		{ctrld.ResolverTypeDOH, func(addr string) string { return "https://" + addr + dohListenerPath }, &net.TCPAddr{}},
+		{ctrld.ResolverTypeDOH3, func(addr string) string { return "https://" + addr + dohListenerPath }, &net.UDPAddr{}},
+		{ctrld.ResolverTypeDOT, func(addr string) string { return addr }, &net.TCPAddr{}},
+		{ctrld.ResolverTypeDOQ, func(addr string) string { return addr }, &net.UDPAddr{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.protocol, func(t *testing.T) {
+			lc := &ctrld.ListenerConfig{IP: "127.0.0.1", Port: freePort(t), Protocol: tc.protocol}
+			p := &prog{stopCh: make(chan struct{}), started: make(chan struct{}, 1)}
+			errCh := make(chan error, 1)
+			go func() { errCh <- p.serveEncryptedDNS(lc, handler) }()
+			select {
+			case <-p.started:
+			case err := <-errCh:
+				t.Fatal(err)
+			}
+			defer func() {
+				close(p.stopCh)
+				assert.NoError(t, <-errCh)
+			}()
+
+			uc := &ctrld.UpstreamConfig{
+				Name:     tc.protocol,
+				Type:     tc.protocol,
+				Endpoint: tc.endpoint(net.JoinHostPort(lc.IP, strconv.Itoa(lc.Port))),
+				Timeout:  5000,
+			}
+			uc.Init()
+			uc.SetCertPool(listenerCAPool(t))
+			uc.SetupBootstrapIP()
+			r, err := ctrld.NewResolver(uc)
+			require.NoError(t, err)
+
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			answer, err := r.Resolve(context.Background(), msg)
+			require.NoError(t, err)
+			require.Len(t, answer.Answer, 1)
+			assert.Equal(t, "192.0.2.1", answer.Answer[0].(*dns.A).A.String())
+			assert.IsType(t, tc.remoteAddr, *remoteAddr.Load())
+		})
+	}
+}
+
+func Test_loadOrCreateListenerCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := dir+"/ca.crt", dir+"/ca.key"
+	cert, key, err := loadOrCreateListenerCA(certFile, keyFile)
+	require.NoError(t, err)
+	assert.True(t, cert.IsCA)
+
+	// The CA must be re-used, so clients only need to trust it once.
+	cert2, key2, err := loadOrCreateListenerCA(certFile, keyFile)
+	require.NoError(t, err)
+	assert.True(t, cert.Equal(cert2))
+	assert.True(t, key.Equal(key2))
+
+	leaf, err := issueListenerCertificate(cert, key, "192.168.1.1")
+	require.NoError(t, err)
+	leafCert, err := x509.ParseCertificate(leaf.Certificate[0])
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	_, err = leafCert.Verify(x509.VerifyOptions{Roots: pool, DNSName: "192.168.1.1"})
+	assert.NoError(t, err)
+}
+
+// listenerCAPool returns a cert pool which trusts the listener self-signed CA.
+func listenerCAPool(t *testing.T) *x509.CertPool {
+	t.Helper()
+	buf, err := os.ReadFile(absHomeDir(listenerCACertFile))
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	require.True(t, pool.AppendCertsFromPEM(buf))
+	return pool
+}
+
+// freePort returns a port which is available for both TCP and UDP on 127.0.0.1.
+func freePort(t *testing.T) int {
+	t.Helper()
+	for {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		port := ln.Addr().(*net.TCPAddr).Port
+		ln.Close()
+		if pc, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+			pc.Close()
+			return port
+		}
+	}
+}
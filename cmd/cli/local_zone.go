@@ -0,0 +1,222 @@
+package cli
+
+import (
+	"net/netip"
+	"sort"
+
+	"github.com/miekg/dns"
+	"tailscale.com/net/tsaddr"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// maxLocalZoneCnameChain is the maximum number of CNAME records followed when answering local zone queries.
+const maxLocalZoneCnameChain = 8
+
+// localZone is a zone which ctrld answers authoritatively.
+type localZone struct {
+	origin  string
+	soa     *dns.SOA
+	records map[string][]dns.RR
+	// names contains all existing names in zone, including empty non-terminals,
+	// so we could tell NODATA from NXDOMAIN.
+	names map[string]struct{}
+}
+
+// localZones holds all local zones defined in config.
+type localZones struct {
+	// zones are sorted by number of labels in descending order, so the most specific zone is matched first.
+	zones []*localZone
+	// ptr contains PTR records generated from A/AAAA records with private IP addresses.
+	ptr map[string][]dns.RR
+}
+
+// newLocalZones creates localZones from given zones config, zones with invalid records are ignored.
+func newLocalZones(zcs map[string]*ctrld.ZoneConfig) *localZones {
+	lz := &localZones{ptr: make(map[string][]dns.RR)}
+	for n, zc := range zcs {
+		rrs, err := zc.ParseRecords()
+		if err != nil {
+			mainLog.Load().Error().Err(err).Msgf("could not parse records of zone.%s", n)
+			continue
+		}
+		z := &localZone{
+			origin:  zc.Origin(),
+			records: make(map[string][]dns.RR),
+			names:   map[string]struct{}{zc.Origin(): {}},
+		}
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			hdr.Name = dns.CanonicalName(hdr.Name)
+			if soa, ok := rr.(*dns.SOA); ok && hdr.Name == z.origin {
+				z.soa = soa
+			}
+			z.records[hdr.Name] = append(z.records[hdr.Name], rr)
+			for name := hdr.Name; name != z.origin && name != ""; {
+				z.names[name] = struct{}{}
+				i, _ := dns.NextLabel(name, 0)
+				name = name[i:]
+			}
+			lz.addPtr(rr)
+		}
+		if z.soa == nil {
+			z.soa = defaultLocalZoneSOA(z.origin, zc.TTL)
+		}
+		lz.zones = append(lz.zones, z)
+	}
+	sort.Slice(lz.zones, func(i, j int) bool {
+		return dns.CountLabel(lz.zones[i].origin) > dns.CountLabel(lz.zones[j].origin)
+	})
+	return lz
+}
+
+// addPtr adds PTR record for the given A/AAAA record, if its IP is private.
+func (lz *localZones) addPtr(rr dns.RR) {
+	var addr netip.Addr
+	switch rr := rr.(type) {
+	case *dns.A:
+		addr, _ = netip.AddrFromSlice(rr.A.To4())
+	case *dns.AAAA:
+		addr, _ = netip.AddrFromSlice(rr.AAAA)
+	default:
+		return
+	}
+	if !addr.IsPrivate() && !addr.IsLinkLocalUnicast() && !tsaddr.CGNATRange().Contains(addr) {
+		return
+	}
+	name, err := dns.ReverseAddr(addr.String())
+	if err != nil {
+		return
+	}
+	lz.ptr[name] = append(lz.ptr[name], &dns.PTR{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: rr.Header().Ttl},
+		Ptr: rr.Header().Name,
+	})
+}
+
+// defaultLocalZoneSOA returns the SOA record for zone without one.
+func defaultLocalZoneSOA(origin string, ttl int) *dns.SOA {
+	if ttl <= 0 {
+		ttl = 300
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(ttl)},
+		Ns:      "localhost.",
+		Mbox:    "hostmaster." + origin,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  uint32(ttl),
+	}
+}
+
+// zoneFor returns the most specific zone which contains name, or nil if there's none.
+func (lz *localZones) zoneFor(name string) *localZone {
+	if lz == nil {
+		return nil
+	}
+	for _, z := range lz.zones {
+		if dns.IsSubDomain(z.origin, name) {
+			return z
+		}
+	}
+	return nil
+}
+
+// answer returns the authoritative answer for msg, or nil if the query
+// is not for any local zone, nor PTR query for a local zone record.
+func (lz *localZones) answer(msg *dns.Msg) *dns.Msg {
+	if lz == nil || len(msg.Question) == 0 {
+		return nil
+	}
+	q := msg.Question[0]
+	name := dns.CanonicalName(q.Name)
+	z := lz.zoneFor(name)
+	if z == nil {
+		ptrs := lz.ptr[name]
+		if q.Qtype != dns.TypePTR || len(ptrs) == 0 {
+			return nil
+		}
+		answer := newLocalZoneAnswer(msg)
+		answer.Answer = append(answer.Answer, ptrs...)
+		return answer
+	}
+
+	answer := newLocalZoneAnswer(msg)
+	for i := 0; i < maxLocalZoneCnameChain; i++ {
+		rrs, exists := z.lookup(name)
+		if !exists {
+			// The rcode is for the last name of the CNAME chain: https://www.rfc-editor.org/rfc/rfc6604#section-2.1
+			answer.Rcode = dns.RcodeNameError
+			answer.Ns = []dns.RR{z.soa}
+			return answer
+		}
+		matched := false
+		var cname *dns.CNAME
+		for _, rr := range rrs {
+			switch {
+			case rr.Header().Rrtype == q.Qtype, q.Qtype == dns.TypeANY:
+				answer.Answer = append(answer.Answer, rr)
+				matched = true
+			case rr.Header().Rrtype == dns.TypeCNAME:
+				cname = rr.(*dns.CNAME)
+			}
+		}
+		if matched {
+			return answer
+		}
+		if cname == nil {
+			// NODATA.
+			answer.Ns = []dns.RR{z.soa}
+			return answer
+		}
+		answer.Answer = append(answer.Answer, cname)
+		// Follow the CNAME if the target is also in local zones,
+		// otherwise, the client is responsible for resolving it.
+		name = dns.CanonicalName(cname.Target)
+		if z = lz.zoneFor(name); z == nil {
+			return answer
+		}
+	}
+	return answer
+}
+
+// lookup returns records of the given name, including records synthesized from
+// wildcard, see RFC 4592. The second return value reports whether the name exists.
+func (z *localZone) lookup(name string) ([]dns.RR, bool) {
+	if rrs, ok := z.records[name]; ok {
+		return rrs, true
+	}
+	if _, ok := z.names[name]; ok {
+		return nil, true
+	}
+	// Find the closest encloser, then look for the wildcard record.
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		parent := name[off:]
+		if _, ok := z.names[parent]; !ok {
+			continue
+		}
+		wildcard := z.records["*."+parent]
+		if len(wildcard) == 0 {
+			return nil, false
+		}
+		rrs := make([]dns.RR, 0, len(wildcard))
+		for _, rr := range wildcard {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			rrs = append(rrs, rr)
+		}
+		return rrs, true
+	}
+	return nil, false
+}
+
+func newLocalZoneAnswer(msg *dns.Msg) *dns.Msg {
+	answer := new(dns.Msg)
+	answer.SetReply(msg)
+	answer.Authoritative = true
+	answer.RecursionAvailable = true
+	answer.Compress = true
+	return answer
+}
@@ -0,0 +1,125 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_localZones_answer(t *testing.T) {
+	zoneFile := filepath.Join(t.TempDir(), "corp.lan.zone")
+	require.NoError(t, os.WriteFile(zoneFile, []byte(`$ORIGIN corp.lan.
+$TTL 60
+@     IN SOA ns.corp.lan. admin.corp.lan. 2024010101 3600 600 86400 30
+wiki  IN A   10.0.0.5
+`), 0600))
+	lz := newLocalZones(map[string]*ctrld.ZoneConfig{
+		"0": {
+			Name: "home.lan",
+			Records: []string{
+				"nas A 192.168.1.10",
+				"nas AAAA fd00::10",
+				"www CNAME nas",
+				"ext CNAME example.com.",
+				"dangling CNAME missing",
+				"@ MX 10 mail",
+				"mail A 192.168.1.20",
+				"@ TXT \"v=spf1 -all\"",
+				"_http._tcp SRV 0 0 80 nas",
+				"*.apps A 192.168.1.30",
+				"public A 8.8.8.8",
+				"a.b.deep A 192.168.1.40",
+			},
+		},
+		"1": {Name: "corp.lan", File: zoneFile},
+	})
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		noAnswer  bool
+		rcode     int
+		answers   []string
+		hasSOA    bool
+		soaMinTTL uint32
+	}{
+		{"A record", "nas.home.lan.", dns.TypeA, false, dns.RcodeSuccess, []string{"192.168.1.10"}, false, 0},
+		{"case insensitive", "NAS.Home.LAN.", dns.TypeA, false, dns.RcodeSuccess, []string{"192.168.1.10"}, false, 0},
+		{"AAAA record", "nas.home.lan.", dns.TypeAAAA, false, dns.RcodeSuccess, []string{"fd00::10"}, false, 0},
+		{"CNAME followed", "www.home.lan.", dns.TypeA, false, dns.RcodeSuccess, []string{"nas.home.lan.", "192.168.1.10"}, false, 0},
+		{"CNAME to missing name", "dangling.home.lan.", dns.TypeA, false, dns.RcodeNameError, []string{"missing.home.lan."}, true, 300},
+		{"CNAME to external", "ext.home.lan.", dns.TypeA, false, dns.RcodeSuccess, []string{"example.com."}, false, 0},
+		{"MX record", "home.lan.", dns.TypeMX, false, dns.RcodeSuccess, []string{"mail.home.lan."}, false, 0},
+		{"TXT record", "home.lan.", dns.TypeTXT, false, dns.RcodeSuccess, []string{"v=spf1 -all"}, false, 0},
+		{"SRV record", "_http._tcp.home.lan.", dns.TypeSRV, false, dns.RcodeSuccess, []string{"nas.home.lan."}, false, 0},
+		{"wildcard", "grafana.apps.home.lan.", dns.TypeA, false, dns.RcodeSuccess, []string{"192.168.1.30"}, false, 0},
+		{"NODATA", "mail.home.lan.", dns.TypeAAAA, false, dns.RcodeSuccess, nil, true, 300},
+		{"empty non-terminal", "b.deep.home.lan.", dns.TypeA, false, dns.RcodeSuccess, nil, true, 300},
+		{"NXDOMAIN", "missing.home.lan.", dns.TypeA, false, dns.RcodeNameError, nil, true, 300},
+		{"zone file", "wiki.corp.lan.", dns.TypeA, false, dns.RcodeSuccess, []string{"10.0.0.5"}, false, 0},
+		{"zone file SOA", "missing.corp.lan.", dns.TypeA, false, dns.RcodeNameError, nil, true, 30},
+		{"private PTR", "10.1.168.192.in-addr.arpa.", dns.TypePTR, false, dns.RcodeSuccess, []string{"nas.home.lan."}, false, 0},
+		{"private PTR v6", "0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dns.TypePTR, false, dns.RcodeSuccess, []string{"nas.home.lan."}, false, 0},
+		{"public IP has no PTR", "8.8.8.8.in-addr.arpa.", dns.TypePTR, true, 0, nil, false, 0},
+		{"not local zone", "example.com.", dns.TypeA, true, 0, nil, false, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := new(dns.Msg)
+			msg.SetQuestion(tc.qname, tc.qtype)
+			answer := lz.answer(msg)
+			if tc.noAnswer {
+				assert.Nil(t, answer)
+				return
+			}
+			require.NotNil(t, answer)
+			assert.True(t, answer.Authoritative)
+			assert.Equal(t, tc.rcode, answer.Rcode)
+			var got []string
+			for _, rr := range answer.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					got = append(got, rr.A.String())
+				case *dns.AAAA:
+					got = append(got, rr.AAAA.String())
+				case *dns.CNAME:
+					got = append(got, rr.Target)
+				case *dns.MX:
+					got = append(got, rr.Mx)
+				case *dns.TXT:
+					got = append(got, rr.Txt...)
+				case *dns.SRV:
+					got = append(got, rr.Target)
+				case *dns.PTR:
+					got = append(got, rr.Ptr)
+				}
+			}
+			assert.Equal(t, tc.answers, got)
+			if tc.hasSOA {
+				require.Len(t, answer.Ns, 1)
+				assert.Equal(t, tc.soaMinTTL, answer.Ns[0].(*dns.SOA).Minttl)
+			}
+		})
+	}
+}
+
+func Test_prog_proxy_localZone(t *testing.T) {
+	p := &prog{cfg: &ctrld.Config{}}
+	p.localZones.Store(newLocalZones(map[string]*ctrld.ZoneConfig{
+		"0": {Name: "home.lan", Records: []string{"nas A 192.168.1.10"}},
+	}))
+	msg := new(dns.Msg)
+	msg.SetQuestion("nas.home.lan.", dns.TypeA)
+	res := p.proxy(context.Background(), &proxyRequest{msg: msg, ufr: &upstreamForResult{}})
+	require.NotNil(t, res.answer)
+	assert.True(t, res.localZone)
+	assert.Len(t, res.answer.Answer, 1)
+}
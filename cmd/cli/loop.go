@@ -69,8 +69,11 @@ func (p *prog) detectLoop(msg *dns.Msg) {
 	unFQDNname := strings.TrimSuffix(q.Name, ".")
 	uid := strings.TrimSuffix(unFQDNname, loopTestDomain)
 	p.loopMu.Lock()
-	if _, loop := p.loop[uid]; loop {
-		p.loop[uid] = loop
+	if detected, ok := p.loop[uid]; ok {
+		if !detected {
+			statsLoopDetections.Inc()
+		}
+		p.loop[uid] = true
 	}
 	p.loopMu.Unlock()
 }
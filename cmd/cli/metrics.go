@@ -19,6 +19,7 @@ type metricsServer struct {
 	server  *http.Server
 	mux     *http.ServeMux
 	reg     *prometheus.Registry
+	jsonReg *prometheus.Registry // metrics only exposed in JSON format, like top statistics.
 	addr    string
 	started bool
 }
@@ -27,9 +28,10 @@ type metricsServer struct {
 func newMetricsServer(addr string, reg *prometheus.Registry) (*metricsServer, error) {
 	mux := http.NewServeMux()
 	ms := &metricsServer{
-		server: &http.Server{Handler: mux},
-		mux:    mux,
-		reg:    reg,
+		server:  &http.Server{Handler: mux},
+		mux:     mux,
+		reg:     reg,
+		jsonReg: prometheus.NewRegistry(),
 	}
 	ms.addr = addr
 	ms.registerMetricsServerHandler()
@@ -51,7 +53,7 @@ func (ms *metricsServer) registerMetricsServerHandler() {
 		},
 	))
 	ms.register("/metrics/json", jsonResponse(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		g := prometheus.ToTransactionalGatherer(ms.reg)
+		g := prometheus.ToTransactionalGatherer(prometheus.Gatherers{ms.reg, ms.jsonReg})
 		mfs, done, err := g.Gather()
 		defer done()
 		if err != nil {
@@ -130,6 +132,13 @@ func (p *prog) runMetricsServer(ctx context.Context, reloadCh chan struct{}) {
 		statsVersion.WithLabelValues(commit, runtime.Version(), curVersion()).Inc()
 		reg.MustRegister(statsTimeStart)
 		statsTimeStart.Set(float64(time.Now().Unix()))
+		reg.MustRegister(newUpstreamCollector(p))
+		reg.MustRegister(statsCacheHits, statsCacheNegativeHits, statsCacheMisses, statsCachePrefetches)
+		reg.MustRegister(statsQueryLogDropped)
+		reg.MustRegister(statsCacheStaleServes, statsQueryDuration, statsInflightRequests)
+		reg.MustRegister(statsUpstreamRequestDuration, statsUpstreamErrors, statsUpstreamFailovers)
+		reg.MustRegister(statsLoopDetections, statsRecoveryEvents)
+		ms.jsonReg.MustRegister(newTopStatsCollector(p))
 		mainLog.Load().Debug().Msgf("starting metrics server on: %s", addr)
 		if err := ms.start(); err != nil {
 			mainLog.Load().Warn().Err(err).Msg("could not start metrics server")
@@ -0,0 +1,315 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+const (
+	otelProtocolGrpc = "grpc"
+	otelProtocolHttp = "http"
+
+	// otelInstrumentationName is the name of ctrld tracer and meter.
+	otelInstrumentationName = "github.com/Control-D-Inc/ctrld"
+	// otelShutdownTimeout is the maximum time to wait for pending telemetry to be exported on shutdown.
+	otelShutdownTimeout = 5 * time.Second
+)
+
+// Span attributes.
+const (
+	otelAttrRequestID    = attribute.Key("ctrld.request_id")
+	otelAttrListener     = attribute.Key("ctrld.listener")
+	otelAttrPolicy       = attribute.Key("ctrld.policy")
+	otelAttrNetwork      = attribute.Key("ctrld.network")
+	otelAttrRule         = attribute.Key("ctrld.rule")
+	otelAttrUpstreams    = attribute.Key("ctrld.upstreams")
+	otelAttrUpstream     = attribute.Key("ctrld.upstream")
+	otelAttrCached       = attribute.Key("ctrld.cached")
+	otelAttrCacheHit     = attribute.Key("ctrld.cache.hit")
+	otelAttrCacheStale   = attribute.Key("ctrld.cache.stale")
+	otelAttrErrorClass   = attribute.Key("ctrld.error_class")
+	otelAttrClientIP     = attribute.Key("client.address")
+	otelAttrQname        = attribute.Key("dns.question.name")
+	otelAttrQtype        = attribute.Key("dns.question.type")
+	otelAttrRcode        = attribute.Key("dns.response_code")
+	otelAttrServerAddr   = attribute.Key("server.address")
+	otelAttrUpstreamType = attribute.Key("ctrld.upstream.type")
+)
+
+// otelTelemetry holds the OpenTelemetry providers and instruments of ctrld.
+type otelTelemetry struct {
+	tp *sdktrace.TracerProvider
+	mp *sdkmetric.MeterProvider
+
+	tracer           trace.Tracer
+	queryDuration    metric.Float64Histogram
+	upstreamDuration metric.Float64Histogram
+	upstreamErrors   metric.Int64Counter
+}
+
+// otelConfig is the OpenTelemetry part of ctrld config.
+type otelConfig struct {
+	endpoint, protocol string
+	insecure           bool
+	headers            string
+	sampleRatio        float64
+	metricsInterval    time.Duration
+}
+
+// telemetry is the current OpenTelemetry exporter, nil if disabled.
+var telemetry atomic.Pointer[otelTelemetry]
+
+// noopTracer is used when OpenTelemetry export is disabled.
+var noopTracer = noop.NewTracerProvider().Tracer(otelInstrumentationName)
+
+// tracer returns the tracer of ctrld.
+func tracer() trace.Tracer {
+	if t := telemetry.Load(); t != nil {
+		return t.tracer
+	}
+	return noopTracer
+}
+
+// startSpan starts a span as child of the span in ctx, carrying the request ID of ctx if any.
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if reqId, ok := ctx.Value(ctrld.ReqIdCtxKey{}).(string); ok {
+		opts = append(opts, trace.WithAttributes(otelAttrRequestID.String(reqId)))
+	}
+	return tracer().Start(ctx, name, opts...)
+}
+
+// newOtelConfig returns the OpenTelemetry config of the given service config.
+func newOtelConfig(sc *ctrld.ServiceConfig) otelConfig {
+	oc := otelConfig{
+		endpoint:        sc.OtelEndpoint,
+		protocol:        sc.OtelProtocol,
+		insecure:        sc.OtelInsecure,
+		headers:         strings.Join(sc.OtelHeaders, ","),
+		sampleRatio:     1,
+		metricsInterval: time.Minute,
+	}
+	if oc.protocol == "" {
+		oc.protocol = otelProtocolGrpc
+	}
+	if sc.OtelTraceSampleRatio != nil {
+		oc.sampleRatio = *sc.OtelTraceSampleRatio
+	}
+	if sc.OtelMetricsInterval != nil {
+		oc.metricsInterval = *sc.OtelMetricsInterval
+	}
+	return oc
+}
+
+// otelHeaders parses the "key=value" headers list.
+func otelHeaders(headers []string) (map[string]string, error) {
+	m := make(map[string]string, len(headers))
+	for _, h := range headers {
+		k, v, ok := strings.Cut(h, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid otel header, want key=value: %q", h)
+		}
+		m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return m, nil
+}
+
+// newOtelTelemetry creates the OpenTelemetry exporters of current config,
+// or returns nil if OpenTelemetry export is disabled.
+func (p *prog) newOtelTelemetry(ctx context.Context) (*otelTelemetry, error) {
+	sc := &p.cfg.Service
+	if sc.OtelEndpoint == "" {
+		return nil, nil
+	}
+	oc := newOtelConfig(sc)
+	headers, err := otelHeaders(sc.OtelHeaders)
+	if err != nil {
+		return nil, err
+	}
+	spanExporter, metricExporter, err := newOtelExporters(ctx, oc, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "ctrld"),
+		attribute.String("service.version", curVersion()),
+		attribute.String("host.name", hostname),
+	))
+	if err != nil {
+		res = resource.Default()
+	}
+	t := &otelTelemetry{
+		tp: sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(spanExporter),
+			sdktrace.WithResource(res),
+			sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(oc.sampleRatio))),
+		),
+		mp: sdkmetric.NewMeterProvider(
+			sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter, sdkmetric.WithInterval(oc.metricsInterval))),
+			sdkmetric.WithResource(res),
+		),
+	}
+	t.tracer = t.tp.Tracer(otelInstrumentationName)
+	if err := t.initInstruments(p); err != nil {
+		t.shutdown()
+		return nil, err
+	}
+	return t, nil
+}
+
+// initInstruments creates the metric instruments, which mirror the Prometheus metrics without client labels.
+func (t *otelTelemetry) initInstruments(p *prog) error {
+	meter := t.mp.Meter(otelInstrumentationName)
+	var err error
+	t.queryDuration, err = meter.Float64Histogram("ctrld.query.duration",
+		metric.WithDescription("End-to-end latency of queries answered by ctrld."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(latencyBuckets...))
+	if err != nil {
+		return err
+	}
+	t.upstreamDuration, err = meter.Float64Histogram("ctrld.upstream.duration",
+		metric.WithDescription("Round trip time of queries answered by upstream."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(latencyBuckets...))
+	if err != nil {
+		return err
+	}
+	t.upstreamErrors, err = meter.Int64Counter("ctrld.upstream.errors",
+		metric.WithDescription("Total number of failed queries of upstream, by error class."))
+	if err != nil {
+		return err
+	}
+
+	counters := []struct {
+		name, description string
+		c                 prometheus.Counter
+	}{
+		{"ctrld.cache.hits", "Total number of queries answered from cache.", statsCacheHits},
+		{"ctrld.cache.misses", "Total number of queries not found in cache.", statsCacheMisses},
+		{"ctrld.cache.stale_serves", "Total number of queries answered with stale cached responses.", statsCacheStaleServes},
+		{"ctrld.dns_loop.detections", "Total number of DNS forwarding loops detected.", statsLoopDetections},
+		{"ctrld.query_log.dropped", "Total number of query log records dropped because the query log buffer was full.", statsQueryLogDropped},
+	}
+	for _, c := range counters {
+		_, err := meter.Int64ObservableCounter(c.name, metric.WithDescription(c.description),
+			metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+				o.Observe(int64(counterValue(c.c)))
+				return nil
+			}))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = meter.Int64ObservableGauge("ctrld.inflight_requests",
+		metric.WithDescription("Number of queries being processed."),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(int64(gaugeValue(statsInflightRequests)))
+			return nil
+		}))
+	if err != nil {
+		return err
+	}
+	_, err = meter.Int64ObservableGauge("ctrld.upstream.down",
+		metric.WithDescription("Whether upstream is marked as down, 1 is down, 0 is up."),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			if p.um == nil {
+				return nil
+			}
+			for _, s := range p.um.stats() {
+				down := int64(0)
+				if s.circuit == circuitOpen {
+					down = 1
+				}
+				o.Observe(down, metric.WithAttributes(otelAttrUpstream.String(s.Upstream)))
+			}
+			return nil
+		}))
+	return err
+}
+
+// shutdown exports pending telemetry, then stops the exporters.
+func (t *otelTelemetry) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), otelShutdownTimeout)
+	defer cancel()
+	if err := errors.Join(t.tp.Shutdown(ctx), t.mp.Shutdown(ctx)); err != nil {
+		mainLog.Load().Warn().Err(err).Msg("could not shutdown OpenTelemetry exporters")
+	}
+}
+
+// initOtel replaces the current OpenTelemetry exporters with the ones of current config.
+// The current exporters are kept if the OpenTelemetry config did not change.
+func (p *prog) initOtel() {
+	oc := newOtelConfig(&p.cfg.Service)
+	if telemetry.Load() != nil && oc == p.otelCfg {
+		return
+	}
+	p.otelCfg = oc
+	t, err := p.newOtelTelemetry(context.Background())
+	if err != nil {
+		mainLog.Load().Error().Err(err).Msg("failed to create OpenTelemetry exporters, OpenTelemetry export is disabled")
+	} else if t != nil {
+		mainLog.Load().Debug().Msgf("exporting OpenTelemetry traces and metrics to: %s (%s)", oc.endpoint, oc.protocol)
+	}
+	if old := telemetry.Swap(t); old != nil {
+		old.shutdown()
+	}
+}
+
+// stopOtel exports pending telemetry, and disables OpenTelemetry export.
+func stopOtel() {
+	if t := telemetry.Swap(nil); t != nil {
+		t.shutdown()
+	}
+}
+
+// otelRecordQuery records the end-to-end latency of a query.
+func otelRecordQuery(ctx context.Context, d time.Duration, rcode string, cached bool) {
+	if t := telemetry.Load(); t != nil {
+		t.queryDuration.Record(ctx, d.Seconds(), metric.WithAttributes(otelAttrRcode.String(rcode), otelAttrCached.Bool(cached)))
+	}
+}
+
+// otelRecordUpstreamSuccess records the round trip time of a query answered by upstream.
+func otelRecordUpstreamSuccess(upstream string, rtt time.Duration) {
+	if t := telemetry.Load(); t != nil {
+		t.upstreamDuration.Record(context.Background(), rtt.Seconds(), metric.WithAttributes(otelAttrUpstream.String(upstream)))
+	}
+}
+
+// otelRecordUpstreamFailure records a query failed by upstream with the given error.
+func otelRecordUpstreamFailure(upstream string, err error) {
+	if t := telemetry.Load(); t != nil {
+		t.upstreamErrors.Add(context.Background(), 1, metric.WithAttributes(
+			otelAttrUpstream.String(upstream),
+			otelAttrErrorClass.String(upstreamErrorClass(err)),
+		))
+	}
+}
+
+// endSpanWithError records err on the span if not nil, then ends it.
+func endSpanWithError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
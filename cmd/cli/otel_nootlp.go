@@ -0,0 +1,20 @@
+//go:build !otlp
+
+package cli
+
+import (
+	"context"
+	"errors"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// errOtlpNotSupported is returned when otel_endpoint is set, but ctrld was built without
+// the otlp tag. The OTLP exporters are left out by default, to keep the gRPC and protobuf
+// dependencies out of ctrld binary.
+var errOtlpNotSupported = errors.New(`OTLP export is not supported, ctrld must be built with "otlp" tag`)
+
+func newOtelExporters(context.Context, otelConfig, map[string]string) (sdktrace.SpanExporter, sdkmetric.Exporter, error) {
+	return nil, nil, errOtlpNotSupported
+}
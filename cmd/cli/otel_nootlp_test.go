@@ -0,0 +1,21 @@
+//go:build !otlp
+
+package cli
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func TestOtel_notSupported(t *testing.T) {
+	p := &prog{cfg: &ctrld.Config{Service: ctrld.ServiceConfig{OtelEndpoint: "127.0.0.1:4317"}}}
+	p.initOtel()
+	t.Cleanup(stopOtel)
+	assert.Nil(t, telemetry.Load())
+	_, err := p.newOtelTelemetry(context.Background())
+	assert.ErrorIs(t, err, errOtlpNotSupported)
+}
@@ -0,0 +1,68 @@
+//go:build otlp
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// newOtelExporters creates the OTLP span and metric exporters of the given config.
+func newOtelExporters(ctx context.Context, oc otelConfig, headers map[string]string) (spanExporter sdktrace.SpanExporter, metricExporter sdkmetric.Exporter, err error) {
+	// An endpoint with scheme is an URL, its scheme decides whether TLS is used.
+	isURL := strings.Contains(oc.endpoint, "://")
+
+	switch oc.protocol {
+	case otelProtocolGrpc:
+		traceOpts := []otlptracegrpc.Option{otlptracegrpc.WithHeaders(headers)}
+		metricOpts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithHeaders(headers)}
+		if isURL {
+			traceOpts = append(traceOpts, otlptracegrpc.WithEndpointURL(oc.endpoint))
+			metricOpts = append(metricOpts, otlpmetricgrpc.WithEndpointURL(oc.endpoint))
+		} else {
+			traceOpts = append(traceOpts, otlptracegrpc.WithEndpoint(oc.endpoint))
+			metricOpts = append(metricOpts, otlpmetricgrpc.WithEndpoint(oc.endpoint))
+		}
+		if oc.insecure {
+			traceOpts = append(traceOpts, otlptracegrpc.WithInsecure())
+			metricOpts = append(metricOpts, otlpmetricgrpc.WithInsecure())
+		}
+		if spanExporter, err = otlptracegrpc.New(ctx, traceOpts...); err != nil {
+			return nil, nil, err
+		}
+		metricExporter, err = otlpmetricgrpc.New(ctx, metricOpts...)
+	case otelProtocolHttp:
+		traceOpts := []otlptracehttp.Option{otlptracehttp.WithHeaders(headers)}
+		metricOpts := []otlpmetrichttp.Option{otlpmetrichttp.WithHeaders(headers)}
+		if isURL {
+			traceOpts = append(traceOpts, otlptracehttp.WithEndpointURL(strings.TrimSuffix(oc.endpoint, "/")+"/v1/traces"))
+			metricOpts = append(metricOpts, otlpmetrichttp.WithEndpointURL(strings.TrimSuffix(oc.endpoint, "/")+"/v1/metrics"))
+		} else {
+			traceOpts = append(traceOpts, otlptracehttp.WithEndpoint(oc.endpoint))
+			metricOpts = append(metricOpts, otlpmetrichttp.WithEndpoint(oc.endpoint))
+		}
+		if oc.insecure {
+			traceOpts = append(traceOpts, otlptracehttp.WithInsecure())
+			metricOpts = append(metricOpts, otlpmetrichttp.WithInsecure())
+		}
+		if spanExporter, err = otlptracehttp.New(ctx, traceOpts...); err != nil {
+			return nil, nil, err
+		}
+		metricExporter, err = otlpmetrichttp.New(ctx, metricOpts...)
+	default:
+		return nil, nil, fmt.Errorf("invalid otel protocol: %q", oc.protocol)
+	}
+	if err != nil {
+		_ = spanExporter.Shutdown(ctx)
+		return nil, nil, err
+	}
+	return spanExporter, metricExporter, nil
+}
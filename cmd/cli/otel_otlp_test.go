@@ -0,0 +1,169 @@
+//go:build otlp
+
+package cli
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+// testTraceCollector is an in-process OTLP collector, receiving spans exported by ctrld.
+type testTraceCollector struct {
+	coltracepb.UnimplementedTraceServiceServer
+	spans chan *tracepb.Span
+}
+
+func newTestTraceCollector() *testTraceCollector {
+	return &testTraceCollector{spans: make(chan *tracepb.Span, 64)}
+}
+
+func (c *testTraceCollector) Export(_ context.Context, req *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	for _, rs := range req.GetResourceSpans() {
+		for _, ss := range rs.GetScopeSpans() {
+			for _, span := range ss.GetSpans() {
+				select {
+				case c.spans <- span:
+				default:
+				}
+			}
+		}
+	}
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+// span returns the first received span with the given name.
+func (c *testTraceCollector) span(t *testing.T, name string) *tracepb.Span {
+	t.Helper()
+	for {
+		select {
+		case span := <-c.spans:
+			if span.GetName() == name {
+				return span
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("span %q not received", name)
+		}
+	}
+}
+
+type testMetricsCollector struct {
+	colmetricpb.UnimplementedMetricsServiceServer
+}
+
+func (testMetricsCollector) Export(context.Context, *colmetricpb.ExportMetricsServiceRequest) (*colmetricpb.ExportMetricsServiceResponse, error) {
+	return &colmetricpb.ExportMetricsServiceResponse{}, nil
+}
+
+// spanAttributes returns the string and bool attributes of span.
+func spanAttributes(span *tracepb.Span) map[string]any {
+	attrs := make(map[string]any)
+	for _, kv := range span.GetAttributes() {
+		switch v := kv.GetValue().GetValue().(type) {
+		case *commonpb.AnyValue_StringValue:
+			attrs[kv.GetKey()] = v.StringValue
+		case *commonpb.AnyValue_BoolValue:
+			attrs[kv.GetKey()] = v.BoolValue
+		}
+	}
+	return attrs
+}
+
+// testOtelCacheHit answers a cached query, then checks the exported cache lookup span.
+func testOtelCacheHit(t *testing.T, sc ctrld.ServiceConfig, c *testTraceCollector) {
+	t.Helper()
+	p := &prog{cfg: &ctrld.Config{Service: sc}}
+	p.initOtel()
+	t.Cleanup(stopOtel)
+	tel := telemetry.Load()
+	require.NotNil(t, tel)
+	// Unchanged config keeps the current exporters.
+	p.initOtel()
+	assert.Same(t, tel, telemetry.Load())
+
+	cacher, err := dnscache.NewLRUCache(4096)
+	require.NoError(t, err)
+	p.cache = cacher
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	answer := new(dns.Msg)
+	answer.SetRcode(msg, dns.RcodeSuccess)
+	p.cache.Add(dnscache.NewKey(msg, "upstream.0"), dnscache.NewValue(answer, time.Now().Add(time.Minute)))
+
+	ctx := context.WithValue(context.Background(), ctrld.ReqIdCtxKey{}, "abcdef")
+	ctx, span := startSpan(ctx, "dns.query")
+	res := p.proxy(ctx, &proxyRequest{msg: msg, ufr: &upstreamForResult{upstreams: []string{"upstream.0"}}})
+	span.End()
+	require.True(t, res.cached)
+	// Stopping exports pending spans.
+	stopOtel()
+	assert.Nil(t, telemetry.Load())
+
+	got := c.span(t, "cache.lookup")
+	attrs := spanAttributes(got)
+	assert.Equal(t, "abcdef", attrs[string(otelAttrRequestID)])
+	assert.Equal(t, true, attrs[string(otelAttrCacheHit)])
+	assert.Equal(t, "upstream.0", attrs[string(otelAttrUpstream)])
+	assert.Equal(t, span.SpanContext().TraceID(), trace.TraceID(got.GetTraceId()))
+}
+
+func TestOtel_grpcCollector(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	c := newTestTraceCollector()
+	srv := grpc.NewServer()
+	coltracepb.RegisterTraceServiceServer(srv, c)
+	colmetricpb.RegisterMetricsServiceServer(srv, testMetricsCollector{})
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+
+	testOtelCacheHit(t, ctrld.ServiceConfig{OtelEndpoint: ln.Addr().String(), OtelInsecure: true}, c)
+}
+
+func TestOtel_httpCollector(t *testing.T) {
+	c := newTestTraceCollector()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/traces", func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req := &coltracepb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(b, req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res, _ := c.Export(r.Context(), req)
+		b, _ = proto.Marshal(res)
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		_, _ = w.Write(b)
+	})
+	mux.HandleFunc("/v1/metrics", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := proto.Marshal(&colmetricpb.ExportMetricsServiceResponse{})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		_, _ = w.Write(b)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	testOtelCacheHit(t, ctrld.ServiceConfig{OtelEndpoint: srv.URL, OtelProtocol: otelProtocolHttp}, c)
+}
@@ -0,0 +1,19 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_otelHeaders(t *testing.T) {
+	headers, err := otelHeaders([]string{"authorization = Bearer token", "x-empty="})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"authorization": "Bearer token", "x-empty": ""}, headers)
+
+	_, err = otelHeaders([]string{"authorization"})
+	assert.Error(t, err)
+	_, err = otelHeaders([]string{"=value"})
+	assert.Error(t, err)
+}
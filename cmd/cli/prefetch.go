@@ -0,0 +1,90 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+const (
+	// defaultCachePrefetchWindow is the default time before expiry, during which cache hits trigger a prefetch.
+	defaultCachePrefetchWindow = 10 * time.Second
+	// defaultCachePrefetchHits is the default number of hits a cache entry needs before it is prefetched.
+	defaultCachePrefetchHits = 2
+)
+
+// shouldPrefetch records a hit of the cached value v, and reports whether it should be refreshed.
+func (p *prog) shouldPrefetch(v *dnscache.Value, now time.Time) bool {
+	hits := v.Hit()
+	if !p.cfg.Service.CachePrefetch {
+		return false
+	}
+	window := defaultCachePrefetchWindow
+	if n := p.cfg.Service.CachePrefetchWindow; n > 0 {
+		window = time.Duration(n) * time.Second
+	}
+	minHits := int64(defaultCachePrefetchHits)
+	if n := p.cfg.Service.CachePrefetchHits; n > 0 {
+		minHits = int64(n)
+	}
+	return hits >= minHits && v.Expire.Sub(now) <= window
+}
+
+// prefetch refreshes the cached answer of msg in background, through the same upstream,
+// on behalf of the client ci. Concurrent refreshes of the same key are deduplicated.
+func (p *prog) prefetch(key dnscache.Key, upstream string, uc *ctrld.UpstreamConfig, msg *dns.Msg, ci *ctrld.ClientInfo) {
+	if uc == nil {
+		return
+	}
+	go p.prefetchGroup.Do(fmt.Sprint(key), func() (any, error) {
+		statsCachePrefetches.Inc()
+		ctx := context.WithValue(context.Background(), ctrld.ReqIdCtxKey{}, requestID())
+		if uc.UpstreamSendClientInfo() && ci != nil {
+			ctx = context.WithValue(ctx, ctrld.ClientInfoCtxKey{}, ci)
+		}
+		ok, probe := p.um.admit(upstream)
+		if !ok {
+			ctrld.Log(ctx, mainLog.Load().Debug(), "upstream %s is being probed, skipping prefetch", upstream)
+			return nil, nil
+		}
+		if probe {
+			defer p.um.probeDone(upstream)
+		}
+		ctrld.Log(ctx, mainLog.Load().Debug(), "prefetching %s %s from %s", dns.TypeToString[key.Qtype], key.Name, upstream)
+		resolver, err := ctrld.NewResolver(uc)
+		if err != nil {
+			ctrld.Log(ctx, mainLog.Load().Error().Err(err), "failed to create resolver")
+			return nil, err
+		}
+		query := p.ecsQuery(msg, ci, uc)
+		if key.Dnssec {
+			query = ctrld.DnssecQuery(query)
+		}
+		resolveCtx, cancel := uc.Context(ctx)
+		defer cancel()
+		start := time.Now()
+		answer, err := resolver.Resolve(resolveCtx, query)
+		if err != nil {
+			p.um.recordFailure(upstream, err)
+			ctrld.Log(ctx, mainLog.Load().Debug().Err(err), "failed to prefetch cached response")
+			return nil, err
+		}
+		p.um.recordSuccess(upstream, time.Since(start))
+		if key.Dnssec {
+			answer = p.validateDnssec(ctx, uc, msg, answer)
+		}
+		// Keep the current cached response, it will be refreshed by the next query after expiry.
+		if answer.Rcode != dns.RcodeSuccess && answer.Rcode != dns.RcodeNameError {
+			return nil, nil
+		}
+		answer.Compress = true
+		p.cacheAnswer(ecsCacheKey(key, answer), answer)
+		ctrld.Log(ctx, mainLog.Load().Debug(), "prefetched cached response")
+		return nil, nil
+	})
+}
@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+func Test_prog_proxy_prefetch(t *testing.T) {
+	var queries atomic.Int32
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var started sync.WaitGroup
+	started.Add(1)
+	server := &dns.Server{
+		PacketConn:        pc,
+		NotifyStartedFunc: started.Done,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, msg *dns.Msg) {
+			queries.Add(1)
+			m := new(dns.Msg)
+			m.SetReply(msg)
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("10.0.0.1"),
+			})
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	started.Wait()
+	t.Cleanup(func() { server.Shutdown() })
+
+	cfg := &ctrld.Config{
+		Service: ctrld.ServiceConfig{CachePrefetch: true, CachePrefetchWindow: 120, CachePrefetchHits: 2},
+		Upstream: map[string]*ctrld.UpstreamConfig{
+			"0": {Name: "0", Type: ctrld.ResolverTypeLegacy, Endpoint: pc.LocalAddr().String(), Timeout: 5000},
+		},
+	}
+	cfg.Upstream["0"].Init()
+	p := &prog{cfg: cfg}
+	p.um = newUpstreamMonitor(cfg)
+	p.cache, err = dnscache.NewLRUCache(4096)
+	require.NoError(t, err)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	proxy := func() {
+		res := p.proxy(context.Background(), &proxyRequest{
+			msg: msg,
+			ufr: &upstreamForResult{upstreams: []string{"upstream.0"}},
+		})
+		require.Len(t, res.answer.Answer, 1)
+	}
+
+	proxy() // cache miss.
+	assert.Equal(t, int32(1), queries.Load())
+	proxy() // first hit.
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), queries.Load())
+	proxy() // second hit, prefetch.
+	assert.Eventually(t, func() bool { return queries.Load() == 2 }, time.Second, 10*time.Millisecond)
+
+	// The prefetched entry is a new one, so it needs new hits before the next prefetch.
+	time.Sleep(100 * time.Millisecond)
+	proxy()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(2), queries.Load())
+}
@@ -34,6 +34,7 @@ import (
 	"github.com/Control-D-Inc/ctrld/internal/clientinfo"
 	"github.com/Control-D-Inc/ctrld/internal/controld"
 	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+	"github.com/Control-D-Inc/ctrld/internal/querylog"
 	"github.com/Control-D-Inc/ctrld/internal/router"
 	"github.com/Control-D-Inc/ctrld/internal/router/dnsmasq"
 )
@@ -62,6 +63,18 @@ const (
 	RecoveryReasonOSFailure
 )
 
+func (r RecoveryReason) String() string {
+	switch r {
+	case RecoveryReasonNetworkChange:
+		return "network_change"
+	case RecoveryReasonRegularFailure:
+		return "upstream_failure"
+	case RecoveryReasonOSFailure:
+		return "os_failure"
+	}
+	return "unknown"
+}
+
 // ControlSocketName returns name for control unix socket.
 func ControlSocketName() string {
 	if isMobile() {
@@ -101,6 +114,7 @@ type prog struct {
 	apiReloadCh          chan *ctrld.Config
 	apiForceReloadCh     chan struct{}
 	apiForceReloadGroup  singleflight.Group
+	prefetchGroup        singleflight.Group
 	logConn              net.Conn
 	cs                   *controlServer
 	csSetDnsDone         chan struct{}
@@ -116,6 +130,8 @@ type prog struct {
 	appCallback               *AppCallback
 	cache                     dnscache.Cacher
 	cacheFlushDomainsMap      map[string]struct{}
+	localZones                atomic.Pointer[localZones]
+	blocklists                atomic.Pointer[localBlocklists]
 	sema                      semaphore
 	ciTable                   *clientinfo.Table
 	um                        *upstreamMonitor
@@ -124,6 +140,17 @@ type prog struct {
 	lanLoopGuard              *loopGuard
 	metricsQueryStats         atomic.Bool
 	queryFromSelfMap          sync.Map
+	ruleMatchers              sync.Map // *ctrld.ListenerPolicyConfig => *policyRuleMatcher
+	upstreamStrategies        sync.Map // *ctrld.ListenerPolicyConfig => *upstreamStrategy
+	dnssecValidators          sync.Map // *ctrld.UpstreamConfig => *ctrld.DnssecValidator
+	wanIP                     atomic.Pointer[wanIPAddr]
+	wanIPRefreshing           atomic.Bool
+	queryLog                  atomic.Pointer[querylog.Logger]
+	queryLogCfg               queryLogConfig
+	otelCfg                   otelConfig
+	topStats                  atomic.Pointer[topStats]
+	queryStream               queryStream
+	clock                     func() time.Time
 	initInternalLogWriterOnce sync.Once
 	internalLogWriter         *logWriter
 	internalWarnLogWriter     *logWriter
@@ -207,7 +234,7 @@ func (p *prog) runWait() {
 				waitOldRunDone()
 				continue
 			}
-			if err := v.Unmarshal(&newCfg); err != nil {
+			if err := v.Unmarshal(&newCfg, ctrld.DecodeHook()); err != nil {
 				logger.Err(err).Msg("could not unmarshal new config")
 				waitOldRunDone()
 				continue
@@ -437,6 +464,14 @@ func (p *prog) setupUpstream(cfg *ctrld.Config) {
 	p.ptrNameservers = ptrNameservers
 }
 
+// clearConfigStates removes the states built from the previous config, which are keyed
+// by its pointers, so they are not kept alive after reload.
+func (p *prog) clearConfigStates() {
+	p.ruleMatchers.Clear()
+	p.upstreamStrategies.Clear()
+	p.dnssecValidators.Clear()
+}
+
 // run runs the ctrld main components.
 //
 // The reload boolean indicates that the function is run when ctrld first start
@@ -470,7 +505,7 @@ func (p *prog) run(reload bool, reloadCh chan struct{}) {
 	p.cacheFlushDomainsMap = nil
 	p.metricsQueryStats.Store(p.cfg.Service.MetricsQueryStats)
 	if p.cfg.Service.CacheEnable {
-		cacher, err := dnscache.NewLRUCache(p.cfg.Service.CacheSize)
+		cacher, err := p.newCacher()
 		if err != nil {
 			mainLog.Load().Error().Err(err).Msg("failed to create cacher, caching is disabled")
 		} else {
@@ -481,6 +516,12 @@ func (p *prog) run(reload bool, reloadCh chan struct{}) {
 			}
 		}
 	}
+	p.initQueryLogger()
+	p.initOtel()
+	p.initTopStats()
+	p.clearConfigStates()
+	p.localZones.Store(newLocalZones(p.cfg.Zone))
+	p.blocklists.Store(newLocalBlocklists(p.cfg.Blocklist, p.blocklists.Load()))
 	if domain, err := getActiveDirectoryDomain(); err == nil && domain != "" && hasLocalDnsServerRunning() {
 		mainLog.Load().Debug().Msgf("active directory domain: %s", domain)
 		p.adDomain = domain
@@ -589,6 +630,22 @@ func (p *prog) run(reload bool, reloadCh chan struct{}) {
 		p.checkDnsLoopTicker(ctx)
 	}()
 
+	wg.Add(1)
+	// Blocklists refresh goroutine.
+	go func() {
+		defer wg.Done()
+		p.blocklists.Load().refreshLoop(ctx)
+	}()
+
+	if pc, ok := p.cache.(*dnscache.PersistentCache); ok && p.cfg.Service.CacheEnable {
+		wg.Add(1)
+		// Persistent cache snapshot goroutine.
+		go func() {
+			defer wg.Done()
+			p.snapshotCacheLoop(pc, reloadCh)
+		}()
+	}
+
 	wg.Add(1)
 	// Prometheus exporter goroutine.
 	go func() {
@@ -636,6 +693,14 @@ func (p *prog) metricsEnabled() bool {
 	return p.cfg.Service.MetricsQueryStats || p.cfg.Service.MetricsListener != ""
 }
 
+// now returns the current time, from p.clock if set. Tests use p.clock to control time.
+func (p *prog) now() time.Time {
+	if p.clock != nil {
+		return p.clock()
+	}
+	return time.Now()
+}
+
 func (p *prog) Stop(s service.Service) error {
 	p.stopDnsWatchers()
 	mainLog.Load().Debug().Msg("dns watchers stopped")
@@ -673,6 +738,11 @@ func (p *prog) Stop(s service.Service) error {
 			os.Exit(deactivationPinInvalidExitCode)
 		}
 	}
+	if pc, ok := p.cache.(*dnscache.PersistentCache); ok {
+		saveCacheSnapshot(pc)
+	}
+	p.closeQueryLogger(p.queryLog.Swap(nil))
+	stopOtel()
 	close(p.stopCh)
 	return nil
 }
@@ -2,12 +2,14 @@ package cli
 
 import (
 	"runtime"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/Masterminds/semver/v3"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/Control-D-Inc/ctrld"
 )
@@ -271,3 +273,25 @@ func Test_performUpgrade(t *testing.T) {
 		})
 	}
 }
+
+func Test_prog_clearConfigStates(t *testing.T) {
+	uc := &ctrld.UpstreamConfig{Name: "legacy", Type: ctrld.ResolverTypeLegacy, Endpoint: "127.0.0.1:53"}
+	uc.Init()
+	policy := &ctrld.ListenerPolicyConfig{Name: "Policy"}
+	p := &prog{cfg: &ctrld.Config{}}
+	p.ruleMatcherFor(policy)
+	p.upstreamStrategyFor(policy)
+	v, err := p.dnssecValidatorFor(uc)
+	require.NoError(t, err)
+
+	p.clearConfigStates()
+	for _, m := range []*sync.Map{&p.ruleMatchers, &p.upstreamStrategies, &p.dnssecValidators} {
+		m.Range(func(key, value any) bool {
+			t.Errorf("unexpected state after reload: %v", key)
+			return false
+		})
+	}
+	newV, err := p.dnssecValidatorFor(uc)
+	require.NoError(t, err)
+	assert.NotSame(t, v, newV)
+}
@@ -10,8 +10,16 @@ const (
 	metricsLabelUpstream       = "upstream"
 	metricsLabelRRType         = "rr_type"
 	metricsLabelRCode          = "rcode"
+	metricsLabelErrorClass     = "class"
+	metricsLabelReason         = "reason"
+	metricsLabelEvent          = "event"
+	metricsLabelWindow         = "window"
+	metricsLabelDomain         = "domain"
 )
 
+// latencyBuckets are the histogram buckets of DNS latencies, in seconds.
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
 // statsVersion represent ctrld version.
 var statsVersion = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "ctrld_build_info",
@@ -49,9 +57,161 @@ var statsClientQueriesCount = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Help: "Total number queries of a client.",
 }, []string{metricsLabelClientSourceIP, metricsLabelClientMac, metricsLabelClientHostname})
 
+// statsCacheHits counts total number of queries answered from cache.
+var statsCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "ctrld_cache_hits_count",
+	Help: "Total number of queries answered from cache.",
+})
+
+// statsCacheNegativeHits counts total number of queries answered from negative cache entries (NXDOMAIN or NODATA).
+var statsCacheNegativeHits = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "ctrld_cache_negative_hits_count",
+	Help: "Total number of queries answered from negative cache entries.",
+})
+
+// statsCacheMisses counts total number of queries not found in cache.
+var statsCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "ctrld_cache_misses_count",
+	Help: "Total number of queries not found in cache.",
+})
+
+// statsCachePrefetches counts total number of cache entries refreshed before expiry.
+var statsCachePrefetches = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "ctrld_cache_prefetches_count",
+	Help: "Total number of cache entries refreshed before expiry.",
+})
+
+// statsQueryLogDropped counts total number of query log records dropped because the query log buffer was full.
+var statsQueryLogDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "ctrld_query_log_dropped_count",
+	Help: "Total number of query log records dropped because the query log buffer was full.",
+})
+
+// statsCacheStaleServes counts total number of queries answered with stale cached responses.
+var statsCacheStaleServes = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "ctrld_cache_stale_serves_count",
+	Help: "Total number of queries answered with stale cached responses.",
+})
+
+// statsQueryDuration observes the end-to-end latency of queries, from receiving to answering them.
+var statsQueryDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "ctrld_query_duration_seconds",
+	Help:    "End-to-end latency of queries answered by ctrld.",
+	Buckets: latencyBuckets,
+})
+
+// statsInflightRequests is the number of queries being processed, see prog.sema.
+var statsInflightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "ctrld_inflight_requests",
+	Help: "Number of queries being processed.",
+})
+
+// statsUpstreamRequestDuration observes the round trip time of queries answered by upstreams.
+var statsUpstreamRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "ctrld_upstream_request_duration_seconds",
+	Help:    "Round trip time of queries answered by upstream.",
+	Buckets: latencyBuckets,
+}, []string{metricsLabelUpstream})
+
+// statsUpstreamErrors counts total number of failed queries of upstreams, by error class, see upstreamErrorClass.
+var statsUpstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ctrld_upstream_errors_count",
+	Help: "Total number of failed queries of upstream, by error class.",
+}, []string{metricsLabelUpstream, metricsLabelErrorClass})
+
+// statsUpstreamFailovers counts total number of times queries were sent to the next upstream,
+// because the upstream failed, or answered with a failover rcode.
+var statsUpstreamFailovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ctrld_upstream_failovers_count",
+	Help: "Total number of queries failed over from upstream to the next one.",
+}, []string{metricsLabelUpstream})
+
+// statsLoopDetections counts total number of DNS forwarding loops detected, see prog.detectLoop.
+var statsLoopDetections = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "ctrld_dns_loop_detections_count",
+	Help: "Total number of DNS forwarding loops detected.",
+})
+
+// statsRecoveryEvents counts recovery events by reason, see prog.handleRecovery.
+// The event is one of "started", "recovered" or "canceled".
+var statsRecoveryEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ctrld_recovery_events_count",
+	Help: "Total number of recovery events, by reason.",
+}, []string{metricsLabelReason, metricsLabelEvent})
+
 // WithLabelValuesInc increases prometheus counter by 1 if query stats is enabled.
 func (p *prog) WithLabelValuesInc(c *prometheus.CounterVec, lvs ...string) {
 	if p.metricsQueryStats.Load() {
 		c.WithLabelValues(lvs...).Inc()
 	}
 }
+
+// upstreamCollector exposes upstreams health and statistics, see upstreamMonitor.stats.
+type upstreamCollector struct {
+	p *prog
+
+	state       *prometheus.Desc
+	queries     *prometheus.Desc
+	failures    *prometheus.Desc
+	timeouts    *prometheus.Desc
+	errorRate   *prometheus.Desc
+	timeoutRate *prometheus.Desc
+	rtt         *prometheus.Desc
+	down        *prometheus.Desc
+}
+
+// newUpstreamCollector returns new upstreamCollector of the given prog.
+func newUpstreamCollector(p *prog) *upstreamCollector {
+	labels := []string{metricsLabelUpstream}
+	return &upstreamCollector{
+		p: p,
+		state: prometheus.NewDesc("ctrld_upstream_circuit_state",
+			"Circuit breaker state of upstream, 0 is closed, 1 is open (upstream is down), 2 is half-open.", labels, nil),
+		queries:  prometheus.NewDesc("ctrld_upstream_queries_total", "Total number of queries sent to upstream.", labels, nil),
+		failures: prometheus.NewDesc("ctrld_upstream_failures_total", "Total number of failed queries of upstream.", labels, nil),
+		timeouts: prometheus.NewDesc("ctrld_upstream_timeouts_total", "Total number of timed out queries of upstream.", labels, nil),
+		errorRate: prometheus.NewDesc("ctrld_upstream_error_rate",
+			"Ratio of failed queries among the latest queries of upstream.", labels, nil),
+		timeoutRate: prometheus.NewDesc("ctrld_upstream_timeout_rate",
+			"Ratio of timed out queries among the latest queries of upstream.", labels, nil),
+		rtt: prometheus.NewDesc("ctrld_upstream_rtt_seconds",
+			"Round trip time percentiles of the latest successful queries of upstream.", append(labels, "quantile"), nil),
+		down: prometheus.NewDesc("ctrld_upstream_down", "Whether upstream is marked as down, 1 is down, 0 is up.", labels, nil),
+	}
+}
+
+// Describe implements prometheus.Collector interface.
+func (c *upstreamCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.state
+	ch <- c.queries
+	ch <- c.failures
+	ch <- c.timeouts
+	ch <- c.errorRate
+	ch <- c.timeoutRate
+	ch <- c.rtt
+	ch <- c.down
+}
+
+// Collect implements prometheus.Collector interface.
+func (c *upstreamCollector) Collect(ch chan<- prometheus.Metric) {
+	um := c.p.um
+	if um == nil {
+		return
+	}
+	for _, s := range um.stats() {
+		ch <- prometheus.MustNewConstMetric(c.state, prometheus.GaugeValue, float64(s.circuit), s.Upstream)
+		down := 0.0
+		if s.circuit == circuitOpen {
+			down = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.down, prometheus.GaugeValue, down, s.Upstream)
+		ch <- prometheus.MustNewConstMetric(c.queries, prometheus.CounterValue, float64(s.Queries), s.Upstream)
+		ch <- prometheus.MustNewConstMetric(c.failures, prometheus.CounterValue, float64(s.Failures), s.Upstream)
+		ch <- prometheus.MustNewConstMetric(c.timeouts, prometheus.CounterValue, float64(s.Timeouts), s.Upstream)
+		ch <- prometheus.MustNewConstMetric(c.errorRate, prometheus.GaugeValue, s.ErrorRate, s.Upstream)
+		ch <- prometheus.MustNewConstMetric(c.timeoutRate, prometheus.GaugeValue, s.TimeoutRate, s.Upstream)
+		for quantile, ms := range map[string]float64{"0.5": s.RTTP50, "0.9": s.RTTP90, "0.99": s.RTTP99} {
+			ch <- prometheus.MustNewConstMetric(c.rtt, prometheus.GaugeValue, ms/1000, s.Upstream, quantile)
+		}
+	}
+}
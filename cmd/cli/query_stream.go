@@ -0,0 +1,162 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld/internal/querylog"
+)
+
+// queryStreamBufferSize is the number of query events buffered for each subscriber.
+// Events are dropped if a subscriber is too slow to receive them.
+const queryStreamBufferSize = 256
+
+// queryStreamDroppedInterval is how often subscribers are told about their dropped events.
+const queryStreamDroppedInterval = 5 * time.Second
+
+// queryStream broadcasts query events to the live query stream subscribers, see "ctrld log tail".
+type queryStream struct {
+	mu   sync.Mutex
+	subs map[*queryStreamSub]struct{}
+	n    atomic.Int32
+}
+
+// queryStreamSub is a subscriber of the live query stream.
+type queryStreamSub struct {
+	filter  *logTailRequest
+	ch      chan *querylog.Record
+	dropped atomic.Uint64
+}
+
+// subscribe adds a new subscriber, receiving query events matching the filter.
+func (s *queryStream) subscribe(filter *logTailRequest) *queryStreamSub {
+	sub := &queryStreamSub{filter: filter, ch: make(chan *querylog.Record, queryStreamBufferSize)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subs == nil {
+		s.subs = make(map[*queryStreamSub]struct{})
+	}
+	s.subs[sub] = struct{}{}
+	s.n.Store(int32(len(s.subs)))
+	return sub
+}
+
+// unsubscribe removes the subscriber.
+func (s *queryStream) unsubscribe(sub *queryStreamSub) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subs, sub)
+	s.n.Store(int32(len(s.subs)))
+}
+
+// publish sends the query event to matching subscribers. It never blocks.
+func (s *queryStream) publish(r *querylog.Record) {
+	// Fast path, there is usually no subscriber.
+	if s.n.Load() == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subs {
+		if !sub.filter.matches(r) {
+			continue
+		}
+		select {
+		case sub.ch <- r:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// droppedReport returns the report of events dropped since the last report, or nil if none was dropped.
+func (sub *queryStreamSub) droppedReport() *logTailDropped {
+	if n := sub.dropped.Swap(0); n > 0 {
+		return &logTailDropped{Dropped: n}
+	}
+	return nil
+}
+
+// validate checks and normalizes the filter.
+func (f *logTailRequest) validate() error {
+	if f.Rcode != "" {
+		if _, ok := dns.StringToRcode[strings.ToUpper(f.Rcode)]; !ok {
+			return fmt.Errorf("invalid rcode: %s", f.Rcode)
+		}
+		f.Rcode = strings.ToUpper(f.Rcode)
+	}
+	if f.Domain != "" {
+		f.Domain = canonicalName(f.Domain)
+		if strings.Count(f.Domain, "*") > 1 {
+			return fmt.Errorf("invalid domain pattern: %s", f.Domain)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the query event matches the filter.
+//
+// The client matches the client IP, MAC or hostname, the domain may be a wildcard
+// pattern, and the upstream matches the event upstream endpoint, like "cache", or its id, like "upstream.0".
+func (f *logTailRequest) matches(r *querylog.Record) bool {
+	if f.Client != "" &&
+		f.Client != r.ClientIP &&
+		!strings.EqualFold(f.Client, r.ClientMac) &&
+		!strings.EqualFold(f.Client, r.ClientHostname) {
+		return false
+	}
+	if f.Domain != "" {
+		if strings.Contains(f.Domain, "*") {
+			if !wildcardMatches(f.Domain, r.Qname) {
+				return false
+			}
+		} else if f.Domain != r.Qname {
+			return false
+		}
+	}
+	if f.Rcode != "" && f.Rcode != r.Rcode {
+		return false
+	}
+	if f.Upstream != "" && !strings.EqualFold(f.Upstream, r.Upstream) && !strings.EqualFold(f.Upstream, r.UpstreamID) {
+		return false
+	}
+	return true
+}
+
+// logTailEvent is a query event, as received by "ctrld log tail".
+type logTailEvent struct {
+	querylog.Record
+	LatencyMs float64 `json:"latency_ms"`
+	// Dropped is only set by drop reports, see logTailDropped.
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// logTailDropped is sent to "ctrld log tail" in place of a query event, reporting the number
+// of events dropped because the client was too slow to receive them.
+type logTailDropped struct {
+	Dropped uint64 `json:"dropped"`
+}
+
+// String returns the one line representation of the drop report.
+func (d *logTailDropped) String() string {
+	return fmt.Sprintf("%d queries dropped, the client is too slow", d.Dropped)
+}
+
+// String returns the one line representation of the query event.
+func (ev *logTailEvent) String() string {
+	client := ev.ClientIP
+	if ev.ClientHostname != "" {
+		client += " (" + ev.ClientHostname + ")"
+	}
+	upstream := ev.Upstream
+	if upstream == "" {
+		upstream = "-"
+	}
+	return fmt.Sprintf("%s %-30s %-6s %-40s %-9s %8.1fms  %s",
+		ev.Time.Local().Format(time.StampMilli), client, ev.Qtype, ev.Qname, ev.Rcode, ev.LatencyMs, upstream)
+}
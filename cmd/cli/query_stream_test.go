@@ -0,0 +1,133 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/querylog"
+)
+
+func Test_logTailRequest_matches(t *testing.T) {
+	r := &querylog.Record{
+		ClientIP:       "192.168.1.20",
+		ClientMac:      "aa:bb:cc:dd:ee:ff",
+		ClientHostname: "laptop",
+		Qname:          "www.example.com",
+		Rcode:          "NXDOMAIN",
+		Upstream:       "https://freedns.controld.com/p2",
+		UpstreamID:     "upstream.1",
+	}
+	tests := []struct {
+		name    string
+		filter  logTailRequest
+		matched bool
+	}{
+		{"no filter", logTailRequest{}, true},
+		{"client ip", logTailRequest{Client: "192.168.1.20"}, true},
+		{"client mac", logTailRequest{Client: "AA:BB:CC:DD:EE:FF"}, true},
+		{"client hostname", logTailRequest{Client: "Laptop"}, true},
+		{"other client", logTailRequest{Client: "192.168.1.21"}, false},
+		{"domain", logTailRequest{Domain: "www.example.com."}, true},
+		{"domain wildcard", logTailRequest{Domain: "*.example.com"}, true},
+		{"other domain", logTailRequest{Domain: "example.com"}, false},
+		{"rcode", logTailRequest{Rcode: "nxdomain"}, true},
+		{"other rcode", logTailRequest{Rcode: "NOERROR"}, false},
+		{"upstream id", logTailRequest{Upstream: "Upstream.1"}, true},
+		{"upstream endpoint", logTailRequest{Upstream: "https://freedns.controld.com/p2"}, true},
+		{"partial upstream endpoint", logTailRequest{Upstream: "controld.com"}, false},
+		{"other upstream", logTailRequest{Upstream: "cache"}, false},
+		{"upstream id prefix", logTailRequest{Upstream: "upstream.10"}, false},
+		{"all filters", logTailRequest{Client: "laptop", Domain: "*.example.com", Rcode: "NXDOMAIN", Upstream: "upstream.1"}, true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, tc.filter.validate())
+			assert.Equal(t, tc.matched, tc.filter.matches(r))
+		})
+	}
+
+	assert.Error(t, (&logTailRequest{Rcode: "FOO"}).validate())
+	assert.Error(t, (&logTailRequest{Domain: "*.example.*"}).validate())
+}
+
+func Test_queryStream_publish(t *testing.T) {
+	var s queryStream
+	sub := s.subscribe(&logTailRequest{Rcode: "NXDOMAIN"})
+	for i := 0; i < queryStreamBufferSize+10; i++ {
+		s.publish(&querylog.Record{Rcode: "NXDOMAIN"})
+		s.publish(&querylog.Record{Rcode: "NOERROR"})
+	}
+	assert.Len(t, sub.ch, queryStreamBufferSize)
+	assert.Equal(t, &logTailDropped{Dropped: 10}, sub.droppedReport())
+	// The report resets the dropped count.
+	assert.Nil(t, sub.droppedReport())
+
+	// Drop reports are decoded as query events with the dropped count.
+	b, err := json.Marshal(&logTailDropped{Dropped: 10})
+	require.NoError(t, err)
+	var ev logTailEvent
+	require.NoError(t, json.Unmarshal(b, &ev))
+	assert.Equal(t, uint64(10), ev.Dropped)
+
+	s.unsubscribe(sub)
+	s.publish(&querylog.Record{Rcode: "NXDOMAIN"})
+	assert.Len(t, sub.ch, queryStreamBufferSize)
+}
+
+func TestControlServer_tailLogs(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "ctrld.sock")
+	cs, err := newControlServer(sock)
+	require.NoError(t, err)
+	p := &prog{cs: cs, cfg: &ctrld.Config{}, stopCh: make(chan struct{})}
+	p.registerControlServerHandler()
+	require.NoError(t, cs.start())
+	t.Cleanup(func() {
+		close(p.stopCh)
+		cs.stop()
+	})
+
+	cc := newControlClient(sock)
+	resp, err := cc.post(tailLogsPath, bytes.NewReader([]byte(`{"rcode": "BADRCODE"}`)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = cc.post(tailLogsPath, bytes.NewReader([]byte(`{"domain": "*.example.com"}`)))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	p.logQuery(&querylog.Record{Qname: "example.org", Qtype: "A", Rcode: "NOERROR"})
+	p.logQuery(&querylog.Record{Qname: "www.example.com", Qtype: "AAAA", Rcode: "NXDOMAIN", Latency: 2 * time.Millisecond})
+
+	events := make(chan *logTailEvent, 1)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		if sc.Scan() {
+			var ev logTailEvent
+			if json.Unmarshal(sc.Bytes(), &ev) == nil {
+				events <- &ev
+			}
+		}
+		close(events)
+	}()
+	select {
+	case ev := <-events:
+		require.NotNil(t, ev)
+		assert.Equal(t, "www.example.com", ev.Qname)
+		assert.Equal(t, "NXDOMAIN", ev.Rcode)
+		assert.Equal(t, 2.0, ev.LatencyMs)
+	case <-time.After(5 * time.Second):
+		t.Fatal("query event not received")
+	}
+}
@@ -0,0 +1,132 @@
+package cli
+
+import (
+	"errors"
+	"os"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/querylog"
+)
+
+const (
+	queryLogFormatJSON   = "json"
+	queryLogFormatDnstap = "dnstap"
+
+	// defaultQueryLogMaxSize is the default maximum size of the query log file, in MB.
+	defaultQueryLogMaxSize = 10
+	// defaultQueryLogMaxBackups is the default number of rotated query log files kept.
+	defaultQueryLogMaxBackups = 3
+)
+
+// newQueryLogger returns the query logger of current config, or nil if the query log is disabled.
+func (p *prog) newQueryLogger() (*querylog.Logger, error) {
+	sc := p.cfg.Service
+	if sc.QueryLogPath == "" && sc.QueryLogSocket == "" {
+		return nil, nil
+	}
+	var sink querylog.Sink
+	switch sc.QueryLogFormat {
+	case "", queryLogFormatJSON:
+		if sc.QueryLogSocket != "" {
+			return nil, errors.New("query_log_socket requires query_log_format dnstap")
+		}
+		s, err := querylog.NewJSONFileSink(normalizeLogFilePath(sc.QueryLogPath), queryLogMaxSize(&sc), queryLogMaxBackups(&sc))
+		if err != nil {
+			return nil, err
+		}
+		sink = s
+	case queryLogFormatDnstap:
+		identity, _ := os.Hostname()
+		version := "ctrld " + curVersion()
+		if sc.QueryLogSocket != "" {
+			sink = querylog.NewDnstapSocketSink(sc.QueryLogSocket, identity, version)
+			break
+		}
+		s, err := querylog.NewDnstapFileSink(normalizeLogFilePath(sc.QueryLogPath), identity, version, queryLogMaxSize(&sc), queryLogMaxBackups(&sc))
+		if err != nil {
+			return nil, err
+		}
+		sink = s
+	}
+	return querylog.New(sink, sc.QueryLogBufferSize, func(err error) {
+		mainLog.Load().Debug().Err(err).Msg("could not write query log")
+	}), nil
+}
+
+// queryLogMaxSize returns the maximum size of the query log file, in bytes.
+func queryLogMaxSize(sc *ctrld.ServiceConfig) int64 {
+	maxSize := int64(defaultQueryLogMaxSize)
+	if sc.QueryLogMaxSize > 0 {
+		maxSize = int64(sc.QueryLogMaxSize)
+	}
+	return maxSize * 1024 * 1024
+}
+
+// queryLogMaxBackups returns the number of rotated query log files to keep.
+func queryLogMaxBackups(sc *ctrld.ServiceConfig) int {
+	if sc.QueryLogMaxBackups > 0 {
+		return sc.QueryLogMaxBackups
+	}
+	return defaultQueryLogMaxBackups
+}
+
+// queryLogConfig is the query log part of ctrld config.
+type queryLogConfig struct {
+	format, path, socket            string
+	maxSize, maxBackups, bufferSize int
+}
+
+// initQueryLogger replaces the current query logger with the one of current config.
+// The current query logger is kept if the query log config did not change, since
+// re-creating a dnstap file truncates it.
+func (p *prog) initQueryLogger() {
+	sc := p.cfg.Service
+	qlc := queryLogConfig{
+		format:     sc.QueryLogFormat,
+		path:       sc.QueryLogPath,
+		socket:     sc.QueryLogSocket,
+		maxSize:    sc.QueryLogMaxSize,
+		maxBackups: sc.QueryLogMaxBackups,
+		bufferSize: sc.QueryLogBufferSize,
+	}
+	if p.queryLog.Load() != nil && qlc == p.queryLogCfg {
+		return
+	}
+	p.queryLogCfg = qlc
+	ql, err := p.newQueryLogger()
+	if err != nil {
+		mainLog.Load().Error().Err(err).Msg("failed to create query logger, query log is disabled")
+	}
+	p.closeQueryLogger(p.queryLog.Swap(ql))
+}
+
+// closeQueryLogger closes the query logger, writing its buffered records.
+func (p *prog) closeQueryLogger(ql *querylog.Logger) {
+	if ql == nil {
+		return
+	}
+	if err := ql.Close(); err != nil {
+		mainLog.Load().Warn().Err(err).Msg("could not close query log")
+	}
+}
+
+// logQuery sends the record to the live query stream, and to the query logger, if enabled. It never blocks.
+func (p *prog) logQuery(r *querylog.Record) {
+	p.queryStream.publish(r)
+	ql := p.queryLog.Load()
+	if ql == nil {
+		return
+	}
+	if !ql.Log(r) {
+		statsQueryLogDropped.Inc()
+	}
+}
+
+// matchedName returns the policy, network or rule name of an upstreamForResult,
+// or an empty string if it is the placeholder of nothing matched.
+func matchedName(name, placeholder string) string {
+	if name == placeholder {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/querylog"
+)
+
+func Test_prog_newQueryLogger(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		sc      ctrld.ServiceConfig
+		enabled bool
+		wantErr bool
+	}{
+		{"disabled", ctrld.ServiceConfig{}, false, false},
+		{"json", ctrld.ServiceConfig{QueryLogPath: filepath.Join(dir, "query.log")}, true, false},
+		{"dnstap file", ctrld.ServiceConfig{QueryLogFormat: queryLogFormatDnstap, QueryLogPath: filepath.Join(dir, "query.dnstap")}, true, false},
+		{"dnstap socket", ctrld.ServiceConfig{QueryLogFormat: queryLogFormatDnstap, QueryLogSocket: filepath.Join(dir, "dnstap.sock")}, true, false},
+		{"json socket", ctrld.ServiceConfig{QueryLogSocket: filepath.Join(dir, "dnstap.sock")}, false, true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			p := &prog{cfg: &ctrld.Config{Service: tc.sc}}
+			ql, err := p.newQueryLogger()
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.enabled, ql != nil)
+			if ql != nil {
+				assert.NoError(t, ql.Close())
+			}
+		})
+	}
+}
+
+func Test_prog_initQueryLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	p := &prog{cfg: &ctrld.Config{Service: ctrld.ServiceConfig{QueryLogPath: path}}}
+	p.initQueryLogger()
+	ql := p.queryLog.Load()
+	require.NotNil(t, ql)
+
+	// Unchanged config keeps the current logger.
+	p.initQueryLogger()
+	assert.Same(t, ql, p.queryLog.Load())
+
+	p.logQuery(&querylog.Record{Qname: "example.com", Qtype: "A", Rcode: "NOERROR"})
+	p.cfg.Service.QueryLogPath = ""
+	p.initQueryLogger()
+	assert.Nil(t, p.queryLog.Load())
+	// Closing the replaced logger writes its buffered records.
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"qname":"example.com"`)
+}
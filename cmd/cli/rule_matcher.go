@@ -0,0 +1,493 @@
+package cli
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// ruleTrieNode is a node of the reversed-label trie, children are keyed by domain labels.
+type ruleTrieNode struct {
+	children map[string]*ruleTrieNode
+	// exact are the indexes of rules matching the domain exactly, in ascending order.
+	exact []int
+	// subdomains are the indexes of "*.domain" rules, in ascending order.
+	subdomains []int
+}
+
+// globRule is a "prefix*suffix" rule, stored in globTrieNode of its prefix, or its reversed suffix.
+type globRule struct {
+	index int
+	// suffix is the remaining part of the rule, which must be checked after the trie is matched.
+	suffix string
+}
+
+// globTrieNode is a node of the byte trie of glob rules.
+type globTrieNode struct {
+	children map[byte]*globTrieNode
+	// rules are the rules ending at this node, ordered by index.
+	rules []globRule
+}
+
+func (n *globTrieNode) child(c byte) *globTrieNode {
+	if n.children == nil {
+		n.children = make(map[byte]*globTrieNode)
+	}
+	child := n.children[c]
+	if child == nil {
+		child = &globTrieNode{}
+		n.children[c] = child
+	}
+	return child
+}
+
+// patternRule is a rule which is matched by its rulePattern.
+type patternRule struct {
+	index   int
+	matches rulePattern
+}
+
+// domainRuleMatcher matches domains against a list of policy rules. The result is the same as
+// checking rules one by one, the first rule matching both domain and rule conditions wins, but the
+// cost does not grow with the number of rules:
+//
+//   - "example.com" and "*.example.com" rules are stored in a reversed-label trie.
+//   - "prefix*" and "prefix*suffix" rules are stored in a byte trie of their prefixes.
+//   - "*suffix" rules are stored in a byte trie of their reversed suffixes.
+//   - Regex and multiple wildcards rules are checked in order, until a rule with a higher
+//     index than the tries result is reached.
+//
+// Matching walks all tries, the rule with lowest index wins.
+type domainRuleMatcher struct {
+	labels   *ruleTrieNode
+	prefixes *globTrieNode
+	suffixes *globTrieNode
+	patterns []patternRule
+	// conds are conditions of rules, indexed by rule index.
+	conds []ruleCond
+}
+
+// newDomainRuleMatcher compiles rules to a domainRuleMatcher, schedules maps
+// schedule names to their indexes, see ruleQuery.
+func newDomainRuleMatcher(rules []ctrld.Rule, schedules map[string]int) *domainRuleMatcher {
+	m := &domainRuleMatcher{labels: &ruleTrieNode{}, prefixes: &globTrieNode{}, suffixes: &globTrieNode{}}
+	m.conds = make([]ruleCond, len(rules))
+	for i, rule := range rules {
+		// There's only one entry per rule, config validation ensures this.
+		for source, target := range rule {
+			m.conds[i] = newRuleCond(target, schedules)
+			if strings.HasPrefix(source, ctrld.RuleRegexPrefix) || strings.Count(source, "*") > 1 {
+				m.patterns = append(m.patterns, patternRule{index: i, matches: newRulePattern(source, true)})
+				continue
+			}
+			m.add(i, canonicalName(source))
+		}
+	}
+	return m
+}
+
+func (m *domainRuleMatcher) add(index int, source string) {
+	prefix, suffix, isWildcard := strings.Cut(source, "*")
+	switch {
+	case source == "":
+	case !isWildcard:
+		m.addLabels(index, source, false)
+	case prefix != "":
+		n := m.prefixes
+		for i := 0; i < len(prefix); i++ {
+			n = n.child(prefix[i])
+		}
+		n.rules = append(n.rules, globRule{index: index, suffix: suffix})
+	case strings.HasPrefix(suffix, ".") && len(suffix) > 1:
+		m.addLabels(index, suffix[1:], true)
+	case suffix != "":
+		n := m.suffixes
+		for i := len(suffix) - 1; i >= 0; i-- {
+			n = n.child(suffix[i])
+		}
+		n.rules = append(n.rules, globRule{index: index})
+	}
+}
+
+func (m *domainRuleMatcher) addLabels(index int, domain string, subdomains bool) {
+	n := m.labels
+	for end := len(domain); end >= 0; {
+		start := strings.LastIndexByte(domain[:end], '.') + 1
+		label := domain[start:end]
+		child := n.children[label]
+		if child == nil {
+			if n.children == nil {
+				n.children = make(map[string]*ruleTrieNode)
+			}
+			child = &ruleTrieNode{}
+			n.children[label] = child
+		}
+		n = child
+		end = start - 1
+	}
+	if subdomains {
+		n.subdomains = append(n.subdomains, index)
+	} else {
+		n.exact = append(n.exact, index)
+	}
+}
+
+// match returns the index of the first rule matching domain and query q, or -1 if there's none.
+// The domain must be in canonical form, see canonicalName.
+func (m *domainRuleMatcher) match(domain string, q ruleQuery) int {
+	if domain == "" {
+		return -1
+	}
+	best := -1
+	better := func(indexes []int) {
+		for _, idx := range indexes {
+			if best != -1 && idx > best {
+				return
+			}
+			if m.conds[idx].matches(q) {
+				best = idx
+				return
+			}
+		}
+	}
+
+	n := m.labels
+	for end := len(domain); end >= 0; {
+		start := strings.LastIndexByte(domain[:end], '.') + 1
+		if n = n.children[domain[start:end]]; n == nil {
+			break
+		}
+		if start == 0 {
+			better(n.exact)
+		} else {
+			better(n.subdomains)
+		}
+		end = start - 1
+	}
+
+	g := m.prefixes
+	for i := 0; g != nil; i++ {
+		for _, r := range g.rules {
+			if best != -1 && r.index > best {
+				break
+			}
+			if strings.HasSuffix(domain, r.suffix) && m.conds[r.index].matches(q) {
+				best = r.index
+				break
+			}
+		}
+		if i == len(domain) {
+			break
+		}
+		g = g.children[domain[i]]
+	}
+
+	g = m.suffixes
+	for i := len(domain) - 1; i >= 0; i-- {
+		if g = g.children[domain[i]]; g == nil {
+			break
+		}
+		for _, r := range g.rules {
+			if best != -1 && r.index > best {
+				break
+			}
+			if m.conds[r.index].matches(q) {
+				best = r.index
+				break
+			}
+		}
+	}
+
+	for _, r := range m.patterns {
+		if best != -1 && r.index > best {
+			break
+		}
+		if r.matches(domain) && m.conds[r.index].matches(q) {
+			return r.index
+		}
+	}
+	return best
+}
+
+// qtypeSet is the set of query types of a rule, an empty set contains all query types.
+type qtypeSet []uint16
+
+// contains reports whether qtype is in the set.
+func (s qtypeSet) contains(qtype uint16) bool {
+	return len(s) == 0 || slices.Contains(s, qtype)
+}
+
+// ruleQuery is the query which rule conditions are checked against.
+type ruleQuery struct {
+	qtype uint16
+	// schedules reports whether the policy schedules are active, indexed by schedule index.
+	schedules []bool
+}
+
+// ruleCond is the conditions of a rule, other than its source.
+type ruleCond struct {
+	qtypes qtypeSet
+	// schedule is the index of the rule schedule, or -1 if the rule applies at any time.
+	schedule int
+}
+
+// newRuleCond returns the conditions of the rule target, schedules maps schedule names to their indexes.
+func newRuleCond(target ctrld.RuleTarget, schedules map[string]int) ruleCond {
+	c := ruleCond{qtypes: target.Qtypes(), schedule: -1}
+	if target.Schedule != "" {
+		// Config validation ensures the schedule exists.
+		if i, ok := schedules[target.Schedule]; ok {
+			c.schedule = i
+		}
+	}
+	return c
+}
+
+// matches reports whether query q satisfies the conditions.
+func (c ruleCond) matches(q ruleQuery) bool {
+	if c.schedule != -1 && !q.schedules[c.schedule] {
+		return false
+	}
+	return c.qtypes.contains(q.qtype)
+}
+
+// Last seen states of a policySchedule.
+const (
+	scheduleStateUnknown int32 = iota
+	scheduleStateInactive
+	scheduleStateActive
+)
+
+// policySchedule is a compiled schedule of a policy.
+type policySchedule struct {
+	name     string
+	schedule *ctrld.Schedule
+	// state is the state of the schedule seen by the last query.
+	state atomic.Int32
+}
+
+// policyRuleMatcher holds the compiled rules of a policy.
+type policyRuleMatcher struct {
+	domains *domainRuleMatcher
+	// macs are patterns of policy mac rules, in the same order.
+	macs []rulePattern
+	// macConds are conditions of policy mac rules, in the same order.
+	macConds []ruleCond
+	// networkConds are conditions of policy network rules, in the same order.
+	networkConds []ruleCond
+	// schedules are the policy schedules, ordered by name.
+	schedules []*policySchedule
+	// upstreams are all upstreams of the policy rules.
+	upstreams []string
+}
+
+// matchMac returns the index of the first mac rule matching mac and query q, or -1 if there's none.
+func (m *policyRuleMatcher) matchMac(mac string, q ruleQuery) int {
+	mac = strings.ToLower(mac)
+	for i, matches := range m.macs {
+		if matches(mac) && m.macConds[i].matches(q) {
+			return i
+		}
+	}
+	return -1
+}
+
+// query returns the ruleQuery for the given query type at time now. The second return
+// value is the names of schedules whose state changed since the previous query.
+func (m *policyRuleMatcher) query(qtype uint16, now time.Time) (ruleQuery, []string) {
+	q := ruleQuery{qtype: qtype}
+	if len(m.schedules) == 0 {
+		return q, nil
+	}
+	var changed []string
+	q.schedules = make([]bool, len(m.schedules))
+	for i, ps := range m.schedules {
+		// An invalid schedule is never active, config validation ensures this won't happen.
+		q.schedules[i] = ps.schedule != nil && ps.schedule.Active(now)
+		state := scheduleStateInactive
+		if q.schedules[i] {
+			state = scheduleStateActive
+		}
+		if old := ps.state.Swap(state); old != scheduleStateUnknown && old != state {
+			changed = append(changed, ps.name)
+		}
+	}
+	return q, changed
+}
+
+// ruleMatcherFor returns the policyRuleMatcher of the given policy, compiling it on first use.
+func (p *prog) ruleMatcherFor(policy *ctrld.ListenerPolicyConfig) *policyRuleMatcher {
+	if m, ok := p.ruleMatchers.Load(policy); ok {
+		return m.(*policyRuleMatcher)
+	}
+	names := make([]string, 0, len(policy.Schedules))
+	for name := range policy.Schedules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	schedules := make(map[string]int, len(names))
+	m := &policyRuleMatcher{
+		macs:         make([]rulePattern, len(policy.Macs)),
+		macConds:     make([]ruleCond, len(policy.Macs)),
+		networkConds: make([]ruleCond, len(policy.Networks)),
+	}
+	for i, name := range names {
+		schedules[name] = i
+		ps := &policySchedule{name: name}
+		if sc := policy.Schedules[name]; sc != nil {
+			ps.schedule, _ = sc.Parse()
+		}
+		m.schedules = append(m.schedules, ps)
+	}
+	m.domains = newDomainRuleMatcher(policy.Rules, schedules)
+	for i, rule := range policy.Macs {
+		m.macs[i] = func(string) bool { return false }
+		// There's only one entry per rule, config validation ensures this.
+		for source, target := range rule {
+			m.macs[i] = newRulePattern(source, false)
+			m.macConds[i] = newRuleCond(target, schedules)
+		}
+	}
+	for i, rule := range policy.Networks {
+		for _, target := range rule {
+			m.networkConds[i] = newRuleCond(target, schedules)
+		}
+	}
+	for _, rules := range [][]ctrld.Rule{policy.Networks, policy.Macs, policy.Rules} {
+		for _, rule := range rules {
+			for _, target := range rule {
+				if len(target.Upstreams) == 0 && !slices.Contains(m.upstreams, upstreamOS) {
+					m.upstreams = append(m.upstreams, upstreamOS)
+				}
+				for _, upstream := range target.Upstreams {
+					if !slices.Contains(m.upstreams, upstream) {
+						m.upstreams = append(m.upstreams, upstream)
+					}
+				}
+			}
+		}
+	}
+	actual, _ := p.ruleMatchers.LoadOrStore(policy, m)
+	return actual.(*policyRuleMatcher)
+}
+
+// rulePattern reports whether a canonical domain or lower case mac address matches a rule.
+type rulePattern func(s string) bool
+
+// newRulePattern compiles the rule source to a rulePattern. The source can be:
+//
+//   - A regular expression, prefixed with "regex:".
+//   - A pattern without "*", which must be equal to the domain or mac address.
+//   - A pattern with one "*", see wildcardMatches.
+//   - A pattern with multiple "*". For domains, the pattern is matched label by label:
+//     a leading or trailing "*" label matches one or more labels, other "*" labels match
+//     exactly one label, and "*" inside a label matches any characters in that label,
+//     so "*.cdn.*.example.com" matches "a.b.cdn.eu.example.com". For mac addresses,
+//     "*" matches any characters.
+//
+// An invalid regular expression never matches, config validation ensures this won't happen.
+func newRulePattern(source string, isDomain bool) rulePattern {
+	if re, err := ctrld.RuleRegex(source); re != nil || err != nil {
+		if err != nil {
+			return func(string) bool { return false }
+		}
+		return re.MatchString
+	}
+	if isDomain {
+		source = canonicalName(source)
+	} else {
+		source = strings.ToLower(source)
+	}
+	switch n := strings.Count(source, "*"); {
+	case source == "":
+		return func(string) bool { return false }
+	case n == 0:
+		return func(s string) bool { return s == source }
+	case n == 1:
+		return func(s string) bool { return wildcardMatches(source, s) }
+	case isDomain:
+		labels := strings.Split(source, ".")
+		return func(s string) bool { return labelsMatch(labels, strings.Split(s, ".")) }
+	default:
+		parts := strings.Split(source, "*")
+		return func(s string) bool { return globMatches(parts, s) }
+	}
+}
+
+// labelsMatch reports whether domain labels match pattern labels, see newRulePattern.
+func labelsMatch(pattern, labels []string) bool {
+	leading := len(pattern) > 1 && pattern[0] == "*"
+	trailing := len(pattern) > 1 && pattern[len(pattern)-1] == "*"
+	core := pattern
+	if leading {
+		core = core[1:]
+	}
+	if trailing {
+		core = core[:len(core)-1]
+	}
+	minOffset, maxOffset := 0, 0
+	switch {
+	case leading && trailing:
+		minOffset, maxOffset = 1, len(labels)-len(core)-1
+	case leading:
+		minOffset = len(labels) - len(core)
+		maxOffset = minOffset
+		if minOffset < 1 {
+			return false
+		}
+	case trailing:
+		if len(labels)-len(core) < 1 {
+			return false
+		}
+	default:
+		if len(labels) != len(core) {
+			return false
+		}
+	}
+	for off := minOffset; off <= maxOffset; off++ {
+		if labelsMatchAt(core, labels[off:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// labelsMatchAt reports whether the first len(pattern) labels match pattern labels.
+func labelsMatchAt(pattern, labels []string) bool {
+	if len(labels) < len(pattern) {
+		return false
+	}
+	for i, p := range pattern {
+		if p == "*" {
+			continue
+		}
+		if !globMatches(strings.Split(p, "*"), labels[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// globMatches reports whether s matches the glob pattern, given as parts split by "*".
+func globMatches(parts []string, s string) bool {
+	if len(parts) == 1 {
+		return s == parts[0]
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i == -1 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return len(s) >= len(last) && strings.HasSuffix(s, last)
+}
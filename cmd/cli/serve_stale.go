@@ -0,0 +1,63 @@
+package cli
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+// Default values of serve-stale settings, as recommended by RFC 8767.
+const (
+	// defaultCacheStaleTTL is the default TTL of stale answers.
+	defaultCacheStaleTTL = 30 * time.Second
+	// defaultCacheMaxStale is the default maximum time after expiry, during which a cached value can be served.
+	defaultCacheMaxStale = 24 * time.Hour
+	// defaultCacheStaleAnswerTimeout is the default time to wait for upstreams before answering with stale data.
+	defaultCacheStaleAnswerTimeout = 1800 * time.Millisecond
+)
+
+// staleTTL returns the TTL of stale answers.
+func (p *prog) staleTTL() time.Duration {
+	if n := p.cfg.Service.CacheStaleTTL; n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return defaultCacheStaleTTL
+}
+
+// staleAnswerTimeout returns the client response timer, after which stale data is answered
+// while the upstream resolution continues in background.
+func (p *prog) staleAnswerTimeout() time.Duration {
+	if n := p.cfg.Service.CacheStaleAnswerTimeout; n > 0 {
+		return time.Duration(n) * time.Millisecond
+	}
+	return defaultCacheStaleAnswerTimeout
+}
+
+// canServeStale reports whether the expired cached value v is still young enough to be served.
+func (p *prog) canServeStale(v *dnscache.Value, now time.Time) bool {
+	maxStale := defaultCacheMaxStale
+	if n := p.cfg.Service.CacheMaxStale; n > 0 {
+		maxStale = time.Duration(n) * time.Second
+	}
+	return now.Sub(v.Expire) <= maxStale
+}
+
+// staleResponse returns a response for msg using the stale answer, with TTLs set to the stale TTL.
+// The Stale Answer extended DNS error is added if the client supports EDNS0.
+func (p *prog) staleResponse(msg, staleAnswer *dns.Msg) *proxyResponse {
+	answer := staleAnswer.Copy()
+	now := time.Now()
+	setCachedAnswerTTL(answer, now, now.Add(p.staleTTL()))
+	if reqOpt := msg.IsEdns0(); reqOpt != nil {
+		opt := answer.IsEdns0()
+		if opt == nil {
+			answer.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+			opt = answer.IsEdns0()
+		}
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer})
+	}
+	statsCacheStaleServes.Inc()
+	return &proxyResponse{answer: answer, cached: true}
+}
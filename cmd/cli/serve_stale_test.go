@@ -0,0 +1,136 @@
+package cli
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+func Test_prog_proxy_serveStale(t *testing.T) {
+	endpoint := runStrategyTestServer(t, 300*time.Millisecond, "10.0.0.2")
+	newProg := func(t *testing.T, expired time.Duration) (*prog, *dns.Msg) {
+		cfg := &ctrld.Config{
+			Service: ctrld.ServiceConfig{
+				CacheServeStale:         true,
+				CacheStaleTTL:           10,
+				CacheMaxStale:           3600,
+				CacheStaleAnswerTimeout: 50,
+			},
+			Upstream: map[string]*ctrld.UpstreamConfig{
+				"0": {Name: "0", Type: ctrld.ResolverTypeLegacy, Endpoint: endpoint, Timeout: 5000},
+			},
+		}
+		cfg.Upstream["0"].Init()
+		p := &prog{cfg: cfg}
+		p.um = newUpstreamMonitor(cfg)
+		var err error
+		p.cache, err = dnscache.NewLRUCache(4096)
+		require.NoError(t, err)
+
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		stale := new(dns.Msg)
+		stale.SetReply(msg)
+		stale.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("10.0.0.1"),
+		}}
+		p.cache.Add(dnscache.NewKey(msg, "upstream.0"), dnscache.NewValue(stale, time.Now().Add(-expired)))
+		return p, msg
+	}
+	proxy := func(p *prog, msg *dns.Msg) *proxyResponse {
+		return p.proxy(context.Background(), &proxyRequest{
+			msg: msg,
+			ufr: &upstreamForResult{upstreams: []string{"upstream.0"}},
+		})
+	}
+
+	t.Run("stale answer", func(t *testing.T) {
+		p, msg := newProg(t, time.Minute)
+		res := proxy(p, msg)
+		require.Len(t, res.answer.Answer, 1)
+		assert.True(t, res.cached)
+		assert.Equal(t, net.ParseIP("10.0.0.1").To4(), res.answer.Answer[0].(*dns.A).A.To4())
+		assert.Equal(t, uint32(10), res.answer.Answer[0].Header().Ttl)
+		opt := res.answer.IsEdns0()
+		require.NotNil(t, opt)
+		require.Len(t, opt.Option, 1)
+		assert.Equal(t, dns.ExtendedErrorCodeStaleAnswer, opt.Option[0].(*dns.EDNS0_EDE).InfoCode)
+
+		// The resolution continues in background, and refreshes the cache.
+		assert.Eventually(t, func() bool {
+			v := p.cache.Get(dnscache.NewKey(msg, "upstream.0"))
+			return v != nil && v.Expire.After(time.Now())
+		}, 2*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("too old", func(t *testing.T) {
+		p, msg := newProg(t, 2*time.Hour)
+		res := proxy(p, msg)
+		require.Len(t, res.answer.Answer, 1)
+		assert.False(t, res.cached)
+		assert.Equal(t, net.ParseIP("10.0.0.2").To4(), res.answer.Answer[0].(*dns.A).A.To4())
+	})
+}
+
+func Test_prog_proxy_negativeWithoutSOA(t *testing.T) {
+	var queries atomic.Int32
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var started sync.WaitGroup
+	started.Add(1)
+	server := &dns.Server{
+		PacketConn:        pc,
+		NotifyStartedFunc: started.Done,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, msg *dns.Msg) {
+			queries.Add(1)
+			m := new(dns.Msg)
+			m.SetRcode(msg, dns.RcodeNameError)
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	started.Wait()
+	t.Cleanup(func() { server.Shutdown() })
+
+	cfg := &ctrld.Config{
+		Service: ctrld.ServiceConfig{
+			CacheServeStale:     true,
+			CacheMaxStale:       3600,
+			CacheNegativeMinTTL: 300,
+		},
+		Upstream: map[string]*ctrld.UpstreamConfig{
+			"0": {Name: "0", Type: ctrld.ResolverTypeLegacy, Endpoint: pc.LocalAddr().String(), Timeout: 5000},
+		},
+	}
+	cfg.Upstream["0"].Init()
+	p := &prog{cfg: cfg}
+	p.um = newUpstreamMonitor(cfg)
+	p.cache, err = dnscache.NewLRUCache(4096)
+	require.NoError(t, err)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("nxdomain.example.com.", dns.TypeA)
+	for i := 1; i <= 2; i++ {
+		res := p.proxy(context.Background(), &proxyRequest{
+			msg: msg,
+			ufr: &upstreamForResult{upstreams: []string{"upstream.0"}},
+		})
+		require.NotNil(t, res.answer)
+		assert.Equal(t, dns.RcodeNameError, res.answer.Rcode)
+		assert.False(t, res.cached)
+		assert.Nil(t, p.cache.Get(dnscache.NewKey(msg, "upstream.0")))
+		assert.Equal(t, int32(i), queries.Load())
+	}
+}
@@ -0,0 +1,188 @@
+package cli
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Control-D-Inc/ctrld/internal/topstats"
+)
+
+const (
+	// defaultTopStatsSize is the default number of top domains and clients tracked by each statistics list.
+	defaultTopStatsSize = 10
+
+	topStatsWindowHour = "1h"
+	topStatsWindowDay  = "24h"
+)
+
+// topStatsWindows are the rolling windows of top statistics, in display order.
+var topStatsWindows = []struct {
+	name    string
+	window  time.Duration
+	buckets int
+}{
+	{topStatsWindowHour, time.Hour, 12},
+	{topStatsWindowDay, 24 * time.Hour, 24},
+}
+
+// topStatsTrackers are the top statistics of a rolling window.
+type topStatsTrackers struct {
+	domains   *topstats.Tracker
+	nxdomains *topstats.Tracker
+	blocked   *topstats.Tracker
+	clients   *topstats.Tracker
+}
+
+// topStats keeps the top queried, NXDOMAIN and blocked domains, and the top clients, over rolling windows.
+type topStats struct {
+	size    int
+	windows map[string]*topStatsTrackers
+}
+
+// newTopStats returns new topStats, tracking the top size domains and clients.
+func newTopStats(size int) *topStats {
+	ts := &topStats{size: size, windows: make(map[string]*topStatsTrackers, len(topStatsWindows))}
+	for _, w := range topStatsWindows {
+		ts.windows[w.name] = &topStatsTrackers{
+			domains:   topstats.New(size, w.window, w.buckets),
+			nxdomains: topstats.New(size, w.window, w.buckets),
+			blocked:   topstats.New(size, w.window, w.buckets),
+			clients:   topstats.New(size, w.window, w.buckets),
+		}
+	}
+	return ts
+}
+
+// record counts a query of the client for domain, answered with the given rcode.
+func (ts *topStats) record(now time.Time, domain, clientIP string, rcode int, blocked bool) {
+	for _, t := range ts.windows {
+		t.domains.Add(domain, now)
+		if rcode == dns.RcodeNameError {
+			t.nxdomains.Add(domain, now)
+		}
+		if blocked {
+			t.blocked.Add(domain, now)
+		}
+		if clientIP != "" {
+			t.clients.Add(clientIP, now)
+		}
+	}
+}
+
+// topStatsClient is a top client, with its estimated number of queries.
+type topStatsClient struct {
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname,omitempty"`
+	Count    uint64 `json:"count"`
+}
+
+// topStatsReport represents the top statistics of a rolling window.
+type topStatsReport struct {
+	Window    string           `json:"window"`
+	Queries   uint64           `json:"queries"`
+	Domains   []topstats.Entry `json:"domains"`
+	NXDomains []topstats.Entry `json:"nxdomains"`
+	Blocked   []topstats.Entry `json:"blocked"`
+	Clients   []topStatsClient `json:"clients"`
+}
+
+// recordTopStats counts the query in top statistics, if enabled.
+func (p *prog) recordTopStats(domain, clientIP string, rcode int, blocked bool) {
+	if ts := p.topStats.Load(); ts != nil {
+		ts.record(p.now(), domain, clientIP, rcode, blocked)
+	}
+}
+
+// initTopStats enables top statistics if configured. Current statistics are kept if the size did not change.
+func (p *prog) initTopStats() {
+	if !p.cfg.Service.TopStats {
+		p.topStats.Store(nil)
+		return
+	}
+	size := p.cfg.Service.TopStatsSize
+	if size == 0 {
+		size = defaultTopStatsSize
+	}
+	if ts := p.topStats.Load(); ts != nil && ts.size == size {
+		return
+	}
+	p.topStats.Store(newTopStats(size))
+}
+
+// topStatsReports returns the top statistics of the given windows, all windows if empty,
+// with at most limit entries in each list. It returns nil if top statistics are disabled.
+func (p *prog) topStatsReports(window string, limit int) []*topStatsReport {
+	ts := p.topStats.Load()
+	if ts == nil {
+		return nil
+	}
+	now := p.now()
+	reports := make([]*topStatsReport, 0, len(topStatsWindows))
+	for _, w := range topStatsWindows {
+		if window != "" && window != w.name {
+			continue
+		}
+		t := ts.windows[w.name]
+		r := &topStatsReport{Window: w.name}
+		r.Domains, r.Queries = t.domains.Top(limit, now)
+		r.NXDomains, _ = t.nxdomains.Top(limit, now)
+		r.Blocked, _ = t.blocked.Top(limit, now)
+		clients, _ := t.clients.Top(limit, now)
+		r.Clients = make([]topStatsClient, len(clients))
+		for i, c := range clients {
+			r.Clients[i] = topStatsClient{IP: c.Key, Count: c.Count}
+			if p.ciTable != nil {
+				r.Clients[i].Hostname = p.ciTable.LookupHostname(c.Key, "")
+			}
+		}
+		reports = append(reports, r)
+	}
+	return reports
+}
+
+// topStatsCollector exposes top statistics, see prog.topStatsReports.
+type topStatsCollector struct {
+	p *prog
+
+	domains   *prometheus.Desc
+	nxdomains *prometheus.Desc
+	blocked   *prometheus.Desc
+	clients   *prometheus.Desc
+}
+
+// newTopStatsCollector returns new topStatsCollector of the given prog.
+func newTopStatsCollector(p *prog) *topStatsCollector {
+	labels := []string{metricsLabelWindow, metricsLabelDomain}
+	return &topStatsCollector{
+		p:         p,
+		domains:   prometheus.NewDesc("ctrld_top_domains", "Estimated number of queries of the top queried domains.", labels, nil),
+		nxdomains: prometheus.NewDesc("ctrld_top_nxdomain_domains", "Estimated number of NXDOMAIN answers of the top NXDOMAIN domains.", labels, nil),
+		blocked:   prometheus.NewDesc("ctrld_top_blocked_domains", "Estimated number of blocked queries of the top blocked domains.", labels, nil),
+		clients: prometheus.NewDesc("ctrld_top_clients", "Estimated number of queries of the top clients.",
+			[]string{metricsLabelWindow, metricsLabelClientSourceIP, metricsLabelClientHostname}, nil),
+	}
+}
+
+// Describe implements prometheus.Collector interface.
+func (c *topStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.domains
+	ch <- c.nxdomains
+	ch <- c.blocked
+	ch <- c.clients
+}
+
+// Collect implements prometheus.Collector interface.
+func (c *topStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, r := range c.p.topStatsReports("", 0) {
+		for desc, entries := range map[*prometheus.Desc][]topstats.Entry{c.domains: r.Domains, c.nxdomains: r.NXDomains, c.blocked: r.Blocked} {
+			for _, e := range entries {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(e.Count), r.Window, e.Key)
+			}
+		}
+		for _, client := range r.Clients {
+			ch <- prometheus.MustNewConstMetric(c.clients, prometheus.GaugeValue, float64(client.Count), r.Window, client.IP, client.Hostname)
+		}
+	}
+}
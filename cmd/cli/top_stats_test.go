@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/topstats"
+)
+
+func Test_prog_topStatsReports(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	p := &prog{cfg: &ctrld.Config{}, clock: func() time.Time { return now }}
+	p.initTopStats()
+	assert.Nil(t, p.topStatsReports("", 0), "top stats must be disabled by default")
+	p.recordTopStats("example.com", "192.168.1.2", dns.RcodeSuccess, false)
+
+	p.cfg.Service.TopStats = true
+	p.initTopStats()
+	ts := p.topStats.Load()
+	require.NotNil(t, ts)
+	assert.Equal(t, defaultTopStatsSize, ts.size)
+	p.initTopStats()
+	assert.Same(t, ts, p.topStats.Load(), "unchanged config must keep current stats")
+
+	for i := 0; i < 3; i++ {
+		p.recordTopStats("example.com", "192.168.1.2", dns.RcodeSuccess, false)
+	}
+	p.recordTopStats("nx.example.com", "192.168.1.3", dns.RcodeNameError, false)
+	p.recordTopStats("ads.example.com", "192.168.1.3", dns.RcodeNameError, true)
+
+	reports := p.topStatsReports("", 0)
+	require.Len(t, reports, 2)
+	assert.Equal(t, topStatsWindowHour, reports[0].Window)
+	assert.Equal(t, topStatsWindowDay, reports[1].Window)
+	r := reports[0]
+	assert.Equal(t, uint64(5), r.Queries)
+	assert.Equal(t, topstats.Entry{Key: "example.com", Count: 3}, r.Domains[0])
+	assert.Equal(t, []topstats.Entry{{Key: "ads.example.com", Count: 1}, {Key: "nx.example.com", Count: 1}}, r.NXDomains)
+	assert.Equal(t, []topstats.Entry{{Key: "ads.example.com", Count: 1}}, r.Blocked)
+	assert.Equal(t, []topStatsClient{{IP: "192.168.1.2", Count: 3}, {IP: "192.168.1.3", Count: 2}}, r.Clients)
+
+	reports = p.topStatsReports(topStatsWindowDay, 1)
+	require.Len(t, reports, 1)
+	assert.Equal(t, topStatsWindowDay, reports[0].Window)
+	assert.Len(t, reports[0].Domains, 1)
+	assert.Len(t, reports[0].NXDomains, 1)
+
+	// The hour window rolls, the day window keeps counting.
+	now = now.Add(2 * time.Hour)
+	reports = p.topStatsReports("", 0)
+	assert.Zero(t, reports[0].Queries)
+	assert.Equal(t, uint64(5), reports[1].Queries)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newTopStatsCollector(p))
+	// 3 domains, 2 NXDOMAIN domains, 1 blocked domain and 2 clients of the day window.
+	assert.Equal(t, 8, testutil.CollectAndCount(reg))
+}
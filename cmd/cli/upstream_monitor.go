@@ -1,6 +1,12 @@
 package cli
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
 	"sync"
 	"time"
 
@@ -8,35 +14,138 @@ import (
 )
 
 const (
-	// maxFailureRequest is the maximum failed queries allowed before an upstream is marked as down.
+	// maxFailureRequest is the default number of consecutive failed queries allowed before an upstream is marked as down.
 	maxFailureRequest = 50
-	// checkUpstreamBackoffSleep is the time interval between each upstream checks.
+	// maxFailureDuration is the default duration that failures may persist, without any success, before an upstream is marked as down.
+	maxFailureDuration = 10 * time.Second
+	// checkUpstreamBackoffSleep is the default time interval between each upstream checks.
 	checkUpstreamBackoffSleep = 2 * time.Second
+	// maxCheckUpstreamBackoffSleep is the default upper bound of the time interval between each upstream checks.
+	maxCheckUpstreamBackoffSleep = 2 * time.Minute
+	// upstreamSamplesSize is the number of latest queries used to compute upstream percentiles and rates.
+	upstreamSamplesSize = 256
 )
 
+// circuitState represents the state of an upstream circuit breaker.
+type circuitState int
+
+const (
+	// circuitClosed means the upstream is healthy, queries are sent to it.
+	circuitClosed circuitState = iota
+	// circuitOpen means the upstream is marked as down, queries are not sent to it until the probe time.
+	circuitOpen
+	// circuitHalfOpen means the upstream is being probed, a single probe query is sent to it,
+	// and its result decides whether the circuit is closed or opened again.
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitClosed:
+		return "closed"
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// upstreamSample is the result of a query sent to an upstream.
+type upstreamSample struct {
+	rtt     time.Duration
+	failed  bool
+	timeout bool
+}
+
+// upstreamHealth holds the circuit breaker state and statistics of an upstream.
+type upstreamHealth struct {
+	state        circuitState
+	stateChanged time.Time
+	reason       string
+	lastError    string
+	failures     int       // consecutive failures.
+	firstFailure time.Time // time of the first consecutive failure.
+	probeBackoff time.Duration
+	probeAt      time.Time // when an open circuit becomes half-open.
+	probing      bool      // whether the probe query of a half-open circuit is in flight.
+	recovered    bool
+
+	queries      uint64
+	failuresSum  uint64
+	timeoutsSum  uint64
+	srtt         time.Duration
+	samples      [upstreamSamplesSize]upstreamSample
+	samplesCount int
+	samplesNext  int
+}
+
+// upstreamStats is the statistics of an upstream, exposed through the control server.
+type upstreamStats struct {
+	Upstream            string     `json:"upstream"`
+	State               string     `json:"state"`
+	StateChanged        time.Time  `json:"state_changed"`
+	Reason              string     `json:"reason,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	NextProbe           *time.Time `json:"next_probe,omitempty"`
+	Queries             uint64     `json:"queries"`
+	Failures            uint64     `json:"failures"`
+	Timeouts            uint64     `json:"timeouts"`
+	ErrorRate           float64    `json:"error_rate"`
+	TimeoutRate         float64    `json:"timeout_rate"`
+	RTT                 float64    `json:"rtt_ms"`
+	RTTP50              float64    `json:"rtt_p50_ms"`
+	RTTP90              float64    `json:"rtt_p90_ms"`
+	RTTP99              float64    `json:"rtt_p99_ms"`
+
+	circuit circuitState
+}
+
 // upstreamMonitor performs monitoring upstreams health.
+//
+// Each upstream has a circuit breaker. The circuit is opened, marking the upstream as down, when
+// there are too many consecutive failures, or when failures persist for too long without any success.
+// After the probe backoff, the circuit becomes half-open, and the next query is admitted as the probe,
+// which decides whether it is closed, or opened again with the probe backoff doubled. Other queries are
+// not admitted until the probe finishes, see upstreamMonitor.admit.
 type upstreamMonitor struct {
 	cfg *ctrld.Config
 
-	mu         sync.RWMutex
-	checking   map[string]bool
-	down       map[string]bool
-	failureReq map[string]uint64
-	recovered  map[string]bool
+	maxFailures     int
+	maxFailureTime  time.Duration
+	probeInterval   time.Duration
+	probeBackoffMax time.Duration
+	// now returns the current time, tests use it to control the circuit breaker.
+	now func() time.Time
 
-	// failureTimerActive tracks if a timer is already running for a given upstream.
-	failureTimerActive map[string]bool
+	mu       sync.RWMutex
+	upstream map[string]*upstreamHealth
 }
 
 func newUpstreamMonitor(cfg *ctrld.Config) *upstreamMonitor {
 	um := &upstreamMonitor{
-		cfg:                cfg,
-		checking:           make(map[string]bool),
-		down:               make(map[string]bool),
-		failureReq:         make(map[string]uint64),
-		recovered:          make(map[string]bool),
-		failureTimerActive: make(map[string]bool),
+		cfg:             cfg,
+		maxFailures:     maxFailureRequest,
+		maxFailureTime:  maxFailureDuration,
+		probeInterval:   checkUpstreamBackoffSleep,
+		probeBackoffMax: maxCheckUpstreamBackoffSleep,
+		now:             time.Now,
+		upstream:        make(map[string]*upstreamHealth),
+	}
+	if n := cfg.Service.UpstreamFailures; n != nil {
+		um.maxFailures = *n
+	}
+	if d := cfg.Service.UpstreamFailureTime; d != nil {
+		um.maxFailureTime = *d
 	}
+	if d := cfg.Service.UpstreamProbeInterval; d != nil {
+		um.probeInterval = *d
+	}
+	if d := cfg.Service.UpstreamProbeBackoffMax; d != nil {
+		um.probeBackoffMax = *d
+	}
+	um.probeBackoffMax = max(um.probeBackoffMax, um.probeInterval)
 	for n := range cfg.Upstream {
 		upstream := upstreamPrefix + n
 		um.reset(upstream)
@@ -45,82 +154,308 @@ func newUpstreamMonitor(cfg *ctrld.Config) *upstreamMonitor {
 	return um
 }
 
-// increaseFailureCount increases failed queries count for an upstream by 1 and logs debug information.
-// It uses a timer to debounce failure detection, ensuring that an upstream is marked as down
-// within 10 seconds if failures persist, without spawning duplicate goroutines.
-func (um *upstreamMonitor) increaseFailureCount(upstream string) {
+// health returns the upstreamHealth of the given upstream, creating it if necessary.
+// um.mu must be held for writing.
+func (um *upstreamMonitor) health(upstream string) *upstreamHealth {
+	h := um.upstream[upstream]
+	if h == nil {
+		h = &upstreamHealth{stateChanged: um.now(), probeBackoff: um.probeInterval}
+		um.upstream[upstream] = h
+	}
+	return h
+}
+
+// setState changes the circuit state of an upstream, logging the transition.
+func (um *upstreamMonitor) setState(upstream string, h *upstreamHealth, state circuitState, reason string) {
+	if h.state == state {
+		return
+	}
+	mainLog.Load().Debug().Msgf("upstream %q circuit changed from %s to %s", upstream, h.state, state)
+	h.state = state
+	h.stateChanged = um.now()
+	h.reason = reason
+	h.probing = false
+}
+
+// open opens the circuit of an upstream, marking it as down until the probe time.
+func (um *upstreamMonitor) open(upstream string, h *upstreamHealth, reason string) {
+	if h.state == circuitHalfOpen {
+		h.probeBackoff = min(h.probeBackoff*2, um.probeBackoffMax)
+	}
+	h.probeAt = um.now().Add(h.probeBackoff)
+	um.setState(upstream, h, circuitOpen, reason)
+	mainLog.Load().Warn().Msgf("upstream %q marked as down: %s, next probe in %s", upstream, reason, h.probeBackoff)
+}
+
+// close closes the circuit of an upstream, marking it as up.
+func (um *upstreamMonitor) close(upstream string, h *upstreamHealth) {
+	h.failures = 0
+	h.probeBackoff = um.probeInterval
+	h.probeAt = time.Time{}
+	um.setState(upstream, h, circuitClosed, "")
+}
+
+// refresh updates the circuit state of an upstream based on the current time.
+func (um *upstreamMonitor) refresh(upstream string, h *upstreamHealth) {
+	now := um.now()
+	switch h.state {
+	case circuitClosed:
+		if h.failures > 0 && !h.recovered && now.Sub(h.firstFailure) >= um.maxFailureTime {
+			um.open(upstream, h, fmt.Sprintf("%d failures in %s without success", h.failures, um.maxFailureTime))
+		}
+	case circuitOpen:
+		if !now.Before(h.probeAt) {
+			um.setState(upstream, h, circuitHalfOpen, h.reason)
+		}
+	}
+}
+
+// addSample records the result of a query sent to an upstream.
+func (h *upstreamHealth) addSample(s upstreamSample) {
+	h.queries++
+	if s.failed {
+		h.failuresSum++
+	}
+	if s.timeout {
+		h.timeoutsSum++
+	}
+	h.samples[h.samplesNext] = s
+	h.samplesNext = (h.samplesNext + 1) % upstreamSamplesSize
+	h.samplesCount = min(h.samplesCount+1, upstreamSamplesSize)
+}
+
+// recordSuccess records a query answered by an upstream within the given rtt, closing its circuit.
+func (um *upstreamMonitor) recordSuccess(upstream string, rtt time.Duration) {
+	statsUpstreamRequestDuration.WithLabelValues(upstream).Observe(rtt.Seconds())
+	otelRecordUpstreamSuccess(upstream, rtt)
 	um.mu.Lock()
 	defer um.mu.Unlock()
+	h := um.health(upstream)
+	h.addSample(upstreamSample{rtt: rtt})
+	// Update smoothed round trip time using the same weight as TCP smoothed RTT (RFC 6298).
+	if h.srtt == 0 {
+		h.srtt = rtt
+	} else {
+		h.srtt += (rtt - h.srtt) / 8
+	}
+	if h.state != circuitClosed {
+		mainLog.Load().Info().Msgf("upstream %q is up again", upstream)
+	}
+	um.close(upstream, h)
+}
 
-	if um.recovered[upstream] {
+// recordFailure records a query failed by an upstream with the given error,
+// opening its circuit if the failure thresholds are reached.
+func (um *upstreamMonitor) recordFailure(upstream string, err error) {
+	statsUpstreamErrors.WithLabelValues(upstream, upstreamErrorClass(err)).Inc()
+	otelRecordUpstreamFailure(upstream, err)
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	h := um.health(upstream)
+	if h.recovered {
 		mainLog.Load().Debug().Msgf("upstream %q is recovered, skipping failure count increase", upstream)
 		return
 	}
+	h.addSample(upstreamSample{failed: true, timeout: isTimeoutError(err)})
+	if err != nil {
+		h.lastError = err.Error()
+	}
+	h.failures++
+	if h.failures == 1 {
+		h.firstFailure = um.now()
+	}
+	mainLog.Load().Debug().Msgf("upstream %q failure count updated to %d", upstream, h.failures)
 
-	um.failureReq[upstream] += 1
-	failedCount := um.failureReq[upstream]
-
-	// Log the updated failure count.
-	mainLog.Load().Debug().Msgf("upstream %q failure count updated to %d", upstream, failedCount)
-
-	// If this is the first failure and no timer is running, start a 10-second timer.
-	if failedCount == 1 && !um.failureTimerActive[upstream] {
-		um.failureTimerActive[upstream] = true
-		go func(upstream string) {
-			time.Sleep(10 * time.Second)
-			um.mu.Lock()
-			defer um.mu.Unlock()
-			// If no success occurred during the 10-second window (i.e. counter remains > 0)
-			// and the upstream is not in a recovered state, mark it as down.
-			if um.failureReq[upstream] > 0 && !um.recovered[upstream] {
-				um.down[upstream] = true
-				mainLog.Load().Warn().Msgf("upstream %q marked as down after 10 seconds (failure count: %d)", upstream, um.failureReq[upstream])
-			}
-			// Reset the timer flag so that a new timer can be spawned if needed.
-			um.failureTimerActive[upstream] = false
-		}(upstream)
+	um.refresh(upstream, h)
+	switch h.state {
+	case circuitHalfOpen:
+		um.open(upstream, h, "probe query failed")
+	case circuitClosed:
+		if h.failures >= um.maxFailures {
+			um.open(upstream, h, fmt.Sprintf("%d consecutive failures", h.failures))
+		}
 	}
+}
 
-	// If the failure count quickly reaches the threshold, mark the upstream as down immediately.
-	if failedCount >= maxFailureRequest {
-		um.down[upstream] = true
-		mainLog.Load().Warn().Msgf("upstream %q marked as down immediately (failure count: %d)", upstream, failedCount)
+// isTimeoutError reports whether err is a timeout error.
+func isTimeoutError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
 	}
+	var e net.Error
+	return errors.As(err, &e) && e.Timeout()
+}
+
+// upstreamErrorClass returns the class of an upstream query error, used as metrics label.
+func upstreamErrorClass(err error) string {
+	var recordHeaderErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	switch {
+	case err == nil:
+		return "no_answer"
+	case isTimeoutError(err):
+		return "timeout"
+	case errConnectionRefused(err):
+		return "refused"
+	case errors.As(err, &certErr), errors.As(err, &recordHeaderErr), errors.As(err, &alertErr):
+		return "tls"
+	case errUrlNetworkError(err), errNetworkError(err):
+		return "network"
+	}
+	return "other"
 }
 
 // isDown reports whether the given upstream is being marked as down.
 func (um *upstreamMonitor) isDown(upstream string) bool {
 	um.mu.Lock()
 	defer um.mu.Unlock()
+	h := um.upstream[upstream]
+	if h == nil {
+		return false
+	}
+	um.refresh(upstream, h)
+	return h.state == circuitOpen
+}
+
+// admit reports whether a query could be sent to the given upstream, and whether it is the probe
+// query of a half-open circuit. Only one probe query is admitted at a time, other queries are
+// rejected until probeDone is called, or the probe result changes the circuit state.
+func (um *upstreamMonitor) admit(upstream string) (ok, probe bool) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	h := um.upstream[upstream]
+	if h == nil {
+		return true, false
+	}
+	um.refresh(upstream, h)
+	if h.state != circuitHalfOpen {
+		return true, false
+	}
+	if h.probing {
+		return false, false
+	}
+	h.probing = true
+	return true, true
+}
+
+// probeDone marks the probe query of the given upstream as finished, so another probe could be admitted
+// if the probe did not change the circuit state, like when it was canceled.
+func (um *upstreamMonitor) probeDone(upstream string) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if h := um.upstream[upstream]; h != nil {
+		h.probing = false
+	}
+}
 
-	return um.down[upstream]
+// probeBackoff returns the time to wait before probing the given upstream again,
+// after the given number of failed attempts.
+func (um *upstreamMonitor) probeBackoff(attempts int) time.Duration {
+	d := um.probeInterval
+	for i := 1; i < attempts && d < um.probeBackoffMax; i++ {
+		d *= 2
+	}
+	return min(d, um.probeBackoffMax)
 }
 
 // reset marks an upstream as up and set failed queries counter to zero.
 func (um *upstreamMonitor) reset(upstream string) {
 	um.mu.Lock()
-	um.failureReq[upstream] = 0
-	um.down[upstream] = false
-	um.recovered[upstream] = true
+	h := um.health(upstream)
+	um.close(upstream, h)
+	h.recovered = true
 	um.mu.Unlock()
-	go func() {
-		// debounce the recovery to avoid incrementing failure counts already in flight
-		time.Sleep(1 * time.Second)
+	// debounce the recovery to avoid incrementing failure counts already in flight
+	time.AfterFunc(time.Second, func() {
 		um.mu.Lock()
-		um.recovered[upstream] = false
+		h.recovered = false
 		um.mu.Unlock()
-	}()
+	})
 }
 
 // countHealthy returns the number of upstreams in the provided map that are considered healthy.
 func (um *upstreamMonitor) countHealthy(upstreams []string) int {
 	var count int
-	um.mu.RLock()
 	for _, upstream := range upstreams {
-		if !um.down[upstream] {
+		if !um.isDown(upstream) {
 			count++
 		}
 	}
-	um.mu.RUnlock()
 	return count
 }
+
+// smoothedRTT returns the smoothed round trip time of an upstream, or zero if there's no sample yet.
+func (um *upstreamMonitor) smoothedRTT(upstream string) time.Duration {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+	if h := um.upstream[upstream]; h != nil {
+		return h.srtt
+	}
+	return 0
+}
+
+// stats returns the statistics of all monitored upstreams, sorted by upstream name.
+func (um *upstreamMonitor) stats() []*upstreamStats {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	stats := make([]*upstreamStats, 0, len(um.upstream))
+	for upstream, h := range um.upstream {
+		um.refresh(upstream, h)
+		s := &upstreamStats{
+			Upstream:            upstream,
+			State:               h.state.String(),
+			circuit:             h.state,
+			StateChanged:        h.stateChanged,
+			Reason:              h.reason,
+			LastError:           h.lastError,
+			ConsecutiveFailures: h.failures,
+			Queries:             h.queries,
+			Failures:            h.failuresSum,
+			Timeouts:            h.timeoutsSum,
+			RTT:                 durationMs(h.srtt),
+		}
+		if h.state == circuitOpen {
+			probeAt := h.probeAt
+			s.NextProbe = &probeAt
+		}
+		var failed, timeout int
+		rtts := make([]time.Duration, 0, h.samplesCount)
+		for _, sample := range h.samples[:h.samplesCount] {
+			switch {
+			case sample.timeout:
+				timeout++
+				failed++
+			case sample.failed:
+				failed++
+			default:
+				rtts = append(rtts, sample.rtt)
+			}
+		}
+		if h.samplesCount > 0 {
+			s.ErrorRate = float64(failed) / float64(h.samplesCount)
+			s.TimeoutRate = float64(timeout) / float64(h.samplesCount)
+		}
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+		s.RTTP50 = durationMs(percentile(rtts, 50))
+		s.RTTP90 = durationMs(percentile(rtts, 90))
+		s.RTTP99 = durationMs(percentile(rtts, 99))
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Upstream < stats[j].Upstream })
+	return stats
+}
+
+// percentile returns the p-th percentile of the sorted durations, using the nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
+
+// durationMs returns d in milliseconds.
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,239 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// markUpstreamDown opens the circuit of the given upstream.
+func markUpstreamDown(um *upstreamMonitor, upstream string) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.open(upstream, um.health(upstream), "test")
+}
+
+// newTestUpstreamMonitor returns an upstreamMonitor of the given config, using a fake clock,
+// which is advanced by the returned function.
+func newTestUpstreamMonitor(cfg *ctrld.Config) (*upstreamMonitor, func(time.Duration)) {
+	now := time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC)
+	um := newUpstreamMonitor(cfg)
+	um.mu.Lock()
+	um.now = func() time.Time { return now }
+	for _, h := range um.upstream {
+		h.recovered = false
+	}
+	um.mu.Unlock()
+	return um, func(d time.Duration) { now = now.Add(d) }
+}
+
+func Test_upstreamMonitor_circuitBreaker(t *testing.T) {
+	failures := 3
+	probeInterval := time.Second
+	probeBackoffMax := 3 * time.Second
+	cfg := &ctrld.Config{
+		Service: ctrld.ServiceConfig{
+			UpstreamFailures:        &failures,
+			UpstreamProbeInterval:   &probeInterval,
+			UpstreamProbeBackoffMax: &probeBackoffMax,
+		},
+		Upstream: map[string]*ctrld.UpstreamConfig{"0": {}},
+	}
+	const upstream = "upstream.0"
+	um, advance := newTestUpstreamMonitor(cfg)
+	errFailed := errors.New("failed")
+
+	for range failures - 1 {
+		um.recordFailure(upstream, errFailed)
+	}
+	assert.False(t, um.isDown(upstream))
+	um.recordFailure(upstream, errFailed)
+	assert.True(t, um.isDown(upstream))
+	assert.Equal(t, "3 consecutive failures", um.stats()[0].Reason)
+
+	// Probe failures double the backoff, up to the max.
+	for _, backoff := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		advance(backoff - time.Millisecond)
+		assert.True(t, um.isDown(upstream))
+		advance(time.Millisecond)
+		assert.False(t, um.isDown(upstream))
+		assert.Equal(t, circuitHalfOpen.String(), um.stats()[0].State)
+		um.recordFailure(upstream, errFailed)
+		assert.True(t, um.isDown(upstream))
+		assert.Equal(t, "probe query failed", um.stats()[0].Reason)
+	}
+
+	// A successful probe closes the circuit, and resets the backoff.
+	advance(3 * time.Second)
+	um.recordSuccess(upstream, 10*time.Millisecond)
+	assert.False(t, um.isDown(upstream))
+	assert.Equal(t, circuitClosed.String(), um.stats()[0].State)
+	for range failures {
+		um.recordFailure(upstream, errFailed)
+	}
+	advance(time.Second)
+	assert.False(t, um.isDown(upstream))
+}
+
+func Test_upstreamMonitor_admitProbe(t *testing.T) {
+	probeInterval := time.Second
+	cfg := &ctrld.Config{
+		Service:  ctrld.ServiceConfig{UpstreamProbeInterval: &probeInterval},
+		Upstream: map[string]*ctrld.UpstreamConfig{"0": {}},
+	}
+	const upstream = "upstream.0"
+	um, advance := newTestUpstreamMonitor(cfg)
+
+	ok, probe := um.admit(upstream)
+	assert.True(t, ok)
+	assert.False(t, probe)
+
+	// Only one probe query is admitted while the circuit is half-open.
+	markUpstreamDown(um, upstream)
+	advance(probeInterval)
+	ok, probe = um.admit(upstream)
+	assert.True(t, ok)
+	assert.True(t, probe)
+	ok, _ = um.admit(upstream)
+	assert.False(t, ok)
+
+	// An unfinished probe, like a canceled query, allows the next probe.
+	um.probeDone(upstream)
+	ok, probe = um.admit(upstream)
+	assert.True(t, ok)
+	assert.True(t, probe)
+
+	// A failed probe opens the circuit again, the next probe is admitted after the backoff.
+	um.recordFailure(upstream, errors.New("failed"))
+	um.probeDone(upstream)
+	advance(2*probeInterval - time.Millisecond)
+	ok, _ = um.admit(upstream)
+	assert.True(t, ok)
+	assert.True(t, um.isDown(upstream))
+	advance(time.Millisecond)
+	ok, probe = um.admit(upstream)
+	assert.True(t, ok)
+	assert.True(t, probe)
+
+	// A successful probe closes the circuit, all queries are admitted.
+	um.recordSuccess(upstream, 10*time.Millisecond)
+	um.probeDone(upstream)
+	for range 2 {
+		ok, probe = um.admit(upstream)
+		assert.True(t, ok)
+		assert.False(t, probe)
+	}
+}
+
+func Test_upstreamMonitor_failureTime(t *testing.T) {
+	cfg := &ctrld.Config{Upstream: map[string]*ctrld.UpstreamConfig{"0": {}}}
+	const upstream = "upstream.0"
+	um, advance := newTestUpstreamMonitor(cfg)
+
+	um.recordFailure(upstream, context.DeadlineExceeded)
+	advance(maxFailureDuration - time.Millisecond)
+	assert.False(t, um.isDown(upstream))
+	advance(time.Millisecond)
+	assert.True(t, um.isDown(upstream))
+	assert.Equal(t, 1, um.countHealthy([]string{upstream, upstreamOS}))
+
+	um.reset(upstream)
+	assert.False(t, um.isDown(upstream))
+	// Failures right after the reset are in flight queries, they are ignored.
+	um.recordFailure(upstream, context.DeadlineExceeded)
+	assert.Zero(t, um.stats()[0].ConsecutiveFailures)
+}
+
+func Test_upstreamMonitor_stats(t *testing.T) {
+	cfg := &ctrld.Config{Upstream: map[string]*ctrld.UpstreamConfig{"0": {}}}
+	const upstream = "upstream.0"
+	um, _ := newTestUpstreamMonitor(cfg)
+
+	for i := 1; i <= 100; i++ {
+		um.recordSuccess(upstream, time.Duration(i)*time.Millisecond)
+	}
+	um.recordFailure(upstream, context.DeadlineExceeded)
+	um.recordFailure(upstream, errors.New("failed"))
+
+	stats := um.stats()
+	require.Len(t, stats, 2)
+	assert.Equal(t, upstreamOS, stats[1].Upstream)
+	s := stats[0]
+	assert.Equal(t, upstream, s.Upstream)
+	assert.Equal(t, circuitClosed.String(), s.State)
+	assert.Equal(t, uint64(102), s.Queries)
+	assert.Equal(t, uint64(2), s.Failures)
+	assert.Equal(t, uint64(1), s.Timeouts)
+	assert.Equal(t, 2, s.ConsecutiveFailures)
+	assert.Equal(t, "failed", s.LastError)
+	assert.InDelta(t, 2.0/102, s.ErrorRate, 1e-9)
+	assert.InDelta(t, 1.0/102, s.TimeoutRate, 1e-9)
+	assert.Equal(t, 50.0, s.RTTP50)
+	assert.Equal(t, 90.0, s.RTTP90)
+	assert.Equal(t, 99.0, s.RTTP99)
+
+	// Only the latest samples are used for rates and percentiles.
+	for range upstreamSamplesSize {
+		um.recordSuccess(upstream, time.Millisecond)
+	}
+	s = um.stats()[0]
+	assert.Zero(t, s.ErrorRate)
+	assert.Equal(t, 1.0, s.RTTP99)
+}
+
+func Test_upstreamErrorClass(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"no error", nil, "no_answer"},
+		{"deadline", context.DeadlineExceeded, "timeout"},
+		{"refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, "refused"},
+		{"network", &net.OpError{Op: "dial", Err: syscall.ENETUNREACH}, "network"},
+		{"tls", fmt.Errorf("handshake: %w", &tls.CertificateVerificationError{Err: errors.New("bad cert")}), "tls"},
+		{"other", errors.New("boom"), "other"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, upstreamErrorClass(tc.err))
+		})
+	}
+}
+
+func Test_upstreamMonitor_metrics(t *testing.T) {
+	um, _ := newTestUpstreamMonitor(&ctrld.Config{})
+	upstream := "upstream.metrics"
+	timeouts := testutil.ToFloat64(statsUpstreamErrors.WithLabelValues(upstream, "timeout"))
+	um.recordFailure(upstream, context.DeadlineExceeded)
+	assert.Equal(t, timeouts+1, testutil.ToFloat64(statsUpstreamErrors.WithLabelValues(upstream, "timeout")))
+
+	um.recordSuccess(upstream, 20*time.Millisecond)
+	var m dto.Metric
+	require.NoError(t, statsUpstreamRequestDuration.WithLabelValues(upstream).(prometheus.Metric).Write(&m))
+	assert.Equal(t, uint64(1), m.GetHistogram().GetSampleCount())
+
+	markUpstreamDown(um, upstream)
+	c := newUpstreamCollector(&prog{um: um})
+	assert.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP ctrld_upstream_down Whether upstream is marked as down, 1 is down, 0 is up.
+# TYPE ctrld_upstream_down gauge
+ctrld_upstream_down{upstream="upstream.metrics"} 1
+ctrld_upstream_down{upstream="upstream.os"} 0
+`), "ctrld_upstream_down"))
+}
@@ -0,0 +1,123 @@
+package cli
+
+import (
+	"math/rand"
+	"sort"
+	"sync/atomic"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// upstreamStrategy decides how the upstreams of a matched policy rule are used,
+// see ctrld.UpstreamStrategy* constants.
+type upstreamStrategy struct {
+	name      string
+	raceCount int
+	weights   map[string]int
+	// next is the round robin counter.
+	next atomic.Uint64
+	// intn returns a random number in [0, n), tests use it to control weighted strategy.
+	intn func(n int) int
+}
+
+// newUpstreamStrategy returns the upstreamStrategy of the given policy.
+func newUpstreamStrategy(policy *ctrld.ListenerPolicyConfig) *upstreamStrategy {
+	s := &upstreamStrategy{
+		name:      policy.Strategy,
+		raceCount: policy.RaceCount,
+		weights:   policy.Weights,
+		intn:      rand.Intn,
+	}
+	if s.name == "" {
+		s.name = ctrld.UpstreamStrategySequential
+	}
+	if s.raceCount == 0 {
+		s.raceCount = ctrld.DefaultRaceCount
+	}
+	return s
+}
+
+// upstreamStrategyFor returns the upstreamStrategy of the given policy, creating it on first use.
+func (p *prog) upstreamStrategyFor(policy *ctrld.ListenerPolicyConfig) *upstreamStrategy {
+	if s, ok := p.upstreamStrategies.Load(policy); ok {
+		return s.(*upstreamStrategy)
+	}
+	actual, _ := p.upstreamStrategies.LoadOrStore(policy, newUpstreamStrategy(policy))
+	return actual.(*upstreamStrategy)
+}
+
+// order returns the upstreams and their configs in the order they should be tried.
+//
+// Except for sequential strategy, which keeps the order defined in config, upstreams
+// marked as down by um are skipped, unless all of them are down.
+func (s *upstreamStrategy) order(um *upstreamMonitor, upstreams []string, configs []*ctrld.UpstreamConfig) ([]string, []*ctrld.UpstreamConfig) {
+	if s == nil || s.name == ctrld.UpstreamStrategySequential || len(upstreams) < 2 {
+		return upstreams, configs
+	}
+	indexes := make([]int, 0, len(upstreams))
+	for i, upstream := range upstreams {
+		if um == nil || !um.isDown(upstream) {
+			indexes = append(indexes, i)
+		}
+	}
+	if len(indexes) == 0 {
+		for i := range upstreams {
+			indexes = append(indexes, i)
+		}
+	}
+
+	switch s.name {
+	case ctrld.UpstreamStrategyRoundRobin:
+		first := int((s.next.Add(1) - 1) % uint64(len(indexes)))
+		indexes = append(indexes[first:], indexes[:first]...)
+	case ctrld.UpstreamStrategyWeighted:
+		first := s.pickWeighted(upstreams, indexes)
+		indexes[0], indexes[first] = indexes[first], indexes[0]
+	case ctrld.UpstreamStrategyLowestLatency:
+		if um != nil {
+			// Upstreams without any samples come first, so their RTT is measured.
+			sort.SliceStable(indexes, func(i, j int) bool {
+				return um.smoothedRTT(upstreams[indexes[i]]) < um.smoothedRTT(upstreams[indexes[j]])
+			})
+		}
+	}
+
+	orderedUpstreams := make([]string, len(indexes))
+	orderedConfigs := make([]*ctrld.UpstreamConfig, len(indexes))
+	for i, idx := range indexes {
+		orderedUpstreams[i] = upstreams[idx]
+		orderedConfigs[i] = configs[idx]
+	}
+	return orderedUpstreams, orderedConfigs
+}
+
+// pickWeighted returns the position in indexes of an upstream picked randomly, in proportion
+// to its weight. Upstreams without weight have the weight of 1.
+func (s *upstreamStrategy) pickWeighted(upstreams []string, indexes []int) int {
+	weight := func(upstream string) int {
+		if w, ok := s.weights[upstream]; ok {
+			return w
+		}
+		return 1
+	}
+	total := 0
+	for _, idx := range indexes {
+		total += weight(upstreams[idx])
+	}
+	n := s.intn(total)
+	for i, idx := range indexes {
+		if n -= weight(upstreams[idx]); n < 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+// raceSize returns the number of upstreams, among n upstreams, which the query is sent to concurrently.
+// A value less than 2 means the upstreams are tried one by one.
+func (s *upstreamStrategy) raceSize(n int) int {
+	if s == nil || s.name != ctrld.UpstreamStrategyRace {
+		return 1
+	}
+	return min(s.raceCount, n)
+}
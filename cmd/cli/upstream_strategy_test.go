@@ -0,0 +1,151 @@
+package cli
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_upstreamStrategy_order(t *testing.T) {
+	upstreams := []string{"upstream.0", "upstream.1", "upstream.2"}
+	configs := []*ctrld.UpstreamConfig{{Name: "0"}, {Name: "1"}, {Name: "2"}}
+	cfg := &ctrld.Config{Upstream: map[string]*ctrld.UpstreamConfig{"0": configs[0], "1": configs[1], "2": configs[2]}}
+
+	t.Run("sequential", func(t *testing.T) {
+		um := newUpstreamMonitor(cfg)
+		markUpstreamDown(um, "upstream.0")
+		s := newUpstreamStrategy(&ctrld.ListenerPolicyConfig{})
+		got, _ := s.order(um, upstreams, configs)
+		assert.Equal(t, upstreams, got)
+	})
+
+	t.Run("round robin", func(t *testing.T) {
+		s := newUpstreamStrategy(&ctrld.ListenerPolicyConfig{Strategy: ctrld.UpstreamStrategyRoundRobin})
+		um := newUpstreamMonitor(cfg)
+		for _, want := range [][]string{
+			{"upstream.0", "upstream.1", "upstream.2"},
+			{"upstream.1", "upstream.2", "upstream.0"},
+			{"upstream.2", "upstream.0", "upstream.1"},
+			{"upstream.0", "upstream.1", "upstream.2"},
+		} {
+			got, gotConfigs := s.order(um, upstreams, configs)
+			assert.Equal(t, want, got)
+			for i := range got {
+				assert.Equal(t, got[i], upstreamPrefix+gotConfigs[i].Name)
+			}
+		}
+	})
+
+	t.Run("weighted", func(t *testing.T) {
+		s := newUpstreamStrategy(&ctrld.ListenerPolicyConfig{
+			Strategy: ctrld.UpstreamStrategyWeighted,
+			Weights:  map[string]int{"upstream.0": 2, "upstream.2": 5},
+		})
+		um := newUpstreamMonitor(cfg)
+		for n, want := range map[int]string{0: "upstream.0", 1: "upstream.0", 2: "upstream.1", 3: "upstream.2", 7: "upstream.2"} {
+			s.intn = func(total int) int {
+				assert.Equal(t, 8, total)
+				return n
+			}
+			got, _ := s.order(um, upstreams, configs)
+			assert.Equal(t, want, got[0])
+			assert.ElementsMatch(t, upstreams, got)
+		}
+	})
+
+	t.Run("lowest latency", func(t *testing.T) {
+		s := newUpstreamStrategy(&ctrld.ListenerPolicyConfig{Strategy: ctrld.UpstreamStrategyLowestLatency})
+		um := newUpstreamMonitor(cfg)
+		um.recordSuccess("upstream.0", 100*time.Millisecond)
+		um.recordSuccess("upstream.1", 10*time.Millisecond)
+		got, _ := s.order(um, upstreams, configs)
+		assert.Equal(t, []string{"upstream.2", "upstream.1", "upstream.0"}, got)
+
+		um.recordSuccess("upstream.2", 50*time.Millisecond)
+		got, _ = s.order(um, upstreams, configs)
+		assert.Equal(t, []string{"upstream.1", "upstream.2", "upstream.0"}, got)
+	})
+
+	t.Run("skip down upstreams", func(t *testing.T) {
+		s := newUpstreamStrategy(&ctrld.ListenerPolicyConfig{Strategy: ctrld.UpstreamStrategyRace})
+		um := newUpstreamMonitor(cfg)
+		markUpstreamDown(um, "upstream.0")
+		got, _ := s.order(um, upstreams, configs)
+		assert.Equal(t, []string{"upstream.1", "upstream.2"}, got)
+
+		markUpstreamDown(um, "upstream.1")
+		markUpstreamDown(um, "upstream.2")
+		got, _ = s.order(um, upstreams, configs)
+		assert.Equal(t, upstreams, got)
+	})
+}
+
+func Test_prog_proxy_race(t *testing.T) {
+	slowAddr := runStrategyTestServer(t, 500*time.Millisecond, "10.0.0.1")
+	fastAddr := runStrategyTestServer(t, 0, "10.0.0.2")
+	cfg := &ctrld.Config{
+		Upstream: map[string]*ctrld.UpstreamConfig{
+			"0": {Name: "slow", Type: ctrld.ResolverTypeLegacy, Endpoint: slowAddr, Timeout: 5000},
+			"1": {Name: "fast", Type: ctrld.ResolverTypeLegacy, Endpoint: fastAddr, Timeout: 5000},
+		},
+	}
+	for _, uc := range cfg.Upstream {
+		uc.Init()
+	}
+	p := &prog{cfg: cfg}
+	p.um = newUpstreamMonitor(cfg)
+
+	policy := &ctrld.ListenerPolicyConfig{Name: "Race Policy", Strategy: ctrld.UpstreamStrategyRace}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	res := p.proxy(context.Background(), &proxyRequest{
+		msg: msg,
+		ufr: &upstreamForResult{
+			upstreams: []string{"upstream.0", "upstream.1"},
+			matched:   true,
+			strategy:  p.upstreamStrategyFor(policy),
+		},
+	})
+	require.NotNil(t, res.answer)
+	require.Len(t, res.answer.Answer, 1)
+	assert.Equal(t, "10.0.0.2", res.answer.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, fastAddr, res.upstream)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.NotZero(t, p.um.smoothedRTT("upstream.1"))
+}
+
+// runStrategyTestServer runs a local UDP DNS server, which answers A queries with ip after the given delay.
+func runStrategyTestServer(t *testing.T, delay time.Duration, ip string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var started sync.WaitGroup
+	started.Add(1)
+	server := &dns.Server{
+		PacketConn:        pc,
+		NotifyStartedFunc: started.Done,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, msg *dns.Msg) {
+			time.Sleep(delay)
+			m := new(dns.Msg)
+			m.SetReply(msg)
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(ip),
+			})
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	started.Wait()
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
@@ -15,6 +15,8 @@ import (
 	"net/netip"
 	"net/url"
 	"os"
+	"reflect"
+	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
@@ -26,6 +28,7 @@ import (
 	"github.com/ameshkov/dnsstamps"
 	"github.com/go-playground/validator/v10"
 	"github.com/miekg/dns"
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 	"golang.org/x/net/http2"
 	"golang.org/x/sync/singleflight"
@@ -83,6 +86,7 @@ const (
 	endpointPrefixQUIC  = "quic://"
 	endpointPrefixH3    = "h3://"
 	endpointPrefixSdns  = "sdns://"
+	endpointPrefixTCP   = "tcp://"
 )
 
 var (
@@ -121,11 +125,11 @@ func InitConfig(v *viper.Viper, name string) {
 			Policy: &ListenerPolicyConfig{
 				Name: "Main Policy",
 				Networks: []Rule{
-					{"network.0": []string{"upstream.0"}},
+					{"network.0": {Upstreams: []string{"upstream.0"}}},
 				},
 				Rules: []Rule{
-					{"example.com": []string{"upstream.0"}},
-					{"*.ads.com": []string{"upstream.1"}},
+					{"example.com": {Upstreams: []string{"upstream.0"}}},
+					{"*.ads.com": {Upstreams: []string{"upstream.1"}}},
 				},
 			},
 		},
@@ -156,10 +160,12 @@ func InitConfig(v *viper.Viper, name string) {
 
 // Config represents ctrld supported configuration.
 type Config struct {
-	Service  ServiceConfig              `mapstructure:"service" toml:"service,omitempty"`
-	Listener map[string]*ListenerConfig `mapstructure:"listener" toml:"listener" validate:"min=1,dive"`
-	Network  map[string]*NetworkConfig  `mapstructure:"network" toml:"network" validate:"min=1,dive"`
-	Upstream map[string]*UpstreamConfig `mapstructure:"upstream" toml:"upstream" validate:"min=1,dive"`
+	Service   ServiceConfig               `mapstructure:"service" toml:"service,omitempty"`
+	Listener  map[string]*ListenerConfig  `mapstructure:"listener" toml:"listener" validate:"min=1,dive"`
+	Network   map[string]*NetworkConfig   `mapstructure:"network" toml:"network" validate:"min=1,dive"`
+	Upstream  map[string]*UpstreamConfig  `mapstructure:"upstream" toml:"upstream" validate:"min=1,dive"`
+	Zone      map[string]*ZoneConfig      `mapstructure:"zone" toml:"zone,omitempty" validate:"dive"`
+	Blocklist map[string]*BlocklistConfig `mapstructure:"blocklist" toml:"blocklist,omitempty" validate:"dive"`
 }
 
 // HasUpstreamSendClientInfo reports whether the config has any upstream
@@ -174,6 +180,7 @@ func (c *Config) HasUpstreamSendClientInfo() bool {
 }
 
 // FirstListener returns the first listener config of current config. Listeners are sorted numerically.
+// Plain DNS listeners take precedence over encrypted ones, since only they can be used as OS nameserver.
 //
 // It panics if Config has no listeners configured.
 func (c *Config) FirstListener() *ListenerConfig {
@@ -189,6 +196,11 @@ func (c *Config) FirstListener() *ListenerConfig {
 		panic("missing listener config")
 	}
 	sort.Ints(listeners)
+	for _, n := range listeners {
+		if lc := c.Listener[strconv.Itoa(n)]; !lc.IsEncrypted() {
+			return lc
+		}
+	}
 	return c.Listener[strconv.Itoa(listeners[0])]
 }
 
@@ -218,7 +230,21 @@ type ServiceConfig struct {
 	CacheEnable             bool           `mapstructure:"cache_enable" toml:"cache_enable,omitempty"`
 	CacheSize               int            `mapstructure:"cache_size" toml:"cache_size,omitempty"`
 	CacheTTLOverride        int            `mapstructure:"cache_ttl_override" toml:"cache_ttl_override,omitempty"`
+	CacheMinTTL             int            `mapstructure:"cache_min_ttl" toml:"cache_min_ttl,omitempty" validate:"gte=0"`
+	CacheMaxTTL             int            `mapstructure:"cache_max_ttl" toml:"cache_max_ttl,omitempty" validate:"gte=0"`
+	CacheNegativeMinTTL     int            `mapstructure:"cache_negative_min_ttl" toml:"cache_negative_min_ttl,omitempty" validate:"gte=0"`
+	CacheNegativeMaxTTL     int            `mapstructure:"cache_negative_max_ttl" toml:"cache_negative_max_ttl,omitempty" validate:"gte=0"`
 	CacheServeStale         bool           `mapstructure:"cache_serve_stale" toml:"cache_serve_stale,omitempty"`
+	CacheStaleTTL           int            `mapstructure:"cache_stale_ttl" toml:"cache_stale_ttl,omitempty" validate:"gte=0"`
+	CacheMaxStale           int            `mapstructure:"cache_max_stale" toml:"cache_max_stale,omitempty" validate:"gte=0"`
+	CacheStaleAnswerTimeout int            `mapstructure:"cache_stale_answer_timeout" toml:"cache_stale_answer_timeout,omitempty" validate:"gte=0"`
+	CachePrefetch           bool           `mapstructure:"cache_prefetch" toml:"cache_prefetch,omitempty"`
+	CachePrefetchWindow     int            `mapstructure:"cache_prefetch_window" toml:"cache_prefetch_window,omitempty" validate:"gte=0"`
+	CachePrefetchHits       int            `mapstructure:"cache_prefetch_hits" toml:"cache_prefetch_hits,omitempty" validate:"gte=0"`
+	CachePersist            bool           `mapstructure:"cache_persist" toml:"cache_persist,omitempty"`
+	CachePersistInterval    int            `mapstructure:"cache_persist_interval" toml:"cache_persist_interval,omitempty" validate:"gte=0"`
+	CacheShards             int            `mapstructure:"cache_shards" toml:"cache_shards,omitempty" validate:"gte=0"`
+	CacheKeyScope           string         `mapstructure:"cache_key_scope" toml:"cache_key_scope,omitempty" validate:"omitempty,oneof=client_id mac network"`
 	CacheFlushDomains       []string       `mapstructure:"cache_flush_domains" toml:"cache_flush_domains" validate:"max=256"`
 	MaxConcurrentRequests   *int           `mapstructure:"max_concurrent_requests" toml:"max_concurrent_requests,omitempty" validate:"omitempty,gte=0"`
 	DHCPLeaseFile           string         `mapstructure:"dhcp_lease_file_path" toml:"dhcp_lease_file_path" validate:"omitempty,file"`
@@ -232,15 +258,136 @@ type ServiceConfig struct {
 	ClientIDPref            string         `mapstructure:"client_id_preference" toml:"client_id_preference,omitempty" validate:"omitempty,oneof=host mac"`
 	MetricsQueryStats       bool           `mapstructure:"metrics_query_stats" toml:"metrics_query_stats,omitempty"`
 	MetricsListener         string         `mapstructure:"metrics_listener" toml:"metrics_listener,omitempty"`
+	QueryLogFormat          string         `mapstructure:"query_log_format" toml:"query_log_format,omitempty" validate:"omitempty,oneof=json dnstap"`
+	QueryLogPath            string         `mapstructure:"query_log_path" toml:"query_log_path,omitempty"`
+	QueryLogSocket          string         `mapstructure:"query_log_socket" toml:"query_log_socket,omitempty"`
+	QueryLogMaxSize         int            `mapstructure:"query_log_max_size" toml:"query_log_max_size,omitempty" validate:"gte=0"`
+	QueryLogMaxBackups      int            `mapstructure:"query_log_max_backups" toml:"query_log_max_backups,omitempty" validate:"gte=0"`
+	QueryLogBufferSize      int            `mapstructure:"query_log_buffer_size" toml:"query_log_buffer_size,omitempty" validate:"gte=0"`
+	TopStats                bool           `mapstructure:"top_stats" toml:"top_stats,omitempty"`
+	TopStatsSize            int            `mapstructure:"top_stats_size" toml:"top_stats_size,omitempty" validate:"gte=0"`
+	OtelEndpoint            string         `mapstructure:"otel_endpoint" toml:"otel_endpoint,omitempty"`
+	OtelProtocol            string         `mapstructure:"otel_protocol" toml:"otel_protocol,omitempty" validate:"omitempty,oneof=grpc http"`
+	OtelInsecure            bool           `mapstructure:"otel_insecure" toml:"otel_insecure,omitempty"`
+	OtelHeaders             []string       `mapstructure:"otel_headers" toml:"otel_headers,omitempty"`
+	OtelTraceSampleRatio    *float64       `mapstructure:"otel_trace_sample_ratio" toml:"otel_trace_sample_ratio,omitempty" validate:"omitempty,gte=0,lte=1"`
+	OtelMetricsInterval     *time.Duration `mapstructure:"otel_metrics_interval" toml:"otel_metrics_interval,omitempty" validate:"omitempty,gt=0"`
 	DnsWatchdogEnabled      *bool          `mapstructure:"dns_watchdog_enabled" toml:"dns_watchdog_enabled,omitempty"`
 	DnsWatchdogInvterval    *time.Duration `mapstructure:"dns_watchdog_interval" toml:"dns_watchdog_interval,omitempty"`
 	RefetchTime             *int           `mapstructure:"refetch_time" toml:"refetch_time,omitempty"`
 	ForceRefetchWaitTime    *int           `mapstructure:"force_refetch_wait_time" toml:"force_refetch_wait_time,omitempty"`
 	LeakOnUpstreamFailure   *bool          `mapstructure:"leak_on_upstream_failure" toml:"leak_on_upstream_failure,omitempty"`
+	UpstreamFailures        *int           `mapstructure:"upstream_failures" toml:"upstream_failures,omitempty" validate:"omitempty,gt=0"`
+	UpstreamFailureTime     *time.Duration `mapstructure:"upstream_failure_time" toml:"upstream_failure_time,omitempty" validate:"omitempty,gt=0"`
+	UpstreamProbeInterval   *time.Duration `mapstructure:"upstream_probe_interval" toml:"upstream_probe_interval,omitempty" validate:"omitempty,gt=0"`
+	UpstreamProbeBackoffMax *time.Duration `mapstructure:"upstream_probe_backoff_max" toml:"upstream_probe_backoff_max,omitempty" validate:"omitempty,gt=0"`
 	Daemon                  bool           `mapstructure:"-" toml:"-"`
 	AllocateIP              bool           `mapstructure:"-" toml:"-"`
 }
 
+// ZoneConfig specifies a local zone that ctrld answers authoritatively.
+type ZoneConfig struct {
+	Name    string   `mapstructure:"name" toml:"name,omitempty" validate:"required"`
+	File    string   `mapstructure:"file" toml:"file,omitempty" validate:"omitempty,file"`
+	Records []string `mapstructure:"records" toml:"records,omitempty"`
+	TTL     int      `mapstructure:"ttl" toml:"ttl,omitempty" validate:"gte=0"`
+}
+
+const defaultZoneTTL = 300
+
+// zoneRecordTypes is the list of record types which can be defined in zone records.
+var zoneRecordTypes = map[uint16]bool{
+	dns.TypeA:     true,
+	dns.TypeAAAA:  true,
+	dns.TypeCNAME: true,
+	dns.TypeTXT:   true,
+	dns.TypeSRV:   true,
+	dns.TypeMX:    true,
+	dns.TypePTR:   true,
+}
+
+// Origin returns the zone origin, in canonical form.
+func (zc *ZoneConfig) Origin() string {
+	return dns.CanonicalName(zc.Name)
+}
+
+// ParseRecords parses the zone records, from both the zone file and records list.
+// Records names are relative to the zone name, the same as in RFC 1035 zone file.
+func (zc *ZoneConfig) ParseRecords() ([]dns.RR, error) {
+	origin := zc.Origin()
+	ttl := uint32(defaultZoneTTL)
+	if zc.TTL > 0 {
+		ttl = uint32(zc.TTL)
+	}
+	var rrs []dns.RR
+	parse := func(r io.Reader, file string, restrictTypes bool) error {
+		zp := dns.NewZoneParser(r, origin, file)
+		zp.SetDefaultTTL(ttl)
+		for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+			hdr := rr.Header()
+			if !dns.IsSubDomain(origin, hdr.Name) {
+				return fmt.Errorf("record %q is outside of zone %q", hdr.Name, origin)
+			}
+			if restrictTypes && !zoneRecordTypes[hdr.Rrtype] {
+				return fmt.Errorf("unsupported record type %s: %q", dns.TypeToString[hdr.Rrtype], rr.String())
+			}
+			rrs = append(rrs, rr)
+		}
+		return zp.Err()
+	}
+	if zc.File != "" {
+		f, err := os.Open(zc.File)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := parse(f, zc.File, false); err != nil {
+			return nil, err
+		}
+	}
+	if len(zc.Records) > 0 {
+		if err := parse(strings.NewReader(strings.Join(zc.Records, "\n")), "", true); err != nil {
+			return nil, err
+		}
+	}
+	return rrs, nil
+}
+
+// BlocklistConfig specifies a list of domains which ctrld blocks locally.
+type BlocklistConfig struct {
+	Name            string   `mapstructure:"name" toml:"name,omitempty"`
+	Sources         []string `mapstructure:"sources" toml:"sources,omitempty" validate:"min=1,dive,blocklist_source"`
+	RefreshInterval int      `mapstructure:"refresh_interval" toml:"refresh_interval,omitempty" validate:"gte=0"`
+	Response        string   `mapstructure:"response" toml:"response,omitempty" validate:"omitempty,blocklist_response"`
+}
+
+const (
+	BlocklistResponseNxdomain = "nxdomain"
+	BlocklistResponseNull     = "null"
+	BlocklistResponseRefused  = "refused"
+
+	defaultBlocklistRefreshInterval = 24 * time.Hour
+)
+
+// IsURLSource reports whether the blocklist source is an URL, otherwise, it's a file path.
+func IsURLSource(source string) bool {
+	return strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://")
+}
+
+// RefreshDuration returns the interval for refreshing blocklist sources.
+func (bc *BlocklistConfig) RefreshDuration() time.Duration {
+	if bc.RefreshInterval <= 0 {
+		return defaultBlocklistRefreshInterval
+	}
+	return time.Duration(bc.RefreshInterval) * time.Second
+}
+
+// ResponseIP returns the custom IP used to answer blocked queries, or nil if
+// the blocklist response is not a custom IP.
+func (bc *BlocklistConfig) ResponseIP() net.IP {
+	return net.ParseIP(bc.Response)
+}
+
 // NetworkConfig specifies configuration for networks where ctrld will handle requests.
 type NetworkConfig struct {
 	Name   string       `mapstructure:"name" toml:"name,omitempty"`
@@ -264,6 +411,20 @@ type UpstreamConfig struct {
 	// How to transmit client info to upstream. (e.g. default:Headers, Subdomain, Path)
 	ClientIdType string `mapstructure:"client_id_type" toml:"client_id_type,omitempty"`
 
+	// HTTP method for sending DoH/DoH3 requests, "get" or "post".
+	DohMethod string `mapstructure:"doh_method" toml:"doh_method,omitempty" validate:"omitempty,oneof=get post"`
+
+	// Validate DNSSEC signatures of answers from this upstream.
+	Dnssec bool `mapstructure:"dnssec" toml:"dnssec,omitempty"`
+
+	// How EDNS0 client subnet of queries is sent to this upstream: "strip", "forward", "truncate" or "synthesize".
+	// By default, public client subnets are forwarded, while private and loopback ones are stripped.
+	Ecs string `mapstructure:"ecs" toml:"ecs,omitempty" validate:"omitempty,oneof=strip forward truncate synthesize"`
+
+	// Prefix lengths of client subnets sent in "truncate" and "synthesize" ECS modes.
+	EcsPrefixV4 int `mapstructure:"ecs_prefix_v4" toml:"ecs_prefix_v4,omitempty" validate:"gte=0,lte=32"`
+	EcsPrefixV6 int `mapstructure:"ecs_prefix_v6" toml:"ecs_prefix_v6,omitempty" validate:"gte=0,lte=128"`
+
 	// The caller should not access this field directly.
 	// Use IsDiscoverable instead.
 	Discoverable *bool `mapstructure:"discoverable" toml:"discoverable"`
@@ -280,6 +441,11 @@ type UpstreamConfig struct {
 	http3RoundTripper  http.RoundTripper
 	http3RoundTripper4 http.RoundTripper
 	http3RoundTripper6 http.RoundTripper
+	doqPool            *doqPool
+	doqPoolOnce        sync.Once
+	connPool           *dnsConnPool
+	connPoolOnce       sync.Once
+	legacyTCP          bool
 	certPool           *x509.CertPool
 	u                  *url.URL
 	fallbackOnce       sync.Once
@@ -292,7 +458,24 @@ type ListenerConfig struct {
 	Port            int                   `mapstructure:"port" toml:"port,omitempty" validate:"gte=0"`
 	Restricted      bool                  `mapstructure:"restricted" toml:"restricted,omitempty"`
 	AllowWanClients bool                  `mapstructure:"allow_wan_clients" toml:"allow_wan_clients,omitempty"`
+	Protocol        string                `mapstructure:"protocol" toml:"protocol,omitempty" validate:"omitempty,oneof=dns doh doh3 dot doq"`
+	CertFile        string                `mapstructure:"cert_file" toml:"cert_file,omitempty" validate:"required_with=KeyFile,omitempty,file"`
+	KeyFile         string                `mapstructure:"key_file" toml:"key_file,omitempty" validate:"required_with=CertFile,omitempty,file"`
 	Policy          *ListenerPolicyConfig `mapstructure:"policy" toml:"policy,omitempty"`
+	Dnssec          bool                  `mapstructure:"dnssec" toml:"dnssec,omitempty"`
+}
+
+// IsEncrypted reports whether the listener serves encrypted DNS protocol,
+// i.e: DoH, DoH3, DoT or DoQ, instead of plain DNS over UDP and TCP.
+func (lc *ListenerConfig) IsEncrypted() bool {
+	if lc == nil {
+		return false
+	}
+	switch lc.Protocol {
+	case ResolverTypeDOH, ResolverTypeDOH3, ResolverTypeDOT, ResolverTypeDOQ:
+		return true
+	}
+	return false
 }
 
 // IsDirectDnsListener reports whether ctrld can be a direct listener on port 53.
@@ -302,7 +485,7 @@ type ListenerConfig struct {
 // If someone listening on port 53, or ctrld could only listen on port 53 for a specific
 // interface, ctrld could only be configured as a DNS forwarder.
 func (lc *ListenerConfig) IsDirectDnsListener() bool {
-	if lc == nil || lc.Port != 53 {
+	if lc == nil || lc.Port != 53 || lc.IsEncrypted() {
 		return false
 	}
 	switch lc.IP {
@@ -316,17 +499,221 @@ func (lc *ListenerConfig) IsDirectDnsListener() bool {
 // ListenerPolicyConfig specifies the policy rules for ctrld to filter incoming requests.
 type ListenerPolicyConfig struct {
 	Name                 string   `mapstructure:"name" toml:"name,omitempty"`
-	Networks             []Rule   `mapstructure:"networks" toml:"networks,omitempty,inline,multiline" validate:"dive,len=1"`
-	Rules                []Rule   `mapstructure:"rules" toml:"rules,omitempty,inline,multiline" validate:"dive,len=1"`
-	Macs                 []Rule   `mapstructure:"macs" toml:"macs,omitempty,inline,multiline" validate:"dive,len=1"`
+	Networks             []Rule   `mapstructure:"networks" toml:"networks,omitempty,inline,multiline" validate:"dive,len=1,dive"`
+	Rules                []Rule   `mapstructure:"rules" toml:"rules,omitempty,inline,multiline" validate:"dive,len=1,dive,keys,rule_pattern,endkeys,required"`
+	Macs                 []Rule   `mapstructure:"macs" toml:"macs,omitempty,inline,multiline" validate:"dive,len=1,dive,keys,rule_pattern,endkeys,required"`
 	FailoverRcodes       []string `mapstructure:"failover_rcodes" toml:"failover_rcodes,omitempty" validate:"dive,dnsrcode"`
 	FailoverRcodeNumbers []int    `mapstructure:"-" toml:"-"`
+	// Schedules are the named schedules, which could be referenced by the policy rules.
+	Schedules map[string]*ScheduleConfig `mapstructure:"schedules" toml:"schedules,omitempty" validate:"dive"`
+	// Strategy is how the upstreams of a matched rule are used, see UpstreamStrategy* constants.
+	Strategy  string         `mapstructure:"strategy" toml:"strategy,omitempty" validate:"omitempty,oneof=sequential race round_robin weighted lowest_latency"`
+	RaceCount int            `mapstructure:"race_count" toml:"race_count,omitempty" validate:"gte=0"`
+	Weights   map[string]int `mapstructure:"weights" toml:"weights,omitempty" validate:"dive,keys,startswith=upstream.,endkeys,gt=0"`
+}
+
+const (
+	// UpstreamStrategySequential tries upstreams in order, the next one is used on failure, or failover rcodes.
+	UpstreamStrategySequential = "sequential"
+	// UpstreamStrategyRace sends the query to the first RaceCount upstreams, and uses the first good answer.
+	UpstreamStrategyRace = "race"
+	// UpstreamStrategyRoundRobin rotates the first upstream between queries.
+	UpstreamStrategyRoundRobin = "round_robin"
+	// UpstreamStrategyWeighted picks the first upstream randomly, using Weights.
+	UpstreamStrategyWeighted = "weighted"
+	// UpstreamStrategyLowestLatency tries upstreams in order of their round trip time.
+	UpstreamStrategyLowestLatency = "lowest_latency"
+
+	// DefaultRaceCount is the number of upstreams raced if RaceCount is not set.
+	DefaultRaceCount = 2
+)
+
+// ScheduleConfig specifies the weekdays and time ranges when the policy rules referencing it apply.
+//
+//	[listener.0.policy.schedules.night]
+//	days = ["mon-fri"]
+//	times = ["21:00-07:00"]
+//	timezone = "America/New_York"
+type ScheduleConfig struct {
+	Days     []string `mapstructure:"days" toml:"days,omitempty"`
+	Times    []string `mapstructure:"times" toml:"times,omitempty"`
+	Timezone string   `mapstructure:"timezone" toml:"timezone,omitempty"`
 }
 
-// Rule is a map from source to list of upstreams.
+// Rule is a map from source to rule target.
 // ctrld uses rule to perform requests matching and forward
 // the request to corresponding upstreams if it's matched.
-type Rule map[string][]string
+type Rule map[string]RuleTarget
+
+// RuleTarget specifies the upstreams of a rule, the query types and the schedule which the rule applies to.
+// In config, it's either the list of upstreams, or a table with "types", "schedule" and "upstreams" keys:
+//
+//	{"example.com" = ["upstream.1"]}
+//	{"example.com" = {types = ["AAAA"], upstreams = ["upstream.2"]}}
+//	{"network.1" = {schedule = "night", upstreams = ["upstream.2"]}}
+type RuleTarget struct {
+	Types     []string `mapstructure:"types" toml:"types,omitempty" validate:"dive,dnsqtype"`
+	Schedule  string   `mapstructure:"schedule" toml:"schedule,omitempty"`
+	Upstreams []string `mapstructure:"upstreams" toml:"upstreams"`
+}
+
+// Qtypes returns the DNS query types of the rule target. If empty, the rule applies to all query types.
+func (rt RuleTarget) Qtypes() []uint16 {
+	qtypes := make([]uint16, 0, len(rt.Types))
+	for _, typ := range rt.Types {
+		if qtype, ok := dns.StringToType[strings.ToUpper(typ)]; ok {
+			qtypes = append(qtypes, qtype)
+		}
+	}
+	return qtypes
+}
+
+var ruleTargetType = reflect.TypeOf(RuleTarget{})
+
+// ruleTargetDecodeHook decodes a list of upstreams to RuleTarget, so rules
+// could be written using the short form.
+func ruleTargetDecodeHook(from, to reflect.Type, data any) (any, error) {
+	if to != ruleTargetType {
+		return data, nil
+	}
+	switch from.Kind() {
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"upstreams": data}, nil
+	}
+	return data, nil
+}
+
+// DecodeHook returns the viper decoder option for decoding ctrld config.
+// It must be used when unmarshalling config from viper.
+func DecodeHook() viper.DecoderConfigOption {
+	return viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		// The viper default hooks.
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		ruleTargetDecodeHook,
+	))
+}
+
+// TOMLValue returns the value of rt to be encoded in TOML. It's the list of upstreams
+// if rt has no types and schedule, so rules are written using the short form.
+func (rt RuleTarget) TOMLValue() any {
+	if len(rt.Types) == 0 && rt.Schedule == "" {
+		return rt.Upstreams
+	}
+	return rt
+}
+
+// TOMLValue returns the value of c to be encoded in TOML, where rule targets are
+// replaced by their RuleTarget.TOMLValue. go-toml does not support custom marshalers,
+// so the structs containing rule targets are copied to equivalent structs, with the
+// same fields and tags, but rule targets typed as any.
+func (c *Config) TOMLValue() any {
+	return tomlValue(reflect.ValueOf(c)).Interface()
+}
+
+var anyType = reflect.TypeOf((*any)(nil)).Elem()
+
+// tomlType returns the type used to encode values of type t, see Config.TOMLValue.
+func tomlType(t reflect.Type) reflect.Type {
+	switch t.Kind() {
+	case reflect.Pointer:
+		if elem := tomlType(t.Elem()); elem != t.Elem() {
+			return reflect.PointerTo(elem)
+		}
+	case reflect.Slice:
+		if elem := tomlType(t.Elem()); elem != t.Elem() {
+			return reflect.SliceOf(elem)
+		}
+	case reflect.Map:
+		if elem := tomlType(t.Elem()); elem != t.Elem() {
+			return reflect.MapOf(t.Key(), elem)
+		}
+	case reflect.Struct:
+		if t == ruleTargetType {
+			return anyType
+		}
+		fields := make([]reflect.StructField, t.NumField())
+		changed := false
+		for i := range fields {
+			f := t.Field(i)
+			// Structs with unexported fields could not be copied.
+			if !f.IsExported() {
+				return t
+			}
+			if ft := tomlType(f.Type); ft != f.Type {
+				f.Type = ft
+				changed = true
+			}
+			fields[i] = f
+		}
+		if changed {
+			return reflect.StructOf(fields)
+		}
+	}
+	return t
+}
+
+// tomlValue returns v converted to its tomlType.
+func tomlValue(v reflect.Value) reflect.Value {
+	t := tomlType(v.Type())
+	if t == v.Type() {
+		return v
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return reflect.Zero(t)
+		}
+		out := reflect.New(t.Elem())
+		out.Elem().Set(tomlValue(v.Elem()))
+		return out
+	case reflect.Slice:
+		if v.IsNil() {
+			return reflect.Zero(t)
+		}
+		out := reflect.MakeSlice(t, v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(tomlValue(v.Index(i)))
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return reflect.Zero(t)
+		}
+		out := reflect.MakeMapWithSize(t, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out.SetMapIndex(iter.Key(), tomlValue(iter.Value()))
+		}
+		return out
+	case reflect.Struct:
+		if v.Type() == ruleTargetType {
+			return reflect.ValueOf(v.Interface().(RuleTarget).TOMLValue())
+		}
+		out := reflect.New(t).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			out.Field(i).Set(tomlValue(v.Field(i)))
+		}
+		return out
+	}
+	return v
+}
+
+// RuleRegexPrefix is the prefix of rule sources which are regular expressions.
+const RuleRegexPrefix = "regex:"
+
+// RuleRegex returns the compiled regular expression of rule source. The returned
+// regexp is nil if source is not a regular expression, see RuleRegexPrefix.
+func RuleRegex(source string) (*regexp.Regexp, error) {
+	expr, ok := strings.CutPrefix(source, RuleRegexPrefix)
+	if !ok {
+		return nil, nil
+	}
+	if expr == "" {
+		return nil, errors.New("empty regular expression")
+	}
+	return regexp.Compile(expr)
+}
 
 // Init initialized necessary values for an UpstreamConfig.
 func (uc *UpstreamConfig) Init() {
@@ -334,6 +721,7 @@ func (uc *UpstreamConfig) Init() {
 		ProxyLogger.Load().Fatal().Err(err).Msg("invalid DNS Stamps")
 	}
 	uc.initDoHScheme()
+	uc.initLegacyNetwork()
 	uc.uid = upstreamUID()
 	if u, err := url.Parse(uc.Endpoint); err == nil {
 		uc.Domain = u.Hostname()
@@ -730,6 +1118,18 @@ func (uc *UpstreamConfig) netForDNSType(dnsType uint16) (string, string) {
 	return "tcp-tls", "udp"
 }
 
+// initLegacyNetwork strips the "tcp://" prefix from legacy upstream endpoint,
+// recording that queries must be sent over TCP instead of UDP.
+func (uc *UpstreamConfig) initLegacyNetwork() {
+	if uc.Type != ResolverTypeLegacy {
+		return
+	}
+	if after, found := strings.CutPrefix(uc.Endpoint, endpointPrefixTCP); found {
+		uc.Endpoint = after
+		uc.legacyTCP = true
+	}
+}
+
 // initDoHScheme initializes the endpoint scheme for DoH/DoH3 upstream if not present.
 func (uc *UpstreamConfig) initDoHScheme() {
 	if strings.HasPrefix(uc.Endpoint, endpointPrefixH3) && uc.Type == "" {
@@ -843,7 +1243,14 @@ func ValidateConfig(validate *validator.Validate, cfg *Config) error {
 	_ = validate.RegisterValidation("dnsrcode", validateDnsRcode)
 	_ = validate.RegisterValidation("ipstack", validateIpStack)
 	_ = validate.RegisterValidation("iporempty", validateIpOrEmpty)
+	_ = validate.RegisterValidation("rule_pattern", validateRulePattern)
+	_ = validate.RegisterValidation("dnsqtype", validateDnsQtype)
+	_ = validate.RegisterValidation("blocklist_source", validateBlocklistSource)
+	_ = validate.RegisterValidation("blocklist_response", validateBlocklistResponse)
 	validate.RegisterStructValidation(upstreamConfigStructLevelValidation, UpstreamConfig{})
+	validate.RegisterStructValidation(zoneConfigStructLevelValidation, ZoneConfig{})
+	validate.RegisterStructValidation(listenerPolicyConfigStructLevelValidation, ListenerPolicyConfig{})
+	validate.RegisterStructValidation(scheduleConfigStructLevelValidation, ScheduleConfig{})
 	return validate.Struct(cfg)
 }
 
@@ -851,6 +1258,11 @@ func validateDnsRcode(fl validator.FieldLevel) bool {
 	return dnsrcode.FromString(fl.Field().String()) != -1
 }
 
+func validateDnsQtype(fl validator.FieldLevel) bool {
+	_, ok := dns.StringToType[strings.ToUpper(fl.Field().String())]
+	return ok
+}
+
 func validateIpStack(fl validator.FieldLevel) bool {
 	switch fl.Field().String() {
 	case IpStackBoth, IpStackV4, IpStackV6, IpStackSplit, "":
@@ -868,6 +1280,82 @@ func validateIpOrEmpty(fl validator.FieldLevel) bool {
 	return net.ParseIP(val) != nil
 }
 
+// validateRulePattern validates the source of domain or mac rule. A regular expression must
+// be compilable, a pattern with multiple "*" is matched label by label, so it must not have
+// empty labels.
+func validateRulePattern(fl validator.FieldLevel) bool {
+	source := fl.Field().String()
+	if re, err := RuleRegex(source); re != nil || err != nil {
+		return err == nil
+	}
+	if strings.Count(source, "*") > 1 {
+		for _, label := range strings.Split(strings.TrimSuffix(source, "."), ".") {
+			if label == "" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func validateBlocklistSource(fl validator.FieldLevel) bool {
+	source := fl.Field().String()
+	if IsURLSource(source) {
+		u, err := url.Parse(source)
+		return err == nil && u.Host != ""
+	}
+	_, err := os.Stat(source)
+	return err == nil
+}
+
+func validateBlocklistResponse(fl validator.FieldLevel) bool {
+	switch val := fl.Field().String(); val {
+	case BlocklistResponseNxdomain, BlocklistResponseNull, BlocklistResponseRefused:
+		return true
+	default:
+		return net.ParseIP(val) != nil
+	}
+}
+
+func zoneConfigStructLevelValidation(sl validator.StructLevel) {
+	zc := sl.Current().Addr().Interface().(*ZoneConfig)
+	if _, ok := dns.IsDomainName(zc.Name); !ok {
+		sl.ReportError(zc.Name, "name", "Name", "fqdn", "")
+		return
+	}
+	if zc.File == "" && len(zc.Records) == 0 {
+		sl.ReportError(zc.Records, "records", "Records", "required_without", "File")
+		return
+	}
+	if _, err := zc.ParseRecords(); err != nil {
+		sl.ReportError(zc.Records, "records", "Records", "dns_record", err.Error())
+	}
+}
+
+func listenerPolicyConfigStructLevelValidation(sl validator.StructLevel) {
+	lpc := sl.Current().Addr().Interface().(*ListenerPolicyConfig)
+	for _, rules := range [][]Rule{lpc.Networks, lpc.Rules, lpc.Macs} {
+		for _, rule := range rules {
+			for _, target := range rule {
+				if target.Schedule == "" {
+					continue
+				}
+				if _, ok := lpc.Schedules[target.Schedule]; !ok {
+					sl.ReportError(target.Schedule, "schedule", "Schedule", "schedule", target.Schedule)
+					return
+				}
+			}
+		}
+	}
+}
+
+func scheduleConfigStructLevelValidation(sl validator.StructLevel) {
+	sc := sl.Current().Addr().Interface().(*ScheduleConfig)
+	if _, err := sc.Parse(); err != nil {
+		sl.ReportError(sc, "schedule", "Schedule", "schedule", err.Error())
+	}
+}
+
 func upstreamConfigStructLevelValidation(sl validator.StructLevel) {
 	uc := sl.Current().Addr().Interface().(*UpstreamConfig)
 	if uc.Type == ResolverTypeOS {
@@ -924,6 +1412,7 @@ func defaultPortFor(typ string) string {
 // using following rules:
 //
 // - If endpoint is an IP address ->  ResolverTypeLegacy
+// - If endpoint starts with "tcp://" -> ResolverTypeLegacy
 // - If endpoint starts with "https://" -> ResolverTypeDOH
 // - If endpoint starts with "quic://" -> ResolverTypeDOQ
 // - If endpoint starts with "h3://" -> ResolverTypeDOH3
@@ -939,6 +1428,8 @@ func ResolverTypeFromEndpoint(endpoint string) string {
 		return ResolverTypeDOH3
 	case strings.HasPrefix(endpoint, endpointPrefixSdns):
 		return ResolverTypeSDNS
+	case strings.HasPrefix(endpoint, endpointPrefixTCP):
+		return ResolverTypeLegacy
 	}
 	host := endpoint
 	if strings.Contains(endpoint, ":") {
@@ -1,6 +1,7 @@
 package ctrld_test
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"strings"
@@ -8,6 +9,8 @@ import (
 	"time"
 
 	"github.com/go-playground/validator/v10"
+	"github.com/miekg/dns"
+	"github.com/pelletier/go-toml/v2"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -75,7 +78,7 @@ func TestConfigOverride(t *testing.T) {
 	cfg := ctrld.Config{Listener: map[string]*ctrld.ListenerConfig{
 		"0": {IP: "127.0.0.1", Port: 53},
 	}}
-	require.NoError(t, v.Unmarshal(&cfg))
+	require.NoError(t, v.Unmarshal(&cfg, ctrld.DecodeHook()))
 
 	assert.Equal(t, "10.10.42.69", cfg.Listener["1"].IP)
 	assert.Equal(t, 1337, cfg.Listener["1"].Port)
@@ -112,6 +115,36 @@ func TestConfigValidation(t *testing.T) {
 		{"sdns endpoint without type", sdnsUpstreamEndpointWithoutType(t), false},
 		{"maximum number of flush cache domains", configWithInvalidFlushCacheDomain(t), true},
 		{"kea dhcp4 format", configWithDhcp4KeaFormat(t), false},
+		{"invalid doh method", configWithInvalidDohMethod(t), true},
+		{"encrypted listener", configWithEncryptedListener(t), false},
+		{"invalid listener protocol", configWithInvalidListenerProtocol(t), true},
+		{"listener cert file without key file", configWithListenerCertFileOnly(t), true},
+		{"local zone", configWithZone(t), false},
+		{"local zone without records", configWithEmptyZone(t), true},
+		{"local zone invalid record", configWithInvalidZoneRecord(t), true},
+		{"local zone unsupported record type", configWithUnsupportedZoneRecordType(t), true},
+		{"local zone record outside zone", configWithOutOfZoneRecord(t), true},
+		{"blocklist", configWithBlocklist(t), false},
+		{"blocklist without sources", configWithEmptyBlocklist(t), true},
+		{"blocklist non-existed file", configWithNonExistedBlocklistFile(t), true},
+		{"blocklist invalid response", configWithInvalidBlocklistResponse(t), true},
+		{"regex and multiple wildcards rules", configWithPatternRules(t), false},
+		{"invalid regex rule", configWithInvalidRegexRule(t), true},
+		{"invalid multiple wildcards rule", configWithInvalidMultiWildcardRule(t), true},
+		{"invalid regex mac rule", configWithInvalidRegexMacRule(t), true},
+		{"query types rules", configWithQtypeRules(t), false},
+		{"invalid query type rule", configWithInvalidQtypeRule(t), true},
+		{"scheduled rules", configWithScheduledRules(t), false},
+		{"rule with undefined schedule", configWithUndefinedScheduleRule(t), true},
+		{"invalid schedule", configWithInvalidSchedule(t), true},
+		{"weighted strategy", configWithWeightedStrategy(t), false},
+		{"invalid strategy", configWithInvalidStrategy(t), true},
+		{"invalid strategy weight", configWithInvalidStrategyWeight(t), true},
+		{"otel", configWithOtel(t), false},
+		{"invalid top stats size", configWithInvalidTopStatsSize(t), true},
+		{"invalid otel protocol", configWithInvalidOtelProtocol(t), true},
+		{"invalid otel trace sample ratio", configWithInvalidOtelTraceSampleRatio(t), true},
+		{"invalid otel metrics interval", configWithInvalidOtelMetricsInterval(t), true},
 	}
 
 	for _, tc := range tests {
@@ -160,7 +193,7 @@ discover_ptr = false
 `
 	require.NoError(t, v.ReadConfig(strings.NewReader(configStr)))
 	cfg := ctrld.Config{}
-	require.NoError(t, v.Unmarshal(&cfg))
+	require.NoError(t, v.Unmarshal(&cfg, ctrld.DecodeHook()))
 
 	require.False(t, *cfg.Service.DiscoverARP)
 	require.False(t, *cfg.Service.DiscoverDHCP)
@@ -169,6 +202,55 @@ discover_ptr = false
 	require.False(t, *cfg.Service.DiscoverPtr)
 }
 
+func TestConfigRuleTargets(t *testing.T) {
+	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+	ctrld.InitConfig(v, "test_config_rule_targets")
+	v.SetConfigType("toml")
+	configStr := `
+[listener.0.policy]
+name = "Query Types Policy"
+rules = [
+    {"example.com" = ["upstream.1"]},
+    {"example.net" = {types = ["AAAA", "HTTPS"], upstreams = ["upstream.2"]}},
+]
+`
+	require.NoError(t, v.ReadConfig(strings.NewReader(configStr)))
+	cfg := ctrld.Config{}
+	require.NoError(t, v.Unmarshal(&cfg, ctrld.DecodeHook()))
+
+	rules := cfg.Listener["0"].Policy.Rules
+	require.Len(t, rules, 2)
+	assert.Equal(t, ctrld.RuleTarget{Upstreams: []string{"upstream.1"}}, rules[0]["example.com"])
+	assert.Equal(t, ctrld.RuleTarget{Types: []string{"AAAA", "HTTPS"}, Upstreams: []string{"upstream.2"}}, rules[1]["example.net"])
+	assert.Equal(t, []uint16{dns.TypeAAAA, dns.TypeHTTPS}, rules[1]["example.net"].Qtypes())
+}
+
+func TestConfigTOMLValue(t *testing.T) {
+	cfg := testhelper.SampleConfig(t)
+	cfg.Listener["0"].Policy.Rules = append(cfg.Listener["0"].Policy.Rules, ctrld.Rule{
+		"example.net": {Types: []string{"AAAA"}, Upstreams: []string{"upstream.2"}},
+	})
+
+	var buf bytes.Buffer
+	require.NoError(t, toml.NewEncoder(&buf).SetIndentTables(true).Encode(cfg.TOMLValue()))
+	encoded := buf.String()
+	// Rule targets without types and schedule are written using the short form.
+	assert.Regexp(t, `'network\.0' = \['upstream\.1', 'upstream\.0'\]`, encoded)
+	assert.Regexp(t, `'\*\.local\.host' = \['upstream\.2', 'upstream\.0'\]`, encoded)
+	assert.Regexp(t, `'14:45:a0:67:83:0a' = \['upstream\.2'\]`, encoded)
+	assert.Regexp(t, `'example\.net' = \{\s*types = \['AAAA'\],\s*upstreams = \['upstream\.2'\]\}`, encoded)
+
+	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+	ctrld.InitConfig(v, "test_config_toml_value")
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(strings.NewReader(encoded)))
+	var decoded ctrld.Config
+	require.NoError(t, v.Unmarshal(&decoded, ctrld.DecodeHook()))
+	assert.Equal(t, cfg.Listener, decoded.Listener)
+	assert.Equal(t, cfg.Network, decoded.Network)
+	assert.Equal(t, cfg.Upstream, decoded.Upstream)
+}
+
 func defaultConfig(t *testing.T) *ctrld.Config {
 	v := viper.New()
 	ctrld.InitConfig(v, "test_load_default_config")
@@ -176,7 +258,7 @@ func defaultConfig(t *testing.T) *ctrld.Config {
 	require.True(t, ok)
 
 	var cfg ctrld.Config
-	require.NoError(t, v.Unmarshal(&cfg))
+	require.NoError(t, v.Unmarshal(&cfg, ctrld.DecodeHook()))
 	return &cfg
 }
 
@@ -263,7 +345,7 @@ func configWithInvalidRules(t *testing.T) *ctrld.Config {
 	cfg := defaultConfig(t)
 	cfg.Listener["0"].Policy = &ctrld.ListenerPolicyConfig{
 		Name:     "Invalid Policy",
-		Networks: []ctrld.Rule{{"*.com": []string{"upstream.1"}, "*.net": []string{"upstream.0"}}},
+		Networks: []ctrld.Rule{{"*.com": {Upstreams: []string{"upstream.1"}}, "*.net": {Upstreams: []string{"upstream.0"}}}},
 		Rules:    nil,
 	}
 	return cfg
@@ -273,7 +355,7 @@ func configWithInvalidRcodes(t *testing.T) *ctrld.Config {
 	cfg := defaultConfig(t)
 	cfg.Listener["0"].Policy = &ctrld.ListenerPolicyConfig{
 		Name:           "Policy with invalid Rcodes",
-		Networks:       []ctrld.Rule{{"*.com": []string{"upstream.0"}}},
+		Networks:       []ctrld.Rule{{"*.com": {Upstreams: []string{"upstream.0"}}}},
 		FailoverRcodes: []string{"foo"},
 	}
 	return cfg
@@ -335,3 +417,222 @@ func configWithInvalidFlushCacheDomain(t *testing.T) *ctrld.Config {
 	}
 	return cfg
 }
+
+func configWithInvalidDohMethod(t *testing.T) *ctrld.Config {
+	cfg := defaultConfig(t)
+	cfg.Upstream["0"].DohMethod = "put"
+	return cfg
+}
+
+func configWithEncryptedListener(t *testing.T) *ctrld.Config {
+	cfg := defaultConfig(t)
+	cfg.Listener["0"].Protocol = ctrld.ResolverTypeDOT
+	return cfg
+}
+
+func configWithInvalidListenerProtocol(t *testing.T) *ctrld.Config {
+	cfg := defaultConfig(t)
+	cfg.Listener["0"].Protocol = "dnscrypt"
+	return cfg
+}
+
+func configWithListenerCertFileOnly(t *testing.T) *ctrld.Config {
+	cfg := defaultConfig(t)
+	cfg.Listener["0"].Protocol = ctrld.ResolverTypeDOH
+	cfg.Listener["0"].CertFile = "/etc/hosts"
+	return cfg
+}
+
+func configWithZone(t *testing.T) *ctrld.Config {
+	cfg := defaultConfig(t)
+	cfg.Zone = map[string]*ctrld.ZoneConfig{
+		"0": {Name: "home.lan", Records: []string{"nas A 192.168.1.10", "www CNAME nas", "@ MX 10 nas"}},
+	}
+	return cfg
+}
+
+func configWithEmptyZone(t *testing.T) *ctrld.Config {
+	cfg := defaultConfig(t)
+	cfg.Zone = map[string]*ctrld.ZoneConfig{"0": {Name: "home.lan"}}
+	return cfg
+}
+
+func configWithInvalidZoneRecord(t *testing.T) *ctrld.Config {
+	cfg := configWithZone(t)
+	cfg.Zone["0"].Records = []string{"nas A 192.168.1"}
+	return cfg
+}
+
+func configWithUnsupportedZoneRecordType(t *testing.T) *ctrld.Config {
+	cfg := configWithZone(t)
+	cfg.Zone["0"].Records = []string{"@ NS ns1.example.com."}
+	return cfg
+}
+
+func configWithOutOfZoneRecord(t *testing.T) *ctrld.Config {
+	cfg := configWithZone(t)
+	cfg.Zone["0"].Records = []string{"nas.example.com. A 192.168.1.10"}
+	return cfg
+}
+
+func configWithBlocklist(t *testing.T) *ctrld.Config {
+	cfg := defaultConfig(t)
+	cfg.Blocklist = map[string]*ctrld.BlocklistConfig{
+		"0": {Sources: []string{"/etc/hosts", "https://example.com/hosts.txt"}, Response: "192.168.1.1"},
+		"1": {Sources: []string{"/etc/hosts"}, Response: ctrld.BlocklistResponseNull},
+	}
+	return cfg
+}
+
+func configWithEmptyBlocklist(t *testing.T) *ctrld.Config {
+	cfg := defaultConfig(t)
+	cfg.Blocklist = map[string]*ctrld.BlocklistConfig{"0": {}}
+	return cfg
+}
+
+func configWithNonExistedBlocklistFile(t *testing.T) *ctrld.Config {
+	cfg := configWithBlocklist(t)
+	cfg.Blocklist["0"].Sources = []string{"/path/to/non/existed/file"}
+	return cfg
+}
+
+func configWithInvalidBlocklistResponse(t *testing.T) *ctrld.Config {
+	cfg := configWithBlocklist(t)
+	cfg.Blocklist["0"].Response = "servfail"
+	return cfg
+}
+
+func configWithPatternRules(t *testing.T) *ctrld.Config {
+	cfg := defaultConfig(t)
+	cfg.Listener["0"].Policy = &ctrld.ListenerPolicyConfig{
+		Name: "Pattern Policy",
+		Rules: []ctrld.Rule{
+			{`regex:^ads[0-9]*\.example\.com$`: {Upstreams: []string{"upstream.0"}}},
+			{"*.cdn.*.example.com": {Upstreams: []string{"upstream.0"}}},
+		},
+		Macs: []ctrld.Rule{
+			{"regex:^14:45:a0:": {Upstreams: []string{"upstream.0"}}},
+			{"14:*:a0:*": {Upstreams: []string{"upstream.0"}}},
+		},
+	}
+	return cfg
+}
+
+func configWithInvalidRegexRule(t *testing.T) *ctrld.Config {
+	cfg := configWithPatternRules(t)
+	cfg.Listener["0"].Policy.Rules = []ctrld.Rule{{"regex:(ads": {Upstreams: []string{"upstream.0"}}}}
+	return cfg
+}
+
+func configWithInvalidMultiWildcardRule(t *testing.T) *ctrld.Config {
+	cfg := configWithPatternRules(t)
+	cfg.Listener["0"].Policy.Rules = []ctrld.Rule{{"*..*.example.com": {Upstreams: []string{"upstream.0"}}}}
+	return cfg
+}
+
+func configWithInvalidRegexMacRule(t *testing.T) *ctrld.Config {
+	cfg := configWithPatternRules(t)
+	cfg.Listener["0"].Policy.Macs = []ctrld.Rule{{"regex:": {Upstreams: []string{"upstream.0"}}}}
+	return cfg
+}
+
+func configWithQtypeRules(t *testing.T) *ctrld.Config {
+	cfg := defaultConfig(t)
+	cfg.Listener["0"].Policy = &ctrld.ListenerPolicyConfig{
+		Name:     "Query Types Policy",
+		Networks: []ctrld.Rule{{"network.0": {Types: []string{"aaaa"}, Upstreams: []string{"upstream.0"}}}},
+		Rules:    []ctrld.Rule{{"example.com": {Types: []string{"HTTPS", "SVCB"}, Upstreams: []string{"upstream.0"}}}},
+		Macs:     []ctrld.Rule{{"14:45:a0:*": {Types: []string{"PTR"}, Upstreams: []string{"upstream.0"}}}},
+	}
+	return cfg
+}
+
+func configWithInvalidQtypeRule(t *testing.T) *ctrld.Config {
+	cfg := configWithQtypeRules(t)
+	cfg.Listener["0"].Policy.Rules = []ctrld.Rule{{"example.com": {Types: []string{"FOO"}, Upstreams: []string{"upstream.0"}}}}
+	return cfg
+}
+
+func configWithScheduledRules(t *testing.T) *ctrld.Config {
+	cfg := defaultConfig(t)
+	cfg.Listener["0"].Policy = &ctrld.ListenerPolicyConfig{
+		Name:     "Scheduled Policy",
+		Networks: []ctrld.Rule{{"network.0": {Schedule: "night", Upstreams: []string{"upstream.1"}}}},
+		Rules:    []ctrld.Rule{{"example.com": {Schedule: "school", Upstreams: []string{"upstream.1"}}}},
+		Schedules: map[string]*ctrld.ScheduleConfig{
+			"night":  {Times: []string{"21:00-07:00"}, Timezone: "America/New_York"},
+			"school": {Days: []string{"mon-fri"}, Times: []string{"08:00-15:00"}},
+		},
+	}
+	return cfg
+}
+
+func configWithUndefinedScheduleRule(t *testing.T) *ctrld.Config {
+	cfg := configWithScheduledRules(t)
+	cfg.Listener["0"].Policy.Macs = []ctrld.Rule{{"14:45:a0:*": {Schedule: "weekend", Upstreams: []string{"upstream.0"}}}}
+	return cfg
+}
+
+func configWithInvalidSchedule(t *testing.T) *ctrld.Config {
+	cfg := configWithScheduledRules(t)
+	cfg.Listener["0"].Policy.Schedules["night"].Times = []string{"21:00-31:00"}
+	return cfg
+}
+
+func configWithWeightedStrategy(t *testing.T) *ctrld.Config {
+	cfg := defaultConfig(t)
+	cfg.Listener["0"].Policy.Strategy = ctrld.UpstreamStrategyWeighted
+	cfg.Listener["0"].Policy.Weights = map[string]int{"upstream.0": 3, "upstream.1": 1}
+	return cfg
+}
+
+func configWithInvalidStrategy(t *testing.T) *ctrld.Config {
+	cfg := defaultConfig(t)
+	cfg.Listener["0"].Policy.Strategy = "random"
+	return cfg
+}
+
+func configWithInvalidStrategyWeight(t *testing.T) *ctrld.Config {
+	cfg := configWithWeightedStrategy(t)
+	cfg.Listener["0"].Policy.Weights["upstream.1"] = 0
+	return cfg
+}
+
+func configWithOtel(t *testing.T) *ctrld.Config {
+	cfg := defaultConfig(t)
+	ratio := 0.5
+	interval := 30 * time.Second
+	cfg.Service.OtelEndpoint = "localhost:4317"
+	cfg.Service.OtelProtocol = "grpc"
+	cfg.Service.OtelHeaders = []string{"authorization=Bearer token"}
+	cfg.Service.OtelTraceSampleRatio = &ratio
+	cfg.Service.OtelMetricsInterval = &interval
+	return cfg
+}
+
+func configWithInvalidOtelProtocol(t *testing.T) *ctrld.Config {
+	cfg := configWithOtel(t)
+	cfg.Service.OtelProtocol = "udp"
+	return cfg
+}
+
+func configWithInvalidOtelTraceSampleRatio(t *testing.T) *ctrld.Config {
+	cfg := configWithOtel(t)
+	ratio := 1.5
+	cfg.Service.OtelTraceSampleRatio = &ratio
+	return cfg
+}
+
+func configWithInvalidOtelMetricsInterval(t *testing.T) *ctrld.Config {
+	cfg := configWithOtel(t)
+	interval := time.Duration(0)
+	cfg.Service.OtelMetricsInterval = &interval
+	return cfg
+}
+
+func configWithInvalidTopStatsSize(t *testing.T) *ctrld.Config {
+	cfg := defaultConfig(t)
+	cfg.Service.TopStats = true
+	cfg.Service.TopStatsSize = -1
+	return cfg
+}
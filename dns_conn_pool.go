@@ -0,0 +1,306 @@
+package ctrld
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// dnsConnMaxAttempts is the maximum number of attempts for a single query
+	// sent over a pooled TCP/TLS connection.
+	dnsConnMaxAttempts = 3
+	// dnsConnIdleTimeout is the duration after which an unused pooled connection is closed.
+	dnsConnIdleTimeout = 30 * time.Second
+	// dnsConnDefaultTimeout is the query timeout used if the context has no deadline.
+	dnsConnDefaultTimeout = 5 * time.Second
+)
+
+// errDnsConnClosed is returned when the connection was closed before the answer arrived.
+var errDnsConnClosed = errors.New("dns connection closed")
+
+// dnsConnPool maintains long-lived TCP/TLS connections to a DoT or legacy upstream,
+// keyed by network and remote address.
+//
+// Queries are pipelined on a connection as described in RFC 7766 section 6.2.1,
+// answers are matched to queries by message ID, so they could arrive out of order.
+type dnsConnPool struct {
+	dialer    *net.Dialer
+	tlsConfig *tls.Config
+
+	conns *dnsConnSet
+	g     singleflight.Group
+}
+
+// dnsConnSet is the set of pooled connections, keyed by network and remote address.
+//
+// It is kept apart from dnsConnPool, because pooled connections remove themselves
+// from the set when closed. If they referenced the pool instead, the pool would stay
+// reachable while any connection is alive, and its finalizer would never run.
+type dnsConnSet struct {
+	mu    sync.Mutex
+	conns map[string]*dnsConn
+}
+
+// newDnsConnPool creates a new dnsConnPool for the given upstream config.
+func newDnsConnPool(uc *UpstreamConfig) *dnsConnPool {
+	p := &dnsConnPool{
+		// See comment in (*dotResolver).Resolve method.
+		dialer: newDialer(net.JoinHostPort(controldPublicDns, "53")),
+		conns:  &dnsConnSet{conns: make(map[string]*dnsConn)},
+	}
+	if uc.Type == ResolverTypeDOT {
+		p.tlsConfig = &tls.Config{
+			RootCAs:            uc.certPool,
+			ServerName:         uc.Domain,
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		}
+	}
+	runtime.SetFinalizer(p, func(p *dnsConnPool) {
+		p.conns.closeAll()
+	})
+	return p
+}
+
+// dnsConnPool returns the TCP/TLS connection pool of the upstream, creating it if necessary.
+func (uc *UpstreamConfig) dnsConnPool() *dnsConnPool {
+	uc.connPoolOnce.Do(func() {
+		uc.connPool = newDnsConnPool(uc)
+	})
+	return uc.connPool
+}
+
+// exchange sends msg to endpoint using a pooled connection.
+//
+// If a pooled connection was closed by the server before the answer arrived,
+// the query is retried transparently on a new connection.
+func (p *dnsConnPool) exchange(ctx context.Context, msg *dns.Msg, network, endpoint string) (*dns.Msg, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dnsConnDefaultTimeout)
+		defer cancel()
+	}
+	var err error
+	for i := 0; i < dnsConnMaxAttempts; i++ {
+		var c *dnsConn
+		var reused bool
+		c, reused, err = p.get(ctx, network, endpoint)
+		if err != nil {
+			return nil, err
+		}
+		var answer *dns.Msg
+		answer, err = c.exchange(ctx, msg)
+		if err == nil {
+			return answer, nil
+		}
+		// Only retry if the connection was reused, a fresh connection
+		// failing means the upstream has problem, no point to retry.
+		if !reused || ctx.Err() != nil || !errors.Is(err, errDnsConnClosed) {
+			return nil, err
+		}
+		ProxyLogger.Load().Debug().Err(err).Msgf("pooled connection to %s is broken, reconnecting", endpoint)
+	}
+	return nil, err
+}
+
+// get returns a usable connection to endpoint, dialing a new one if needed.
+// The returned boolean reports whether the connection was already in the pool.
+func (p *dnsConnPool) get(ctx context.Context, network, endpoint string) (*dnsConn, bool, error) {
+	key := network + "|" + endpoint
+	if c := p.conns.get(key); c != nil && !c.isClosed() {
+		return c, true, nil
+	}
+
+	// Ensure only one dial is in flight for an endpoint. The dial is shared by
+	// all waiting queries, so it must not be canceled by any single caller.
+	ch := p.g.DoChan(key, func() (any, error) {
+		dialCtx, cancel := context.WithTimeout(context.Background(), dnsConnDefaultTimeout)
+		defer cancel()
+		dnsClient := &dns.Client{Net: network, Dialer: p.dialer, TLSConfig: p.tlsConfig}
+		conn, err := dnsClient.DialContext(dialCtx, endpoint)
+		if err != nil {
+			return nil, err
+		}
+		// Do not reference p here, see dnsConnSet.
+		conns := p.conns
+		c := newDnsConn(conn, func(c *dnsConn) { conns.remove(key, c) })
+		conns.put(key, c)
+		return c, nil
+	})
+	// A freshly dialed connection is never reused, even if the dial was
+	// shared with other queries.
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, false, res.Err
+		}
+		return res.Val.(*dnsConn), false, nil
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+// get returns the connection of the given key, or nil if there's none.
+func (s *dnsConnSet) get(key string) *dnsConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns[key]
+}
+
+// put stores the connection c with the given key.
+func (s *dnsConnSet) put(key string, c *dnsConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[key] = c
+}
+
+// remove removes the connection c of the given key from the set.
+func (s *dnsConnSet) remove(key string, c *dnsConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+// closeAll closes all connections in the set.
+func (s *dnsConnSet) closeAll() {
+	s.mu.Lock()
+	conns := make([]*dnsConn, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.close(errDnsConnClosed)
+	}
+}
+
+// dnsConn is a TCP/TLS connection which supports pipelining queries.
+type dnsConn struct {
+	conn    *dns.Conn
+	onClose func(*dnsConn)
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	err     error
+	done    chan struct{}
+}
+
+// newDnsConn wraps conn and starts reading answers from it.
+func newDnsConn(conn *dns.Conn, onClose func(*dnsConn)) *dnsConn {
+	c := &dnsConn{
+		conn:    conn,
+		onClose: onClose,
+		pending: make(map[uint16]chan *dns.Msg),
+		done:    make(chan struct{}),
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(dnsConnIdleTimeout))
+	go c.readLoop()
+	return c
+}
+
+// exchange sends msg on the connection and waits for its answer.
+func (c *dnsConn) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	// Use our own message ID, since queries from different clients could share the same ID.
+	ch := make(chan *dns.Msg, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, errors.Join(errDnsConnClosed, err)
+	}
+	id := dns.Id()
+	for _, ok := c.pending[id]; ok; _, ok = c.pending[id] {
+		id = dns.Id()
+	}
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	m := *msg
+	m.Id = id
+	c.writeMu.Lock()
+	deadline, _ := ctx.Deadline()
+	_ = c.conn.SetWriteDeadline(deadline)
+	err := c.conn.WriteMsg(&m)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, errors.Join(errDnsConnClosed, err)
+	}
+	// Keep the connection open while we are waiting for the answer.
+	_ = c.conn.SetReadDeadline(time.Now().Add(dnsConnIdleTimeout))
+
+	select {
+	case answer := <-ch:
+		answer.Id = msg.Id
+		return answer, nil
+	case <-c.done:
+		return nil, errors.Join(errDnsConnClosed, c.err)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readLoop reads answers from the connection, and dispatches them to waiting queries.
+//
+// The connection is closed if there's no answer within dnsConnIdleTimeout, or if the
+// server closed the connection.
+func (c *dnsConn) readLoop() {
+	for {
+		answer, err := c.conn.ReadMsg()
+		if err != nil {
+			c.close(err)
+			return
+		}
+		c.mu.Lock()
+		ch := c.pending[answer.Id]
+		delete(c.pending, answer.Id)
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- answer
+		}
+		_ = c.conn.SetReadDeadline(time.Now().Add(dnsConnIdleTimeout))
+	}
+}
+
+// isClosed reports whether the connection was closed.
+func (c *dnsConn) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// close closes the connection with the given reason, queries
+// waiting for answers will be failed with errDnsConnClosed.
+func (c *dnsConn) close(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.mu.Unlock()
+	_ = c.conn.Close()
+	if c.onClose != nil {
+		c.onClose(c)
+	}
+}
@@ -0,0 +1,885 @@
+package ctrld
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DnssecResult is the result of DNSSEC validation of a DNS response.
+type DnssecResult int
+
+const (
+	// DnssecInsecure means the response is not signed, and the chain of trust proves that it does not need to be.
+	DnssecInsecure DnssecResult = iota
+	// DnssecSecure means the response is signed, and the signatures are validated up to the root trust anchor.
+	DnssecSecure
+	// DnssecBogus means the response should be signed, but its signatures are missing or invalid.
+	DnssecBogus
+)
+
+func (r DnssecResult) String() string {
+	switch r {
+	case DnssecInsecure:
+		return "insecure"
+	case DnssecSecure:
+		return "secure"
+	case DnssecBogus:
+		return "bogus"
+	}
+	return "unknown"
+}
+
+const (
+	// dnssecUDPSize is the EDNS0 UDP payload size used for DNSSEC queries.
+	dnssecUDPSize = 1232
+	// dnssecMaxCacheTTL is the maximum time that a validated zone is cached.
+	dnssecMaxCacheTTL = time.Hour
+	// dnssecMaxCacheSize is the maximum number of zones, and of names which are not zone cuts, cached by a DnssecValidator.
+	dnssecMaxCacheSize = 10000
+	// dnssecMaxNsec3Iterations is the maximum number of NSEC3 iterations, proofs using more
+	// iterations are considered insecure (RFC 9276, section 3.2).
+	dnssecMaxNsec3Iterations = 150
+)
+
+// rootTrustAnchors are the DS records of the root zone KSKs, KSK-2017 and KSK-2024.
+//
+// See: https://data.iana.org/root-anchors/root-anchors.xml
+var rootTrustAnchors = []string{
+	". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+var errDnssecBogus = errors.New("dnssec: bogus")
+
+// dnssecAlgorithms are the DNSKEY algorithms supported by the validator.
+var dnssecAlgorithms = map[uint8]bool{
+	dns.RSASHA1:          true,
+	dns.RSASHA1NSEC3SHA1: true,
+	dns.RSASHA256:        true,
+	dns.RSASHA512:        true,
+	dns.ECDSAP256SHA256:  true,
+	dns.ECDSAP384SHA384:  true,
+	dns.ED25519:          true,
+}
+
+// dnssecDigests are the DS digest types supported by the validator.
+var dnssecDigests = map[uint8]bool{
+	dns.SHA1:   true,
+	dns.SHA256: true,
+	dns.SHA384: true,
+}
+
+// dnssecZone is a zone cut in the chain of trust, with its validated DS and DNSKEY records.
+type dnssecZone struct {
+	ds []*dns.DS
+	// keys are the validated DNSKEY records of the zone, nil if the zone is an insecure delegation.
+	keys   []*dns.DNSKEY
+	expire time.Time
+}
+
+// DnssecValidator validates DNSSEC signatures of DNS responses. The DNSKEY and DS records
+// of the chain of trust are fetched through the given resolver, validated from the
+// built-in root trust anchors, and cached by zone.
+//
+// Proofs of non-existence and wildcard answers are validated with NSEC (RFC 4035, section 5.4)
+// or NSEC3 (RFC 5155, section 8) records, including the closest encloser and wildcard proofs.
+// Answers covered by an NSEC3 opt-out record are insecure.
+type DnssecValidator struct {
+	resolver Resolver
+	timeout  time.Duration
+	anchors  []*dns.DS
+	// now returns the current time, tests use it to check signatures validity period.
+	now func() time.Time
+
+	mu    sync.Mutex
+	zones map[string]*dnssecZone
+	// names are the expiration times of names known not to be zone cuts.
+	names map[string]time.Time
+}
+
+// NewDnssecValidator returns a DnssecValidator, which fetches the chain of trust through the given upstream.
+func NewDnssecValidator(uc *UpstreamConfig) (*DnssecValidator, error) {
+	r, err := NewResolver(uc)
+	if err != nil {
+		return nil, err
+	}
+	return newDnssecValidator(r, time.Duration(uc.Timeout)*time.Millisecond), nil
+}
+
+func newDnssecValidator(r Resolver, timeout time.Duration) *DnssecValidator {
+	v := &DnssecValidator{
+		resolver: r,
+		timeout:  timeout,
+		now:      time.Now,
+		zones:    make(map[string]*dnssecZone),
+		names:    make(map[string]time.Time),
+	}
+	for _, s := range rootTrustAnchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(fmt.Sprintf("invalid root trust anchor %q: %v", s, err))
+		}
+		v.anchors = append(v.anchors, rr.(*dns.DS))
+	}
+	return v
+}
+
+// DnssecQuery returns a copy of msg, with the DO bit set, so upstreams send DNSSEC records,
+// and the CD bit set, so the response can be validated even if upstreams consider it bogus.
+func DnssecQuery(msg *dns.Msg) *dns.Msg {
+	m := msg.Copy()
+	if opt := m.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		m.SetEdns0(dnssecUDPSize, true)
+	}
+	m.CheckingDisabled = true
+	return m
+}
+
+// StripDnssecRecords removes from answer the DNSSEC records, which were not asked by query.
+// Nothing is removed if query has the DO bit set.
+func StripDnssecRecords(query, answer *dns.Msg) {
+	opt := query.IsEdns0()
+	if opt != nil && opt.Do() {
+		return
+	}
+	qtype := query.Question[0].Qtype
+	strip := func(rrs []dns.RR) []dns.RR {
+		n := 0
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			case dns.TypeOPT:
+				if opt == nil {
+					continue
+				}
+				rr.(*dns.OPT).SetDo(false)
+			}
+			rrs[n] = rr
+			n++
+		}
+		return rrs[:n]
+	}
+	answer.Answer = strip(answer.Answer)
+	answer.Ns = strip(answer.Ns)
+	answer.Extra = strip(answer.Extra)
+}
+
+// Validate validates the DNSSEC signatures of the given response.
+//
+// The error is non-nil when the chain of trust could not be fetched, the result is DnssecBogus then.
+func (v *DnssecValidator) Validate(ctx context.Context, msg *dns.Msg) (DnssecResult, error) {
+	if len(msg.Question) == 0 || (msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError) {
+		return DnssecInsecure, nil
+	}
+	result := DnssecSecure
+	for _, set := range dnssecRRsets(msg.Answer) {
+		r, err := v.verifyRRset(ctx, set)
+		if err != nil {
+			return DnssecBogus, err
+		}
+		if r == DnssecSecure && set.wildcard() {
+			// The answer was expanded from a wildcard, the name itself must not exist.
+			r, err = v.verifyWildcard(ctx, msg, set)
+			if err != nil {
+				return DnssecBogus, err
+			}
+		}
+		result = result.combine(r)
+	}
+	if msg.Rcode == dns.RcodeNameError || !answered(msg) {
+		q := msg.Question[0]
+		r, err := v.verifyDenial(ctx, msg, cnameTarget(msg), q.Qtype)
+		if err != nil {
+			return DnssecBogus, err
+		}
+		result = result.combine(r)
+	}
+	return result, nil
+}
+
+// answered reports whether the answer section of msg has records of the question type,
+// after following the CNAME chain.
+func answered(msg *dns.Msg) bool {
+	qtype := msg.Question[0].Qtype
+	if qtype == dns.TypeCNAME || qtype == dns.TypeANY {
+		return len(msg.Answer) > 0
+	}
+	name := cnameTarget(msg)
+	for _, rr := range msg.Answer {
+		if hdr := rr.Header(); hdr.Rrtype == qtype && strings.EqualFold(hdr.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// cnameTarget returns the name at the end of the CNAME chain of msg, starting from the question name.
+func cnameTarget(msg *dns.Msg) string {
+	name := msg.Question[0].Name
+	// Bound the chain, in case of CNAME loop.
+	for range len(msg.Answer) {
+		found := false
+		for _, rr := range msg.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				name, found = cname.Target, true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return name
+}
+
+// combine returns the result of a response made of records with results r and other.
+func (r DnssecResult) combine(other DnssecResult) DnssecResult {
+	switch {
+	case r == DnssecBogus || other == DnssecBogus:
+		return DnssecBogus
+	case r == DnssecInsecure || other == DnssecInsecure:
+		return DnssecInsecure
+	}
+	return DnssecSecure
+}
+
+// dnssecRRset is a set of records with the same owner, class and type, and the signatures covering them.
+type dnssecRRset struct {
+	name  string
+	rtype uint16
+	rrs   []dns.RR
+	sigs  []*dns.RRSIG
+	// sig is the signature which validated the set, set by verifyRRset.
+	sig *dns.RRSIG
+}
+
+// wildcard reports whether the set was expanded from a wildcard, which is when the
+// signature has fewer labels than the owner name (RFC 4035, section 5.3.4).
+func (set *dnssecRRset) wildcard() bool {
+	if set.sig == nil {
+		return false
+	}
+	labels := dns.CountLabel(set.name)
+	if strings.HasPrefix(set.name, "*.") {
+		labels--
+	}
+	return int(set.sig.Labels) < labels
+}
+
+// dnssecRRsets groups rrs by RRset.
+func dnssecRRsets(rrs []dns.RR) []*dnssecRRset {
+	var sets []*dnssecRRset
+	find := func(name string, rtype uint16) *dnssecRRset {
+		for _, set := range sets {
+			if set.rtype == rtype && strings.EqualFold(set.name, name) {
+				return set
+			}
+		}
+		set := &dnssecRRset{name: name, rtype: rtype}
+		sets = append(sets, set)
+		return set
+	}
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		switch hdr.Rrtype {
+		case dns.TypeOPT:
+		case dns.TypeRRSIG:
+			sig := rr.(*dns.RRSIG)
+			set := find(hdr.Name, sig.TypeCovered)
+			set.sigs = append(set.sigs, sig)
+		default:
+			set := find(hdr.Name, hdr.Rrtype)
+			set.rrs = append(set.rrs, rr)
+		}
+	}
+	// Drop signatures without records.
+	n := 0
+	for _, set := range sets {
+		if len(set.rrs) > 0 {
+			sets[n] = set
+			n++
+		}
+	}
+	return sets[:n]
+}
+
+// verifyRRset validates the signatures of set.
+func (v *DnssecValidator) verifyRRset(ctx context.Context, set *dnssecRRset) (DnssecResult, error) {
+	if len(set.sigs) == 0 {
+		keys, _, err := v.zoneKeys(ctx, set.name)
+		if err != nil {
+			return DnssecBogus, err
+		}
+		if keys == nil {
+			return DnssecInsecure, nil
+		}
+		return DnssecBogus, nil
+	}
+	for _, sig := range set.sigs {
+		if !dns.IsSubDomain(sig.SignerName, set.name) {
+			continue
+		}
+		keys, zone, err := v.zoneKeys(ctx, sig.SignerName)
+		if err != nil {
+			return DnssecBogus, err
+		}
+		if keys == nil {
+			return DnssecInsecure, nil
+		}
+		if !strings.EqualFold(zone, sig.SignerName) {
+			continue
+		}
+		if v.verifySig(sig, keys, set.rrs) {
+			set.sig = sig
+			return DnssecSecure, nil
+		}
+	}
+	return DnssecBogus, nil
+}
+
+// verifySig reports whether sig is a valid signature of rrs, made by one of the given keys.
+func (v *DnssecValidator) verifySig(sig *dns.RRSIG, keys []*dns.DNSKEY, rrs []dns.RR) bool {
+	if !sig.ValidityPeriod(v.now()) {
+		return false
+	}
+	for _, key := range keys {
+		if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, rrs) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyZoneRRset reports whether set is signed by the given zone keys.
+func (v *DnssecValidator) verifyZoneRRset(set *dnssecRRset, zone string, keys []*dns.DNSKEY) bool {
+	for _, sig := range set.sigs {
+		if strings.EqualFold(sig.SignerName, zone) && v.verifySig(sig, keys, set.rrs) {
+			return true
+		}
+	}
+	return false
+}
+
+// denialRecords returns the validated NSEC and NSEC3 records in the authority section of msg.
+// The result is not DnssecSecure if the records are not signed by a secure zone.
+func (v *DnssecValidator) denialRecords(ctx context.Context, msg *dns.Msg) ([]*dns.NSEC, []*dns.NSEC3, DnssecResult, error) {
+	result := DnssecSecure
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, set := range dnssecRRsets(msg.Ns) {
+		switch set.rtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3:
+		default:
+			continue
+		}
+		r, err := v.verifyRRset(ctx, set)
+		if err != nil {
+			return nil, nil, DnssecBogus, err
+		}
+		result = result.combine(r)
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, rr)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, rr)
+			}
+		}
+	}
+	return nsecs, nsec3s, result, nil
+}
+
+// verifyDenial validates the proof of non-existence of qname/qtype in the authority section of msg.
+func (v *DnssecValidator) verifyDenial(ctx context.Context, msg *dns.Msg, qname string, qtype uint16) (DnssecResult, error) {
+	nsecs, nsec3s, result, err := v.denialRecords(ctx, msg)
+	if err != nil || result != DnssecSecure {
+		return result, err
+	}
+	nodata := msg.Rcode == dns.RcodeSuccess
+	switch {
+	case len(nsecs) > 0:
+		if nsecDenies(nsecs, qname, qtype, nodata) {
+			return DnssecSecure, nil
+		}
+		return DnssecBogus, nil
+	case len(nsec3s) > 0:
+		return nsec3Denies(nsec3s, qname, qtype, nodata), nil
+	}
+	// No signed records at all, secure only if qname is not in a secure zone.
+	keys, _, err := v.zoneKeys(ctx, qname)
+	if err != nil {
+		return DnssecBogus, err
+	}
+	if keys == nil {
+		return DnssecInsecure, nil
+	}
+	return DnssecBogus, nil
+}
+
+// verifyWildcard validates the proof that the owner of set, which was expanded from a wildcard,
+// does not exist, so the wildcard applies (RFC 4035, section 5.3.4 and RFC 5155, section 8.8).
+func (v *DnssecValidator) verifyWildcard(ctx context.Context, msg *dns.Msg, set *dnssecRRset) (DnssecResult, error) {
+	nsecs, nsec3s, result, err := v.denialRecords(ctx, msg)
+	if err != nil || result != DnssecSecure {
+		return result, err
+	}
+	if nsecCovering(nsecs, set.name) != nil {
+		return DnssecSecure, nil
+	}
+	if len(nsec3s) > 0 {
+		if nsec3Unsupported(nsec3s) {
+			return DnssecInsecure, nil
+		}
+		// The closest encloser is the wildcard parent, the next closer name must not exist.
+		next := ancestor(set.name, int(set.sig.Labels)+1)
+		if cover := nsec3Covering(nsec3s, next); cover != nil {
+			if cover.Flags&1 == 1 {
+				return DnssecInsecure, nil
+			}
+			return DnssecSecure, nil
+		}
+	}
+	return DnssecBogus, nil
+}
+
+// nsecDenies reports whether the NSEC records prove that qname/qtype does not exist (RFC 4035, section 5.4).
+func nsecDenies(nsecs []*dns.NSEC, qname string, qtype uint16, nodata bool) bool {
+	if nodata {
+		for _, rr := range nsecs {
+			if strings.EqualFold(rr.Hdr.Name, qname) {
+				return !hasType(rr.TypeBitMap, qtype) && !hasType(rr.TypeBitMap, dns.TypeCNAME)
+			}
+		}
+	}
+	cover := nsecCovering(nsecs, qname)
+	if cover == nil {
+		return false
+	}
+	// qname is an empty non-terminal, it exists but has no records.
+	if nodata && dns.IsSubDomain(qname, cover.NextDomain) {
+		return true
+	}
+	wildcard := wildcardName(nsecClosestEncloser(qname, cover))
+	if !nodata {
+		return nsecCovering(nsecs, wildcard) != nil
+	}
+	// The wildcard exists, but does not have qtype.
+	for _, rr := range nsecs {
+		if strings.EqualFold(rr.Hdr.Name, wildcard) {
+			return !hasType(rr.TypeBitMap, qtype) && !hasType(rr.TypeBitMap, dns.TypeCNAME)
+		}
+	}
+	return false
+}
+
+// nsecCovering returns the NSEC record which proves that name does not exist, or nil if there's none.
+func nsecCovering(nsecs []*dns.NSEC, name string) *dns.NSEC {
+	for _, rr := range nsecs {
+		// An NSEC record at a delegation point or a DNAME cannot prove anything below it.
+		if dns.IsSubDomain(rr.Hdr.Name, name) && (hasType(rr.TypeBitMap, dns.TypeDNAME) ||
+			hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeSOA)) {
+			continue
+		}
+		if nsecCovers(rr, name) {
+			return rr
+		}
+	}
+	return nil
+}
+
+// nsecClosestEncloser returns the closest encloser of name, which is proved not to exist by rr.
+// It is the longest ancestor of name which is also an ancestor of the owner or the next name of rr.
+func nsecClosestEncloser(name string, rr *dns.NSEC) string {
+	n := max(dns.CompareDomainName(name, rr.Hdr.Name), dns.CompareDomainName(name, rr.NextDomain))
+	return ancestor(name, n)
+}
+
+// nsec3Denies returns the result of the NSEC3 proof that qname/qtype does not exist (RFC 5155, section 8).
+func nsec3Denies(nsec3s []*dns.NSEC3, qname string, qtype uint16, nodata bool) DnssecResult {
+	if nsec3Unsupported(nsec3s) {
+		return DnssecInsecure
+	}
+	if nodata {
+		if rr := nsec3Matching(nsec3s, qname); rr != nil {
+			if hasType(rr.TypeBitMap, qtype) || hasType(rr.TypeBitMap, dns.TypeCNAME) {
+				return DnssecBogus
+			}
+			return DnssecSecure
+		}
+	}
+	ce, cover := nsec3ClosestEncloser(nsec3s, qname)
+	if cover == nil {
+		return DnssecBogus
+	}
+	optOut := cover.Flags&1 == 1
+	wildcard := wildcardName(ce)
+	if nodata {
+		// A DS query for an insecure delegation, which is covered by an opt-out record.
+		if qtype == dns.TypeDS && optOut {
+			return DnssecInsecure
+		}
+		// The wildcard exists, but does not have qtype.
+		if rr := nsec3Matching(nsec3s, wildcard); rr != nil &&
+			!hasType(rr.TypeBitMap, qtype) && !hasType(rr.TypeBitMap, dns.TypeCNAME) {
+			return DnssecSecure
+		}
+		return DnssecBogus
+	}
+	if nsec3Covering(nsec3s, wildcard) == nil {
+		return DnssecBogus
+	}
+	if optOut {
+		return DnssecInsecure
+	}
+	return DnssecSecure
+}
+
+// nsec3ClosestEncloser returns the closest encloser of name, and the NSEC3 record covering
+// the next closer name (RFC 5155, section 8.3). The record is nil if there's no such proof.
+func nsec3ClosestEncloser(nsec3s []*dns.NSEC3, name string) (string, *dns.NSEC3) {
+	labels := dns.CountLabel(name)
+	for n := labels - 1; n >= 0; n-- {
+		ce := ancestor(name, n)
+		rr := nsec3Matching(nsec3s, ce)
+		if rr == nil {
+			continue
+		}
+		// The closest encloser cannot be a delegation point or a DNAME.
+		if hasType(rr.TypeBitMap, dns.TypeDNAME) || hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeSOA) {
+			return "", nil
+		}
+		return ce, nsec3Covering(nsec3s, ancestor(name, n+1))
+	}
+	return "", nil
+}
+
+// nsec3Matching returns the NSEC3 record matching name, or nil if there's none.
+func nsec3Matching(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, rr := range nsec3s {
+		if rr.Match(name) {
+			return rr
+		}
+	}
+	return nil
+}
+
+// nsec3Covering returns the NSEC3 record which proves that name does not exist, or nil if there's none.
+func nsec3Covering(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, rr := range nsec3s {
+		if !rr.Match(name) && rr.Cover(name) {
+			return rr
+		}
+	}
+	return nil
+}
+
+// nsec3Unsupported reports whether any of the NSEC3 records uses an unknown hash algorithm,
+// or too many iterations, so they cannot be used for a proof.
+func nsec3Unsupported(nsec3s []*dns.NSEC3) bool {
+	for _, rr := range nsec3s {
+		if rr.Hash != dns.SHA1 || rr.Iterations > dnssecMaxNsec3Iterations {
+			return true
+		}
+	}
+	return false
+}
+
+// ancestor returns the ancestor of name with the given number of labels.
+func ancestor(name string, labels int) string {
+	l := dns.SplitDomainName(name)
+	return dns.Fqdn(strings.Join(l[len(l)-labels:], "."))
+}
+
+// wildcardName returns the wildcard name whose closest encloser is ce.
+func wildcardName(ce string) string {
+	if ce == "." {
+		return "*."
+	}
+	return "*." + ce
+}
+
+// nsecCovers reports whether name is between the owner and the next name of rr, in canonical order.
+func nsecCovers(rr *dns.NSEC, name string) bool {
+	owner, next := rr.Hdr.Name, rr.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// The last NSEC of the zone, next is the zone apex.
+	return canonicalCompare(owner, name) < 0 && dns.IsSubDomain(next, name)
+}
+
+// canonicalCompare compares domain names a and b in canonical DNS order (RFC 4034, section 6.1).
+func canonicalCompare(a, b string) int {
+	la, lb := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneKeys walks the chain of trust from the root down to name, returning the closest enclosing
+// zone of name and its validated keys. The keys are nil if name is below an insecure delegation.
+//
+// Validated zones, and names which are not zone cuts, are cached, so the DS and DNSKEY records
+// of a zone are only fetched again after they expire.
+func (v *DnssecValidator) zoneKeys(ctx context.Context, name string) ([]*dns.DNSKEY, string, error) {
+	zone := "."
+	root := v.cachedZone(zone)
+	if root == nil {
+		var err error
+		if root, err = v.zoneCut(ctx, zone, v.anchors); err != nil {
+			return nil, "", err
+		}
+		v.storeZone(zone, root)
+	}
+	keys := root.keys
+	if keys == nil {
+		return nil, zone, nil
+	}
+	labels := dns.SplitDomainName(dns.Fqdn(name))
+	for i := len(labels) - 1; i >= 0; i-- {
+		n := dns.Fqdn(strings.ToLower(strings.Join(labels[i:], ".")))
+		if v.cachedNotCut(n) {
+			continue
+		}
+		z := v.cachedZone(n)
+		if z == nil {
+			var err error
+			if z, err = v.delegation(ctx, n, zone, keys); err != nil {
+				return nil, "", err
+			}
+			if z == nil {
+				continue
+			}
+		}
+		if z.keys == nil {
+			return nil, n, nil
+		}
+		zone, keys = n, z.keys
+	}
+	return keys, zone, nil
+}
+
+// delegation returns the zone cut at name, whose closest enclosing zone is the given secure zone,
+// or nil if name is not a zone cut. The result is cached.
+func (v *DnssecValidator) delegation(ctx context.Context, name, zone string, keys []*dns.DNSKEY) (*dnssecZone, error) {
+	resp, err := v.query(ctx, name, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	for _, set := range dnssecRRsets(resp.Answer) {
+		if set.rtype != dns.TypeDS || !strings.EqualFold(set.name, name) {
+			continue
+		}
+		if !v.verifyZoneRRset(set, zone, keys) {
+			return nil, fmt.Errorf("%w: invalid DS of %s", errDnssecBogus, name)
+		}
+		var ds []*dns.DS
+		for _, rr := range set.rrs {
+			ds = append(ds, rr.(*dns.DS))
+		}
+		z, err := v.zoneCut(ctx, name, ds)
+		if err != nil {
+			return nil, err
+		}
+		v.storeZone(name, z)
+		return z, nil
+	}
+
+	// No DS, the zone must prove that it does not exist.
+	var proved []dns.RR
+	for _, set := range dnssecRRsets(resp.Ns) {
+		if set.rtype != dns.TypeNSEC && set.rtype != dns.TypeNSEC3 {
+			continue
+		}
+		if !v.verifyZoneRRset(set, zone, keys) {
+			return nil, fmt.Errorf("%w: invalid denial of DS of %s", errDnssecBogus, name)
+		}
+		proved = append(proved, set.rrs...)
+	}
+	// insecure caches name as an insecure delegation.
+	insecure := func() (*dnssecZone, error) {
+		z := &dnssecZone{expire: v.expire(proved)}
+		v.storeZone(name, z)
+		return z, nil
+	}
+	// notCut caches name as a name which is not a zone cut.
+	notCut := func() (*dnssecZone, error) {
+		v.storeNotCut(name, v.expire(proved))
+		return nil, nil
+	}
+	for _, rr := range proved {
+		var bitmap []uint16
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if !strings.EqualFold(rr.Hdr.Name, name) {
+				if nsecCovers(rr, name) {
+					return notCut()
+				}
+				continue
+			}
+			bitmap = rr.TypeBitMap
+		case *dns.NSEC3:
+			if !rr.Match(name) {
+				continue
+			}
+			bitmap = rr.TypeBitMap
+		default:
+			continue
+		}
+		if hasType(bitmap, dns.TypeDS) {
+			return nil, fmt.Errorf("%w: DS of %s exists", errDnssecBogus, name)
+		}
+		if hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA) {
+			return insecure()
+		}
+		return notCut()
+	}
+	// With NSEC3, there may be an opt-out record covering name, which means it may be an insecure delegation.
+	for _, rr := range proved {
+		if rr, ok := rr.(*dns.NSEC3); ok && rr.Cover(name) {
+			if rr.Flags&1 == 1 {
+				return insecure()
+			}
+			return notCut()
+		}
+	}
+	return nil, fmt.Errorf("%w: no proof of missing DS of %s", errDnssecBogus, name)
+}
+
+// zoneCut fetches the DNSKEY records of zone, returning the zone with the keys validated by one of the
+// given DS records. The keys are nil if none of the DS records are supported, which makes the zone insecure.
+func (v *DnssecValidator) zoneCut(ctx context.Context, zone string, ds []*dns.DS) (*dnssecZone, error) {
+	dsRRs := make([]dns.RR, 0, len(ds))
+	supported := false
+	for _, d := range ds {
+		dsRRs = append(dsRRs, d)
+		if dnssecAlgorithms[d.Algorithm] && dnssecDigests[d.DigestType] {
+			supported = true
+		}
+	}
+	z := &dnssecZone{ds: ds, expire: v.expire(dsRRs)}
+	if !supported {
+		return z, nil
+	}
+	resp, err := v.query(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	for _, set := range dnssecRRsets(resp.Answer) {
+		if set.rtype != dns.TypeDNSKEY || !strings.EqualFold(set.name, zone) {
+			continue
+		}
+		var keys []*dns.DNSKEY
+		for _, rr := range set.rrs {
+			keys = append(keys, rr.(*dns.DNSKEY))
+		}
+		for _, key := range keys {
+			for _, d := range ds {
+				if key.KeyTag() != d.KeyTag || key.Algorithm != d.Algorithm {
+					continue
+				}
+				if kds := key.ToDS(d.DigestType); kds == nil || !strings.EqualFold(kds.Digest, d.Digest) {
+					continue
+				}
+				if v.verifyZoneRRset(set, zone, []*dns.DNSKEY{key}) {
+					z.keys = keys
+					if expire := v.expire(set.rrs); expire.Before(z.expire) {
+						z.expire = expire
+					}
+					return z, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: no valid DNSKEY for %s", errDnssecBogus, zone)
+}
+
+// query sends a DNSSEC query for name/qtype through the validator resolver.
+func (v *DnssecValidator) query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	if v.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.timeout)
+		defer cancel()
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	resp, err := v.resolver.Resolve(ctx, DnssecQuery(msg))
+	if err != nil {
+		return nil, fmt.Errorf("dnssec: could not query %s %s: %w", name, dns.TypeToString[qtype], err)
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("dnssec: could not query %s %s: %s", name, dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// expire returns the expiration time of a cached state, based on the TTL of the given records.
+func (v *DnssecValidator) expire(rrs []dns.RR) time.Time {
+	ttl := dnssecMaxCacheTTL
+	for _, rr := range rrs {
+		ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+	}
+	return v.now().Add(ttl)
+}
+
+// cachedZone returns the cached zone cut at name, or nil if there's none.
+func (v *DnssecValidator) cachedZone(name string) *dnssecZone {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	z := v.zones[name]
+	if z == nil || !v.now().Before(z.expire) {
+		return nil
+	}
+	return z
+}
+
+// storeZone caches the zone cut at name.
+func (v *DnssecValidator) storeZone(name string, z *dnssecZone) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.zones) >= dnssecMaxCacheSize {
+		clear(v.zones)
+	}
+	v.zones[name] = z
+}
+
+// cachedNotCut reports whether name is cached as a name which is not a zone cut.
+func (v *DnssecValidator) cachedNotCut(name string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	expire, ok := v.names[name]
+	return ok && v.now().Before(expire)
+}
+
+// storeNotCut caches name as a name which is not a zone cut, until expire.
+func (v *DnssecValidator) storeNotCut(name string, expire time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.names) >= dnssecMaxCacheSize {
+		clear(v.names)
+	}
+	v.names[name] = expire
+}
@@ -0,0 +1,329 @@
+package ctrld
+
+import (
+	"context"
+	"crypto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dnssecTestZone is a signed zone used for testing DnssecValidator.
+type dnssecTestZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newDnssecTestZone(t *testing.T, name string) *dnssecTestZone {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+	return &dnssecTestZone{name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns rrs, followed by their signature made by the zone key.
+func (z *dnssecTestZone) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	t.Helper()
+	hdr := rrs[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: hdr.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: hdr.Ttl},
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+		Algorithm:  z.key.Algorithm,
+	}
+	require.NoError(t, sig.Sign(z.priv, rrs))
+	return append(rrs, sig)
+}
+
+// dnssecTestResolver answers queries from a map of "name type" to response records.
+type dnssecTestResolver struct {
+	answers   map[string][]dns.RR
+	authority map[string][]dns.RR
+	queries   int
+}
+
+func (r *dnssecTestResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	r.queries++
+	q := msg.Question[0]
+	key := strings.ToLower(q.Name) + " " + dns.TypeToString[q.Qtype]
+	answer := new(dns.Msg)
+	answer.SetReply(msg)
+	answer.Answer = r.answers[key]
+	answer.Ns = r.authority[key]
+	return answer, nil
+}
+
+func nsec(owner, next string, types ...uint16) *dns.NSEC {
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+// nsec3 returns an NSEC3 record of zone, without salt and extra iterations.
+// The owner and next are hashes, see nsec3Hash.
+func nsec3(zone, owner, next string, flags uint8, types ...uint16) *dns.NSEC3 {
+	return &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: owner + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 3600},
+		Hash:       dns.SHA1,
+		Flags:      flags,
+		HashLength: 20,
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+// nsec3Hash returns the NSEC3 hash of name, as used by nsec3.
+func nsec3Hash(name string) string {
+	return dns.HashName(name, dns.SHA1, 0, "")
+}
+
+const (
+	nsec3HashMin = "00000000000000000000000000000000"
+	nsec3HashMax = "VVVVVVVVVVVVVVVVVVVVVVVVVVVVVVVV"
+)
+
+// nsec3CoverOnly returns an NSEC3 record of zone covering name, but not wildcard.
+func nsec3CoverOnly(zone, name, wildcard string) *dns.NSEC3 {
+	h, w := nsec3Hash(name), nsec3Hash(wildcard)
+	if h < w {
+		return nsec3(zone, nsec3HashMin, w, 0, dns.TypeA)
+	}
+	return nsec3(zone, w, nsec3HashMax, 0, dns.TypeA)
+}
+
+// wildcardRRs returns rrs signed as the wildcard owner, then expanded to name.
+func wildcardRRs(t *testing.T, z *dnssecTestZone, wildcard dns.RR, name string) []dns.RR {
+	rrs := z.sign(t, wildcard)
+	for _, rr := range rrs {
+		rr.Header().Name = name
+	}
+	return rrs
+}
+
+func TestDnssecValidator(t *testing.T) {
+	root := newDnssecTestZone(t, ".")
+	example := newDnssecTestZone(t, "example.")
+	other := newDnssecTestZone(t, "example.")
+
+	r := &dnssecTestResolver{
+		answers:   make(map[string][]dns.RR),
+		authority: make(map[string][]dns.RR),
+	}
+	r.answers[". DNSKEY"] = root.sign(t, root.key)
+	r.answers["example. DS"] = root.sign(t, example.key.ToDS(dns.SHA256))
+	r.answers["example. DNSKEY"] = example.sign(t, example.key)
+	// insecure. is a delegation without DS.
+	r.authority["insecure. DS"] = root.sign(t, nsec("insecure.", "zzz.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC))
+	// www.example. is not a delegation.
+	r.authority["www.example. DS"] = example.sign(t, nsec("www.example.", "zzz.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))
+	r.authority["bad.example. DS"] = example.sign(t, nsec("bad.example.", "www.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))
+
+	v := newDnssecValidator(r, time.Second)
+	v.anchors = []*dns.DS{root.key.ToDS(dns.SHA256)}
+
+	wwwA := mustRR("www.example. 300 IN A 10.0.0.1")
+	tests := []struct {
+		name   string
+		msg    func() *dns.Msg
+		result DnssecResult
+	}{
+		{"secure answer", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("www.example.", dns.TypeA)
+			m.Answer = example.sign(t, wwwA)
+			return m
+		}, DnssecSecure},
+		{"insecure answer", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("www.insecure.", dns.TypeA)
+			m.Answer = []dns.RR{mustRR("www.insecure. 300 IN A 10.0.0.2")}
+			return m
+		}, DnssecInsecure},
+		{"missing signature", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("www.example.", dns.TypeA)
+			m.Answer = []dns.RR{wwwA}
+			return m
+		}, DnssecBogus},
+		{"signed by wrong key", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("www.example.", dns.TypeA)
+			m.Answer = other.sign(t, wwwA)
+			return m
+		}, DnssecBogus},
+		{"tampered answer", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("bad.example.", dns.TypeA)
+			rrs := example.sign(t, mustRR("bad.example. 300 IN A 10.0.0.1"))
+			rrs[0].(*dns.A).A[3] = 2
+			m.Answer = rrs
+			return m
+		}, DnssecBogus},
+		{"secure nxdomain", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("none.example.", dns.TypeA)
+			m.Rcode = dns.RcodeNameError
+			m.Ns = append(example.sign(t, nsec("bad.example.", "www.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)),
+				example.sign(t, nsec("example.", "bad.example.", dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC))...)
+			return m
+		}, DnssecSecure},
+		{"nxdomain without wildcard proof", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("none.example.", dns.TypeA)
+			m.Rcode = dns.RcodeNameError
+			m.Ns = example.sign(t, nsec("bad.example.", "www.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))
+			return m
+		}, DnssecBogus},
+		{"nxdomain proved by delegation nsec", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("a.sub.example.", dns.TypeA)
+			m.Rcode = dns.RcodeNameError
+			m.Ns = example.sign(t, nsec("sub.example.", "www.example.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC))
+			return m
+		}, DnssecBogus},
+		{"empty non-terminal nodata", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("ent.example.", dns.TypeA)
+			m.Ns = example.sign(t, nsec("bad.example.", "a.ent.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))
+			return m
+		}, DnssecSecure},
+		{"wildcard nodata", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("none.example.", dns.TypeAAAA)
+			m.Ns = append(example.sign(t, nsec("bad.example.", "www.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)),
+				example.sign(t, nsec("*.example.", "bad.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))...)
+			return m
+		}, DnssecSecure},
+		{"secure wildcard answer", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("none.example.", dns.TypeA)
+			m.Answer = wildcardRRs(t, example, mustRR("*.example. 300 IN A 10.0.0.3"), "none.example.")
+			m.Ns = example.sign(t, nsec("bad.example.", "www.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))
+			return m
+		}, DnssecSecure},
+		{"wildcard answer without proof", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("none.example.", dns.TypeA)
+			m.Answer = wildcardRRs(t, example, mustRR("*.example. 300 IN A 10.0.0.3"), "none.example.")
+			return m
+		}, DnssecBogus},
+		{"secure nsec3 nxdomain", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("none.example.", dns.TypeA)
+			m.Rcode = dns.RcodeNameError
+			m.Ns = append(example.sign(t, nsec3("example.", nsec3Hash("example."), nsec3HashMax, 0, dns.TypeSOA, dns.TypeNS)),
+				example.sign(t, nsec3("example.", nsec3HashMin, nsec3Hash("example."), 0, dns.TypeA))...)
+			return m
+		}, DnssecSecure},
+		{"nsec3 nxdomain without wildcard proof", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("none.example.", dns.TypeA)
+			m.Rcode = dns.RcodeNameError
+			// The apex record covers no other name.
+			m.Ns = append(example.sign(t, nsec3("example.", nsec3Hash("example."), nsec3Hash("example.")+"0", 0, dns.TypeSOA, dns.TypeNS)),
+				example.sign(t, nsec3CoverOnly("example.", "none.example.", "*.example."))...)
+			return m
+		}, DnssecBogus},
+		{"nsec3 nxdomain without closest encloser", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("none.example.", dns.TypeA)
+			m.Rcode = dns.RcodeNameError
+			m.Ns = example.sign(t, nsec3CoverOnly("example.", "none.example.", "*.example."))
+			return m
+		}, DnssecBogus},
+		{"nsec3 opt-out nxdomain", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("none.example.", dns.TypeA)
+			m.Rcode = dns.RcodeNameError
+			m.Ns = append(example.sign(t, nsec3("example.", nsec3Hash("example."), nsec3HashMax, 1, dns.TypeSOA, dns.TypeNS)),
+				example.sign(t, nsec3("example.", nsec3HashMin, nsec3Hash("example."), 1, dns.TypeA))...)
+			return m
+		}, DnssecInsecure},
+		{"secure nodata", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("www.example.", dns.TypeAAAA)
+			m.Ns = example.sign(t, nsec("www.example.", "zzz.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))
+			return m
+		}, DnssecSecure},
+		{"nodata of existing type", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("www.example.", dns.TypeA)
+			m.Ns = example.sign(t, nsec("www.example.", "zzz.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))
+			return m
+		}, DnssecBogus},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result, _ := v.Validate(context.Background(), tc.msg())
+			assert.Equal(t, tc.result, result)
+		})
+	}
+
+	t.Run("cached chain of trust", func(t *testing.T) {
+		v := newDnssecValidator(r, time.Second)
+		v.anchors = []*dns.DS{root.key.ToDS(dns.SHA256)}
+		for _, name := range []string{"www.example.", "mail.example."} {
+			queries := r.queries
+			m := new(dns.Msg)
+			m.SetQuestion(name, dns.TypeA)
+			m.Answer = example.sign(t, mustRR(name+" 300 IN A 10.0.0.1"))
+			result, err := v.Validate(context.Background(), m)
+			require.NoError(t, err)
+			assert.Equal(t, DnssecSecure, result)
+			if name == "www.example." {
+				// Root DNSKEY, example. DS and DNSKEY.
+				assert.Equal(t, 3, r.queries-queries)
+			} else {
+				assert.Equal(t, 0, r.queries-queries)
+			}
+		}
+	})
+
+	t.Run("expired signature", func(t *testing.T) {
+		v := newDnssecValidator(r, time.Second)
+		v.anchors = []*dns.DS{root.key.ToDS(dns.SHA256)}
+		v.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.", dns.TypeA)
+		m.Answer = example.sign(t, wwwA)
+		result, err := v.Validate(context.Background(), m)
+		assert.Equal(t, DnssecBogus, result)
+		assert.ErrorIs(t, err, errDnssecBogus)
+	})
+}
+
+func TestStripDnssecRecords(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	answer := new(dns.Msg)
+	answer.SetReply(query)
+	answer.Answer = []dns.RR{
+		mustRR("www.example. 300 IN A 10.0.0.1"),
+		mustRR("www.example. 300 IN RRSIG A 13 2 300 20240101000000 20230101000000 1 example. AAAA"),
+	}
+	answer.SetEdns0(dnssecUDPSize, true)
+
+	withDo := DnssecQuery(query)
+	kept := answer.Copy()
+	StripDnssecRecords(withDo, kept)
+	assert.Len(t, kept.Answer, 2)
+
+	StripDnssecRecords(query, answer)
+	assert.Len(t, answer.Answer, 1)
+	assert.Nil(t, answer.IsEdns0())
+}
@@ -1,7 +1,9 @@
 package ctrld
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
@@ -27,6 +29,15 @@ const (
 	dohOsHeader           = "x-cd-os"
 	dohClientIDPrefHeader = "x-cd-cpref"
 	headerApplicationDNS  = "application/dns-message"
+
+	// dohMaxGetURLLength is the max length of GET request URL, POST is used for longer one.
+	// Some servers and proxies reject, or do not cache well, request with long URL.
+	dohMaxGetURLLength = 2048
+)
+
+const (
+	dohMethodGet  = "get"
+	dohMethodPost = "post"
 )
 
 // EncodeOsNameMap provides mapping from OS name to a shorter string, used for encoding x-cd-os value.
@@ -92,10 +103,6 @@ func (r *dohResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, erro
 		return nil, err
 	}
 
-	enc := base64.RawURLEncoding.EncodeToString(data)
-	query := r.endpoint.Query()
-	query.Add("dns", enc)
-
 	endpoint := *r.endpoint
 
 	if ci, ok := ctx.Value(ClientInfoCtxKey{}).(*ClientInfo); ok && ci != nil {
@@ -108,8 +115,7 @@ func (r *dohResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, erro
 		}
 	}
 
-	endpoint.RawQuery = query.Encode()
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	req, err := newDohRequest(ctx, &endpoint, data, r.uc.DohMethod)
 	if err != nil {
 		return nil, fmt.Errorf("could not create request: %w", err)
 	}
@@ -131,7 +137,13 @@ func (r *dohResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, erro
 		retryCtx, cancel := r.uc.Context(context.WithoutCancel(ctx))
 		defer cancel()
 		Log(ctx, ProxyLogger.Load().Warn().Err(err), "retrying request after fallback to direct ip")
-		resp, err = c.Do(req.Clone(retryCtx))
+		retryReq := req.Clone(retryCtx)
+		if req.GetBody != nil {
+			if retryReq.Body, err = req.GetBody(); err != nil {
+				return nil, fmt.Errorf("could not create request: %w", err)
+			}
+		}
+		resp, err = c.Do(retryReq)
 	}
 	if err != nil {
 		err = wrapUrlError(err)
@@ -160,6 +172,23 @@ func (r *dohResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, erro
 	return answer, nil
 }
 
+// newDohRequest creates a DoH request for the packed DNS message, see RFC 8484 section 4.1.
+//
+// The request is sent using GET method, unless the method is "post", or the GET request
+// URL is longer than dohMaxGetURLLength.
+func newDohRequest(ctx context.Context, endpoint *url.URL, data []byte, method string) (*http.Request, error) {
+	if method != dohMethodPost {
+		u := *endpoint
+		query := u.Query()
+		query.Add("dns", base64.RawURLEncoding.EncodeToString(data))
+		u.RawQuery = query.Encode()
+		if rawURL := u.String(); len(rawURL) <= dohMaxGetURLLength {
+			return http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+		}
+	}
+	return http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), bytes.NewReader(data))
+}
+
 // addHeader adds necessary HTTP header to request based on upstream config.
 func addHeader(ctx context.Context, req *http.Request, uc *UpstreamConfig) {
 	printed := false
@@ -258,7 +287,7 @@ func clientIdFromHostname(hostname string) string {
 	subdomain = strings.Trim(subdomain, "-")
 
 	return subdomain
-} 
+}
 
 // wrapCertificateVerificationError wraps a certificate verification error with additional context about the certificate issuer.
 // It extracts information like the issuer, organization, and subject from the certificate for a more descriptive error output.
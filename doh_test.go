@@ -5,13 +5,17 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -184,6 +188,96 @@ func Test_ClientCertificateVerificationError(t *testing.T) {
 	}
 }
 
+func Test_dohResolver_Method(t *testing.T) {
+	var gotMethod atomic.Value
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod.Store(r.Method)
+		var data []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			data, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if ct := r.Header.Get("Content-Type"); ct != headerApplicationDNS {
+				err = fmt.Errorf("unexpected content type: %s", ct)
+				break
+			}
+			data, err = io.ReadAll(r.Body)
+		}
+		msg := new(dns.Msg)
+		if err == nil {
+			err = msg.Unpack(data)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		answer := new(dns.Msg)
+		answer.SetReply(msg)
+		buf, _ := answer.Pack()
+		w.Header().Set("Content-Type", headerApplicationDNS)
+		w.Write(buf)
+	})
+	tlsServer, cert := testTLSServer(t, handler)
+	http3Server := newTestHTTP3Server(t, handler)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	h3Pool := x509.NewCertPool()
+	h3Pool.AddCert(http3Server.cert)
+
+	smallMsg := new(dns.Msg)
+	smallMsg.SetQuestion("example.com.", dns.TypeA)
+	// A message which is too large to be sent using GET.
+	largeMsg := new(dns.Msg)
+	largeMsg.SetQuestion("example.com.", dns.TypeA)
+	largeMsg.SetEdns0(4096, false)
+	opt := largeMsg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, dohMaxGetURLLength)})
+
+	tests := []struct {
+		name       string
+		typ        string
+		endpoint   string
+		pool       *x509.CertPool
+		method     string
+		msg        *dns.Msg
+		wantMethod string
+	}{
+		{"doh default", ResolverTypeDOH, tlsServer.URL, pool, "", smallMsg, http.MethodGet},
+		{"doh get", ResolverTypeDOH, tlsServer.URL, pool, dohMethodGet, smallMsg, http.MethodGet},
+		{"doh post", ResolverTypeDOH, tlsServer.URL, pool, dohMethodPost, smallMsg, http.MethodPost},
+		{"doh get large message", ResolverTypeDOH, tlsServer.URL, pool, dohMethodGet, largeMsg, http.MethodPost},
+		{"doh3 get", ResolverTypeDOH3, http3Server.addr, h3Pool, dohMethodGet, smallMsg, http.MethodGet},
+		{"doh3 post", ResolverTypeDOH3, http3Server.addr, h3Pool, dohMethodPost, smallMsg, http.MethodPost},
+		{"doh3 get large message", ResolverTypeDOH3, http3Server.addr, h3Pool, "", largeMsg, http.MethodPost},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			uc := &UpstreamConfig{
+				Name:      tc.name,
+				Type:      tc.typ,
+				Endpoint:  tc.endpoint,
+				Timeout:   5000,
+				DohMethod: tc.method,
+			}
+			uc.Init()
+			uc.SetCertPool(tc.pool)
+			uc.SetupBootstrapIP()
+			r, err := NewResolver(uc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := r.Resolve(context.Background(), tc.msg); err != nil {
+				t.Fatal(err)
+			}
+			if got := gotMethod.Load(); got != tc.wantMethod {
+				t.Errorf("unexpected method, want: %s, got: %v", tc.wantMethod, got)
+			}
+		})
+	}
+}
+
 // testTLSServer creates an HTTPS test server with a self-signed certificate
 // returns the server and its certificate for verification testing
 // testTLSServer creates an HTTPS test server with a self-signed certificate
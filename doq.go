@@ -5,12 +5,29 @@ package ctrld
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
+	"runtime"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// doqMaxAttempts is the maximum number of attempts for a single DoQ query.
+	doqMaxAttempts = 5
+	// doqKeepAlivePeriod is the interval for sending keep-alive packets on idle DoQ connections.
+	// This is also our health check for idle connections, a dead connection will be closed
+	// by quic-go after doqMaxIdleTimeout without any response from the server.
+	doqKeepAlivePeriod = 15 * time.Second
+	// doqMaxIdleTimeout is the duration after which an unresponsive DoQ connection is closed.
+	doqMaxIdleTimeout = 30 * time.Second
+	// doqDialTimeout is the maximum duration for dialing a new DoQ connection.
+	doqDialTimeout = 5 * time.Second
 )
 
 type doqResolver struct {
@@ -19,7 +36,6 @@ type doqResolver struct {
 
 func (r *doqResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
 	endpoint := r.uc.Endpoint
-	tlsConfig := &tls.Config{NextProtos: []string{"doq"}}
 	ip := r.uc.BootstrapIP
 	if ip == "" {
 		dnsTyp := uint16(0)
@@ -28,44 +44,172 @@ func (r *doqResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, erro
 		}
 		ip = r.uc.bootstrapIPForDNSType(dnsTyp)
 	}
-	tlsConfig.ServerName = r.uc.Domain
 	_, port, _ := net.SplitHostPort(endpoint)
 	endpoint = net.JoinHostPort(ip, port)
-	return resolve(ctx, msg, endpoint, tlsConfig)
+	return r.uc.doqConnPool().resolve(ctx, msg, endpoint)
 }
 
-func resolve(ctx context.Context, msg *dns.Msg, endpoint string, tlsConfig *tls.Config) (*dns.Msg, error) {
-	// DoQ quic-go server returns io.EOF error after running for a long time,
-	// even for a good stream. So retrying the query for 5 times before giving up.
-	for i := 0; i < 5; i++ {
-		answer, err := doResolve(ctx, msg, endpoint, tlsConfig)
-		if err == io.EOF {
-			continue
-		}
+// doqPool maintains long-lived QUIC connections to a DoQ upstream, keyed by remote address.
+//
+// Each query is sent on a new stream of a pooled connection. The TLS session cache is
+// shared between connections, so re-connecting can use 0-RTT session resumption.
+type doqPool struct {
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+
+	mu    sync.Mutex
+	conns map[string]*quic.Conn
+	g     singleflight.Group
+}
+
+// newDoqPool creates a new doqPool for the given upstream config.
+func newDoqPool(uc *UpstreamConfig) *doqPool {
+	p := &doqPool{
+		tlsConfig: &tls.Config{
+			NextProtos:         []string{"doq"},
+			RootCAs:            uc.certPool,
+			ServerName:         uc.Domain,
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		},
+		quicConfig: &quic.Config{
+			KeepAlivePeriod: doqKeepAlivePeriod,
+			MaxIdleTimeout:  doqMaxIdleTimeout,
+		},
+		conns: make(map[string]*quic.Conn),
+	}
+	runtime.SetFinalizer(p, func(p *doqPool) {
+		p.closeAll()
+	})
+	return p
+}
+
+// doqConnPool returns the DoQ connection pool of the upstream, creating it if necessary.
+func (uc *UpstreamConfig) doqConnPool() *doqPool {
+	uc.doqPoolOnce.Do(func() {
+		uc.doqPool = newDoqPool(uc)
+	})
+	return uc.doqPool
+}
+
+// resolve sends the DNS query to endpoint using a pooled connection.
+//
+// If the pooled connection was closed by the server, it is discarded and the query
+// is retried transparently on a new connection.
+func (p *doqPool) resolve(ctx context.Context, msg *dns.Msg, endpoint string) (*dns.Msg, error) {
+	var lastErr error
+	for i := 0; i < doqMaxAttempts; i++ {
+		c, err := p.get(ctx, endpoint)
 		if err != nil {
 			return nil, wrapCertificateVerificationError(err)
 		}
-		return answer, nil
+		answer, err := doResolve(ctx, c, msg)
+		if err == nil {
+			return answer, nil
+		}
+		if !isDoqConnError(err) || ctx.Err() != nil {
+			return nil, wrapCertificateVerificationError(err)
+		}
+		ProxyLogger.Load().Debug().Err(err).Msgf("doq connection to %s is broken, reconnecting", endpoint)
+		p.remove(endpoint, c)
+		lastErr = err
+	}
+	if lastErr != nil && lastErr != io.EOF {
+		return nil, lastErr
 	}
 	return nil, &quic.ApplicationError{ErrorCode: quic.ApplicationErrorCode(quic.InternalError), ErrorMessage: quic.InternalError.Message()}
 }
 
-func doResolve(ctx context.Context, msg *dns.Msg, endpoint string, tlsConfig *tls.Config) (*dns.Msg, error) {
-	session, err := quic.DialAddr(ctx, endpoint, tlsConfig, nil)
-	if err != nil {
-		return nil, err
+// get returns a usable connection to endpoint, dialing a new one if needed.
+func (p *doqPool) get(ctx context.Context, endpoint string) (*quic.Conn, error) {
+	p.mu.Lock()
+	c := p.conns[endpoint]
+	p.mu.Unlock()
+	if c != nil {
+		// The connection context is done once the connection was closed,
+		// either by the server, or by quic-go after failed keep-alive.
+		if c.Context().Err() == nil {
+			return c, nil
+		}
+		p.remove(endpoint, c)
+	}
+
+	// Ensure only one dial is in flight for an endpoint. The dial is shared by
+	// all waiting queries, so it must not be canceled by any single caller.
+	ch := p.g.DoChan(endpoint, func() (any, error) {
+		dialCtx, cancel := context.WithTimeout(context.Background(), doqDialTimeout)
+		defer cancel()
+		conn, err := quic.DialAddrEarly(dialCtx, endpoint, p.tlsConfig, p.quicConfig)
+		if err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		p.conns[endpoint] = conn
+		p.mu.Unlock()
+		return conn, nil
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*quic.Conn), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// remove closes and removes the connection c of endpoint from the pool.
+func (p *doqPool) remove(endpoint string, c *quic.Conn) {
+	p.mu.Lock()
+	if p.conns[endpoint] == c {
+		delete(p.conns, endpoint)
+	}
+	p.mu.Unlock()
+	_ = c.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "")
+}
+
+// closeAll closes all pooled connections.
+func (p *doqPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for endpoint, c := range p.conns {
+		_ = c.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "")
+		delete(p.conns, endpoint)
+	}
+}
+
+// isDoqConnError reports whether err indicates that the QUIC connection
+// could not be used anymore, and the query should be retried on a new one.
+func isDoqConnError(err error) bool {
+	if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, quic.Err0RTTRejected) {
+		return true
 	}
-	defer session.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "")
+	var (
+		appErr       *quic.ApplicationError
+		idleErr      *quic.IdleTimeoutError
+		resetErr     *quic.StatelessResetError
+		transportErr *quic.TransportError
+		streamErr    *quic.StreamError
+	)
+	return errors.As(err, &appErr) ||
+		errors.As(err, &idleErr) ||
+		errors.As(err, &resetErr) ||
+		errors.As(err, &transportErr) ||
+		errors.As(err, &streamErr)
+}
 
+// doResolve sends msg on a new stream of the given connection and reads the answer.
+func doResolve(ctx context.Context, conn *quic.Conn, msg *dns.Msg) (*dns.Msg, error) {
 	msgBytes, err := msg.Pack()
 	if err != nil {
 		return nil, err
 	}
 
-	stream, err := session.OpenStream()
+	stream, err := conn.OpenStreamSync(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer stream.Close()
 
 	deadline, ok := ctx.Deadline()
 	if !ok {
@@ -73,33 +217,31 @@ func doResolve(ctx context.Context, msg *dns.Msg, endpoint string, tlsConfig *tl
 	}
 	_ = stream.SetDeadline(deadline)
 
-	var msgLen = uint16(len(msgBytes))
-	var msgLenBytes = []byte{byte(msgLen >> 8), byte(msgLen & 0xFF)}
-	if _, err := stream.Write(msgLenBytes); err != nil {
+	buf := make([]byte, 2+len(msgBytes))
+	buf[0] = byte(len(msgBytes) >> 8)
+	buf[1] = byte(len(msgBytes) & 0xFF)
+	copy(buf[2:], msgBytes)
+	if _, err := stream.Write(buf); err != nil {
 		return nil, err
 	}
 
-	if _, err := stream.Write(msgBytes); err != nil {
+	// DoQ quic-go server returns io.EOF error after running for a long time,
+	// even for a good stream. Make sure io.EOF error returned, so the caller
+	// can retry the query cleanly.
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(stream, lenBuf[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
 		return nil, err
 	}
-
-	buf, err := io.ReadAll(stream)
-	if err != nil {
+	answerBytes := make([]byte, int(lenBuf[0])<<8|int(lenBuf[1]))
+	if _, err := io.ReadFull(stream, answerBytes); err != nil {
 		return nil, err
 	}
 
-	_ = stream.Close()
-
-	// io.ReadAll hide the io.EOF error returned by quic-go server.
-	// Once we figure out why quic-go server sends io.EOF after running
-	// for a long time, we can have a better way to handle this. For now,
-	// make sure io.EOF error returned, so the caller can handle it cleanly.
-	if len(buf) == 0 {
-		return nil, io.EOF
-	}
-
 	answer := new(dns.Msg)
-	if err := answer.Unpack(buf[2:]); err != nil {
+	if err := answer.Unpack(answerBytes); err != nil {
 		return nil, err
 	}
 	answer.SetReply(msg)
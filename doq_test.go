@@ -8,9 +8,12 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"errors"
 	"math/big"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -87,6 +90,10 @@ type testQUICServer struct {
 	listener *quic.Listener
 	cert     *x509.Certificate
 	addr     string
+
+	numConns atomic.Int32
+	mu       sync.Mutex
+	conns    []*quic.Conn
 }
 
 // newTestQUICServer creates and initializes a test QUIC server with TLS configuration and starts accepting connections.
@@ -124,6 +131,13 @@ func newTestQUICServer(t *testing.T) *testQUICServer {
 	return server
 }
 
+// certPool returns a cert pool which trusts the server certificate.
+func (s *testQUICServer) certPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.cert)
+	return pool
+}
+
 // serve handles incoming connections on the QUIC listener and delegates them to connection handlers in separate goroutines.
 func (s *testQUICServer) serve(t *testing.T) {
 	for {
@@ -137,10 +151,24 @@ func (s *testQUICServer) serve(t *testing.T) {
 			continue
 		}
 
+		s.numConns.Add(1)
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
 		go s.handleConnection(t, conn)
 	}
 }
 
+// closeConns closes all accepted connections, simulating the server dropping its sessions.
+func (s *testQUICServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		_ = conn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "")
+	}
+	s.conns = nil
+}
+
 // handleConnection manages an individual QUIC connection by accepting and handling incoming streams in separate goroutines.
 func (s *testQUICServer) handleConnection(t *testing.T, conn *quic.Conn) {
 	for {
@@ -221,3 +249,136 @@ func (s *testQUICServer) handleStream(t *testing.T, stream *quic.Stream) {
 		return
 	}
 }
+
+func Test_doqResolver_ReuseConnection(t *testing.T) {
+	server := newTestQUICServer(t)
+	uc := &UpstreamConfig{
+		Name:     "doq",
+		Type:     ResolverTypeDOQ,
+		Endpoint: server.addr,
+		Timeout:  5000,
+	}
+	uc.Init()
+	uc.SetCertPool(server.certPool())
+
+	r, err := NewResolver(uc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		answer, err := r.Resolve(context.Background(), msg)
+		if err != nil {
+			t.Fatalf("query %d failed: %v", i, err)
+		}
+		if len(answer.Answer) != 1 {
+			t.Fatalf("unexpected answer: %v", answer)
+		}
+	}
+	if n := server.numConns.Load(); n != 1 {
+		t.Errorf("unexpected number of connections, want: 1, got: %d", n)
+	}
+}
+
+func Test_doqResolver_ConcurrentQueries(t *testing.T) {
+	server := newTestQUICServer(t)
+	uc := &UpstreamConfig{
+		Name:     "doq",
+		Type:     ResolverTypeDOQ,
+		Endpoint: server.addr,
+		Timeout:  5000,
+	}
+	uc.Init()
+	uc.SetCertPool(server.certPool())
+
+	r, err := NewResolver(uc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errCh := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			if _, err := r.Resolve(context.Background(), msg); err != nil {
+				errCh <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Error(err)
+	}
+	if n := server.numConns.Load(); n != 1 {
+		t.Errorf("unexpected number of connections, want: 1, got: %d", n)
+	}
+}
+
+func Test_doqResolver_Reconnect(t *testing.T) {
+	server := newTestQUICServer(t)
+	uc := &UpstreamConfig{
+		Name:     "doq",
+		Type:     ResolverTypeDOQ,
+		Endpoint: server.addr,
+		Timeout:  5000,
+	}
+	uc.Init()
+	uc.SetCertPool(server.certPool())
+
+	r, err := NewResolver(uc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolve := func() {
+		t.Helper()
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		if _, err := r.Resolve(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resolve()
+	server.closeConns()
+	// Wait for the client to observe the connection close.
+	time.Sleep(100 * time.Millisecond)
+	resolve()
+	if n := server.numConns.Load(); n != 2 {
+		t.Errorf("unexpected number of connections, want: 2, got: %d", n)
+	}
+}
+
+func Test_doqResolver_CanceledCallerDoesNotAbortDial(t *testing.T) {
+	server := newTestQUICServer(t)
+	uc := &UpstreamConfig{
+		Name:     "doq",
+		Type:     ResolverTypeDOQ,
+		Endpoint: server.addr,
+		Timeout:  5000,
+	}
+	uc.Init()
+	uc.SetCertPool(server.certPool())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := uc.doqConnPool().get(ctx, server.addr); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error, want: %v, got: %v", context.Canceled, err)
+	}
+
+	r, err := NewResolver(uc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if _, err := r.Resolve(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.numConns.Load(); n != 1 {
+		t.Errorf("unexpected number of connections, want: 1, got: %d", n)
+	}
+}
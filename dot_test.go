@@ -0,0 +1,268 @@
+package ctrld
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testDoTServer is a DoT server which answers pipelined queries concurrently.
+type testDoTServer struct {
+	listener net.Listener
+	cert     *x509.Certificate
+	addr     string
+
+	// closeAfterAnswer makes the server close the connection after sending an answer.
+	closeAfterAnswer atomic.Bool
+	numConns         atomic.Int32
+}
+
+// newTestDoTServer creates a DoT server and starts accepting connections.
+//
+// Queries for "slow.example.com." are answered after a delay,
+// so answers for other queries arrive out of order.
+func newTestDoTServer(t *testing.T) *testDoTServer {
+	t.Helper()
+
+	testCert := generateTestCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{testCert.tlsCert},
+	})
+	if err != nil {
+		t.Fatalf("failed to create TLS listener: %v", err)
+	}
+	server := &testDoTServer{
+		listener: listener,
+		cert:     testCert.cert,
+		addr:     listener.Addr().String(),
+	}
+	go server.serve()
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	return server
+}
+
+// newTestTCPServer creates a plain DNS over TCP server and starts accepting connections.
+func newTestTCPServer(t *testing.T) *testDoTServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create TCP listener: %v", err)
+	}
+	server := &testDoTServer{
+		listener: listener,
+		addr:     listener.Addr().String(),
+	}
+	go server.serve()
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	return server
+}
+
+// certPool returns a cert pool which trusts the server certificate.
+func (s *testDoTServer) certPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.cert)
+	return pool
+}
+
+func (s *testDoTServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.numConns.Add(1)
+		go s.handleConnection(&dns.Conn{Conn: conn})
+	}
+}
+
+func (s *testDoTServer) handleConnection(conn *dns.Conn) {
+	defer conn.Close()
+	var mu sync.Mutex
+	for {
+		msg, err := conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		go func() {
+			if msg.Question[0].Name == "slow.example.com." {
+				time.Sleep(200 * time.Millisecond)
+			}
+			answer := new(dns.Msg)
+			answer.SetReply(msg)
+			answer.Answer = append(answer.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP("192.0.2.1"),
+			})
+			mu.Lock()
+			defer mu.Unlock()
+			_ = conn.WriteMsg(answer)
+			if s.closeAfterAnswer.Load() {
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func newTestDoTResolver(t *testing.T, server *testDoTServer) Resolver {
+	t.Helper()
+	uc := &UpstreamConfig{
+		Name:     "dot",
+		Type:     ResolverTypeDOT,
+		Endpoint: server.addr,
+		Timeout:  5000,
+	}
+	uc.Init()
+	uc.SetCertPool(server.certPool())
+	r, err := NewResolver(uc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func Test_dotResolver_ReuseConnection(t *testing.T) {
+	server := newTestDoTServer(t)
+	r := newTestDoTResolver(t, server)
+
+	for i := 0; i < 10; i++ {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		answer, err := r.Resolve(context.Background(), msg)
+		if err != nil {
+			t.Fatalf("query %d failed: %v", i, err)
+		}
+		if answer.Id != msg.Id {
+			t.Errorf("unexpected answer id, want: %d, got: %d", msg.Id, answer.Id)
+		}
+	}
+	if n := server.numConns.Load(); n != 1 {
+		t.Errorf("unexpected number of connections, want: 1, got: %d", n)
+	}
+}
+
+func Test_dotResolver_Pipelining(t *testing.T) {
+	server := newTestDoTServer(t)
+	r := newTestDoTResolver(t, server)
+
+	// Establish the connection first, so all queries below share it.
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if _, err := r.Resolve(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var order []string
+	var mu sync.Mutex
+	for _, name := range []string{"slow.example.com.", "fast.example.com."} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := new(dns.Msg)
+			// Same ID for both queries, as if they came from different clients.
+			msg.Id = 1
+			msg.SetQuestion(name, dns.TypeA)
+			answer, err := r.Resolve(context.Background(), msg)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got := answer.Answer[0].Header().Name; got != name {
+				t.Errorf("mismatched answer, want: %s, got: %s", name, got)
+			}
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+		}()
+		// Make sure the slow query is sent first.
+		time.Sleep(20 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if len(order) != 2 || order[0] != "fast.example.com." {
+		t.Errorf("answers were not pipelined, got order: %v", order)
+	}
+	if n := server.numConns.Load(); n != 1 {
+		t.Errorf("unexpected number of connections, want: 1, got: %d", n)
+	}
+}
+
+func Test_dotResolver_Reconnect(t *testing.T) {
+	server := newTestDoTServer(t)
+	server.closeAfterAnswer.Store(true)
+	r := newTestDoTResolver(t, server)
+
+	for i := 0; i < 3; i++ {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		if _, err := r.Resolve(context.Background(), msg); err != nil {
+			t.Fatalf("query %d failed: %v", i, err)
+		}
+	}
+	if n := server.numConns.Load(); n != 3 {
+		t.Errorf("unexpected number of connections, want: 3, got: %d", n)
+	}
+}
+
+func Test_legacyResolver_TCPReuseConnection(t *testing.T) {
+	server := newTestTCPServer(t)
+	uc := &UpstreamConfig{
+		Name:     "legacy",
+		Type:     ResolverTypeLegacy,
+		Endpoint: "tcp://" + server.addr,
+		Timeout:  5000,
+	}
+	uc.Init()
+	r, err := NewResolver(uc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		if _, err := r.Resolve(context.Background(), msg); err != nil {
+			t.Fatalf("query %d failed: %v", i, err)
+		}
+	}
+	if n := server.numConns.Load(); n != 1 {
+		t.Errorf("unexpected number of connections, want: 1, got: %d", n)
+	}
+}
+
+func Test_dnsConnPool_FinalizerClosesConnections(t *testing.T) {
+	server := newTestTCPServer(t)
+	p := newDnsConnPool(&UpstreamConfig{Type: ResolverTypeLegacy})
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if _, err := p.exchange(context.Background(), msg, "tcp", server.addr); err != nil {
+		t.Fatal(err)
+	}
+	c := p.conns.get("tcp|" + server.addr)
+	if c == nil {
+		t.Fatal("connection was not pooled")
+	}
+
+	// The live connection must not keep the pool reachable.
+	p = nil
+	for i := 0; i < 50 && !c.isClosed(); i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !c.isClosed() {
+		t.Error("pooled connection was not closed after the pool was garbage collected")
+	}
+}
@@ -0,0 +1,222 @@
+package blocklist
+
+import (
+	"bufio"
+	"io"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// hostsIgnoredNames is the list of names found in hosts files which must never be blocked.
+var hostsIgnoredNames = map[string]struct{}{
+	"localhost":             {},
+	"localhost.localdomain": {},
+	"local":                 {},
+	"broadcasthost":         {},
+	"ip6-localhost":         {},
+	"ip6-loopback":          {},
+	"ip6-localnet":          {},
+	"ip6-mcastprefix":       {},
+	"ip6-allnodes":          {},
+	"ip6-allrouters":        {},
+	"ip6-allhosts":          {},
+	"0.0.0.0":               {},
+}
+
+// node is a node of the suffix trie, children are keyed by domain labels.
+type node struct {
+	children map[string]*node
+	// exact reports whether the domain ends at this node.
+	exact bool
+	// subdomains reports whether all subdomains of this node are matched.
+	subdomains bool
+}
+
+// child returns the child node of the given label, creating it if necessary.
+func (n *node) child(label string) *node {
+	if n.children == nil {
+		n.children = make(map[string]*node, 1)
+	}
+	c := n.children[label]
+	if c == nil {
+		c = &node{}
+		n.children[label] = c
+	}
+	return c
+}
+
+// trie is a suffix trie of domain names, stored from the top level label,
+// so domains which share the same suffix share the same nodes.
+type trie struct {
+	root node
+	size int
+}
+
+// add adds domain to trie. If subdomains is true, all subdomains of domain are matched too.
+// A "*." prefixed domain matches its subdomains only.
+func (t *trie) add(domain string, subdomains bool) {
+	wildcard, isWildcard := strings.CutPrefix(domain, "*.")
+	if isWildcard {
+		domain = wildcard
+	}
+	n := &t.root
+	labels := dns.SplitDomainName(domain)
+	for i := len(labels) - 1; i >= 0; i-- {
+		n = n.child(labels[i])
+	}
+	if !n.exact && !n.subdomains {
+		t.size++
+	}
+	n.exact = n.exact || !isWildcard
+	n.subdomains = n.subdomains || subdomains || isWildcard
+}
+
+// match reports whether name is in trie.
+func (t *trie) match(name string) bool {
+	n := &t.root
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		if n.subdomains {
+			return true
+		}
+		n = n.children[labels[i]]
+		if n == nil {
+			return false
+		}
+	}
+	return n.exact
+}
+
+// List is a list of blocked domains.
+type List struct {
+	blocked trie
+	allowed trie
+}
+
+// New returns an empty List.
+func New() *List {
+	return &List{}
+}
+
+// Block adds domain to the list. If subdomains is true, all subdomains of domain are blocked too.
+// A "*." prefixed domain blocks its subdomains only.
+func (l *List) Block(domain string, subdomains bool) {
+	l.blocked.add(normalize(domain), subdomains)
+}
+
+// Allow adds an exception for domain. If subdomains is true, the exception covers all subdomains of domain.
+func (l *List) Allow(domain string, subdomains bool) {
+	l.allowed.add(normalize(domain), subdomains)
+}
+
+// Match reports whether name is blocked by the list.
+func (l *List) Match(name string) bool {
+	if l == nil {
+		return false
+	}
+	name = normalize(name)
+	return l.blocked.match(name) && !l.allowed.match(name)
+}
+
+// Len returns the number of blocked domains in the list.
+func (l *List) Len() int {
+	if l == nil {
+		return 0
+	}
+	return l.blocked.size
+}
+
+// Parse reads blocked domains from r, line by line, and adds them to the list.
+// The format of each line is detected automatically, supported formats are:
+//
+//   - hosts: "0.0.0.0 example.com", the domain is blocked, but not its subdomains.
+//   - AdBlock: "||example.com^", the domain and all its subdomains are blocked,
+//     "@@||example.com^" exceptions are supported. Rules with modifiers or paths are ignored.
+//   - plain domain: "example.com", the domain is blocked, but not its subdomains.
+//     "*.example.com" blocks all subdomains of "example.com".
+//
+// Comments and invalid lines are ignored.
+func (l *List) Parse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		l.parseLine(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+func (l *List) parseLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	switch line[0] {
+	case '#', '!', '[':
+		return
+	}
+	if rule, ok := strings.CutPrefix(line, "@@||"); ok {
+		if domain, ok := parseAdblockRule(rule); ok {
+			l.Allow(domain, true)
+		}
+		return
+	}
+	if rule, ok := strings.CutPrefix(line, "||"); ok {
+		if domain, ok := parseAdblockRule(rule); ok {
+			l.Block(domain, true)
+		}
+		return
+	}
+	if before, _, found := strings.Cut(line, "#"); found {
+		line = before
+	}
+	fields := strings.Fields(line)
+	switch len(fields) {
+	case 0:
+		return
+	case 1:
+		domain := fields[0]
+		if isValidDomain(strings.TrimPrefix(domain, "*.")) {
+			l.Block(domain, false)
+		}
+	default:
+		if _, err := netip.ParseAddr(fields[0]); err != nil {
+			return
+		}
+		for _, domain := range fields[1:] {
+			if _, ignored := hostsIgnoredNames[strings.ToLower(domain)]; ignored {
+				continue
+			}
+			if isValidDomain(domain) {
+				l.Block(domain, false)
+			}
+		}
+	}
+}
+
+// parseAdblockRule returns the domain of AdBlock rule, without the leading "||".
+// Only basic domain rules, "example.com^" or "example.com^|" are supported.
+func parseAdblockRule(rule string) (string, bool) {
+	domain, rest, found := strings.Cut(rule, "^")
+	if !found || (rest != "" && rest != "|") {
+		return "", false
+	}
+	return domain, isValidDomain(domain)
+}
+
+// isValidDomain reports whether s is a valid domain name, which can be blocked.
+func isValidDomain(s string) bool {
+	if s == "" || strings.ContainsAny(s, "*/:") {
+		return false
+	}
+	if _, err := netip.ParseAddr(s); err == nil {
+		return false
+	}
+	_, ok := dns.IsDomainName(s)
+	return ok
+}
+
+// normalize returns the lower case form of domain, without the trailing dot.
+func normalize(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
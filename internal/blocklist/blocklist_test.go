@@ -0,0 +1,95 @@
+package blocklist
+
+import (
+	"strings"
+	"testing"
+)
+
+const testList = `# hosts format
+0.0.0.0 ads.example.com
+127.0.0.1 localhost
+::1 ip6-localhost tracker.example.net # inline comment
+! AdBlock format
+[Adblock Plus 2.0]
+||doubleclick.test^
+||exception.doubleclick.test^
+@@||exception.doubleclick.test^
+||with-modifier.test^$third-party
+||example.org/path^
+# plain domain format
+plain.example.com
+*.wildcard.example.com
+not a valid line
+`
+
+func TestList_Parse(t *testing.T) {
+	l := New()
+	if err := l.Parse(strings.NewReader(testList)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		blocked bool
+	}{
+		{"ads.example.com", true},
+		{"ADS.Example.COM.", true},
+		{"sub.ads.example.com", false},
+		{"example.com", false},
+		{"localhost", false},
+		{"ip6-localhost", false},
+		{"tracker.example.net", true},
+		{"doubleclick.test", true},
+		{"ad.doubleclick.test", true},
+		{"a.b.doubleclick.test", true},
+		{"exception.doubleclick.test", false},
+		{"sub.exception.doubleclick.test", false},
+		{"with-modifier.test", false},
+		{"example.org", false},
+		{"plain.example.com", true},
+		{"sub.plain.example.com", false},
+		{"wildcard.example.com", false},
+		{"sub.wildcard.example.com", true},
+		{"a.sub.wildcard.example.com", true},
+		{"valid", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := l.Match(tc.name); got != tc.blocked {
+				t.Errorf("unexpected result, want: %v, got: %v", tc.blocked, got)
+			}
+		})
+	}
+	if got := l.Len(); got != 6 {
+		t.Errorf("unexpected number of blocked domains, want: 6, got: %d", got)
+	}
+}
+
+func TestList_Nil(t *testing.T) {
+	var l *List
+	if l.Match("example.com") {
+		t.Error("nil list must not block anything")
+	}
+	if l.Len() != 0 {
+		t.Error("nil list must be empty")
+	}
+}
+
+func BenchmarkList_Match(b *testing.B) {
+	l := New()
+	var sb strings.Builder
+	for i := 0; i < 100_000; i++ {
+		sb.WriteString("0.0.0.0 host")
+		sb.WriteString(strings.Repeat("x", i%10))
+		sb.WriteString(".domain")
+		sb.WriteString(string(rune('a' + i%26)))
+		sb.WriteString(".com\n")
+	}
+	if err := l.Parse(strings.NewReader(sb.String())); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.Match("www.hostxxx.domaind.com")
+	}
+}
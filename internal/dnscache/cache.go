@@ -1,7 +1,9 @@
 package dnscache
 
 import (
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru/v2"
@@ -12,7 +14,11 @@ import (
 type Cacher interface {
 	Get(Key) *Value
 	Add(Key, *Value)
+	Remove(Key) bool
+	Range(func(Key, *Value) bool)
+	Len() int
 	Purge()
+	PurgeUpstreams(upstreams ...string)
 }
 
 // Key is the caching key for DNS message.
@@ -21,11 +27,32 @@ type Key struct {
 	Qclass   uint16
 	Name     string
 	Upstream string
+	// Dnssec reports whether the cached response was validated with DNSSEC.
+	Dnssec bool
+	// Scope is the policy identity of the client, like its client ID, MAC or matched network,
+	// so clients with different policies do not share cached responses. Empty means shared.
+	Scope string
+	// Subnet is the EDNS0 client subnet sent to the upstream, if the response is specific to it.
+	Subnet string
 }
 
 type Value struct {
 	Expire time.Time
 	Msg    *dns.Msg
+	// Negative reports whether the cached response is a negative one (NXDOMAIN or NODATA), see RFC 2308.
+	Negative bool
+
+	hits atomic.Int64
+}
+
+// Hit records a cache hit of the value, returning the number of hits so far.
+func (v *Value) Hit() int64 {
+	return v.hits.Add(1)
+}
+
+// Hits returns the number of cache hits of the value.
+func (v *Value) Hits() int64 {
+	return v.hits.Load()
 }
 
 var _ Cacher = (*LRUCache)(nil)
@@ -46,11 +73,47 @@ func (l *LRUCache) Add(key Key, value *Value) {
 	l.cacher.Add(key, value)
 }
 
+// Remove removes key's value from cache, reporting whether it was present.
+func (l *LRUCache) Remove(key Key) bool {
+	if !l.cacher.Contains(key) {
+		return false
+	}
+	l.cacher.Remove(key)
+	return true
+}
+
+// Range calls f for each cached value, without updating their recentness, until f returns false.
+func (l *LRUCache) Range(f func(Key, *Value) bool) {
+	for _, key := range l.cacher.Keys() {
+		v, ok := l.cacher.Peek(key)
+		if !ok {
+			continue
+		}
+		if !f(key, v) {
+			return
+		}
+	}
+}
+
+// Len returns the number of cached values.
+func (l *LRUCache) Len() int {
+	return l.cacher.Len()
+}
+
 // Purge clears the cache.
 func (l *LRUCache) Purge() {
 	l.cacher.Purge()
 }
 
+// PurgeUpstreams removes cached values of the given upstreams.
+func (l *LRUCache) PurgeUpstreams(upstreams ...string) {
+	for _, key := range l.cacher.Keys() {
+		if slices.Contains(upstreams, key.Upstream) {
+			l.cacher.Remove(key)
+		}
+	}
+}
+
 // NewLRUCache creates a new LRUCache instance with given size.
 func NewLRUCache(size int) (*LRUCache, error) {
 	cacher, err := lru.NewARC[Key, *Value](size)
@@ -63,12 +126,31 @@ func NewKey(msg *dns.Msg, upstream string) Key {
 	return Key{Qtype: q.Qtype, Qclass: q.Qclass, Name: normalizeQname(q.Name), Upstream: upstream}
 }
 
+// NewDnssecKey creates a new cache key for given DNS message, whose response is validated with DNSSEC.
+func NewDnssecKey(msg *dns.Msg, upstream string) Key {
+	key := NewKey(msg, upstream)
+	key.Dnssec = true
+	return key
+}
+
 // NewValue creates a new cache value for given DNS message.
 func NewValue(msg *dns.Msg, expire time.Time) *Value {
 	return &Value{
-		Expire: expire,
-		Msg:    msg,
+		Expire:   expire,
+		Msg:      msg,
+		Negative: IsNegative(msg),
+	}
+}
+
+// IsNegative reports whether msg is a negative response, either NXDOMAIN or NODATA.
+func IsNegative(msg *dns.Msg) bool {
+	switch msg.Rcode {
+	case dns.RcodeNameError:
+		return true
+	case dns.RcodeSuccess:
+		return len(msg.Answer) == 0
 	}
+	return false
 }
 
 func normalizeQname(name string) string {
@@ -0,0 +1,183 @@
+package dnscache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// persistentCacheMagic identifies persistent cache files, the last two bytes are the format version.
+var persistentCacheMagic = []byte("CTRLDC01")
+
+// maxPersistentCacheEntrySize is the maximum size of a persisted DNS message, used to bound the snapshot file size.
+const maxPersistentCacheEntrySize = dns.MaxMsgSize
+
+var errCorruptedCacheFile = errors.New("corrupted cache file")
+
+var _ Cacher = (*PersistentCache)(nil)
+
+// PersistentCache is a Cacher, which can be snapshotted to a file, and restored from it,
+// so cached values survive restarts.
+type PersistentCache struct {
+	Cacher
+	size int
+	path string
+	// now returns the current time, tests use it to control expiration of restored values.
+	now func() time.Time
+
+	mu sync.Mutex // serializes snapshots.
+}
+
+// persistentEntry is a cached value, as stored in the snapshot file.
+type persistentEntry struct {
+	Key    Key
+	Expire int64 // Unix nanoseconds.
+	Msg    []byte
+}
+
+// NewPersistentCache creates a new PersistentCache instance with given size, using the file at path for snapshots.
+// The cache is empty, Load must be called to restore the snapshot.
+func NewPersistentCache(size int, path string) (*PersistentCache, error) {
+	l, err := NewLRUCache(size)
+	if err != nil {
+		return nil, err
+	}
+	return newPersistentCache(l, size, path), nil
+}
+
+// NewShardedPersistentCache is like NewPersistentCache, but cached values are stored in a ShardedCache.
+func NewShardedPersistentCache(size, shards int, path string) (*PersistentCache, error) {
+	c, err := NewShardedCache(size, shards)
+	if err != nil {
+		return nil, err
+	}
+	return newPersistentCache(c, size, path), nil
+}
+
+func newPersistentCache(c Cacher, size int, path string) *PersistentCache {
+	return &PersistentCache{Cacher: c, size: size, path: path, now: time.Now}
+}
+
+// Load restores cached values from the snapshot file, skipping the expired ones.
+// It returns the number of restored values. A missing snapshot file is not an error,
+// while a corrupted one is removed, so the cache starts empty.
+func (p *PersistentCache) Load() (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entries, err := p.read()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		_ = os.Remove(p.path)
+		return 0, err
+	}
+	now := p.now()
+	n := 0
+	for _, e := range entries {
+		expire := time.Unix(0, e.Expire)
+		if !expire.After(now) {
+			continue
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(e.Msg); err != nil || len(msg.Question) == 0 {
+			continue
+		}
+		p.Add(e.Key, NewValue(msg, expire))
+		n++
+	}
+	return n, nil
+}
+
+// read reads and verifies the snapshot file.
+func (p *PersistentCache) read() ([]persistentEntry, error) {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// Do not trust the file to be size-bounded, a snapshot is at most the cache size of maximum DNS messages.
+	maxSize := int64(len(persistentCacheMagic)+crc32.Size) + int64(p.size)*(maxPersistentCacheEntrySize+512)
+	if fi.Size() > maxSize {
+		return nil, fmt.Errorf("%w: file too large: %d bytes", errCorruptedCacheFile, fi.Size())
+	}
+	data := make([]byte, fi.Size())
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, err
+	}
+	if len(data) < len(persistentCacheMagic)+crc32.Size || !bytes.Equal(data[:len(persistentCacheMagic)], persistentCacheMagic) {
+		return nil, fmt.Errorf("%w: invalid header", errCorruptedCacheFile)
+	}
+	payload := data[len(persistentCacheMagic) : len(data)-crc32.Size]
+	sum := data[len(data)-crc32.Size:]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(sum) {
+		return nil, fmt.Errorf("%w: checksum mismatch", errCorruptedCacheFile)
+	}
+	var entries []persistentEntry
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("%w: %v", errCorruptedCacheFile, err)
+	}
+	return entries, nil
+}
+
+// Save snapshots the non-expired cached values to the snapshot file.
+// The file is replaced atomically, so a crash while saving does not corrupt the previous snapshot.
+func (p *PersistentCache) Save() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	var entries []persistentEntry
+	p.Range(func(key Key, v *Value) bool {
+		if !v.Expire.After(now) {
+			return true
+		}
+		if msg, err := v.Msg.Pack(); err == nil {
+			entries = append(entries, persistentEntry{Key: key, Expire: v.Expire.UnixNano(), Msg: msg})
+		}
+		return true
+	})
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(entries); err != nil {
+		return err
+	}
+	sum := crc32.ChecksumIEEE(payload.Bytes())
+
+	if err := os.MkdirAll(filepath.Dir(p.path), 0750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p.path), filepath.Base(p.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	data := make([]byte, 0, len(persistentCacheMagic)+payload.Len()+crc32.Size)
+	data = append(data, persistentCacheMagic...)
+	data = append(data, payload.Bytes()...)
+	data = binary.BigEndian.AppendUint32(data, sum)
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.path)
+}
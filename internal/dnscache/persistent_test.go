@@ -0,0 +1,85 @@
+package dnscache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMsg(name string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	return msg
+}
+
+func TestPersistentCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.bin")
+	now := time.Now()
+	c, err := NewPersistentCache(16, path)
+	require.NoError(t, err)
+	c.now = func() time.Time { return now }
+
+	n, err := c.Load()
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	fresh, soon, expired := newTestMsg("fresh.example."), newTestMsg("soon.example."), newTestMsg("expired.example.")
+	c.Add(NewKey(fresh, "upstream.0"), NewValue(fresh, now.Add(time.Hour)))
+	c.Add(NewDnssecKey(soon, "upstream.0"), NewValue(soon, now.Add(time.Minute)))
+	c.Add(NewKey(expired, "upstream.0"), NewValue(expired, now.Add(-time.Minute)))
+	require.NoError(t, c.Save())
+
+	restored, err := NewPersistentCache(16, path)
+	require.NoError(t, err)
+	restored.now = func() time.Time { return now.Add(2 * time.Minute) }
+	n, err = restored.Load()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	v := restored.Get(NewKey(fresh, "upstream.0"))
+	require.NotNil(t, v)
+	assert.Equal(t, now.Add(time.Hour).UnixNano(), v.Expire.UnixNano())
+	assert.Equal(t, "fresh.example.", v.Msg.Question[0].Name)
+	assert.Nil(t, restored.Get(NewDnssecKey(soon, "upstream.0")))
+	assert.Nil(t, restored.Get(NewKey(expired, "upstream.0")))
+}
+
+func TestPersistentCacheCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.bin")
+	c, err := NewPersistentCache(16, path)
+	require.NoError(t, err)
+	msg := newTestMsg("example.")
+	c.Add(NewKey(msg, "upstream.0"), NewValue(msg, time.Now().Add(time.Hour)))
+	require.NoError(t, c.Save())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"invalid header", append([]byte("garbage!"), data[len(persistentCacheMagic):]...)},
+		{"truncated", data[:len(data)-10]},
+		{"flipped byte", func() []byte {
+			b := append([]byte(nil), data...)
+			b[len(persistentCacheMagic)+5] ^= 0xff
+			return b
+		}()},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, os.WriteFile(path, tc.data, 0600))
+			c, err := NewPersistentCache(16, path)
+			require.NoError(t, err)
+			n, err := c.Load()
+			assert.ErrorIs(t, err, errCorruptedCacheFile)
+			assert.Zero(t, n)
+			assert.NoFileExists(t, path)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package dnscache
+
+import (
+	"hash/maphash"
+)
+
+var _ Cacher = (*ShardedCache)(nil)
+
+// ShardedCache implements Cacher interface, spreading cached values over multiple LRUCache shards,
+// so concurrent accesses to different keys do not contend on a single lock.
+type ShardedCache struct {
+	shards []*LRUCache
+	seed   maphash.Seed
+}
+
+// NewShardedCache creates a new ShardedCache instance with given total size, and number of shards.
+func NewShardedCache(size, shards int) (*ShardedCache, error) {
+	shards = max(shards, 1)
+	shardSize := max((size+shards-1)/shards, 1)
+	c := &ShardedCache{shards: make([]*LRUCache, shards), seed: maphash.MakeSeed()}
+	for i := range c.shards {
+		l, err := NewLRUCache(shardSize)
+		if err != nil {
+			return nil, err
+		}
+		c.shards[i] = l
+	}
+	return c, nil
+}
+
+// shard returns the shard, where the value of key is stored.
+func (c *ShardedCache) shard(key Key) *LRUCache {
+	var h maphash.Hash
+	h.SetSeed(c.seed)
+	h.WriteString(key.Name)
+	h.WriteString(key.Upstream)
+	h.WriteString(key.Scope)
+	h.WriteString(key.Subnet)
+	h.WriteByte(byte(key.Qtype >> 8))
+	h.WriteByte(byte(key.Qtype))
+	return c.shards[h.Sum64()%uint64(len(c.shards))]
+}
+
+// Get looks up key's value from cache.
+func (c *ShardedCache) Get(key Key) *Value {
+	return c.shard(key).Get(key)
+}
+
+// Add adds a value to cache.
+func (c *ShardedCache) Add(key Key, value *Value) {
+	c.shard(key).Add(key, value)
+}
+
+// Remove removes key's value from cache, reporting whether it was present.
+func (c *ShardedCache) Remove(key Key) bool {
+	return c.shard(key).Remove(key)
+}
+
+// Range calls f for each cached value, without updating their recentness, until f returns false.
+func (c *ShardedCache) Range(f func(Key, *Value) bool) {
+	for _, l := range c.shards {
+		stopped := false
+		l.Range(func(key Key, v *Value) bool {
+			stopped = !f(key, v)
+			return !stopped
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+// Len returns the number of cached values.
+func (c *ShardedCache) Len() int {
+	n := 0
+	for _, l := range c.shards {
+		n += l.Len()
+	}
+	return n
+}
+
+// Purge clears the cache.
+func (c *ShardedCache) Purge() {
+	for _, l := range c.shards {
+		l.Purge()
+	}
+}
+
+// PurgeUpstreams removes cached values of the given upstreams.
+func (c *ShardedCache) PurgeUpstreams(upstreams ...string) {
+	for _, l := range c.shards {
+		l.PurgeUpstreams(upstreams...)
+	}
+}
@@ -0,0 +1,46 @@
+package dnscache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardedCache(t *testing.T) {
+	c, err := NewShardedCache(64, 4)
+	require.NoError(t, err)
+	require.Len(t, c.shards, 4)
+
+	expire := time.Now().Add(time.Hour)
+	for i := 0; i < 16; i++ {
+		msg := newTestMsg(fmt.Sprintf("%d.example.", i))
+		c.Add(NewKey(msg, fmt.Sprintf("upstream.%d", i%2)), NewValue(msg, expire))
+	}
+	assert.Equal(t, 16, c.Len())
+
+	msg := newTestMsg("1.example.")
+	key := NewKey(msg, "upstream.1")
+	require.NotNil(t, c.Get(key))
+	scoped := key
+	scoped.Scope = "client"
+	assert.Nil(t, c.Get(scoped), "scoped key must not share cached value")
+
+	n := 0
+	c.Range(func(Key, *Value) bool {
+		n++
+		return n < 5
+	})
+	assert.Equal(t, 5, n)
+
+	assert.True(t, c.Remove(key))
+	assert.False(t, c.Remove(key))
+	assert.Nil(t, c.Get(key))
+
+	c.PurgeUpstreams("upstream.0")
+	assert.Equal(t, 7, c.Len())
+	c.Purge()
+	assert.Zero(t, c.Len())
+}
@@ -0,0 +1,338 @@
+package querylog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// dnstapContentType is the Frame Streams content type of dnstap data frames.
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// Frame Streams control frame types and fields.
+// See: https://github.com/farsightsec/fstrm/blob/master/fstrm/control.h
+const (
+	fstrmControlAccept = 0x01
+	fstrmControlStart  = 0x02
+	fstrmControlStop   = 0x03
+	fstrmControlReady  = 0x04
+	fstrmControlFinish = 0x05
+
+	fstrmFieldContentType = 0x01
+
+	fstrmMaxControlFrameSize = 512
+)
+
+// dnstap protobuf message values.
+// See: https://github.com/dnstap/dnstap.pb/blob/master/dnstap.proto
+const (
+	dnstapTypeMessage             = 1
+	dnstapMessageClientResponse   = 6
+	dnstapSocketFamilyInet        = 1
+	dnstapSocketFamilyInet6       = 2
+	dnstapSocketProtocolUDP       = 1
+	dnstapSocketProtocolTCP       = 2
+	dnstapFieldIdentity           = 1
+	dnstapFieldVersion            = 2
+	dnstapFieldExtra              = 3
+	dnstapFieldMessage            = 14
+	dnstapFieldType               = 15
+	dnstapMessageFieldType        = 1
+	dnstapMessageFieldFamily      = 2
+	dnstapMessageFieldProtocol    = 3
+	dnstapMessageFieldQueryAddr   = 4
+	dnstapMessageFieldRespAddr    = 5
+	dnstapMessageFieldQueryPort   = 6
+	dnstapMessageFieldRespPort    = 7
+	dnstapMessageFieldQueryTime   = 8
+	dnstapMessageFieldQueryNsec   = 9
+	dnstapMessageFieldQueryMsg    = 10
+	dnstapMessageFieldRespTime    = 12
+	dnstapMessageFieldRespNsec    = 13
+	dnstapMessageFieldResponseMsg = 14
+)
+
+const (
+	dnstapRedialInterval   = 5 * time.Second
+	dnstapHandshakeTimeout = 5 * time.Second
+	dnstapFinishTimeout    = time.Second
+)
+
+var errDnstapNotAccepted = errors.New("dnstap receiver did not accept content type")
+
+var _ Sink = (*DnstapSink)(nil)
+
+// DnstapSink writes records as dnstap CLIENT_RESPONSE messages, using Frame Streams, either to a file,
+// or to a unix socket. The query log record itself is stored as JSON in the dnstap "extra" field.
+type DnstapSink struct {
+	identity []byte
+	version  []byte
+	file     *logFile
+	socket   string
+
+	c        io.ReadWriteCloser
+	w        *bufio.Writer
+	lastDial time.Time
+}
+
+// NewDnstapFileSink returns a new DnstapSink writing to the file at path. An existing file is rotated,
+// since each file holds a single Frame Streams stream. The file is rotated when its size exceeds maxSize
+// bytes, keeping at most maxBackups rotated files. A zero maxSize disables rotation.
+func NewDnstapFileSink(path, identity, version string, maxSize int64, maxBackups int) (*DnstapSink, error) {
+	var start, stop bytes.Buffer
+	_ = writeControlFrame(&start, fstrmControlStart, true)
+	_ = writeControlFrame(&stop, fstrmControlStop, false)
+	f, err := openLogFile(path, maxSize, maxBackups, start.Bytes(), stop.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &DnstapSink{identity: []byte(identity), version: []byte(version), file: f}, nil
+}
+
+// NewDnstapSocketSink returns a new DnstapSink writing to the unix socket at path.
+// The connection is established on first write, and re-established if it fails,
+// records are dropped while there is no connection.
+func NewDnstapSocketSink(path, identity, version string) *DnstapSink {
+	return &DnstapSink{identity: []byte(identity), version: []byte(version), socket: path}
+}
+
+// dial connects to the dnstap socket, doing the Frame Streams bidirectional handshake.
+func (s *DnstapSink) dial() error {
+	s.lastDial = time.Now()
+	conn, err := net.DialTimeout("unix", s.socket, dnstapHandshakeTimeout)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(dnstapHandshakeTimeout))
+	w := bufio.NewWriter(conn)
+	if err := writeControlFrame(w, fstrmControlReady, true); err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		var typ uint32
+		if typ, err = readControlFrame(conn); err == nil && typ != fstrmControlAccept {
+			err = errDnstapNotAccepted
+		}
+	}
+	if err == nil {
+		err = writeControlFrame(w, fstrmControlStart, true)
+	}
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("dnstap handshake: %w", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	s.c, s.w = conn, w
+	return nil
+}
+
+// Write writes the record as a dnstap data frame.
+func (s *DnstapSink) Write(r *Record) error {
+	if s.file != nil {
+		frame, err := s.encode(r)
+		if err != nil {
+			return err
+		}
+		return s.file.write(append(binary.BigEndian.AppendUint32(nil, uint32(len(frame))), frame...))
+	}
+	if s.c == nil {
+		if s.socket == "" || time.Since(s.lastDial) < dnstapRedialInterval {
+			return nil
+		}
+		if err := s.dial(); err != nil {
+			return err
+		}
+	}
+	frame, err := s.encode(r)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(s.w, binary.BigEndian, uint32(len(frame))); err != nil {
+		return s.fail(err)
+	}
+	if _, err := s.w.Write(frame); err != nil {
+		return s.fail(err)
+	}
+	return nil
+}
+
+// Flush writes buffered data frames.
+func (s *DnstapSink) Flush() error {
+	if s.file != nil {
+		return s.file.Flush()
+	}
+	if s.c == nil {
+		return nil
+	}
+	if err := s.w.Flush(); err != nil {
+		return s.fail(err)
+	}
+	return nil
+}
+
+// fail closes the socket connection after a write error, so it is re-established later.
+func (s *DnstapSink) fail(err error) error {
+	s.c.Close()
+	s.c, s.w = nil, nil
+	return err
+}
+
+// Close ends the Frame Streams stream, and closes the file or socket.
+func (s *DnstapSink) Close() error {
+	if s.file != nil {
+		return s.file.Close()
+	}
+	if s.c == nil {
+		return nil
+	}
+	defer func() { s.c, s.w = nil, nil }()
+	err := writeControlFrame(s.w, fstrmControlStop, false)
+	if err == nil {
+		err = s.w.Flush()
+	}
+	if conn, ok := s.c.(net.Conn); ok && err == nil {
+		_ = conn.SetReadDeadline(time.Now().Add(dnstapFinishTimeout))
+		_, _ = readControlFrame(conn)
+	}
+	if cerr := s.c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// encode returns the dnstap protobuf message of the record.
+func (s *DnstapSink) encode(r *Record) ([]byte, error) {
+	extra, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	var m []byte
+	m = protowire.AppendTag(m, dnstapMessageFieldType, protowire.VarintType)
+	m = protowire.AppendVarint(m, dnstapMessageClientResponse)
+	m = appendAddrs(m, r.ClientAddr, r.ServerAddr)
+	m = appendTime(m, dnstapMessageFieldQueryTime, dnstapMessageFieldQueryNsec, r.Time)
+	if r.Query != nil {
+		if query, err := r.Query.Pack(); err == nil {
+			m = protowire.AppendTag(m, dnstapMessageFieldQueryMsg, protowire.BytesType)
+			m = protowire.AppendBytes(m, query)
+		}
+	}
+	m = appendTime(m, dnstapMessageFieldRespTime, dnstapMessageFieldRespNsec, r.Time.Add(r.Latency))
+	if r.Response != nil {
+		if response, err := r.Response.Pack(); err == nil {
+			m = protowire.AppendTag(m, dnstapMessageFieldResponseMsg, protowire.BytesType)
+			m = protowire.AppendBytes(m, response)
+		}
+	}
+
+	var b []byte
+	b = protowire.AppendTag(b, dnstapFieldIdentity, protowire.BytesType)
+	b = protowire.AppendBytes(b, s.identity)
+	b = protowire.AppendTag(b, dnstapFieldVersion, protowire.BytesType)
+	b = protowire.AppendBytes(b, s.version)
+	b = protowire.AppendTag(b, dnstapFieldExtra, protowire.BytesType)
+	b = protowire.AppendBytes(b, extra)
+	b = protowire.AppendTag(b, dnstapFieldMessage, protowire.BytesType)
+	b = protowire.AppendBytes(b, m)
+	b = protowire.AppendTag(b, dnstapFieldType, protowire.VarintType)
+	b = protowire.AppendVarint(b, dnstapTypeMessage)
+	return b, nil
+}
+
+// appendAddrs appends the socket family, protocol, addresses and ports fields of the client and server addresses.
+func appendAddrs(b []byte, client, server net.Addr) []byte {
+	clientIP, clientPort, protocol := addrInfo(client)
+	if clientIP == nil {
+		return b
+	}
+	family := uint64(dnstapSocketFamilyInet)
+	if ip4 := clientIP.To4(); ip4 != nil {
+		clientIP = ip4
+	} else {
+		family = dnstapSocketFamilyInet6
+	}
+	b = protowire.AppendTag(b, dnstapMessageFieldFamily, protowire.VarintType)
+	b = protowire.AppendVarint(b, family)
+	if protocol != 0 {
+		b = protowire.AppendTag(b, dnstapMessageFieldProtocol, protowire.VarintType)
+		b = protowire.AppendVarint(b, protocol)
+	}
+	b = protowire.AppendTag(b, dnstapMessageFieldQueryAddr, protowire.BytesType)
+	b = protowire.AppendBytes(b, clientIP)
+	b = protowire.AppendTag(b, dnstapMessageFieldQueryPort, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(clientPort))
+	if serverIP, serverPort, _ := addrInfo(server); serverIP != nil {
+		if family == dnstapSocketFamilyInet {
+			serverIP = serverIP.To4()
+		}
+		if serverIP != nil {
+			b = protowire.AppendTag(b, dnstapMessageFieldRespAddr, protowire.BytesType)
+			b = protowire.AppendBytes(b, serverIP)
+			b = protowire.AppendTag(b, dnstapMessageFieldRespPort, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(serverPort))
+		}
+	}
+	return b
+}
+
+// addrInfo returns the IP, port and dnstap socket protocol of addr.
+func addrInfo(addr net.Addr) (net.IP, int, uint64) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port, dnstapSocketProtocolUDP
+	case *net.TCPAddr:
+		return a.IP, a.Port, dnstapSocketProtocolTCP
+	}
+	return nil, 0, 0
+}
+
+func appendTime(b []byte, secField, nsecField protowire.Number, t time.Time) []byte {
+	b = protowire.AppendTag(b, secField, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(t.Unix()))
+	b = protowire.AppendTag(b, nsecField, protowire.Fixed32Type)
+	b = protowire.AppendFixed32(b, uint32(t.Nanosecond()))
+	return b
+}
+
+// writeControlFrame writes a Frame Streams control frame, with the dnstap content type field if requested.
+func writeControlFrame(w io.Writer, typ uint32, withContentType bool) error {
+	payload := binary.BigEndian.AppendUint32(nil, typ)
+	if withContentType {
+		payload = binary.BigEndian.AppendUint32(payload, fstrmFieldContentType)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(dnstapContentType)))
+		payload = append(payload, dnstapContentType...)
+	}
+	frame := binary.BigEndian.AppendUint32(nil, 0) // escape sequence of control frames.
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	frame = append(frame, payload...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readControlFrame reads a Frame Streams control frame, returning its type.
+func readControlFrame(r io.Reader) (uint32, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	if escape := binary.BigEndian.Uint32(header[:4]); escape != 0 {
+		return 0, fmt.Errorf("unexpected data frame of %d bytes", escape)
+	}
+	n := binary.BigEndian.Uint32(header[4:])
+	if n < 4 || n > fstrmMaxControlFrameSize {
+		return 0, fmt.Errorf("invalid control frame size: %d", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(payload[:4]), nil
+}
@@ -0,0 +1,240 @@
+package querylog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func testRecord() *Record {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a := new(dns.Msg)
+	a.SetReply(q)
+	return &Record{
+		Time:       time.Unix(1700000000, 0),
+		Qname:      "example.com",
+		Qtype:      "A",
+		Rcode:      "NOERROR",
+		Latency:    time.Millisecond,
+		ClientAddr: &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 5353},
+		ServerAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53},
+		Query:      q,
+		Response:   a,
+	}
+}
+
+// readDataFrame reads a Frame Streams data frame.
+func readDataFrame(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	var n uint32
+	require.NoError(t, binary.Read(r, binary.BigEndian, &n))
+	require.NotZero(t, n, "unexpected control frame")
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	require.NoError(t, err)
+	return b
+}
+
+// decodeFields returns the bytes and varint fields of a protobuf message.
+func decodeFields(t *testing.T, b []byte) map[protowire.Number]any {
+	t.Helper()
+	fields := make(map[protowire.Number]any)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		require.GreaterOrEqual(t, n, 0)
+		b = b[n:]
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			require.GreaterOrEqual(t, n, 0)
+			fields[num] = v
+			b = b[n:]
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			require.GreaterOrEqual(t, n, 0)
+			fields[num] = v
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			require.GreaterOrEqual(t, n, 0)
+			b = b[n:]
+		}
+	}
+	return fields
+}
+
+func checkDnstapFrame(t *testing.T, frame []byte) {
+	t.Helper()
+	dt := decodeFields(t, frame)
+	assert.Equal(t, []byte("host"), dt[dnstapFieldIdentity])
+	assert.Equal(t, uint64(dnstapTypeMessage), dt[dnstapFieldType])
+	var extra Record
+	require.NoError(t, json.Unmarshal(dt[dnstapFieldExtra].([]byte), &extra))
+	assert.Equal(t, "example.com", extra.Qname)
+
+	m := decodeFields(t, dt[dnstapFieldMessage].([]byte))
+	assert.Equal(t, uint64(dnstapMessageClientResponse), m[dnstapMessageFieldType])
+	assert.Equal(t, uint64(dnstapSocketFamilyInet), m[dnstapMessageFieldFamily])
+	assert.Equal(t, uint64(dnstapSocketProtocolUDP), m[dnstapMessageFieldProtocol])
+	assert.Equal(t, []byte(net.ParseIP("192.168.1.10").To4()), m[dnstapMessageFieldQueryAddr])
+	assert.Equal(t, uint64(5353), m[dnstapMessageFieldQueryPort])
+	response := new(dns.Msg)
+	require.NoError(t, response.Unpack(m[dnstapMessageFieldResponseMsg].([]byte)))
+	assert.True(t, response.Response)
+	assert.Equal(t, "example.com.", response.Question[0].Name)
+}
+
+func TestDnstapFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.dnstap")
+	s, err := NewDnstapFileSink(path, "host", "ctrld test", 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Write(testRecord()))
+	require.NoError(t, s.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	r := bufio.NewReader(f)
+	typ, err := readControlFrame(r)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(fstrmControlStart), typ)
+	checkDnstapFrame(t, readDataFrame(t, r))
+	typ, err = readControlFrame(r)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(fstrmControlStop), typ)
+}
+
+func TestDnstapFileSink_rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.dnstap")
+	s, err := NewDnstapFileSink(path, "host", "ctrld test", 0, 0)
+	require.NoError(t, err)
+	frame, err := s.encode(testRecord())
+	require.NoError(t, err)
+	require.NoError(t, s.Write(testRecord()))
+	require.NoError(t, s.Close())
+
+	// The existing file is rotated, instead of truncated. Then, there is room for two records per file.
+	s, err = NewDnstapFileSink(path, "host", "ctrld test", int64(100+2*(4+len(frame))), 2)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, s.Write(testRecord()))
+	}
+	require.NoError(t, s.Close())
+
+	assert.Equal(t, 1, countDnstapFrames(t, path))
+	assert.Equal(t, 2, countDnstapFrames(t, backupName(path, 1)))
+	assert.Equal(t, 2, countDnstapFrames(t, backupName(path, 2)))
+	_, err = os.Stat(backupName(path, 3))
+	assert.True(t, os.IsNotExist(err), "only 2 backups must be kept")
+}
+
+func TestDnstapFileSink_rotateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.dnstap")
+	// A non-empty directory in place of the backup file makes the rotation fail.
+	require.NoError(t, os.MkdirAll(filepath.Join(backupName(path, 1), "dir"), 0750))
+	s, err := NewDnstapFileSink(path, "host", "ctrld test", 1, 1)
+	require.NoError(t, err)
+	require.NoError(t, s.Write(testRecord()))
+	assert.Error(t, s.Write(testRecord()))
+	require.NoError(t, s.Close())
+	// The current file is reopened without its stop frame, so it is still a single stream.
+	assert.Equal(t, 2, countDnstapFrames(t, path))
+}
+
+// countDnstapFrames returns the number of data frames of the dnstap file, checking its Frame Streams stream.
+func countDnstapFrames(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	r := bufio.NewReader(f)
+	typ, err := readControlFrame(r)
+	require.NoError(t, err)
+	require.Equal(t, uint32(fstrmControlStart), typ)
+	n := 0
+	for {
+		b, err := r.Peek(4)
+		require.NoError(t, err)
+		if binary.BigEndian.Uint32(b) == 0 {
+			break
+		}
+		checkDnstapFrame(t, readDataFrame(t, r))
+		n++
+	}
+	typ, err = readControlFrame(r)
+	require.NoError(t, err)
+	require.Equal(t, uint32(fstrmControlStop), typ)
+	_, err = r.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+	return n
+}
+
+func TestDnstapSocketSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap.sock")
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	defer ln.Close()
+
+	errCh := make(chan error, 1)
+	frames := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer conn.Close()
+		if typ, err := readControlFrame(conn); err != nil || typ != fstrmControlReady {
+			errCh <- err
+			return
+		}
+		if err := writeControlFrame(conn, fstrmControlAccept, true); err != nil {
+			errCh <- err
+			return
+		}
+		if _, err := readControlFrame(conn); err != nil {
+			errCh <- err
+			return
+		}
+		frames <- readDataFrame(t, conn)
+		if _, err := readControlFrame(conn); err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- writeControlFrame(conn, fstrmControlFinish, false)
+	}()
+
+	s := NewDnstapSocketSink(path, "host", "ctrld test")
+	require.NoError(t, s.Write(testRecord()))
+	require.NoError(t, s.Flush())
+	select {
+	case frame := <-frames:
+		checkDnstapFrame(t, frame)
+	case err := <-errCh:
+		t.Fatalf("dnstap receiver failed: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("dnstap frame not received")
+	}
+	require.NoError(t, s.Close())
+	require.NoError(t, <-errCh)
+}
+
+func TestDnstapSocketSink_noReceiver(t *testing.T) {
+	s := NewDnstapSocketSink(filepath.Join(t.TempDir(), "missing.sock"), "host", "ctrld test")
+	assert.Error(t, s.Write(testRecord()))
+	// Records are dropped without re-dialing until the redial interval elapsed.
+	assert.NoError(t, s.Write(testRecord()))
+	assert.NoError(t, s.Close())
+}
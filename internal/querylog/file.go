@@ -0,0 +1,150 @@
+package querylog
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// logFile is a query log file, which is rotated when exceeding its maximum size.
+type logFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	// header and footer, if set, are written at the start and at the end of each file.
+	header, footer []byte
+
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+// openLogFile opens the file at path for appending. The file is rotated when its size exceeds
+// maxSize bytes, keeping at most maxBackups rotated files. A zero maxSize disables rotation.
+//
+// If header is set, an existing file could not be appended, since it was ended by the footer,
+// so it is rotated instead.
+func openLogFile(path string, maxSize int64, maxBackups int, header, footer []byte) (*logFile, error) {
+	l := &logFile{path: path, maxSize: maxSize, maxBackups: maxBackups, header: header, footer: footer}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Size() > 0 && len(header) > 0 {
+		if err := l.shiftBackups(); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *logFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.w, l.size = f, bufio.NewWriter(f), fi.Size()
+	if l.size == 0 && len(l.header) > 0 {
+		n, err := l.w.Write(l.header)
+		l.size += int64(n)
+		return err
+	}
+	return nil
+}
+
+// reopen opens the current file again after it was closed, dropping its footer, which ends at size.
+func (l *logFile) reopen(size int64) error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.w, l.size = f, bufio.NewWriter(f), size
+	return nil
+}
+
+// write writes b, rotating the file first if b does not fit in it. If the rotation fails, b is still
+// written to the current file, and the rotation is retried on next write.
+func (l *logFile) write(b []byte) error {
+	var rotateErr error
+	if l.maxSize > 0 && l.size > int64(len(l.header)) && l.size+int64(len(b)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			rotateErr = fmt.Errorf("could not rotate query log file: %w", err)
+		}
+	}
+	n, err := l.w.Write(b)
+	l.size += int64(n)
+	return errors.Join(rotateErr, err)
+}
+
+// Flush writes buffered data to the file.
+func (l *logFile) Flush() error {
+	return l.w.Flush()
+}
+
+// rotate renames the current file to path.1, shifting older backups, and opens a new file.
+// The current file is reopened if it could not be renamed.
+func (l *logFile) rotate() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	size := l.size
+	err := l.Close()
+	if err == nil {
+		err = l.shiftBackups()
+	}
+	if err != nil {
+		if oerr := l.reopen(size); oerr != nil {
+			return errors.Join(err, oerr)
+		}
+		return err
+	}
+	return l.open()
+}
+
+// shiftBackups renames the file to path.1, after renaming path.N to path.N+1, or removes it
+// if no backups are kept.
+func (l *logFile) shiftBackups() error {
+	if l.maxBackups <= 0 {
+		return os.Remove(l.path)
+	}
+	_ = os.Remove(backupName(l.path, l.maxBackups))
+	for i := l.maxBackups - 1; i > 0; i-- {
+		_ = os.Rename(backupName(l.path, i), backupName(l.path, i+1))
+	}
+	return os.Rename(l.path, backupName(l.path, 1))
+}
+
+// Close writes the footer, flushes buffered data, and closes the file.
+func (l *logFile) Close() error {
+	_, err := l.w.Write(l.footer)
+	if err == nil {
+		err = l.w.Flush()
+	}
+	if err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+func backupName(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
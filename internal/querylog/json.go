@@ -0,0 +1,41 @@
+package querylog
+
+import (
+	"encoding/json"
+)
+
+var _ Sink = (*JSONFileSink)(nil)
+
+// JSONFileSink writes records as JSON lines to a file, which is rotated when exceeding its maximum size.
+type JSONFileSink struct {
+	f *logFile
+}
+
+// NewJSONFileSink returns a new JSONFileSink writing to the file at path. The file is rotated when its size
+// exceeds maxSize bytes, keeping at most maxBackups rotated files. A zero maxSize disables rotation.
+func NewJSONFileSink(path string, maxSize int64, maxBackups int) (*JSONFileSink, error) {
+	f, err := openLogFile(path, maxSize, maxBackups, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONFileSink{f: f}, nil
+}
+
+// Write writes the record as a JSON line.
+func (s *JSONFileSink) Write(r *Record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.f.write(append(line, '\n'))
+}
+
+// Flush writes buffered records to the file.
+func (s *JSONFileSink) Flush() error {
+	return s.f.Flush()
+}
+
+// Close flushes buffered records, and closes the file.
+func (s *JSONFileSink) Close() error {
+	return s.f.Close()
+}
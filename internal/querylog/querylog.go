@@ -0,0 +1,148 @@
+// Package querylog implements the structured query log of ctrld.
+//
+// Records are sent to a Logger, which writes them asynchronously to a Sink,
+// so logging never blocks serving DNS queries.
+package querylog
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultBufferSize is the default number of records buffered by a Logger.
+const DefaultBufferSize = 4096
+
+// Record is a query log record.
+type Record struct {
+	Time           time.Time `json:"time"`
+	RequestID      string    `json:"request_id,omitempty"`
+	Listener       string    `json:"listener,omitempty"`
+	ClientIP       string    `json:"client_ip,omitempty"`
+	ClientMac      string    `json:"client_mac,omitempty"`
+	ClientHostname string    `json:"client_hostname,omitempty"`
+	Qname          string    `json:"qname"`
+	Qtype          string    `json:"qtype"`
+	Policy         string    `json:"policy,omitempty"`
+	Network        string    `json:"network,omitempty"`
+	Rule           string    `json:"rule,omitempty"`
+	Upstream       string    `json:"upstream,omitempty"`
+	UpstreamID     string    `json:"upstream_id,omitempty"`
+	Cached         bool      `json:"cached"`
+	Rcode          string    `json:"rcode"`
+	// Latency is encoded as "latency_ms" in JSON.
+	Latency time.Duration `json:"-"`
+
+	// Fields used by sinks, which log DNS messages, like dnstap.
+	ClientAddr net.Addr `json:"-"`
+	ServerAddr net.Addr `json:"-"`
+	Query      *dns.Msg `json:"-"`
+	Response   *dns.Msg `json:"-"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (r *Record) MarshalJSON() ([]byte, error) {
+	type record Record
+	return json.Marshal(&struct {
+		*record
+		LatencyMs float64 `json:"latency_ms"`
+	}{(*record)(r), float64(r.Latency) / float64(time.Millisecond)})
+}
+
+// Sink writes query log records to their destination.
+type Sink interface {
+	// Write writes the record. It is only called by a single goroutine.
+	Write(r *Record) error
+	// Close flushes pending records, and releases the sink resources.
+	Close() error
+}
+
+// flusher is implemented by sinks, which buffer records. Flush is called when there is no more records to write.
+type flusher interface {
+	Flush() error
+}
+
+// Logger logs records to a Sink asynchronously, through a bounded buffer.
+// Records are dropped if the buffer is full.
+type Logger struct {
+	sink     Sink
+	ch       chan *Record
+	done     chan struct{}
+	dropped  atomic.Uint64
+	closeMu  sync.RWMutex
+	closed   bool
+	errorLog func(error)
+}
+
+// New returns a new Logger, writing records to sink, and buffering up to bufferSize records.
+// Write errors are reported to errorLog if not nil.
+func New(sink Sink, bufferSize int, errorLog func(error)) *Logger {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	l := &Logger{
+		sink:     sink,
+		ch:       make(chan *Record, bufferSize),
+		done:     make(chan struct{}),
+		errorLog: errorLog,
+	}
+	go l.run()
+	return l
+}
+
+// Log queues the record for writing. It never blocks, the record is dropped if the buffer is full.
+// It reports whether the record was queued.
+func (l *Logger) Log(r *Record) bool {
+	l.closeMu.RLock()
+	defer l.closeMu.RUnlock()
+	if l.closed {
+		return false
+	}
+	select {
+	case l.ch <- r:
+		return true
+	default:
+		l.dropped.Add(1)
+		return false
+	}
+}
+
+// Dropped returns the number of records dropped because the buffer was full.
+func (l *Logger) Dropped() uint64 {
+	return l.dropped.Load()
+}
+
+// Close writes the buffered records, then closes the sink.
+func (l *Logger) Close() error {
+	l.closeMu.Lock()
+	if l.closed {
+		l.closeMu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.ch)
+	l.closeMu.Unlock()
+	<-l.done
+	return l.sink.Close()
+}
+
+func (l *Logger) run() {
+	defer close(l.done)
+	f, _ := l.sink.(flusher)
+	for r := range l.ch {
+		l.report(l.sink.Write(r))
+		if f != nil && len(l.ch) == 0 {
+			l.report(f.Flush())
+		}
+	}
+}
+
+func (l *Logger) report(err error) {
+	if err != nil && l.errorLog != nil {
+		l.errorLog(err)
+	}
+}
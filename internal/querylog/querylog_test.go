@@ -0,0 +1,126 @@
+package querylog
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingSink is a Sink, which blocks writes until released.
+type blockingSink struct {
+	release chan struct{}
+	mu      sync.Mutex
+	records []*Record
+}
+
+func (s *blockingSink) Write(r *Record) error {
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, r)
+	return nil
+}
+
+func (s *blockingSink) Close() error { return nil }
+
+func TestLogger_Log_neverBlocks(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{})}
+	l := New(sink, 2, nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			l.Log(&Record{Qname: "example.com"})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Log blocked on a full buffer")
+	}
+	// At most one record is being written, and two are buffered.
+	assert.GreaterOrEqual(t, l.Dropped(), uint64(7))
+
+	close(sink.release)
+	require.NoError(t, l.Close())
+	assert.Equal(t, 10, len(sink.records)+int(l.Dropped()))
+	assert.False(t, l.Log(&Record{}), "Log must fail after Close")
+}
+
+func TestRecord_MarshalJSON(t *testing.T) {
+	r := &Record{Qname: "example.com", Qtype: "A", Rcode: "NOERROR", Cached: true, Latency: 1500 * time.Microsecond}
+	b, err := json.Marshal(r)
+	require.NoError(t, err)
+	var m map[string]any
+	require.NoError(t, json.Unmarshal(b, &m))
+	assert.Equal(t, "example.com", m["qname"])
+	assert.Equal(t, true, m["cached"])
+	assert.Equal(t, 1.5, m["latency_ms"])
+	assert.NotContains(t, m, "Latency")
+	assert.NotContains(t, m, "policy")
+}
+
+func TestJSONFileSink_rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	line, err := json.Marshal(&Record{Qname: "example.com"})
+	require.NoError(t, err)
+	// Room for two records per file.
+	s, err := NewJSONFileSink(path, int64(2*(len(line)+1)), 2)
+	require.NoError(t, err)
+	for i := 0; i < 7; i++ {
+		require.NoError(t, s.Write(&Record{Qname: "example.com"}))
+	}
+	require.NoError(t, s.Close())
+
+	assert.Equal(t, 1, countLines(t, path))
+	assert.Equal(t, 2, countLines(t, backupName(path, 1)))
+	assert.Equal(t, 2, countLines(t, backupName(path, 2)))
+	_, err = os.Stat(backupName(path, 3))
+	assert.True(t, os.IsNotExist(err), "only 2 backups must be kept")
+}
+
+func TestJSONFileSink_rotateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	line, err := json.Marshal(&Record{Qname: "example.com"})
+	require.NoError(t, err)
+	// A non-empty directory in place of the backup file makes the rotation fail.
+	require.NoError(t, os.MkdirAll(filepath.Join(backupName(path, 1), "dir"), 0750))
+	s, err := NewJSONFileSink(path, int64(len(line)+1), 1)
+	require.NoError(t, err)
+	require.NoError(t, s.Write(&Record{Qname: "example.com"}))
+	assert.Error(t, s.Write(&Record{Qname: "example.com"}))
+	require.NoError(t, s.Flush())
+	// The record is still written to the current file.
+	assert.Equal(t, 2, countLines(t, path))
+
+	// The rotation succeeds once the backup file could be written.
+	require.NoError(t, os.RemoveAll(backupName(path, 1)))
+	require.NoError(t, s.Write(&Record{Qname: "example.com"}))
+	require.NoError(t, s.Close())
+	assert.Equal(t, 1, countLines(t, path))
+	assert.Equal(t, 2, countLines(t, backupName(path, 1)))
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	n := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r Record
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &r))
+		n++
+	}
+	require.NoError(t, sc.Err())
+	return n
+}
@@ -0,0 +1,261 @@
+// Package topstats implements bounded in-memory top-N statistics over rolling time windows.
+//
+// A Tracker splits its window into buckets. Each bucket counts keys with a count-min sketch,
+// and keeps the heaviest keys seen in a min-heap, so memory does not grow with the number
+// of distinct keys. Counts are estimates: they may be over-estimated, but never under-estimated.
+package topstats
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// sketchWidth is the number of counters of each row of a count-min sketch.
+	sketchWidth = 1024
+	// sketchDepth is the number of rows of a count-min sketch.
+	sketchDepth = 4
+	// candidatesFactor is the number of heavy keys kept per bucket, relative to the tracker size,
+	// so keys which are not the heaviest of every bucket can still make the top of the window.
+	candidatesFactor = 4
+)
+
+// Entry is a key and its estimated count.
+type Entry struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// Tracker tracks the top keys over a rolling window.
+type Tracker struct {
+	size    int
+	span    time.Duration // time span of a bucket.
+	buckets []bucket
+
+	mu sync.Mutex
+}
+
+// New returns a Tracker keeping the top size keys over the given window, which is split into n buckets.
+// The window rolls one bucket at a time, thus the oldest counts are dropped every window/n.
+func New(size int, window time.Duration, n int) *Tracker {
+	if size <= 0 {
+		size = 1
+	}
+	if n <= 0 {
+		n = 1
+	}
+	span := window / time.Duration(n)
+	if span <= 0 {
+		span = 1
+	}
+	return &Tracker{size: size, span: span, buckets: make([]bucket, n)}
+}
+
+// Add records an occurrence of key at the given time.
+func (t *Tracker) Add(key string, now time.Time) {
+	h1, h2 := hashKey(key)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.bucket(now)
+	b.total++
+	b.add(key, h1, h2, t.size*candidatesFactor)
+}
+
+// Top returns the top n keys in the window ending at the given time, sorted by count in descending order,
+// and the total number of occurrences in the window. n is capped to the tracker size, zero means all.
+func (t *Tracker) Top(n int, now time.Time) ([]Entry, uint64) {
+	if n <= 0 || n > t.size {
+		n = t.size
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	epoch := t.epoch(now)
+	live := make([]*bucket, 0, len(t.buckets))
+	var total uint64
+	for i := range t.buckets {
+		b := &t.buckets[i]
+		if b.sketch == nil || b.epoch > epoch || b.epoch <= epoch-int64(len(t.buckets)) {
+			continue
+		}
+		live = append(live, b)
+		total += b.total
+	}
+
+	seen := make(map[string]struct{})
+	entries := make([]Entry, 0)
+	for _, b := range live {
+		for _, c := range b.candidates.entries {
+			if _, ok := seen[c.key]; ok {
+				continue
+			}
+			seen[c.key] = struct{}{}
+			h1, h2 := hashKey(c.key)
+			var count uint64
+			for _, lb := range live {
+				count += uint64(lb.sketch.estimate(h1, h2))
+			}
+			entries = append(entries, Entry{Key: c.key, Count: count})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries, total
+}
+
+// epoch returns the index of the bucket span which contains the given time.
+func (t *Tracker) epoch(now time.Time) int64 {
+	return now.UnixNano() / int64(t.span)
+}
+
+// bucket returns the bucket of the given time, resetting it if it holds counts of a previous window.
+func (t *Tracker) bucket(now time.Time) *bucket {
+	epoch := t.epoch(now)
+	idx := epoch % int64(len(t.buckets))
+	if idx < 0 {
+		idx += int64(len(t.buckets))
+	}
+	b := &t.buckets[idx]
+	if b.sketch == nil {
+		b.sketch = newSketch()
+		b.candidates.index = make(map[string]*candidate)
+		b.epoch = epoch
+	} else if b.epoch != epoch {
+		b.reset(epoch)
+	}
+	return b
+}
+
+// bucket counts keys seen during a time span of a Tracker.
+type bucket struct {
+	epoch      int64
+	total      uint64
+	sketch     *sketch // lazily allocated, so idle trackers are cheap.
+	candidates candidates
+}
+
+// add counts key in the bucket, keeping it as a candidate if it is one of the capacity heaviest keys.
+func (b *bucket) add(key string, h1, h2 uint64, capacity int) {
+	count := b.sketch.add(h1, h2)
+	c := &b.candidates
+	if e, ok := c.index[key]; ok {
+		e.count = count
+		heap.Fix(c, e.pos)
+		return
+	}
+	if c.Len() < capacity {
+		heap.Push(c, &candidate{key: key, count: count})
+		return
+	}
+	if min := c.entries[0]; count > min.count {
+		delete(c.index, min.key)
+		min.key, min.count = key, count
+		c.index[key] = min
+		heap.Fix(c, 0)
+	}
+}
+
+// reset clears the bucket, so it can be reused for the given epoch.
+func (b *bucket) reset(epoch int64) {
+	b.epoch = epoch
+	b.total = 0
+	clear(b.sketch.counts)
+	clear(b.candidates.index)
+	b.candidates.entries = b.candidates.entries[:0]
+}
+
+// candidate is a heavy key of a bucket.
+type candidate struct {
+	key   string
+	count uint32
+	pos   int // position in the heap.
+}
+
+// candidates is a min-heap of heavy keys, the lightest one being at the root.
+type candidates struct {
+	entries []*candidate
+	index   map[string]*candidate
+}
+
+func (c *candidates) Len() int           { return len(c.entries) }
+func (c *candidates) Less(i, j int) bool { return c.entries[i].count < c.entries[j].count }
+
+func (c *candidates) Swap(i, j int) {
+	c.entries[i], c.entries[j] = c.entries[j], c.entries[i]
+	c.entries[i].pos = i
+	c.entries[j].pos = j
+}
+
+func (c *candidates) Push(x any) {
+	e := x.(*candidate)
+	e.pos = len(c.entries)
+	c.entries = append(c.entries, e)
+	c.index[e.key] = e
+}
+
+func (c *candidates) Pop() any {
+	n := len(c.entries)
+	e := c.entries[n-1]
+	c.entries = c.entries[:n-1]
+	delete(c.index, e.key)
+	return e
+}
+
+// sketch is a count-min sketch.
+type sketch struct {
+	counts []uint32
+}
+
+func newSketch() *sketch {
+	return &sketch{counts: make([]uint32, sketchWidth*sketchDepth)}
+}
+
+// add increments the counters of the key hashes, returning the new estimated count of the key.
+func (s *sketch) add(h1, h2 uint64) uint32 {
+	var est uint32
+	for i := 0; i < sketchDepth; i++ {
+		c := &s.counts[s.index(i, h1, h2)]
+		if *c < ^uint32(0) {
+			*c++
+		}
+		if i == 0 || *c < est {
+			est = *c
+		}
+	}
+	return est
+}
+
+// estimate returns the estimated count of the key hashes.
+func (s *sketch) estimate(h1, h2 uint64) uint32 {
+	var est uint32
+	for i := 0; i < sketchDepth; i++ {
+		c := s.counts[s.index(i, h1, h2)]
+		if i == 0 || c < est {
+			est = c
+		}
+	}
+	return est
+}
+
+// index returns the position of the counter of row i, derived from the key hashes by double hashing.
+func (s *sketch) index(i int, h1, h2 uint64) int {
+	return i*sketchWidth + int((h1+uint64(i)*h2)%sketchWidth)
+}
+
+// hashKey returns the two hashes of key used to index the sketch rows.
+func hashKey(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum64()
+	return sum, sum>>32 | 1
+}
@@ -0,0 +1,69 @@
+package topstats
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracker_Top(t *testing.T) {
+	tr := New(3, time.Hour, 6)
+	now := time.Unix(1700000000, 0)
+	for i, key := range []string{"a.com", "b.com", "c.com", "d.com"} {
+		for j := 0; j < 10*(4-i); j++ {
+			tr.Add(key, now)
+		}
+	}
+	// Many keys seen once, which must not evict the heavy ones.
+	for i := 0; i < 5000; i++ {
+		tr.Add(fmt.Sprintf("%d.example.com", i), now)
+	}
+
+	top, total := tr.Top(0, now)
+	assert.Equal(t, uint64(5100), total)
+	require.Len(t, top, 3)
+	for i, key := range []string{"a.com", "b.com", "c.com"} {
+		assert.Equal(t, key, top[i].Key)
+		// Count-min sketch never under-estimates.
+		assert.GreaterOrEqual(t, top[i].Count, uint64(10*(4-i)))
+	}
+
+	top, _ = tr.Top(1, now)
+	require.Len(t, top, 1)
+	assert.Equal(t, "a.com", top[0].Key)
+}
+
+func TestTracker_rollingWindow(t *testing.T) {
+	tr := New(10, time.Hour, 6)
+	now := time.Unix(1700000000, 0).Truncate(10 * time.Minute)
+	for i := 0; i < 5; i++ {
+		tr.Add("old.com", now)
+	}
+	later := now.Add(30 * time.Minute)
+	for i := 0; i < 3; i++ {
+		tr.Add("new.com", later)
+	}
+	tr.Add("old.com", later)
+
+	top, total := tr.Top(0, later)
+	assert.Equal(t, uint64(9), total)
+	assert.Equal(t, []Entry{{Key: "old.com", Count: 6}, {Key: "new.com", Count: 3}}, top)
+
+	// The first bucket is out of the window.
+	top, total = tr.Top(0, now.Add(time.Hour))
+	assert.Equal(t, uint64(4), total)
+	assert.Equal(t, []Entry{{Key: "new.com", Count: 3}, {Key: "old.com", Count: 1}}, top)
+
+	// Its slot is reused by newer counts.
+	tr.Add("next.com", now.Add(time.Hour))
+	top, total = tr.Top(0, now.Add(time.Hour))
+	assert.Equal(t, uint64(5), total)
+	assert.Len(t, top, 3)
+
+	top, total = tr.Top(0, later.Add(2*time.Hour))
+	assert.Zero(t, total)
+	assert.Empty(t, top)
+}
@@ -527,8 +527,17 @@ func (r *legacyResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, e
 		endpoint = net.JoinHostPort(r.uc.BootstrapIP, port)
 	}
 
+	tcpNet := strings.Replace(dnsClient.Net, "udp", "tcp", 1)
+	if r.uc.legacyTCP {
+		return r.uc.dnsConnPool().exchange(ctx, msg, tcpNet, endpoint)
+	}
+
 	answer, _, err := dnsClient.ExchangeContext(ctx, msg, endpoint)
-	return answer, err
+	if err != nil || !answer.Truncated {
+		return answer, err
+	}
+	// The answer does not fit in UDP, retry using TCP, see RFC 7766 section 5.
+	return r.uc.dnsConnPool().exchange(ctx, msg, tcpNet, endpoint)
 }
 
 type dummyResolver struct{}
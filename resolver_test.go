@@ -322,6 +322,7 @@ func Test_upstreamTypeFromEndpoint(t *testing.T) {
 		{"dot", "p2.freedns.controld.com", ResolverTypeDOT},
 		{"legacy", "8.8.8.8:53", ResolverTypeLegacy},
 		{"legacy ipv6", "[2404:6800:4005:809::200e]:53", ResolverTypeLegacy},
+		{"legacy tcp", "tcp://8.8.8.8:53", ResolverTypeLegacy},
 	}
 
 	for _, tc := range tests {
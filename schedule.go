@@ -0,0 +1,137 @@
+package ctrld
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const minutesPerDay = 24 * 60
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Schedule is the parsed form of ScheduleConfig.
+type Schedule struct {
+	days     [7]bool
+	ranges   []scheduleRange
+	location *time.Location
+}
+
+// scheduleRange is a time range, in minutes of the day. If end is not after
+// start, the range spans midnight, and belongs to the day it starts.
+type scheduleRange struct {
+	start, end int
+}
+
+// Parse parses the schedule config. Days are either weekdays, like "mon", "monday",
+// or ranges of weekdays, like "mon-fri". Times are ranges in 24-hour format, like
+// "21:00-07:00". Empty days means every day, empty times means the whole day.
+// The timezone is an IANA name, like "America/New_York", empty means local time.
+func (sc *ScheduleConfig) Parse() (*Schedule, error) {
+	s := &Schedule{location: time.Local}
+	if sc.Timezone != "" {
+		loc, err := time.LoadLocation(sc.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %q: %w", sc.Timezone, err)
+		}
+		s.location = loc
+	}
+	if len(sc.Days) == 0 {
+		s.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, days := range sc.Days {
+		from, to, isRange := strings.Cut(days, "-")
+		first, err := parseWeekday(from)
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if isRange {
+			if last, err = parseWeekday(to); err != nil {
+				return nil, err
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			s.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	for _, times := range sc.Times {
+		from, to, ok := strings.Cut(times, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid time range %q", times)
+		}
+		start, err := parseTimeOfDay(from)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(to)
+		if err != nil {
+			return nil, err
+		}
+		s.ranges = append(s.ranges, scheduleRange{start: start, end: end})
+	}
+	if len(s.ranges) == 0 {
+		s.ranges = []scheduleRange{{start: 0, end: 0}}
+	}
+	return s, nil
+}
+
+// Active reports whether t is within the schedule.
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.location)
+	day := t.Weekday()
+	yesterday := (day + 6) % 7
+	minute := t.Hour()*60 + t.Minute()
+	for _, r := range s.ranges {
+		if r.end > r.start {
+			if s.days[day] && minute >= r.start && minute < r.end {
+				return true
+			}
+			continue
+		}
+		// The range spans midnight, the part after midnight belongs to the previous day.
+		if s.days[day] && minute >= r.start {
+			return true
+		}
+		if s.days[yesterday] && minute < r.end {
+			return true
+		}
+	}
+	return false
+}
+
+// parseWeekday parses a weekday name, like "mon" or "Monday".
+func parseWeekday(s string) (time.Weekday, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	if len(name) >= 3 {
+		if d, ok := weekdays[name[:3]]; ok && strings.HasPrefix(strings.ToLower(d.String()), name) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday %q", s)
+}
+
+// parseTimeOfDay parses a time in "HH:MM" format, returning the minutes of the day.
+// "24:00" is accepted as the end of the day.
+func parseTimeOfDay(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "24:00" {
+		return minutesPerDay, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
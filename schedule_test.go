@@ -0,0 +1,65 @@
+package ctrld_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func TestScheduleActive(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ctrld.ScheduleConfig
+		time   string
+		active bool
+	}{
+		{"whole day", ctrld.ScheduleConfig{Timezone: "UTC"}, "2024-06-03T12:00:00Z", true},
+		{"in range", ctrld.ScheduleConfig{Times: []string{"08:00-15:00"}, Timezone: "UTC"}, "2024-06-03T08:00:00Z", true},
+		{"range end is excluded", ctrld.ScheduleConfig{Times: []string{"08:00-15:00"}, Timezone: "UTC"}, "2024-06-03T15:00:00Z", false},
+		{"weekday range", ctrld.ScheduleConfig{Days: []string{"mon-fri"}, Timezone: "UTC"}, "2024-06-07T10:00:00Z", true},
+		{"weekday range excludes weekend", ctrld.ScheduleConfig{Days: []string{"Mon-Fri"}, Timezone: "UTC"}, "2024-06-08T10:00:00Z", false},
+		{"weekday range wraps", ctrld.ScheduleConfig{Days: []string{"fri-mon"}, Timezone: "UTC"}, "2024-06-09T10:00:00Z", true},
+		{"full weekday name", ctrld.ScheduleConfig{Days: []string{"Sunday"}, Timezone: "UTC"}, "2024-06-09T10:00:00Z", true},
+		{"overnight before midnight", ctrld.ScheduleConfig{Times: []string{"21:00-07:00"}, Timezone: "UTC"}, "2024-06-03T22:30:00Z", true},
+		{"overnight after midnight", ctrld.ScheduleConfig{Times: []string{"21:00-07:00"}, Timezone: "UTC"}, "2024-06-04T06:59:00Z", true},
+		{"overnight outside", ctrld.ScheduleConfig{Times: []string{"21:00-07:00"}, Timezone: "UTC"}, "2024-06-04T07:00:00Z", false},
+		{"overnight belongs to start day", ctrld.ScheduleConfig{Days: []string{"fri"}, Times: []string{"21:00-07:00"}, Timezone: "UTC"}, "2024-06-08T03:00:00Z", true},
+		{"overnight not started previous day", ctrld.ScheduleConfig{Days: []string{"fri"}, Times: []string{"21:00-07:00"}, Timezone: "UTC"}, "2024-06-07T03:00:00Z", false},
+		{"multiple ranges", ctrld.ScheduleConfig{Times: []string{"08:00-12:00", "13:00-15:00"}, Timezone: "UTC"}, "2024-06-03T14:00:00Z", true},
+		{"end of day", ctrld.ScheduleConfig{Times: []string{"21:00-24:00"}, Timezone: "UTC"}, "2024-06-03T23:59:00Z", true},
+		{"timezone", ctrld.ScheduleConfig{Times: []string{"21:00-07:00"}, Timezone: "America/New_York"}, "2024-06-04T02:00:00Z", true},
+		{"timezone outside", ctrld.ScheduleConfig{Times: []string{"21:00-07:00"}, Timezone: "America/New_York"}, "2024-06-03T22:00:00Z", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := tc.config.Parse()
+			require.NoError(t, err)
+			now, err := time.Parse(time.RFC3339, tc.time)
+			require.NoError(t, err)
+			assert.Equal(t, tc.active, s.Active(now))
+		})
+	}
+}
+
+func TestScheduleParseInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ctrld.ScheduleConfig
+	}{
+		{"invalid weekday", ctrld.ScheduleConfig{Days: []string{"mo"}}},
+		{"invalid weekday range", ctrld.ScheduleConfig{Days: []string{"mon-foo"}}},
+		{"invalid time range", ctrld.ScheduleConfig{Times: []string{"21:00"}}},
+		{"invalid time", ctrld.ScheduleConfig{Times: []string{"21:00-25:00"}}},
+		{"invalid timezone", ctrld.ScheduleConfig{Timezone: "Mars/Olympus_Mons"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.config.Parse()
+			assert.Error(t, err)
+		})
+	}
+}
@@ -15,7 +15,7 @@ func SampleConfig(t *testing.T) *ctrld.Config {
 	v.SetConfigType("toml")
 	require.NoError(t, v.ReadConfig(strings.NewReader(sampleConfigContent)))
 	var cfg ctrld.Config
-	require.NoError(t, v.Unmarshal(&cfg))
+	require.NoError(t, v.Unmarshal(&cfg, ctrld.DecodeHook()))
 	return &cfg
 }
 